@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kelveny/tunnel/pkg/tunnel"
+)
+
+// benchStream is the outcome of one benchmark stream
+type benchStream struct {
+	latencies []time.Duration
+	bytes     int64
+	err       error
+}
+
+// runBench implements "tunnel bench": it pumps request/response round trips
+// of -size bytes over -streams concurrent connections through a tunnel for
+// -duration and reports throughput, latency percentiles and allocations.
+// Without -c the provider and an echo target run in-process.
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	providerAddress := fs.String("c", "", "Remote tunnel provider signaling address, in-process provider if empty")
+	targetAddress := fs.String("t", "", "Echo target to tunnel to, required with -c, in-process echo server if empty")
+	streams := fs.Int("streams", 8, "Concurrent data connections")
+	size := fs.Int("size", 4096, "Bytes per request, echoed back by the target")
+	duration := fs.Duration("duration", 10*time.Second, "How long to pump traffic")
+	encrypt := fs.Bool("encrypt", false, "Negotiate payload encryption")
+	noCompress := fs.Bool("no-compress", false, "Never compress tunneled payloads")
+	identity := fs.String("id", "", "Client identity to authenticate with at a remote provider")
+	token := fs.String("token", "", "Client secret to authenticate with at a remote provider")
+	fs.Parse(args)
+
+	if *streams <= 0 || *size <= 0 {
+		return errors.New("-streams and -size must be positive")
+	}
+
+	compressMin := 256
+	if *noCompress {
+		compressMin = 0
+	}
+
+	target := *targetAddress
+	if len(target) == 0 {
+		if len(*providerAddress) > 0 {
+			return errors.New("-t is required with a remote provider")
+		}
+
+		echo, err := startEchoServer()
+		if err != nil {
+			return err
+		}
+		target = echo.String()
+	}
+
+	provider := *providerAddress
+	if len(provider) == 0 {
+		p, err := tunnel.NewProvider(tunnel.Config{CompressMin: compressMin})
+		if err != nil {
+			return err
+		}
+		defer p.Close()
+
+		addr, err := p.StartListener(0)
+		if err != nil {
+			return err
+		}
+		provider = net.JoinHostPort("127.0.0.1", strconv.Itoa(addr.(*net.TCPAddr).Port))
+	}
+
+	client, err := tunnel.NewProvider(tunnel.Config{CompressMin: compressMin})
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tun, err := client.Connect(ctx, tunnel.ConnectorConfig{
+		ProviderAddress: provider,
+		Identity:        *identity,
+		Token:           *token,
+		Target:          target,
+		Encrypt:         *encrypt,
+	})
+	if err == context.DeadlineExceeded {
+		return errors.New("tunnel was not opened within 10s")
+	}
+	if err != nil {
+		return err
+	}
+
+	providerHost, _, err := net.SplitHostPort(provider)
+	if err != nil {
+		return err
+	}
+	tunnelAddress := net.JoinHostPort(providerHost, strconv.Itoa(tun.Port()))
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	results := make([]benchStream, *streams)
+	deadline := time.Now().Add(*duration)
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(result *benchStream) {
+			defer wg.Done()
+			*result = pumpBenchStream(tunnelAddress, *size, deadline)
+		}(&results[i])
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	var latencies []time.Duration
+	var total int64
+	for _, r := range results {
+		if r.err != nil {
+			fmt.Printf("Stream error: %v\n", r.err)
+		}
+		latencies = append(latencies, r.latencies...)
+		total += r.bytes
+	}
+
+	if len(latencies) == 0 {
+		return errors.New("no round trip completed")
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	fmt.Printf("\nstreams: %d, size: %d, duration: %s\n", *streams, *size, elapsed.Round(time.Millisecond))
+	fmt.Printf("round trips: %d (%.0f/s)\n", len(latencies), float64(len(latencies))/elapsed.Seconds())
+	fmt.Printf("throughput: %.2f MiB/s each way\n", float64(total)/elapsed.Seconds()/(1<<20))
+	fmt.Printf("latency: p50 %s, p90 %s, p99 %s, max %s\n",
+		percentile(latencies, 0.50), percentile(latencies, 0.90), percentile(latencies, 0.99), latencies[len(latencies)-1])
+
+	mallocs := after.Mallocs - before.Mallocs
+	fmt.Printf("allocations: %d (%.1f per round trip), %.1f MiB\n",
+		mallocs, float64(mallocs)/float64(len(latencies)), float64(after.TotalAlloc-before.TotalAlloc)/(1<<20))
+	if len(*providerAddress) == 0 {
+		fmt.Printf("(allocations include the in-process provider and echo target)\n")
+	}
+
+	return nil
+}
+
+// pumpBenchStream writes size byte requests to the tunnel and reads them back
+// until deadline
+func pumpBenchStream(tunnel string, size int, deadline time.Time) benchStream {
+	var result benchStream
+
+	conn, err := net.Dial("tcp", tunnel)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	defer conn.Close()
+
+	request := make([]byte, size)
+	for i := range request {
+		request[i] = byte(i)
+	}
+	response := make([]byte, size)
+
+	for time.Now().Before(deadline) {
+		sent := time.Now()
+		if _, err := conn.Write(request); err != nil {
+			result.err = err
+			break
+		}
+		if _, err := io.ReadFull(conn, response); err != nil {
+			result.err = err
+			break
+		}
+
+		result.latencies = append(result.latencies, time.Since(sent))
+		result.bytes += int64(size)
+	}
+
+	return result
+}
+
+// percentile returns the p-th percentile of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+// startEchoServer echoes every connection accepted on an ephemeral loopback
+// port back to its sender
+func startEchoServer() (net.Addr, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				break
+			}
+
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+
+		l.Close()
+	}()
+
+	return l.Addr(), nil
+}
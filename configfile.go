@@ -0,0 +1,147 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configAliases are readable names of the single letter flags in -config
+// files
+var configAliases = map[string]string{
+	"listen":   "l",
+	"provider": "c",
+	"target":   "t",
+	"local":    "L",
+}
+
+// loadConfigFile sets the flags of fs to the values of the YAML file at
+// path, unless they were set on the command line, and returns the targets of
+// its forwards. Settings are named like the flags, may be grouped into
+// sections, e.g. tls or limits, and lists are joined by commas:
+//
+//	role: provider
+//	listen: 5555
+//	tls:
+//	  tls-cert: provider.pem
+//	  tls-key: provider.key
+//	limits:
+//	  max-tunnels-per-client: 4
+//
+// role, provider or client, is checked against the flags once applied.
+// forwards lists targets a client tunnels over its provider connection.
+func loadConfigFile(fs *flag.FlagSet, path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Role     string   `yaml:"role"`
+		Forwards []string `yaml:"forwards"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var settings map[string]interface{}
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	delete(settings, "role")
+	delete(settings, "forwards")
+
+	values := make(map[string]string)
+	if err := flattenConfig(settings, values); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	// the command line wins over the file
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == "config" || fs.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, values[name]); err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", path, name, err)
+		}
+	}
+
+	listening := fs.Lookup("l").Value.String() != "0"
+	switch file.Role {
+	case "":
+	case "provider":
+		if !listening {
+			return nil, fmt.Errorf("%s: role provider requires listen", path)
+		}
+	case "client":
+		if listening {
+			return nil, fmt.Errorf("%s: role client conflicts with listen", path)
+		}
+		if len(fs.Lookup("c").Value.String()) == 0 {
+			return nil, fmt.Errorf("%s: role client requires provider", path)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unknown role %q, use provider or client", path, file.Role)
+	}
+
+	if len(file.Forwards) > 0 && listening {
+		return nil, fmt.Errorf("%s: forwards are set up by clients, not providers", path)
+	}
+
+	return file.Forwards, nil
+}
+
+// flattenConfig adds the settings of section and its subsections to values,
+// by flag name
+func flattenConfig(section map[string]interface{}, values map[string]string) error {
+	for name, v := range section {
+		if alias, ok := configAliases[name]; ok {
+			name = alias
+		}
+
+		if section, ok := v.(map[string]interface{}); ok {
+			if err := flattenConfig(section, values); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, ok := values[name]; ok {
+			return fmt.Errorf("%q is set twice", name)
+		}
+
+		switch v := v.(type) {
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[name] = strings.Join(items, ",")
+		case nil:
+			values[name] = ""
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+
+	return nil
+}
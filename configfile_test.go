@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	assert := require.New(t)
+
+	f, err := ioutil.TempFile("", "config")
+	assert.Nil(err)
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+// configFlags returns a flag set with some of the flags of the command
+func configFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("tunnel", flag.ContinueOnError)
+	fs.Int("l", 0, "")
+	fs.String("c", "", "")
+	fs.String("id", "", "")
+	fs.String("acme-host", "", "")
+	fs.Int("max-tunnels-per-client", 0, "")
+	fs.Duration("keepalive", 30*time.Second, "")
+	return fs
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	assert := require.New(t)
+
+	fs := configFlags()
+
+	path := writeConfigFile(t, `
+role: client
+provider: provider:5555
+id: alice
+acme-host: [a.example.com, b.example.com]
+limits:
+  max-tunnels-per-client: 4
+  keepalive: 10s
+forwards:
+  - localhost:8080
+  - localhost:22
+`)
+	defer os.Remove(path)
+
+	// the command line wins
+	assert.Nil(fs.Parse([]string{"-id", "bob"}))
+
+	forwards, err := loadConfigFile(fs, path)
+	assert.Nil(err)
+	assert.Equal([]string{"localhost:8080", "localhost:22"}, forwards)
+	assert.Equal("0", fs.Lookup("l").Value.String())
+	assert.Equal("provider:5555", fs.Lookup("c").Value.String())
+	assert.Equal("bob", fs.Lookup("id").Value.String())
+	assert.Equal("a.example.com,b.example.com", fs.Lookup("acme-host").Value.String())
+	assert.Equal("4", fs.Lookup("max-tunnels-per-client").Value.String())
+	assert.Equal("10s", fs.Lookup("keepalive").Value.String())
+
+	invalid := []string{
+		"role: provider\n",
+		"role: server\n",
+		"tls-cert: provider.pem\n",
+		"keepalive: soon\n",
+		"listen: 5555\nforwards: [localhost:22]\n",
+		"id: alice\nauth:\n  id: bob\n",
+	}
+	for _, content := range invalid {
+		path := writeConfigFile(t, content)
+		_, err := loadConfigFile(configFlags(), path)
+		os.Remove(path)
+		assert.NotNil(err, content)
+	}
+}
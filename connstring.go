@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/kelveny/tunnel/pkg/tunnel"
+)
+
+// connectionParameters are the query parameters of connection strings and
+// the flags they stand for
+var connectionParameters = map[string]string{
+	"tls":       "tls",
+	"ca":        "ca",
+	"pin":       "pin",
+	"encrypt":   "encrypt",
+	"obfs":      "obfs",
+	"target":    "t",
+	"transport": "",
+}
+
+// isConnectionString reports whether the -c value s is a connection string
+// rather than host:port
+func isConnectionString(s string) bool {
+	return strings.Contains(s, "://")
+}
+
+// applyConnectionString expands the connection string s into the flags of fs
+// it stands for, those already set win:
+//
+//	tunnel://[identity[:token]@]host:port[?tls=true&pin=...&target=host:port]
+//
+// The identity and token set -id and -token, the query parameters tls, ca,
+// pin, encrypt, obfs and target the flags of the same name, target -t. -c is
+// reset to host:port, which keeps the token out of the logged configuration
+// and the admin API, but not out of the process arguments other users see.
+// The token is therefore better a reference like the -token value,
+// tunnel://identity:env:NAME@host:port or file:%2Fpath with the slashes
+// escaped, a literal one is warned about.
+func applyConnectionString(fs *flag.FlagSet, s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("invalid connection string: %w", err)
+	}
+
+	if u.Scheme != "tunnel" {
+		return fmt.Errorf("unknown connection string scheme %q, use tunnel://", u.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return fmt.Errorf("connection string %s: %w", u.Redacted(), err)
+	}
+	if len(strings.Trim(u.Path, "/")) > 0 {
+		return fmt.Errorf("connection string %s: unexpected path %s", u.Redacted(), u.Path)
+	}
+
+	values := make(map[string][]string)
+	if u.User != nil {
+		if len(u.User.Username()) > 0 {
+			values["id"] = []string{u.User.Username()}
+		}
+		if token, ok := u.User.Password(); ok {
+			if !tunnel.IsSecretReference(token) {
+				tunnel.LogWarn("The token of the -c connection string is visible to other users, use tunnel://identity:env:NAME@host:port or file:")
+			}
+			values["token"] = []string{token}
+		}
+	}
+
+	for name, v := range u.Query() {
+		flagName, ok := connectionParameters[name]
+		if !ok {
+			return fmt.Errorf("connection string %s: unknown parameter %q", u.Redacted(), name)
+		}
+
+		if name == "transport" {
+			if len(v) != 1 || v[0] != "tcp" {
+				return fmt.Errorf("connection string %s: unsupported transport %q, use tcp", u.Redacted(), strings.Join(v, ","))
+			}
+			continue
+		}
+
+		values[flagName] = v
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	for name, v := range values {
+		if set[name] {
+			continue
+		}
+
+		for _, value := range v {
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("connection string %s: %s: %w", u.Redacted(), name, err)
+			}
+		}
+	}
+
+	return fs.Set("c", u.Host)
+}
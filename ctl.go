@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kelveny/tunnel/pkg/tunnel"
+)
+
+// apiClient talks to the admin API of a running provider, either the -api
+// listener or the loopback -admin port
+type apiClient struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+// apiClientFlags registers the flags locating the admin API on fs
+func apiClientFlags(fs *flag.FlagSet) func() (*apiClient, error) {
+	api := fs.String("api", "http://localhost:6060", "Admin API URL, the -api listener or the -admin port of the provider ($TUNNEL_API)")
+	token := fs.String("api-token", "", "Admin API token, file:/path, env:NAME or keyring:service/user ($TUNNEL_API_TOKEN)")
+	caFile := fs.String("ca", "", "CA certificate file used to verify an https API")
+	pin := fs.String("pin", "", "SHA-256 pin of the API certificate or public key")
+
+	return func() (*apiClient, error) {
+		base := *api
+		if env := os.Getenv("TUNNEL_API"); len(env) > 0 && !flagPassed(fs, "api") {
+			base = env
+		}
+
+		u, err := url.Parse(base)
+		if err != nil {
+			return nil, err
+		}
+
+		c := &apiClient{
+			base:   strings.TrimSuffix(base, "/"),
+			client: &http.Client{Timeout: 10 * time.Second},
+		}
+
+		if c.token, err = secretFlag("api-token", *token, "TUNNEL_API_TOKEN"); err != nil {
+			return nil, err
+		}
+
+		if u.Scheme == "https" {
+			config, err := tunnel.NewClientTLSConfig(u.Host, *caFile, *pin)
+			if err != nil {
+				return nil, err
+			}
+			c.client.Transport = &http.Transport{TLSClientConfig: config}
+		}
+
+		return c, nil
+	}
+}
+
+func flagPassed(fs *flag.FlagSet, name string) bool {
+	passed := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			passed = true
+		}
+	})
+	return passed
+}
+
+func (c *apiClient) do(method string, path string, v interface{}) error {
+	req, err := http.NewRequest(method, c.base+path, nil)
+	if err != nil {
+		return err
+	}
+	if len(c.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		var reply struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&reply) == nil && len(reply.Error) > 0 {
+			return fmt.Errorf("%s %s: %s", method, path, reply.Error)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// runStatus implements "tunnel status": it prints the tunnel connections and
+// data connections of a running provider to w
+func runStatus(w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	client := apiClientFlags(fs)
+	asJSON := fs.Bool("json", false, "Print the API replies as JSON")
+	fs.Parse(args)
+
+	c, err := client()
+	if err != nil {
+		return err
+	}
+
+	var tunnels []tunnel.TunnelInfo
+	if err := c.do("GET", "/api/tunnels", &tunnels); err != nil {
+		return err
+	}
+	var connections []tunnel.DataConnectionInfo
+	if err := c.do("GET", "/api/connections", &connections); err != nil {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(map[string]interface{}{
+			"tunnels":     tunnels,
+			"connections": connections,
+		})
+	}
+
+	return tunnel.WriteConnectionTable(w, tunnels, connections)
+}
+
+// runKill implements "tunnel kill": it closes tunnel connections or data
+// connections of a running provider by handle
+func runKill(w io.Writer, args []string) error {
+	fs := flag.NewFlagSet("kill", flag.ExitOnError)
+	client := apiClientFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: tunnel kill [flags] tunnel|connection HANDLE...\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return errors.New("nothing to kill")
+	}
+
+	var collection string
+	switch fs.Arg(0) {
+	case "tunnel", "tunnels":
+		collection = "tunnels"
+	case "connection", "connections", "conn":
+		collection = "connections"
+	default:
+		return fmt.Errorf("unknown kind %q, use tunnel or connection", fs.Arg(0))
+	}
+
+	c, err := client()
+	if err != nil {
+		return err
+	}
+
+	for _, handle := range fs.Args()[1:] {
+		if _, err := strconv.ParseUint(handle, 10, 32); err != nil {
+			return fmt.Errorf("invalid handle %q", handle)
+		}
+
+		if err := c.do("DELETE", "/api/"+collection+"/"+handle, nil); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Closed %s %s\n", strings.TrimSuffix(collection, "s"), handle)
+	}
+
+	return nil
+}
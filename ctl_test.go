@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/kelveny/tunnel/pkg/tunnel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusAndKill(t *testing.T) {
+	assert := require.New(t)
+
+	connections := []tunnel.DataConnectionInfo{{Handle: 2, Tunnel: 1, Opened: true}}
+	connections[0].RxBytes = 3 << 20
+
+	// admin API of a provider holding one tunnel of alice with one data
+	// connection
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "missing or invalid API token"})
+			return
+		}
+
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/api/tunnels":
+			json.NewEncoder(w).Encode([]tunnel.TunnelInfo{{Handle: 1, Identity: "alice", DataConnections: len(connections)}})
+		case r.Method == "GET" && r.URL.Path == "/api/connections":
+			json.NewEncoder(w).Encode(connections)
+		case r.Method == "DELETE" && r.URL.Path == "/api/connections/2" && len(connections) > 0:
+			connections = nil
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "no such connection"})
+		}
+	}))
+	defer server.Close()
+
+	os.Setenv("CTL_TEST_TOKEN", "secret")
+	defer os.Unsetenv("CTL_TEST_TOKEN")
+	flags := []string{"-api", server.URL, "-api-token", "env:CTL_TEST_TOKEN"}
+
+	var out bytes.Buffer
+	assert.Nil(runStatus(&out, flags))
+	assert.Contains(out.String(), "alice")
+	assert.Contains(out.String(), "3.0M")
+
+	out.Reset()
+	assert.Nil(runKill(&out, append(flags, "connection", "2")))
+	assert.Equal("Closed connection 2\n", out.String())
+	assert.Empty(connections)
+
+	// already gone
+	assert.NotNil(runKill(&out, append(flags, "connection", "2")))
+
+	// the token is checked
+	assert.NotNil(runStatus(&out, []string{"-api", server.URL}))
+}
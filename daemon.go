@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// daemonReadyLine ends the startup output a daemon passes to its parent
+const daemonReadyLine = "tunnel: daemon ready"
+
+// daemonStartup carries the output of a daemon to its parent until
+// daemonReady, nil when not running as a daemon
+var daemonStartup *os.File
+
+// daemonReady ends the startup of a daemon, its parent exits reporting
+// success. Output printed from here on is discarded.
+func daemonReady() {
+	if daemonStartup == nil {
+		return
+	}
+
+	fmt.Fprintln(daemonStartup, daemonReadyLine)
+	if null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+		os.Stdout = null
+	}
+
+	daemonStartup.Close()
+	daemonStartup = nil
+}
+
+// writePidFile records the process ID in path, refusing to replace the
+// pidfile of a running process. The returned function removes it.
+func writePidFile(path string) (func(), error) {
+	if b, err := ioutil.ReadFile(path); err == nil {
+		pid, err := strconv.Atoi(string(bytes.TrimSpace(b)))
+		if err == nil && pid != os.Getpid() && processAlive(pid) {
+			return nil, fmt.Errorf("pidfile %s: process %d is running", path, pid)
+		}
+	}
+
+	pid := strconv.Itoa(os.Getpid())
+	if err := ioutil.WriteFile(path, []byte(pid+"\n"), 0644); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		// only remove the pidfile while it is ours
+		if b, err := ioutil.ReadFile(path); err == nil && string(bytes.TrimSpace(b)) == pid {
+			os.Remove(path)
+		}
+	}, nil
+}
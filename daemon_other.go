@@ -0,0 +1,23 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func daemonize() (bool, error) {
+	return false, errors.New("-daemon is not supported on this platform, run as a service instead")
+}
+
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+
+	p.Release()
+	return true
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPidFile(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "pidfile")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tunnel.pid")
+
+	// another process running
+	assert.Nil(ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getppid())+"\n"), 0644))
+	_, err = writePidFile(path)
+	assert.NotNil(err)
+
+	// stale
+	assert.Nil(ioutil.WriteFile(path, []byte("999999999\n"), 0644))
+	remove, err := writePidFile(path)
+	assert.Nil(err)
+
+	b, err := ioutil.ReadFile(path)
+	assert.Nil(err)
+	assert.Equal(strconv.Itoa(os.Getpid())+"\n", string(b))
+
+	remove()
+	_, err = os.Stat(path)
+	assert.True(os.IsNotExist(err))
+}
@@ -0,0 +1,78 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// daemonEnv marks the detached copy of the process
+const daemonEnv = "TUNNEL_DAEMON"
+
+// daemonize detaches the process from its terminal: it starts a copy of
+// itself in a new session, with the standard streams on /dev/null, and
+// returns false once the copy reports it is ready, printing what the copy
+// printed until then. Go cannot fork, re-executing stands in for the classic
+// double fork. In the copy, daemonize returns true.
+func daemonize() (bool, error) {
+	if os.Getenv(daemonEnv) == "1" {
+		os.Unsetenv(daemonEnv)
+
+		// startup errors are printed to the parent
+		daemonStartup = os.NewFile(3, "daemon startup")
+		os.Stdout = daemonStartup
+		return true, nil
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return false, err
+	}
+
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer null.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = null, null, null
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return false, err
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if scanner.Text() == daemonReadyLine {
+			fmt.Printf("Started daemon, pid %d\n", cmd.Process.Pid)
+			return false, nil
+		}
+		fmt.Println(scanner.Text())
+	}
+
+	cmd.Wait()
+	return false, errors.New("daemon exited during startup")
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "github.com/kelveny/tunnel/pkg/tunnel"
+
+// dumpOnSignal does nothing, there is no SIGUSR1 on Windows
+func dumpOnSignal(p *tunnel.Provider) {}
@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/kelveny/tunnel/pkg/tunnel"
+)
+
+// dumpOnSignal logs the connection table on every SIGUSR1 until the
+// provider is closed
+func dumpOnSignal(p *tunnel.Provider) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	go func() {
+		defer signal.Stop(signals)
+
+		for {
+			select {
+			case <-signals:
+				p.DumpConnections()
+			case <-p.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/kelveny/tunnel/pkg/tunnel"
+)
+
+// secretFlag resolves the value of a secret flag, falling back to the
+// environment variable envName when the flag is not set. Literal secrets on
+// the command line are accepted with a warning as they leak through process
+// listings.
+func secretFlag(name string, value string, envName string) (string, error) {
+	if len(value) == 0 {
+		return os.Getenv(envName), nil
+	}
+
+	if !tunnel.IsSecretReference(value) {
+		tunnel.LogWarn(fmt.Sprintf("-%s on the command line is visible to other users, use file:, env:, keyring: or $%s", name, envName))
+		return value, nil
+	}
+
+	return tunnel.ResolveSecret(value)
+}
+
+// stringList is a flag that may be repeated, values are also separated by
+// commas
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// clientLabels returns the labels a client reports to the provider: its
+// hostname and version, and the key=value pairs of -label, which win
+func clientLabels(pairs []string) (map[string]string, error) {
+	labels := map[string]string{"version": versionString()}
+	if hostname, err := os.Hostname(); err == nil {
+		labels["hostname"] = hostname
+	}
+
+	for _, pair := range pairs {
+		key, value, err := tunnel.ParseLabel(pair)
+		if err != nil {
+			return nil, err
+		}
+		labels[key] = value
+	}
+
+	if err := tunnel.ValidateLabels(labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// secretFlagNames are the flags redacted from the configuration served
+var secretFlagNames = []string{"token", "jwt", "obfs", "api-token"}
+
+// flagConfig returns the values of all flags of fs, those named in secrets
+// are redacted when set
+func flagConfig(fs *flag.FlagSet, secrets ...string) map[string]string {
+	config := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		config[f.Name] = f.Value.String()
+	})
+
+	for _, name := range secrets {
+		if len(config[name]) > 0 {
+			config[name] = "(redacted)"
+		}
+	}
+
+	return config
+}
+
+// verbosity returns the log level -v, -vv or -q select, level when none is
+// set
+func verbosity(level string, verbose bool, veryVerbose bool, quiet bool) (string, error) {
+	switch {
+	case quiet && (verbose || veryVerbose):
+		return "", errors.New("-q conflicts with -v, -vv and -trace")
+	case veryVerbose:
+		return "trace", nil
+	case verbose:
+		return "debug", nil
+	case quiet:
+		return "warn", nil
+	}
+
+	return level, nil
+}
+
+// roles of the tunnel binary, each a subcommand
+const (
+	roleServer = "server"
+	roleClient = "client"
+)
+
+// roleFlags are the flags of a single role, the others apply to both
+var roleFlags = map[string][]string{
+	roleServer: {
+		"l", "tokens", "allow-dial", "acl", "jwt-issuer", "jwt-audience", "jwks-url", "jwt-claim",
+		"auth-max-failures", "auth-ban", "quotas", "max-tunnels-per-client", "max-conns-per-client", "tenants",
+		"port-range", "sni-allow", "sni-deny", "access-log", "access-log-format", "client-ca", "spiffe-trust-domain",
+		"acme-host", "acme-cache", "acme-email", "acme-http", "session-grace", "drain-timeout",
+		"registry", "api", "grpc", "api-token", "webhook", "health", "dns", "dns-zone", "dns-ip",
+		"cluster", "cluster-advertise", "reservations", "reservation-ttl", "on-demand", "on-demand-wait",
+		"service-tls", "service-certs", "service-acme-domain",
+	},
+	roleClient: {
+		"c", "t", "L", "label", "standby", "id", "token", "jwt", "tls", "ca", "pin", "reconnect-max", "encrypt",
+		"data-channels", "promote-rate",
+	},
+}
+
+// flagRole returns the role flag name belongs to, empty for both
+func flagRole(name string) string {
+	for role, names := range roleFlags {
+		for _, n := range names {
+			if n == name {
+				return role
+			}
+		}
+	}
+
+	return ""
+}
+
+// checkRoleFlags fails on flags of fs set for the other role than role, on
+// the command line or by the -config file
+func checkRoleFlags(fs *flag.FlagSet, role string) error {
+	if len(role) == 0 {
+		return nil
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if other := flagRole(f.Name); err == nil && len(other) > 0 && other != role {
+			err = fmt.Errorf("-%s is a %s flag, see tunnel %s -h", f.Name, other, other)
+		}
+	})
+
+	return err
+}
+
+// roleUsage prints the usage of role with its flags, all flags when empty
+func roleUsage(fs *flag.FlagSet, role string) {
+	out := fs.Output()
+	switch role {
+	case roleServer:
+		fmt.Fprintf(out, "Usage: tunnel server -l port [flags]\n")
+	case roleClient:
+		fmt.Fprintf(out, "Usage: tunnel client -c host:port -t host:port [flags]\n")
+	default:
+		fmt.Fprintf(out, "Usage: tunnel server|client|status|kill|bench|version [flags]\n")
+		fmt.Fprintf(out, "       tunnel [flags], a server with -l, a client otherwise\n")
+	}
+
+	usage := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	usage.SetOutput(out)
+	fs.VisitAll(func(f *flag.Flag) {
+		if other := flagRole(f.Name); len(role) == 0 || len(other) == 0 || other == role {
+			usage.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	usage.PrintDefaults()
+}
+
+// dnsAnswerIP returns the provider IP address -dns answers, ip when set,
+// otherwise the host of the -dns address if it is not a wildcard
+func dnsAnswerIP(address string, ip string) (net.IP, error) {
+	if len(ip) == 0 {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("-dns %s: %w", address, err)
+		}
+		ip = host
+	}
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.IsUnspecified() {
+		return nil, errors.New("-dns requires -dns-ip unless it listens on a specific IP address")
+	}
+	return parsed, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecretFlag(t *testing.T) {
+	assert := require.New(t)
+
+	os.Setenv("TUNNEL_TEST_SECRET", "from-env")
+	defer os.Unsetenv("TUNNEL_TEST_SECRET")
+
+	v, err := secretFlag("token", "", "TUNNEL_TEST_SECRET")
+	assert.Nil(err)
+	assert.Equal("from-env", v)
+
+	v, err = secretFlag("token", "env:TUNNEL_TEST_SECRET", "TUNNEL_UNUSED")
+	assert.Nil(err)
+	assert.Equal("from-env", v)
+}
+
+func TestFlagConfig(t *testing.T) {
+	assert := require.New(t)
+
+	fs := flag.NewFlagSet("tunnel", flag.ContinueOnError)
+	fs.String("c", "", "")
+	fs.String("token", "", "")
+	fs.String("jwt", "", "")
+	assert.Nil(fs.Parse([]string{"-c", "provider:5555", "-token", "s3cret"}))
+
+	config := flagConfig(fs, "token", "jwt")
+	assert.Equal("provider:5555", config["c"])
+	assert.Equal("(redacted)", config["token"])
+	assert.Equal("", config["jwt"])
+}
+
+func TestCheckRoleFlags(t *testing.T) {
+	assert := require.New(t)
+
+	fs := flag.NewFlagSet("tunnel", flag.ContinueOnError)
+	fs.Int("l", 0, "")
+	fs.String("c", "", "")
+	fs.String("tokens", "", "")
+	fs.String("log-level", "info", "")
+	assert.Nil(fs.Parse([]string{"-c", "provider:5555", "-log-level", "debug"}))
+
+	assert.Nil(checkRoleFlags(fs, roleClient))
+	assert.Nil(checkRoleFlags(fs, ""))
+
+	err := checkRoleFlags(fs, roleServer)
+	assert.NotNil(err)
+	assert.Equal("-c is a client flag, see tunnel client -h", err.Error())
+
+	var out bytes.Buffer
+	fs.SetOutput(&out)
+	roleUsage(fs, roleServer)
+	assert.Contains(out.String(), "-tokens")
+	assert.Contains(out.String(), "-log-level")
+	assert.NotContains(out.String(), "-c ")
+}
+
+func TestVerbosity(t *testing.T) {
+	assert := require.New(t)
+
+	level, err := verbosity("info", false, false, false)
+	assert.Nil(err)
+	assert.Equal("info", level)
+
+	level, _ = verbosity("info", true, false, false)
+	assert.Equal("debug", level)
+	level, _ = verbosity("info", true, true, false)
+	assert.Equal("trace", level)
+	level, _ = verbosity("debug", false, false, true)
+	assert.Equal("warn", level)
+
+	_, err = verbosity("info", true, false, true)
+	assert.NotNil(err)
+}
+
+func TestStringList(t *testing.T) {
+	assert := require.New(t)
+
+	fs := flag.NewFlagSet("tunnel", flag.ContinueOnError)
+	var targets stringList
+	fs.Var(&targets, "t", "")
+	assert.Nil(fs.Parse([]string{"-t", "localhost:8080", "-t", "localhost:22, localhost:5432"}))
+
+	assert.Equal(stringList{"localhost:8080", "localhost:22", "localhost:5432"}, targets)
+	assert.Equal("localhost:8080,localhost:22,localhost:5432", targets.String())
+}
+
+func TestDNSAnswerIP(t *testing.T) {
+	assert := require.New(t)
+
+	ip, err := dnsAnswerIP("10.0.0.1:53", "")
+	assert.Nil(err)
+	assert.Equal("10.0.0.1", ip.String())
+
+	ip, err = dnsAnswerIP(":5353", "192.168.1.10")
+	assert.Nil(err)
+	assert.Equal("192.168.1.10", ip.String())
+
+	_, err = dnsAnswerIP(":5353", "")
+	assert.NotNil(err)
+	_, err = dnsAnswerIP("0.0.0.0:5353", "")
+	assert.NotNil(err)
+}
+
+func TestClientLabels(t *testing.T) {
+	assert := require.New(t)
+
+	labels, err := clientLabels([]string{"env=prod", "version=canary"})
+	assert.Nil(err)
+	assert.Equal("prod", labels["env"])
+	assert.Equal("canary", labels["version"])
+
+	hostname, _ := os.Hostname()
+	assert.Equal(hostname, labels["hostname"])
+
+	_, err = clientLabels([]string{"env"})
+	assert.NotNil(err)
+}
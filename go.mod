@@ -2,4 +2,11 @@ module github.com/kelveny/tunnel
 
 go 1.16
 
-require github.com/stretchr/testify v1.7.0 // indirect
+require (
+	github.com/golang/snappy v0.0.4
+	github.com/stretchr/testify v1.7.0
+	golang.org/x/crypto v0.17.0
+	golang.org/x/net v0.10.0
+	golang.org/x/sys v0.15.0
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
+)
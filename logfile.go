@@ -0,0 +1,144 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// rotatingFile is a log file that is rotated once it would grow beyond
+// maxSize: the file becomes path.1, older backups shift to path.2 and so on,
+// and backups beyond maxBackups are removed. Backups are gzipped to
+// path.N.gz when compress is set.
+type rotatingFile struct {
+	lock sync.Mutex
+
+	path       string
+	maxSize    int64
+	maxBackups int
+	compress   bool
+
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int, compress bool) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		compress:   compress,
+	}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(b []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	// a single write larger than maxSize still goes to a file of its own
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(b)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.file.Close()
+}
+
+func (f *rotatingFile) backup(i int) string {
+	return fmt.Sprintf("%s.%d", f.path, i)
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	// backups of either kind, compression may have been toggled in between
+	for _, suffix := range []string{"", ".gz"} {
+		os.Remove(f.backup(f.maxBackups) + suffix)
+
+		for i := f.maxBackups - 1; i >= 1; i-- {
+			os.Rename(f.backup(i)+suffix, f.backup(i+1)+suffix)
+		}
+	}
+
+	if f.maxBackups > 0 {
+		if err := os.Rename(f.path, f.backup(1)); err != nil {
+			return err
+		}
+
+		if f.compress {
+			if err := gzipFile(f.backup(1)); err != nil {
+				return err
+			}
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+
+	return f.open()
+}
+
+// gzipFile replaces path by path.gz
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := gzip.NewWriter(out)
+	if _, err := io.Copy(w, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotatingFile(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "logfile")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tunnel.log")
+
+	f, err := openRotatingFile(path, 10, 2, false)
+	assert.Nil(err)
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := f.Write([]byte(line))
+		assert.Nil(err)
+	}
+	assert.Nil(f.Close())
+
+	read := func(name string) string {
+		b, err := ioutil.ReadFile(name)
+		assert.Nil(err)
+		return string(b)
+	}
+
+	// the oldest line fell off the end of the backups
+	assert.Equal("fourth\n", read(path))
+	assert.Equal("third\n", read(path+".1"))
+	assert.Equal("second\n", read(path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.True(os.IsNotExist(err))
+
+	// reopening appends
+	f, err = openRotatingFile(path, 100, 2, false)
+	assert.Nil(err)
+	f.Write([]byte("fifth\n"))
+	f.Close()
+	assert.Equal("fourth\nfifth\n", read(path))
+}
+
+func TestRotatingFileCompress(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "logfile")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tunnel.log")
+
+	f, err := openRotatingFile(path, 10, 1, true)
+	assert.Nil(err)
+	f.Write([]byte("first\n"))
+	f.Write([]byte("second\n"))
+	f.Close()
+
+	_, err = os.Stat(path + ".1")
+	assert.True(os.IsNotExist(err))
+
+	gz, err := os.Open(path + ".1.gz")
+	assert.Nil(err)
+	defer gz.Close()
+
+	r, err := gzip.NewReader(gz)
+	assert.Nil(err)
+	b, err := ioutil.ReadAll(r)
+	assert.Nil(err)
+	assert.True(strings.HasPrefix(string(b), "first"))
+}
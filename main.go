@@ -0,0 +1,599 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/kelveny/tunnel/pkg/tunnel"
+)
+
+// subcommands of the tunnel binary, run as "tunnel NAME args..."
+var subcommands = map[string]func(args []string) error{
+	"server": func(args []string) error { return runTunnel(roleServer, args) },
+	"client": func(args []string) error { return runTunnel(roleClient, args) },
+	"bench":  runBench,
+	"status": func(args []string) error { return runStatus(os.Stdout, args) },
+	"kill":   func(args []string) error { return runKill(os.Stdout, args) },
+	"version": func(args []string) error {
+		printVersion(os.Stdout)
+		return nil
+	},
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			exitOnError(run(os.Args[2:]))
+			return
+		}
+	}
+
+	// flags without a subcommand, the role follows from -l
+	exitOnError(runTunnel("", os.Args[1:]))
+}
+
+// exitOnError reports err on stderr and exits with status 1, so that scripts
+// notice failed commands
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// runTunnel runs the provider of role, server or client, or the role args
+// imply when empty
+func runTunnel(role string, args []string) error {
+	fs := flag.NewFlagSet("tunnel", flag.ExitOnError)
+	fs.Usage = func() { roleUsage(fs, role) }
+
+	showVersion := fs.Bool("version", false, "Print the version and build metadata and exit")
+	configPath := fs.String("config", "", "YAML file of settings named like the flags, flags on the command line override it")
+	port := fs.Int("l", 0, "Tunnel provider signaling port")
+	logLevelName := fs.String("log-level", "info", "Least severe events logged: trace (every frame), debug (every data connection), info (tunnel lifecycle), warn or error")
+	verbose := fs.Bool("v", false, "Log every data connection, as -log-level debug")
+	veryVerbose := fs.Bool("vv", false, "Log every frame too, as -log-level trace")
+	quiet := fs.Bool("q", false, "Log warnings and errors only, as -log-level warn")
+	tracePdus := fs.Bool("trace", false, "Log every PDU sent and received with its type, handles and length, as -log-level trace")
+	traceBytes := fs.Int("trace-bytes", 0, "Hex dump this many leading bytes of every PDU traced, except those carrying credentials")
+	recordDir := fs.String("record-dir", "", "Record the cleartext payload of data connections to .rx and .tx files in this directory")
+	recordTargets := fs.String("record", "", "Comma separated host:port patterns of the targets whose data connections -record-dir and -capture record, all if empty")
+	recordMaxSize := fs.String("record-max-size", "10M", "Stop recording a direction of a data connection once its file reaches this size, 0 for no cap")
+	recordMaxFiles := fs.Int("record-max-files", 100, "Recording files to keep in -record-dir, the oldest are removed, 0 keeps all")
+	faultLatency := fs.Duration("fault-latency", 0, "Testing: delay payload read from data connections this long before relaying it")
+	faultJitter := fs.Duration("fault-jitter", 0, "Testing: vary -fault-latency by up to this much either way")
+	faultDrop := fs.Float64("fault-drop", 0, "Testing: lose this fraction of the payloads read from data connections, 0 to 1: datagrams are dropped, streams retransmit with backoff")
+	faultReset := fs.Duration("fault-reset", 0, "Testing: reset tunnel connections after a random time averaging this long")
+	captureFile := fs.String("capture", "", "Write the payload of data connections to this pcapng file as TCP with synthesized headers, for Wireshark")
+	logFormat := fs.String("log-format", "text", "Log line format: text (logfmt) or json")
+	logFile := fs.String("log-file", "", "Log to this file instead of stdout, rotated by size")
+	daemon := fs.Bool("daemon", false, "Detach from the terminal and run in the background once started")
+	pidFile := fs.String("pidfile", "", "Write the process ID to this file, removed on exit")
+	syslogTarget := fs.String("syslog", "", "Log to syslog in RFC 5424 format instead of stdout: local, unix:///path, udp://host:port or tcp://host:port")
+	syslogFacility := fs.String("syslog-facility", "daemon", "Syslog facility of log and audit messages")
+	logMaxSize := fs.String("log-max-size", "100M", "Rotate the log file once it reaches this size")
+	logMaxBackups := fs.Int("log-max-backups", 5, "Rotated log files to keep")
+	logCompress := fs.Bool("log-compress", false, "Gzip rotated log files")
+	apiAddress := fs.String("api", "", "Serve the admin REST API on this address, requires -api-token")
+	grpcAddress := fs.String("grpc", "", "Serve the admin gRPC service, streaming tunnel events, on this address, requires -api-token")
+	apiToken := fs.String("api-token", "", "Bearer token admin API and gRPC requests must carry, file:/path, env:NAME or keyring:service/user ($TUNNEL_API_TOKEN)")
+	webhookURL := fs.String("webhook", "", "POST tunnel opens, closes and authentication failures as JSON to this URL")
+	healthAddress := fs.String("health", "", "Serve unauthenticated /healthz and /readyz probes for load balancers on this address")
+	dnsAddress := fs.String("dns", "", "Answer DNS A and SRV queries for registered service names on this UDP address, e.g. :5353")
+	dnsZone := fs.String("dns-zone", "tunnel.internal", "DNS zone of the service names answered by -dns")
+	dnsIP := fs.String("dns-ip", "", "Provider IP address answered by -dns, defaults to the IP address -dns listens on")
+	adminAddress := fs.String("admin", "", "Serve the dashboard, admin API reads without token, expvar counters and pprof profiles on this loopback address, e.g. 127.0.0.1:6060")
+	providerAddress := fs.String("c", "", "Tunnel provider signaling address, host:port or tunnel://identity:env:NAME@host:port?tls=true&target=host:port, the token takes -token references")
+	var labels stringList
+	fs.Var(&labels, "label", "Label reported to the provider along with hostname and version, key=value, repeat it or separate by commas")
+	var targets stringList
+	fs.Var(&targets, "t", "Target address to be tunnelled, [service=]host:port[/high|low], repeat it or separate by commas for several forwards over one provider connection")
+	localAddress := fs.String("L", "", "Relay connections accepted on this local address to -t directly, without a provider")
+	tokenFile := fs.String("tokens", "", "File of \"identity token\" pairs clients must authenticate with")
+	allowDial := fs.Bool("allow-dial", false, "Let clients of the library dial targets their -acl allows from the provider through their tunnel connection")
+	aclFile := fs.String("acl", "", "File of \"identity host:port ...\" targets each client may request")
+	jwtIssuer := fs.String("jwt-issuer", "", "Trusted OIDC issuer clients may authenticate with JWTs of")
+	jwtAudience := fs.String("jwt-audience", "", "Audience client JWTs must be issued for")
+	jwksURL := fs.String("jwks-url", "", "JWKS URL of the issuer, discovered from -jwt-issuer when empty")
+	jwtClaim := fs.String("jwt-claim", "sub", "JWT claim used as client identity")
+	authMaxFailures := fs.Int("auth-max-failures", 5, "Failed authentications in a row before a source IP is banned, 0 disables bans")
+	authBan := fs.Duration("auth-ban", 15*time.Minute, "How long a source IP stays banned after too many failed authentications")
+	quotaFile := fs.String("quotas", "", "File of \"identity bytes_per_second monthly_bytes\" bandwidth quotas")
+	maxTunnels := fs.Int("max-tunnels-per-client", 0, "Tunnel listeners each client identity may hold, 0 means unlimited")
+	maxConns := fs.Int("max-conns-per-client", 0, "Simultaneous data connections each client identity may hold, 0 means unlimited")
+	tenantFile := fs.String("tenants", "", "File of \"identity max_tunnels max_conns bytes_per_second monthly_bytes\" limits per client identity, replaces -quotas")
+	tunnelPorts := fs.String("port-range", "", "Allocate tunnel ports from this range only, e.g. 20000-21000")
+	otlpEndpoint := fs.String("otlp", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "Export spans of tunnels and data connections to this OTLP/HTTP collector, e.g. http://localhost:4318 ($OTEL_EXPORTER_OTLP_ENDPOINT)")
+	auditTarget := fs.String("audit", "", "Append audit events as JSON lines to a file, tcp://host:port, unix:///path or syslog:TARGET as for -syslog")
+	accessLogFile := fs.String("access-log", "", "Append a line per data connection of the tunnel ports to a file, - for stdout")
+	accessLogFormat := fs.String("access-log-format", "clf", "Format of -access-log lines, clf or json")
+	sniAllow := fs.String("sni-allow", "", "Comma separated SNI patterns data connections must match, e.g. *.example.com, - for connections without SNI")
+	sniDeny := fs.String("sni-deny", "", "Comma separated SNI patterns data connections are refused for")
+	identity := fs.String("id", "", "Client identity to authenticate with")
+	token := fs.String("token", "", "Client token to authenticate with, file:/path, env:NAME or keyring:service/user ($TUNNEL_TOKEN)")
+	jwt := fs.String("jwt", "", "Client JWT to authenticate with, file:/path, env:NAME or keyring:service/user ($TUNNEL_JWT)")
+	tlsCert := fs.String("tls-cert", "", "TLS certificate file, provider certificate or client certificate for mTLS")
+	tlsKey := fs.String("tls-key", "", "TLS private key file of -tls-cert, or env:NAME / keyring:service/user holding the PEM key")
+	clientCA := fs.String("client-ca", "", "CA certificate file clients must present certificates of, enables mTLS")
+	spiffeTrustDomain := fs.String("spiffe-trust-domain", "", "With mTLS, only accept client SPIFFE IDs of this trust domain")
+	acmeHosts := fs.String("acme-host", "", "Comma separated provider host names to obtain Let's Encrypt certificates for")
+	acmeCache := fs.String("acme-cache", "acme-cache", "Directory caching ACME account and certificates")
+	acmeEmail := fs.String("acme-email", "", "Contact email for the ACME account")
+	acmeHTTP := fs.String("acme-http", "", "Address to answer ACME HTTP-01 challenges on, e.g. :80")
+	useTLS := fs.Bool("tls", false, "Connect to the provider over TLS")
+	caFile := fs.String("ca", "", "CA certificate file used to verify the provider")
+	pin := fs.String("pin", "", "SHA-256 pin of the provider certificate or public key, implies -tls")
+	keepalive := fs.Duration("keepalive", 30*time.Second, "Probe tunnels this often, reap data connections the peer no longer knows and drop tunnels silent for 3 probes, 0 disables")
+	statsInterval := fs.Duration("stats-interval", 30*time.Second, "Report the connections, bytes and errors of each tunnel to the peer this often, 0 disables")
+	sessionGrace := fs.Duration("session-grace", 30*time.Second, "Keep the tunnel port of a disconnected client this long for it to resume, 0 disables")
+	drainTimeout := fs.Duration("drain-timeout", 0, "On SIGTERM stop accepting and let open data connections finish for up to this long before closing them")
+	registryFile := fs.String("registry", "", "File persisting tunnel sessions, their ports are re-bound after a restart for clients to resume")
+	reservationFile := fs.String("reservations", "", "File persisting the tunnel ports reserved for authenticated client identities, they get the same ports back on reconnect")
+	reservationTTL := fs.Duration("reservation-ttl", 7*24*time.Hour, "Release a port reservation once its port has been closed this long, 0 keeps it forever")
+	onDemandFile := fs.String("on-demand", "", "File of \"port host:port [key=value ...]\" tunnel ports served by -standby clients of the target and labels")
+	onDemandWait := fs.Duration("on-demand-wait", 10*time.Second, "Hold consumers of an on-demand port this long for a standby client to connect")
+	serviceTLSFile := fs.String("service-tls", "", "File of \"[namespace/]service plain|reencrypt\" services the provider terminates TLS for")
+	serviceCertDir := fs.String("service-certs", "", "Directory keeping the certificates uploaded for -service-tls services")
+	serviceACMEDomain := fs.String("service-acme-domain", "", "Obtain Let's Encrypt certificates of -service-tls services without one for service[.namespace].domain")
+	standby := fs.Bool("standby", false, "Serve the targets of -t for on-demand ports of the provider instead of requesting tunnel ports")
+	clusterStore := fs.String("cluster", "", "Share service names with the providers using this store, redis://[:password@]host:port[/db]")
+	clusterAdvertise := fs.String("cluster-advertise", "", "Host the other providers of -cluster send consumers to for the tunnel ports of this one")
+	reconnectMax := fs.Duration("reconnect-max", time.Minute, "Re-dial a lost provider with exponential backoff up to this delay, 0 exits instead")
+	encrypt := fs.Bool("encrypt", false, "Negotiate AES-GCM encryption of tunneled payloads")
+	dataChannels := fs.Int("data-channels", 0, "Open this many extra connections to the provider for the payload of data connections, up to 8")
+	promoteRate := fs.String("promote-rate", "", "Move data connections relaying more bytes per second to a connection to the provider of their own, e.g. 10M")
+	obfsKey := fs.String("obfs", "", "Pre-shared key obfuscating the signaling connection, must match on both sides, file:/path, env:NAME or keyring:service/user ($TUNNEL_OBFS_KEY)")
+	rekeyInterval := fs.Duration("rekey-interval", time.Hour, "Rotate payload encryption keys this often, 0 disables")
+	rekeyBytes := fs.Uint64("rekey-bytes", 1<<30, "Rotate payload encryption keys after this many bytes, 0 disables")
+	noCompress := fs.Bool("no-compress", false, "Never compress tunneled payloads, e.g. for already compressed traffic")
+	compressMin := fs.Int("compress-min", 256, "Compress tunneled payloads of at least this many bytes")
+	nagle := fs.Bool("nagle", false, "Enable Nagle's algorithm on tunnel and data connections")
+	keepAlive := fs.Duration("tcp-keepalive", 0, "TCP keepalive period of tunnel and data connections, 0 keeps the default, negative disables")
+	sendBuffer := fs.String("sndbuf", "", "SO_SNDBUF size of tunnel and data connections, e.g. 4M")
+	receiveBuffer := fs.String("rcvbuf", "", "SO_RCVBUF size of tunnel and data connections, e.g. 4M")
+	writeTimeout := fs.Duration("write-timeout", time.Minute, "Close tunnel and data connections whose peer stops reading for this long, 0 disables")
+	connectTimeout := fs.Duration("connect-timeout", 30*time.Second, "Close data connections whose peer does not connect them within this long, 0 disables")
+	memoryBudget := fs.String("memory-budget", "", "Cap on data queued for tunnel writes across all tunnels, reads pause beyond it, e.g. 256M")
+	memoryShed := fs.Bool("memory-shed", false, "Also refuse new data connections while the memory budget is used up")
+	ioEngine := fs.String("io-engine", "goroutine", "Data connection read engine: goroutine, or epoll for very many idle connections (Linux only)")
+	acceptors := fs.Int("acceptors", 1, "Accept goroutines per signaling and tunnel port, more than one use SO_REUSEPORT (Linux only)")
+	ingressRate := fs.String("max-ingress-rate", "", "Bytes per second read from all data connections together, e.g. 10M")
+	egressRate := fs.String("max-egress-rate", "", "Bytes per second written to all data connections together, e.g. 10M")
+
+	fs.Parse(args)
+
+	if *showVersion {
+		printVersion(os.Stdout)
+		return nil
+	}
+
+	var forwards []string
+	if len(*configPath) > 0 {
+		var err error
+		if forwards, err = loadConfigFile(fs, *configPath); err != nil {
+			return err
+		}
+	}
+
+	if isConnectionString(*providerAddress) {
+		if err := applyConnectionString(fs, *providerAddress); err != nil {
+			return err
+		}
+	}
+
+	// a target on the command line replaces the forwards of the file
+	if len(targets) > 0 {
+		forwards = targets
+	}
+
+	if err := checkRoleFlags(fs, role); err != nil {
+		return err
+	}
+
+	switch role {
+	case roleServer:
+		if *port == 0 {
+			return errors.New("tunnel server requires -l port")
+		}
+	case roleClient:
+		if len(*localAddress) == 0 && (len(*providerAddress) == 0 || len(forwards) == 0) {
+			return errors.New("tunnel client requires -c host:port and -t host:port, or -L [host]:port and -t host:port")
+		}
+	}
+
+	level, err := verbosity(*logLevelName, *verbose, *veryVerbose || *tracePdus, *quiet)
+	if err != nil {
+		return err
+	}
+	if err := tunnel.SetLogLevel(level); err != nil {
+		return err
+	}
+	if err := tunnel.SetLogFormat(*logFormat); err != nil {
+		return err
+	}
+
+	if *daemon {
+		detached, err := daemonize()
+		if err != nil {
+			return err
+		}
+
+		// the parent is done once the daemon started
+		if !detached {
+			return nil
+		}
+	}
+
+	if len(*logFile) > 0 && len(*syslogTarget) > 0 {
+		return errors.New("use either -log-file or -syslog")
+	}
+
+	facility, err := tunnel.ParseSyslogFacility(*syslogFacility)
+	if err != nil {
+		return err
+	}
+
+	if len(*syslogTarget) > 0 {
+		w, err := tunnel.DialSyslog(*syslogTarget, facility, "-")
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+
+		tunnel.SetLogOutput(w)
+	}
+
+	if len(*logFile) > 0 {
+		maxSize, err := tunnel.ParseByteSize(*logMaxSize)
+		if err != nil {
+			return err
+		}
+
+		f, err := openRotatingFile(*logFile, int64(maxSize), *logMaxBackups, *logCompress)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		tunnel.SetLogOutput(f)
+	}
+
+	if len(*pidFile) > 0 {
+		remove, err := writePidFile(*pidFile)
+		if err != nil {
+			return err
+		}
+		defer remove()
+	}
+
+	config := tunnel.Config{
+		RekeyInterval:  *rekeyInterval,
+		RekeyBytes:     *rekeyBytes,
+		Acceptors:      *acceptors,
+		WriteTimeout:   *writeTimeout,
+		ConnectTimeout: *connectTimeout,
+		SessionGrace:   *sessionGrace,
+		Keepalive:      *keepalive,
+		StatsInterval:  *statsInterval,
+		TraceBytes:     *traceBytes,
+		RecordDir:      *recordDir,
+		RecordTargets:  *recordTargets,
+		RecordMaxFiles: *recordMaxFiles,
+		CaptureFile:    *captureFile,
+		IOEngine:       *ioEngine,
+		MemoryShed:     *memoryShed,
+		Nagle:          *nagle,
+		TCPKeepAlive:   *keepAlive,
+		AuditTarget:    *auditTarget,
+		SyslogFacility: facility,
+		OTLPEndpoint:   *otlpEndpoint,
+		OTLPService:    os.Getenv("OTEL_SERVICE_NAME"),
+
+		AccessLog:       *accessLogFile,
+		AccessLogFormat: *accessLogFormat,
+
+		FaultLatency:       *faultLatency,
+		FaultJitter:        *faultJitter,
+		FaultDropRate:      *faultDrop,
+		FaultResetInterval: *faultReset,
+	}
+	if !*noCompress {
+		config.CompressMin = *compressMin
+	}
+
+	sizes := []struct {
+		value string
+		size  *int
+	}{
+		{*memoryBudget, &config.MemoryBudget},
+		{*sendBuffer, &config.SendBuffer},
+		{*receiveBuffer, &config.ReceiveBuffer},
+	}
+	for _, s := range sizes {
+		if len(s.value) == 0 {
+			continue
+		}
+
+		n, err := tunnel.ParseByteSize(s.value)
+		if err != nil {
+			return err
+		}
+		*s.size = int(n)
+	}
+
+	if len(*recordDir) > 0 {
+		maxSize, err := tunnel.ParseByteSize(*recordMaxSize)
+		if err != nil {
+			return err
+		}
+		config.RecordMaxSize = int64(maxSize)
+	}
+
+	rates := []struct {
+		value string
+		rate  *uint64
+	}{
+		{*ingressRate, &config.MaxIngressRate},
+		{*egressRate, &config.MaxEgressRate},
+	}
+	for _, r := range rates {
+		if len(r.value) == 0 {
+			continue
+		}
+
+		n, err := tunnel.ParseByteSize(r.value)
+		if err != nil {
+			return err
+		}
+		*r.rate = n
+	}
+
+	obfs, err := secretFlag("obfs", *obfsKey, "TUNNEL_OBFS_KEY")
+	if err != nil {
+		return err
+	}
+	if len(obfs) > 0 {
+		config.ObfsKey = []byte(obfs)
+	}
+
+	if *port != 0 {
+		config.TokenFile = *tokenFile
+		config.JWTIssuer = *jwtIssuer
+		config.JWTAudience = *jwtAudience
+		config.JWKSURL = *jwksURL
+		config.JWTClaim = *jwtClaim
+		config.AuthMaxFailures = *authMaxFailures
+		config.AuthBan = *authBan
+		config.ACLFile = *aclFile
+		config.AllowDial = *allowDial
+		config.QuotaFile = *quotaFile
+		config.PortRange = *tunnelPorts
+		config.MaxTunnelsPerClient = *maxTunnels
+		config.MaxConnsPerClient = *maxConns
+		config.TenantFile = *tenantFile
+		config.SNIAllow = *sniAllow
+		config.SNIDeny = *sniDeny
+		config.RegistryFile = *registryFile
+		config.ReservationFile = *reservationFile
+		config.ReservationTTL = *reservationTTL
+		config.OnDemandFile = *onDemandFile
+		config.OnDemandWait = *onDemandWait
+		config.ServiceTLSFile = *serviceTLSFile
+		config.ServiceCertDir = *serviceCertDir
+		config.ServiceACMEDomain = *serviceACMEDomain
+		config.ServiceACMECache = *acmeCache
+		config.ServiceACMEEmail = *acmeEmail
+		config.ClusterStore = *clusterStore
+		config.ClusterAdvertise = *clusterAdvertise
+
+		if len(*registryFile) > 0 && *sessionGrace <= 0 {
+			return errors.New("-registry requires a positive -session-grace")
+		}
+		if len(*clusterStore) > 0 && len(*clusterAdvertise) == 0 {
+			return errors.New("-cluster requires -cluster-advertise")
+		}
+		if (len(*serviceCertDir) > 0 || len(*serviceACMEDomain) > 0) && len(*serviceTLSFile) == 0 {
+			return errors.New("-service-certs and -service-acme-domain require -service-tls")
+		}
+		if len(*acmeHosts) > 0 && (len(*tlsCert) > 0 || len(*tlsKey) > 0) {
+			return errors.New("-acme-host and -tls-cert/-tls-key are mutually exclusive")
+		}
+
+		if len(*tlsCert) > 0 || len(*tlsKey) > 0 {
+			tlsConfig, err := tunnel.LoadServerTLSConfig(*tlsCert, *tlsKey)
+			if err != nil {
+				return err
+			}
+			config.TLSConfig = tlsConfig
+
+			tunnel.LogCertificatePins(tlsConfig)
+		} else if len(*acmeHosts) > 0 {
+			tlsConfig, err := tunnel.NewACMETLSConfig(*acmeHosts, *acmeCache, *acmeEmail, *acmeHTTP)
+			if err != nil {
+				return err
+			}
+			config.TLSConfig = tlsConfig
+		}
+
+		if len(*clientCA) > 0 {
+			if config.TLSConfig == nil {
+				return errors.New("-client-ca requires -tls-cert/-tls-key or -acme-host")
+			}
+
+			if err := tunnel.RequireClientCertificates(config.TLSConfig, *clientCA); err != nil {
+				return err
+			}
+			config.SPIFFETrustDomain = *spiffeTrustDomain
+		}
+	} else if len(*localAddress) == 0 {
+		if len(*providerAddress) == 0 || len(forwards) == 0 {
+			return errors.New("run tunnel server -l port, or tunnel client -c host:port -t host:port")
+		}
+
+		if *useTLS || len(*caFile) > 0 || len(*pin) > 0 || len(*tlsCert) > 0 {
+			tlsConfig, err := tunnel.NewClientTLSConfig(*providerAddress, *caFile, *pin)
+			if err != nil {
+				return err
+			}
+
+			if len(*tlsCert) > 0 {
+				if err := tunnel.LoadClientCertificate(tlsConfig, *tlsCert, *tlsKey); err != nil {
+					return err
+				}
+			}
+			config.TLSConfig = tlsConfig
+		}
+	}
+
+	p, err := tunnel.NewProvider(config)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	dumpOnSignal(p)
+
+	if len(*adminAddress) > 0 {
+		// without a token the admin port serves the API read-only
+		token, err := secretFlag("api-token", *apiToken, "TUNNEL_API_TOKEN")
+		if err != nil {
+			return err
+		}
+
+		config := flagConfig(fs, secretFlagNames...)
+		if _, err := p.StartAdminServer(*adminAddress, token, config); err != nil {
+			return err
+		}
+	}
+
+	if len(*localAddress) > 0 {
+		if len(targets) != 1 {
+			return errors.New("-L requires a single -t host:port")
+		}
+
+		forward, err := tunnel.StartLocalForward(*localAddress, targets[0])
+		if err != nil {
+			return err
+		}
+		defer forward.Close()
+
+		daemonReady()
+
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+		defer stop()
+		<-ctx.Done()
+
+		tunnel.LogInfo("Shutting down local forward")
+		notifyStopping()
+		return nil
+	}
+
+	if *port != 0 {
+		if len(*webhookURL) > 0 {
+			p.StartWebhook(*webhookURL)
+		}
+
+		if _, err := p.StartListener(*port); err != nil {
+			return err
+		}
+
+		if len(*healthAddress) > 0 {
+			if _, err := p.StartHealthServer(*healthAddress); err != nil {
+				return err
+			}
+		}
+
+		if len(*dnsAddress) > 0 {
+			ip, err := dnsAnswerIP(*dnsAddress, *dnsIP)
+			if err != nil {
+				return err
+			}
+
+			if _, err := p.StartDNSServer(*dnsAddress, *dnsZone, ip); err != nil {
+				return err
+			}
+		}
+
+		if len(*apiAddress) > 0 || len(*grpcAddress) > 0 {
+			token, err := secretFlag("api-token", *apiToken, "TUNNEL_API_TOKEN")
+			if err != nil {
+				return err
+			}
+			if len(token) == 0 {
+				return errors.New("-api and -grpc require -api-token")
+			}
+
+			if len(*apiAddress) > 0 {
+				config := flagConfig(fs, secretFlagNames...)
+				if _, err := p.StartAPIServer(*apiAddress, token, config); err != nil {
+					return err
+				}
+			}
+
+			if len(*grpcAddress) > 0 {
+				if _, err := p.StartGRPCServer(*grpcAddress, token); err != nil {
+					return err
+				}
+			}
+		}
+
+		daemonReady()
+		notifyReady(p)
+
+		// tunnel ports close with the provider, sessions are kept for the next
+		// start
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		sig := <-signals
+
+		tunnel.LogInfo("Shutting down", "signal", sig)
+		notifyStopping()
+
+		if *drainTimeout > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+			defer cancel()
+			p.Shutdown(ctx)
+		}
+	} else {
+		connector := tunnel.ConnectorConfig{
+			ProviderAddress:   *providerAddress,
+			Identity:          *identity,
+			Target:            forwards[0],
+			Forwards:          forwards[1:],
+			Encrypt:           *encrypt,
+			DataChannels:      *dataChannels,
+			Standby:           *standby,
+			MaxReconnectDelay: *reconnectMax,
+		}
+		if connector.Labels, err = clientLabels(labels); err != nil {
+			return err
+		}
+		if len(*promoteRate) > 0 {
+			if connector.PromoteRate, err = tunnel.ParseByteSize(*promoteRate); err != nil {
+				return err
+			}
+		}
+		if connector.Token, err = secretFlag("token", *token, "TUNNEL_TOKEN"); err != nil {
+			return err
+		}
+		if connector.JWT, err = secretFlag("jwt", *jwt, "TUNNEL_JWT"); err != nil {
+			return err
+		}
+		if len(connector.JWT) > 0 && config.TLSConfig == nil {
+			return errors.New("-jwt requires -tls, JWTs are bearer credentials")
+		}
+
+		daemonReady()
+		if err := p.RunConnector(connector); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLog writes one line per closed data connection of a tunnel port:
+// the consumer, the host name it asked for by SNI, the identity of the
+// client serving the port, bytes in both directions and duration. Lines are
+// in Common Log Format, with the request line "CONNECT host" and a trailing
+// duration in milliseconds, or JSON. A nil log writes nothing.
+type accessLog struct {
+	json bool
+
+	lock sync.Mutex
+	w    io.WriteCloser
+}
+
+// openAccessLog appends to file, stdout for "-", in format clf or json
+func openAccessLog(file string, format string) (*accessLog, error) {
+	if format != "clf" && format != "json" {
+		return nil, fmt.Errorf("unknown access log format %q, expected clf or json", format)
+	}
+
+	var w io.WriteCloser = os.Stdout
+	if file != "-" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+
+	return &accessLog{json: format == "json", w: w}, nil
+}
+
+// accessEntry is a closed data connection
+type accessEntry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Host     string    `json:"host,omitempty"`
+	Target   string    `json:"target"`
+	Identity string    `json:"identity,omitempty"`
+	RxBytes  uint64    `json:"rx_bytes"`
+	TxBytes  uint64    `json:"tx_bytes"`
+	Duration int64     `json:"duration_ms"`
+}
+
+func (a *accessLog) record(e *accessEntry) {
+	if a == nil {
+		return
+	}
+
+	var line []byte
+	if a.json {
+		b, err := json.Marshal(e)
+		if err != nil {
+			logger.error("Access log error", "error", err)
+			return
+		}
+		line = b
+	} else {
+		line = []byte(e.clf())
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		logger.error("Access log error", "error", err)
+	}
+}
+
+// clf formats e as a Common Log Format line: the bytes are those sent to
+// the consumer, those received and the duration follow
+func (e *accessEntry) clf() string {
+	client := e.Client
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+
+	host := e.Host
+	if len(host) == 0 {
+		host = e.Target
+	}
+
+	return fmt.Sprintf("%s - %s [%s] \"CONNECT %s\" - %d %d %d", client, clfField(e.Identity),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"), host, e.TxBytes, e.RxBytes, e.Duration)
+}
+
+// clfField keeps s a single field, "-" when empty
+func clfField(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return strings.ReplaceAll(s, " ", "%20")
+}
+
+func (a *accessLog) close() error {
+	if a == nil || a.w == os.Stdout {
+		return nil
+	}
+
+	return a.w.Close()
+}
@@ -0,0 +1,68 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLog(t *testing.T) {
+	assert := require.New(t)
+
+	entry := &accessEntry{
+		Time:     time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC),
+		Client:   "192.0.2.1:50000",
+		Host:     "api.example.com",
+		Target:   "localhost:443",
+		Identity: "alice",
+		RxBytes:  100,
+		TxBytes:  2000,
+		Duration: 1500,
+	}
+
+	dir, err := ioutil.TempDir("", "accesslog")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "access.log")
+	a, err := openAccessLog(file, "clf")
+	assert.NoError(err)
+	a.record(entry)
+
+	entry.Host = ""
+	entry.Identity = ""
+	a.record(entry)
+	assert.NoError(a.close())
+
+	b, err := ioutil.ReadFile(file)
+	assert.NoError(err)
+	assert.Equal([]string{
+		`192.0.2.1 - alice [04/Mar/2021:05:06:07 +0000] "CONNECT api.example.com" - 2000 100 1500`,
+		`192.0.2.1 - - [04/Mar/2021:05:06:07 +0000] "CONNECT localhost:443" - 2000 100 1500`,
+	}, strings.Split(strings.TrimSpace(string(b)), "\n"))
+
+	file = filepath.Join(dir, "access.jsonl")
+	a, err = openAccessLog(file, "json")
+	assert.NoError(err)
+	a.record(entry)
+	assert.NoError(a.close())
+
+	b, err = ioutil.ReadFile(file)
+	assert.NoError(err)
+
+	var decoded map[string]interface{}
+	assert.NoError(json.Unmarshal(b, &decoded))
+	assert.Equal("192.0.2.1:50000", decoded["client"])
+	assert.Equal("localhost:443", decoded["target"])
+	assert.Equal(float64(2000), decoded["tx_bytes"])
+	assert.NotContains(decoded, "host")
+
+	_, err = openAccessLog(file, "combined")
+	assert.Error(err)
+}
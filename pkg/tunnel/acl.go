@@ -0,0 +1,130 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// sources client identities are authenticated by. Identities of different
+// sources live in namespaces of their own, e.g. JWT subject alice is not
+// token identity alice.
+const (
+	// tokens file, Authenticator or anonymous clients
+	AUTH_SOURCE_TOKEN = iota
+	AUTH_SOURCE_JWT
+
+	// subject common name of a client certificate
+	AUTH_SOURCE_CERTIFICATE
+
+	// SPIFFE ID of a client certificate
+	AUTH_SOURCE_SPIFFE
+)
+
+// aclIdentitySource splits an ACL identity pattern into the source it
+// applies to and the pattern of identities: "jwt:" and "cn:" prefixes select
+// JWTs and certificate common names, spiffe:// patterns SPIFFE IDs, and
+// everything else identities of the tokens file or Authenticator
+func aclIdentitySource(pattern string) (int, string) {
+	switch {
+	case strings.HasPrefix(pattern, "jwt:"):
+		return AUTH_SOURCE_JWT, strings.TrimPrefix(pattern, "jwt:")
+	case strings.HasPrefix(pattern, "cn:"):
+		return AUTH_SOURCE_CERTIFICATE, strings.TrimPrefix(pattern, "cn:")
+	case strings.HasPrefix(pattern, "spiffe://"):
+		return AUTH_SOURCE_SPIFFE, pattern
+	}
+
+	return AUTH_SOURCE_TOKEN, pattern
+}
+
+type targetPattern struct {
+	host string
+	port string
+}
+
+func (t targetPattern) match(address string, port int) bool {
+	if ok, _ := path.Match(t.host, address); !ok {
+		return false
+	}
+
+	ok, _ := path.Match(t.port, strconv.Itoa(port))
+	return ok
+}
+
+// accessControlList limits which proxyAddress:proxyPort targets a client may
+// request in ListenRequest. A nil list allows everything.
+type accessControlList struct {
+	// map identity pattern -> allowed targets, see aclIdentitySource.
+	// Identity "*" applies to every client.
+	rules map[string][]targetPattern
+}
+
+// loadAccessControlList loads "identity host:port [host:port ...]" entries,
+// host and port are glob patterns, e.g. "alice 10.0.0.*:22 www.myservice.com:*"
+func loadAccessControlList(file string) (*accessControlList, error) {
+	lines, err := readConfigFields(file)
+	if err != nil {
+		return nil, err
+	}
+
+	acl := &accessControlList{
+		rules: make(map[string][]targetPattern),
+	}
+
+	for i, fields := range lines {
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s: entry %d: expected \"identity host:port ...\"", file, i+1)
+		}
+
+		for _, target := range fields[1:] {
+			host, port, err := net.SplitHostPort(target)
+			if err != nil {
+				return nil, fmt.Errorf("%s: entry %d: %v", file, i+1, err)
+			}
+
+			if _, err := path.Match(host, ""); err != nil {
+				return nil, fmt.Errorf("%s: entry %d: %v", file, i+1, err)
+			}
+			if _, err := path.Match(port, ""); err != nil {
+				return nil, fmt.Errorf("%s: entry %d: %v", file, i+1, err)
+			}
+
+			acl.rules[fields[0]] = append(acl.rules[fields[0]], targetPattern{host: host, port: port})
+		}
+	}
+
+	return acl, nil
+}
+
+// isAllowed reports whether the client identity authenticated by source,
+// AUTH_SOURCE_XXX, may request address:port
+func (acl *accessControlList) isAllowed(identity string, source int, address string, port int) bool {
+	if acl == nil {
+		return true
+	}
+
+	// identities may be glob patterns, e.g. spiffe://example.org/edge/*
+	for pattern, targets := range acl.rules {
+		if pattern != "*" {
+			patternSource, identityPattern := aclIdentitySource(pattern)
+			if patternSource != source {
+				continue
+			}
+
+			if ok, _ := path.Match(identityPattern, identity); !ok && identityPattern != identity {
+				continue
+			}
+		}
+
+		for _, t := range targets {
+			if t.match(address, port) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,40 @@
+package tunnel
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessControlList(t *testing.T) {
+	assert := require.New(t)
+
+	f, err := ioutil.TempFile("", "acl")
+	assert.NoError(err)
+	defer os.Remove(f.Name())
+
+	f.WriteString("# identity targets\nalice 10.0.0.*:22 www.myservice.com:*\n* localhost:8080\njwt:bob 10.0.0.*:22\n")
+	f.Close()
+
+	acl, err := loadAccessControlList(f.Name())
+	assert.NoError(err)
+
+	assert.True(acl.isAllowed("alice", AUTH_SOURCE_TOKEN, "10.0.0.5", 22))
+	assert.True(acl.isAllowed("alice", AUTH_SOURCE_TOKEN, "www.myservice.com", 443))
+	assert.True(acl.isAllowed("alice", AUTH_SOURCE_TOKEN, "localhost", 8080))
+	assert.False(acl.isAllowed("alice", AUTH_SOURCE_TOKEN, "10.0.1.5", 22))
+	assert.False(acl.isAllowed("bob", AUTH_SOURCE_TOKEN, "10.0.0.5", 22))
+	assert.True(acl.isAllowed("bob", AUTH_SOURCE_TOKEN, "localhost", 8080))
+
+	// identities of different sources do not share rules
+	assert.True(acl.isAllowed("bob", AUTH_SOURCE_JWT, "10.0.0.5", 22))
+	assert.False(acl.isAllowed("alice", AUTH_SOURCE_JWT, "10.0.0.5", 22))
+	assert.False(acl.isAllowed("alice", AUTH_SOURCE_CERTIFICATE, "10.0.0.5", 22))
+	assert.False(acl.isAllowed("jwt:bob", AUTH_SOURCE_TOKEN, "10.0.0.5", 22))
+	assert.True(acl.isAllowed("alice", AUTH_SOURCE_JWT, "localhost", 8080))
+
+	var none *accessControlList
+	assert.True(none.isAllowed("bob", AUTH_SOURCE_TOKEN, "10.0.0.5", 22))
+}
@@ -0,0 +1,50 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// NewACMETLSConfig obtains and renews certificates for hosts from Let's
+// Encrypt. TLS-ALPN-01 challenges are answered on the signaling listener,
+// which therefore has to be reachable on port 443; when httpAddress is set an
+// HTTP-01 responder is started there as well (usually ":80").
+func NewACMETLSConfig(hosts string, cacheDir string, email string, httpAddress string) (*tls.Config, error) {
+	var names []string
+	for _, h := range strings.Split(hosts, ",") {
+		if h = strings.TrimSpace(h); len(h) > 0 {
+			names = append(names, h)
+		}
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no ACME host names given")
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(names...),
+		Email:      email,
+	}
+
+	if len(cacheDir) > 0 {
+		m.Cache = autocert.DirCache(cacheDir)
+	}
+
+	if len(httpAddress) > 0 {
+		go func() {
+			err := http.ListenAndServe(httpAddress, m.HTTPHandler(nil))
+			logger.error("ACME HTTP-01 responder error", "error", err)
+		}()
+	}
+
+	// offers acme-tls/1 for TLS-ALPN-01 already
+	config := m.TLSConfig()
+	config.MinVersion = tls.VersionTLS12
+
+	return config, nil
+}
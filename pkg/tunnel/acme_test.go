@@ -0,0 +1,35 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme"
+)
+
+func TestACMETLSConfig(t *testing.T) {
+	assert := require.New(t)
+
+	_, err := NewACMETLSConfig(" , ", "", "", "")
+	assert.Error(err)
+
+	dir, err := ioutil.TempDir("", "acme")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	config, err := NewACMETLSConfig("a.example.com, b.example.com", dir, "ops@example.com", "")
+	assert.NoError(err)
+	assert.Equal(uint16(tls.VersionTLS12), config.MinVersion)
+	assert.NotNil(config.GetCertificate)
+
+	alpn := 0
+	for _, proto := range config.NextProtos {
+		if proto == acme.ALPNProto {
+			alpn++
+		}
+	}
+	assert.Equal(1, alpn)
+}
@@ -0,0 +1,110 @@
+package tunnel
+
+import (
+	_ "embed"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// StartAdminServer serves the admin endpoints, the dashboard, expvar counters
+// and pprof profiles, on address, which must be a loopback address: they
+// expose process internals and are not authenticated. The admin API reads
+// without token there as well, but changes only with token, or not at all
+// when token is empty. Returns the bound address.
+func (p *Provider) StartAdminServer(address string, token string, config map[string]string) (net.Addr, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isLoopbackHost(host) {
+		return nil, fmt.Errorf("admin address %s is not a loopback address", address)
+	}
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{Handler: loopbackOnly(p.newAdminMux(token, config))}
+	go func() {
+		if err := server.Serve(l); err != nil && p.ctx.Err() == nil {
+			logger.error("Admin server error", "error", err)
+		}
+	}()
+
+	go func() {
+		<-p.ctx.Done()
+		server.Close()
+	}()
+
+	logger.info("Admin server listening", "address", l.Addr())
+	return l.Addr(), nil
+}
+
+// newAdminMux routes the admin endpoints. expvar and net/http/pprof register
+// with the default mux on import, their handlers are mounted here explicitly
+// instead so that nothing else serving HTTP exposes them.
+func (p *Provider) newAdminMux(token string, config map[string]string) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// the dashboard drives the admin API, reading without a token on this
+	// port and asking for it to close connections
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardPage)
+	})
+	mux.Handle("/api/", &apiServer{provider: p, token: token, config: config, openReads: true})
+
+	health := p.newHealthMux()
+	mux.Handle("/healthz", health)
+	mux.Handle("/readyz", health)
+
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return mux
+}
+
+// loopbackOnly refuses requests for other host names, web pages could
+// otherwise reach the admin port through DNS rebinding
+func loopbackOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+
+		if !isLoopbackHost(host) {
+			http.Error(w, "admin endpoints are only served to loopback host names", http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,198 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminServer(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+	defer p.Close()
+
+	_, err := p.StartAdminServer("0.0.0.0:0", "", nil)
+	assert.NotNil(err)
+	_, err = p.StartAdminServer("example.com:6060", "", nil)
+	assert.NotNil(err)
+
+	addr, err := p.StartAdminServer("127.0.0.1:0", "", nil)
+	assert.Nil(err)
+
+	resp, err := http.Get("http://" + addr.String() + "/debug/pprof/goroutine?debug=1")
+	assert.Nil(err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Contains(string(body), "goroutine profile")
+}
+
+func TestAdminVars(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+	defer p.Close()
+
+	addr, err := p.StartAdminServer("127.0.0.1:0", "", nil)
+	assert.Nil(err)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	opened := metrics.tunnelsOpened.Value()
+	active := metrics.tunnelsActive.Value()
+	tc := p.newTunnelConnection(local)
+	assert.Equal(opened+1, metrics.tunnelsOpened.Value())
+	assert.Equal(active+1, metrics.tunnelsActive.Value())
+
+	resp, err := http.Get("http://" + addr.String() + "/debug/vars")
+	assert.Nil(err)
+	defer resp.Body.Close()
+
+	var vars struct {
+		Tunnel map[string]int64 `json:"tunnel"`
+	}
+	assert.Nil(json.NewDecoder(resp.Body).Decode(&vars))
+	assert.Equal(opened+1, vars.Tunnel["tunnels_opened"])
+
+	p.closeTunnelConnection(tc)
+	p.closeTunnelConnection(tc)
+	assert.Equal(active, metrics.tunnelsActive.Value())
+}
+
+func TestHistogram(t *testing.T) {
+	assert := require.New(t)
+
+	h := newHistogram(1, 10)
+	for _, v := range []float64{0.5, 1, 5, 50} {
+		h.observe(v)
+	}
+
+	var value struct {
+		Buckets []struct {
+			Le    string `json:"le"`
+			Count uint64 `json:"count"`
+		} `json:"buckets"`
+		Count uint64  `json:"count"`
+		Sum   float64 `json:"sum"`
+	}
+	assert.Nil(json.Unmarshal([]byte(h.String()), &value))
+
+	// cumulative, bounds inclusive
+	assert.Len(value.Buckets, 3)
+	assert.Equal("1", value.Buckets[0].Le)
+	assert.Equal(uint64(2), value.Buckets[0].Count)
+	assert.Equal(uint64(3), value.Buckets[1].Count)
+	assert.Equal("+Inf", value.Buckets[2].Le)
+	assert.Equal(uint64(4), value.Buckets[2].Count)
+	assert.Equal(uint64(4), value.Count)
+	assert.Equal(56.5, value.Sum)
+}
+
+func TestAdminDashboard(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+	defer p.Close()
+
+	addr, err := p.StartAdminServer("127.0.0.1:0", "", nil)
+	assert.Nil(err)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	tc := p.newTunnelConnection(local)
+
+	get := func(url string, host string) *http.Response {
+		req, err := http.NewRequest("GET", url, nil)
+		assert.Nil(err)
+		if len(host) > 0 {
+			req.Host = host
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(err)
+		return resp
+	}
+
+	resp := get("http://"+addr.String()+"/", "")
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Contains(string(body), "<title>tunnel</title>")
+
+	// the API reads without a token
+	var tunnels []TunnelInfo
+	resp = get("http://"+addr.String()+"/api/tunnels", "")
+	assert.Nil(json.NewDecoder(resp.Body).Decode(&tunnels))
+	resp.Body.Close()
+	assert.Len(tunnels, 1)
+	assert.Equal(tc.handle, tunnels[0].Handle)
+
+	// rebound host names are refused
+	resp = get("http://"+addr.String()+"/api/tunnels", "attacker.example.com")
+	resp.Body.Close()
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+}
+
+func TestAdminChangesNeedToken(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+	defer p.Close()
+
+	addr, err := p.StartAdminServer("127.0.0.1:0", "secret", nil)
+	assert.Nil(err)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	tc := p.newTunnelConnection(local)
+
+	request := func(method string, contentType string, token string) int {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://%s/api/tunnels/%d", addr, tc.handle), strings.NewReader("{}"))
+		assert.Nil(err)
+		if len(contentType) > 0 {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// cross-site form posts carry no token
+	assert.Equal(http.StatusUnauthorized, request("DELETE", "", ""))
+	assert.Equal(http.StatusUnauthorized, request("POST", "text/plain", ""))
+	assert.Equal(http.StatusOK, request("GET", "", ""))
+
+	assert.Equal(http.StatusNoContent, request("DELETE", "", "secret"))
+}
+
+func TestAdminWithoutTokenIsReadOnly(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+	defer p.Close()
+
+	addr, err := p.StartAdminServer("127.0.0.1:0", "", nil)
+	assert.Nil(err)
+
+	req, err := http.NewRequest("DELETE", "http://"+addr.String()+"/api/tunnels/1", nil)
+	assert.Nil(err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+}
@@ -0,0 +1,568 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxCertificateUpload caps the PEM certificate chain and key uploaded for
+// a service
+const maxCertificateUpload = 1 << 20
+
+// apiServer is the admin REST API of the provider:
+//
+//	GET    /api/tunnels            tunnel connections, ?label=key=value
+//	                               selects those carrying the labels
+//	GET    /api/tunnels/{handle}   a tunnel connection and its data connections
+//	DELETE /api/tunnels/{handle}   close a tunnel connection
+//	GET    /api/connections        data connections
+//	DELETE /api/connections/{handle}
+//	GET    /api/tenants            client identities, their limits and usage
+//	GET    /api/tenants/{identity}
+//	GET    /api/services           registered service names
+//	GET    /api/services/[{namespace}/]{name}
+//	                               the tunnel port of a service
+//	GET    /api/reservations       tunnel ports reserved for client identities
+//	GET    /api/certificates       services whose TLS the provider terminates
+//	PUT    /api/certificates/[{namespace}/]{name}
+//	                               upload the PEM certificate chain and key
+//	                               of a service
+//	DELETE /api/certificates/[{namespace}/]{name}
+//	GET    /api/config             command line configuration, secrets redacted
+//
+// Every request must carry the API token as "Authorization: Bearer <token>".
+// The loopback admin port serves GET requests without it, any other request
+// still needs the token there, so that web pages cannot change the provider
+// with cross-site requests to localhost.
+type apiServer struct {
+	provider *Provider
+	token    string
+	config   map[string]string
+
+	// GET and HEAD requests are served without token
+	openReads bool
+}
+
+// StartAPIServer serves the admin API on address, over TLS when the provider
+// signaling is, and returns the bound address
+func (p *Provider) StartAPIServer(address string, token string, config map[string]string) (net.Addr, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.tlsConfig != nil {
+		tlsConfig := p.tlsConfig.Clone()
+
+		// API clients authenticate with the token, not a certificate
+		tlsConfig.ClientAuth = tls.NoClientCert
+		l = tls.NewListener(l, tlsConfig)
+	}
+
+	server := &http.Server{Handler: &apiServer{provider: p, token: token, config: config}}
+	go func() {
+		if err := server.Serve(l); err != nil && p.ctx.Err() == nil {
+			logger.error("Admin API error", "error", err)
+		}
+	}()
+
+	go func() {
+		<-p.ctx.Done()
+		server.Close()
+	}()
+
+	logger.info("Admin API listening", "address", l.Addr())
+	return l.Addr(), nil
+}
+
+type TunnelInfo struct {
+	Handle     Handle    `json:"handle"`
+	Remote     string    `json:"remote"`
+	Identity   string    `json:"identity"`
+	Namespace  string    `json:"namespace,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	TunnelPort int       `json:"tunnel_port,omitempty"`
+	Encrypted  bool      `json:"encrypted"`
+	Compressed bool      `json:"compressed"`
+	Created    time.Time `json:"created"`
+
+	// payloads are sealed with, empty unless encrypted
+	CipherSuite string `json:"cipher_suite,omitempty"`
+
+	// reported by the connector
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// data channels attached besides the signaling connection
+	DataChannels int `json:"data_channels,omitempty"`
+
+	// current data connections, and the payload relayed by all data
+	// connections since the tunnel was opened
+	DataConnections int `json:"data_connections"`
+	TrafficSnapshot
+
+	// last reported by the peer, see Tunnel.PeerStats
+	Peer *PeerStats `json:"peer,omitempty"`
+
+	// every target tunneled over the connection, Target and TunnelPort are
+	// those of the first
+	Forwards []ForwardInfo `json:"forwards,omitempty"`
+
+	// "listen" when consumers reach the client through tunnel ports, "dial"
+	// when the client may connect to targets from the provider
+	Directions []string `json:"directions"`
+}
+
+type TunnelDetail struct {
+	TunnelInfo
+	Connections []DataConnectionInfo `json:"connections"`
+}
+
+type DataConnectionInfo struct {
+	Handle     Handle    `json:"handle"`
+	PeerHandle Handle    `json:"peer_handle"`
+	Tunnel     Handle    `json:"tunnel"`
+	Client     string    `json:"client,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	Opened     bool      `json:"opened"`
+	Dedicated  bool      `json:"dedicated,omitempty"`
+	Created    time.Time `json:"created"`
+	TrafficSnapshot
+}
+
+func (s *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="tunnel"`)
+		apiError(w, http.StatusUnauthorized, "missing or invalid API token")
+		return
+	}
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case path == "/api/tunnels":
+		s.onTunnels(w, r)
+	case strings.HasPrefix(path, "/api/tunnels/") && strings.HasSuffix(path, "/renegotiate"):
+		s.onRenegotiate(w, r, strings.TrimSuffix(strings.TrimPrefix(path, "/api/tunnels/"), "/renegotiate"))
+	case strings.HasPrefix(path, "/api/tunnels/"):
+		s.onTunnel(w, r, strings.TrimPrefix(path, "/api/tunnels/"))
+	case path == "/api/connections":
+		s.onConnections(w, r)
+	case strings.HasPrefix(path, "/api/connections/"):
+		s.onConnection(w, r, strings.TrimPrefix(path, "/api/connections/"))
+	case path == "/api/tenants":
+		s.onTenants(w, r)
+	case strings.HasPrefix(path, "/api/tenants/"):
+		s.onTenant(w, r, strings.TrimPrefix(path, "/api/tenants/"))
+	case path == "/api/services":
+		s.onServices(w, r)
+	case strings.HasPrefix(path, "/api/services/"):
+		s.onService(w, r, strings.TrimPrefix(path, "/api/services/"))
+	case path == "/api/reservations":
+		s.onReservations(w, r)
+	case path == "/api/certificates":
+		s.onCertificates(w, r)
+	case strings.HasPrefix(path, "/api/certificates/"):
+		s.onCertificate(w, r, strings.TrimPrefix(path, "/api/certificates/"))
+	case path == "/api/config":
+		s.onConfig(w, r)
+	default:
+		apiError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// authorized reports whether r may be served. Without a token only the reads
+// of openReads are, the admin port then serves the API read-only.
+func (s *apiServer) authorized(r *http.Request) bool {
+	if s.openReads && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		return true
+	}
+
+	return len(s.token) > 0 && bearerTokenValid(r, s.token)
+}
+
+// bearerTokenValid reports whether r is authorized by "Bearer <token>"
+func bearerTokenValid(r *http.Request, token string) bool {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+
+	return hmac.Equal([]byte(strings.TrimPrefix(authorization, "Bearer ")), []byte(token))
+}
+
+func (s *apiServer) onTunnels(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	tunnels, _ := s.provider.connectionSnapshot()
+
+	if values := r.URL.Query()["label"]; len(values) > 0 {
+		selector := make(map[string]string)
+		for _, v := range values {
+			key, value, err := ParseLabel(v)
+			if err != nil {
+				apiError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			selector[key] = value
+		}
+
+		selected := []TunnelInfo{}
+		for _, t := range tunnels {
+			if matchLabels(t.Labels, selector) {
+				selected = append(selected, t)
+			}
+		}
+		tunnels = selected
+	}
+
+	apiReply(w, tunnels)
+}
+
+func (s *apiServer) onTunnel(w http.ResponseWriter, r *http.Request, handle string) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+
+	var tc *TunnelConnection
+	if h, err := strconv.ParseUint(handle, 10, 32); err == nil {
+		tc = s.provider.getTunnelConnection(Handle(h))
+	}
+	if tc == nil {
+		apiError(w, http.StatusNotFound, "no such tunnel connection")
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		tc.log.info("Close tunnel connection by admin request", "admin", r.RemoteAddr)
+
+		// the reader tears the tunnel down
+		tc.conn.Close()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	detail := TunnelDetail{
+		TunnelInfo:  tunnelView(tc),
+		Connections: []DataConnectionInfo{},
+	}
+	for _, dc := range sortedDataConnections(tc.dataConnections()) {
+		detail.Connections = append(detail.Connections, dataConnectionView(dc))
+	}
+
+	apiReply(w, detail)
+}
+
+// onRenegotiate changes the payload processing of a tunnel connection as the
+// Renegotiation in the request body asks, and replies with the tunnel
+func (s *apiServer) onRenegotiate(w http.ResponseWriter, r *http.Request, handle string) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	var tc *TunnelConnection
+	if h, err := strconv.ParseUint(handle, 10, 32); err == nil {
+		tc = s.provider.getTunnelConnection(Handle(h))
+	}
+	if tc == nil {
+		apiError(w, http.StatusNotFound, "no such tunnel connection")
+		return
+	}
+
+	var renegotiation Renegotiation
+	if err := json.NewDecoder(r.Body).Decode(&renegotiation); err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), renegotiateTimeout)
+	defer cancel()
+
+	if err := tc.renegotiate(ctx, renegotiation); err != nil {
+		apiError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	tc.log.info("Renegotiated by admin request", "admin", r.RemoteAddr)
+	apiReply(w, tunnelView(tc))
+}
+
+func (s *apiServer) onConnections(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	_, connections := s.provider.connectionSnapshot()
+	apiReply(w, connections)
+}
+
+func (s *apiServer) onConnection(w http.ResponseWriter, r *http.Request, handle string) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+
+	var dc *DataConnection
+	if h, err := strconv.ParseUint(handle, 10, 32); err == nil {
+		dc = s.provider.getDataConnection(Handle(h))
+	}
+	if dc == nil {
+		apiError(w, http.StatusNotFound, "no such data connection")
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		dc.log.info("Close data connection by admin request", "admin", r.RemoteAddr)
+
+		dc.close(true)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	apiReply(w, dataConnectionView(dc))
+}
+
+func (s *apiServer) onTenants(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	apiReply(w, s.provider.tenantSnapshot())
+}
+
+func (s *apiServer) onTenant(w http.ResponseWriter, r *http.Request, identity string) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	for _, tenant := range s.provider.tenantSnapshot() {
+		if tenant.Identity == identity {
+			apiReply(w, tenant)
+			return
+		}
+	}
+
+	apiError(w, http.StatusNotFound, "no such tenant")
+}
+
+func (s *apiServer) onServices(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	apiReply(w, s.provider.services.list())
+}
+
+func (s *apiServer) onReservations(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	apiReply(w, s.provider.sessions.reservations.list())
+}
+
+func (s *apiServer) onCertificates(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	apiReply(w, s.provider.serviceTLS.list())
+}
+
+func (s *apiServer) onCertificate(w http.ResponseWriter, r *http.Request, name string) {
+	if !allowMethods(w, r, http.MethodPut, http.MethodDelete) {
+		return
+	}
+
+	var namespace string
+	if i := strings.Index(name, "/"); i >= 0 {
+		namespace, name = name[:i], name[i+1:]
+	}
+
+	var err error
+	if r.Method == http.MethodDelete {
+		err = s.provider.serviceTLS.remove(namespace, name)
+	} else {
+		var data []byte
+		if data, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxCertificateUpload)); err == nil {
+			err = s.provider.serviceTLS.upload(namespace, name, data)
+		}
+	}
+
+	if err == errServiceNotTerminated {
+		apiError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	logger.info("Service certificate changed", "service", name, "namespace", namespace, "method", r.Method)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *apiServer) onService(w http.ResponseWriter, r *http.Request, name string) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	var namespace string
+	if i := strings.Index(name, "/"); i >= 0 {
+		namespace, name = name[:i], name[i+1:]
+	}
+
+	service, ok := s.provider.services.lookup(namespace, name)
+	if !ok {
+		apiError(w, http.StatusNotFound, "no such service")
+		return
+	}
+
+	apiReply(w, service)
+}
+
+func (s *apiServer) onConfig(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	apiReply(w, s.config)
+}
+
+// connectionSnapshot returns views of all tunnel connections and data
+// connections, ordered by tunnel and handle
+func (p *Provider) connectionSnapshot() ([]TunnelInfo, []DataConnectionInfo) {
+	tunnels := []TunnelInfo{}
+	connections := []DataConnectionInfo{}
+
+	for _, tc := range p.tunnelConnectionList() {
+		tunnels = append(tunnels, tunnelView(tc))
+		for _, dc := range sortedDataConnections(tc.dataConnections()) {
+			connections = append(connections, dataConnectionView(dc))
+		}
+	}
+
+	return tunnels, connections
+}
+
+// tunnelConnectionList returns the tunnel connections ordered by handle
+func (p *Provider) tunnelConnectionList() []*TunnelConnection {
+	var connections []*TunnelConnection
+	for _, v := range p.tunnelConnections.values() {
+		connections = append(connections, v.(*TunnelConnection))
+	}
+
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].handle < connections[j].handle
+	})
+	return connections
+}
+
+func sortedDataConnections(connections []*DataConnection) []*DataConnection {
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].handle < connections[j].handle
+	})
+	return connections
+}
+
+func tunnelView(tc *TunnelConnection) TunnelInfo {
+	view := TunnelInfo{
+		Handle:     tc.handle,
+		Remote:     tc.conn.RemoteAddr().String(),
+		Identity:   tc.identity,
+		Namespace:  tc.namespace,
+		TunnelPort: tc.tunnelPort,
+		Encrypted:  tc.capabilities&CAPABILITY_ENCRYPTION != 0,
+		Compressed: tc.compressing(),
+		Created:    tc.created,
+		Labels:     tc.labels,
+
+		DataChannels:    tc.channelCount(),
+		DataConnections: len(tc.dataConnections()),
+		TrafficSnapshot: tc.snapshot(),
+		Peer:            tc.reportedStats(),
+	}
+
+	if len(tc.proxyAddress) > 0 {
+		view.Target = net.JoinHostPort(tc.proxyAddress, strconv.Itoa(tc.proxyPort))
+	}
+
+	for _, f := range tc.forwardList() {
+		if len(f.proxyAddress) > 0 {
+			view.Forwards = append(view.Forwards, f.info())
+		}
+	}
+
+	if tc.cipher != nil {
+		view.CipherSuite = cipherSuiteNames[tc.cipher.suite()]
+	}
+
+	view.Directions = []string{}
+	if tc.tunnelPort > 0 || len(view.Forwards) > 0 {
+		view.Directions = append(view.Directions, "listen")
+	}
+	if tc.capabilities&CAPABILITY_DIAL != 0 {
+		view.Directions = append(view.Directions, "dial")
+	}
+
+	return view
+}
+
+func dataConnectionView(dc *DataConnection) DataConnectionInfo {
+	tc := dc.tunnelConnection
+	view := DataConnectionInfo{
+		Handle:  dc.handle,
+		Tunnel:  tc.handle,
+		Client:  dc.clientAddress,
+		Opened:  atomic.LoadUint32(&dc.opened) != 0,
+		Created: dc.created,
+
+		TrafficSnapshot: dc.snapshot(),
+	}
+
+	dc.channelLock.Lock()
+	view.Dedicated = dc.dedicated != nil
+	dc.channelLock.Unlock()
+
+	// peerHandle is only set once opened
+	if view.Opened {
+		view.PeerHandle = dc.peerHandle
+	}
+
+	if len(tc.proxyAddress) > 0 || len(dc.target) > 0 {
+		view.Target = dc.targetAddress()
+	}
+
+	return view
+}
+
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+func apiReply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,105 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIServer(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+	defer p.Close()
+
+	tunnelLocal, tunnelRemote := net.Pipe()
+	defer tunnelRemote.Close()
+	tc := p.newTunnelConnection(tunnelLocal)
+	tc.identity = "alice"
+	tc.proxyAddress = "127.0.0.1"
+	tc.proxyPort = 80
+	tc.labels = map[string]string{"hostname": "edge-17", "env": "prod"}
+	tc.tunnelPort = 4000
+	tc.capabilities = CAPABILITY_DIAL
+
+	dataLocal, dataRemote := net.Pipe()
+	defer dataRemote.Close()
+	dc := p.newDataConnection(tc, dataLocal)
+	dc.clientAddress = "192.0.2.1:4000"
+	dc.countRead(10)
+
+	server := httptest.NewServer(&apiServer{
+		provider: p,
+		token:    "secret",
+		config:   map[string]string{"l": "5555"},
+	})
+	defer server.Close()
+
+	request := func(method string, path string, token string, v interface{}) int {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		assert.Nil(err)
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(err)
+		defer resp.Body.Close()
+
+		if v != nil {
+			assert.Nil(json.NewDecoder(resp.Body).Decode(v))
+		}
+		return resp.StatusCode
+	}
+
+	assert.Equal(http.StatusUnauthorized, request("GET", "/api/tunnels", "", nil))
+	assert.Equal(http.StatusUnauthorized, request("GET", "/api/tunnels", "wrong", nil))
+
+	var tunnels []TunnelInfo
+	assert.Equal(http.StatusOK, request("GET", "/api/tunnels", "secret", &tunnels))
+	assert.Len(tunnels, 1)
+	assert.Equal(tc.handle, tunnels[0].Handle)
+	assert.Equal("alice", tunnels[0].Identity)
+	assert.Equal("127.0.0.1:80", tunnels[0].Target)
+	assert.Equal(1, tunnels[0].DataConnections)
+	assert.Equal(uint64(10), tunnels[0].RxBytes)
+	assert.Equal(uint64(1), tunnels[0].RxFrames)
+	assert.Equal("edge-17", tunnels[0].Labels["hostname"])
+	assert.Equal([]string{"listen", "dial"}, tunnels[0].Directions)
+
+	assert.Equal(http.StatusOK, request("GET", "/api/tunnels?label=env=prod&label=hostname=edge-17", "secret", &tunnels))
+	assert.Len(tunnels, 1)
+	assert.Equal(http.StatusOK, request("GET", "/api/tunnels?label=env=dev", "secret", &tunnels))
+	assert.Empty(tunnels)
+	assert.Equal(http.StatusBadRequest, request("GET", "/api/tunnels?label=env", "secret", nil))
+
+	var detail TunnelDetail
+	assert.Equal(http.StatusOK, request("GET", "/api/tunnels/"+strconv.Itoa(int(tc.handle)), "secret", &detail))
+	assert.Len(detail.Connections, 1)
+	assert.Equal("192.0.2.1:4000", detail.Connections[0].Client)
+
+	var connections []DataConnectionInfo
+	assert.Equal(http.StatusOK, request("GET", "/api/connections", "secret", &connections))
+	assert.Len(connections, 1)
+	assert.Equal(dc.handle, connections[0].Handle)
+	assert.Equal(tc.handle, connections[0].Tunnel)
+	assert.False(connections[0].Opened)
+
+	var config map[string]string
+	assert.Equal(http.StatusOK, request("GET", "/api/config", "secret", &config))
+	assert.Equal("5555", config["l"])
+
+	assert.Equal(http.StatusMethodNotAllowed, request("DELETE", "/api/tunnels", "secret", nil))
+	assert.Equal(http.StatusNotFound, request("GET", "/api/tunnels/999999", "secret", nil))
+	assert.Equal(http.StatusNotFound, request("GET", "/api/connections/x", "secret", nil))
+
+	path := "/api/connections/" + strconv.Itoa(int(dc.handle))
+	assert.Equal(http.StatusNoContent, request("DELETE", path, "secret", nil))
+	assert.Nil(p.getDataConnection(dc.handle))
+	assert.Equal(http.StatusNotFound, request("GET", path, "secret", nil))
+}
@@ -0,0 +1,204 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// auditLog is an append-only stream of JSON lines recording tunnels and data
+// connections. A nil log records nothing. Entries are queued and written by
+// a goroutine of their own, so a slow or unreachable target never holds up
+// the tunnels; stream sockets are redialed until the entry is written.
+type auditLog struct {
+	lock    sync.RWMutex
+	closed  bool
+	entries chan []byte
+	closing chan struct{}
+	done    chan struct{}
+
+	// entries dropped because the queue was full
+	dropped uint64
+
+	// network and address of stream sockets, redialed after a failed write
+	network string
+	address string
+	w       io.WriteCloser
+}
+
+const (
+	// entries queued for the writer before further ones are dropped
+	auditQueueLength = 4096
+
+	// delays between attempts to write an entry
+	auditRetryMin = 100 * time.Millisecond
+	auditRetryMax = 10 * time.Second
+
+	// a stalled stream socket is redialed after this period
+	auditWriteTimeout = 10 * time.Second
+
+	// time close waits for queued entries to be written
+	auditCloseTimeout = 5 * time.Second
+)
+
+// openAuditLog opens target, either a file path, a stream socket given as
+// tcp://host:port or unix:///path, or a syslog target prefixed by "syslog:"
+// whose messages carry facility
+func openAuditLog(target string, facility int) (*auditLog, error) {
+	a := &auditLog{
+		entries: make(chan []byte, auditQueueLength),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	var err error
+	switch {
+	case strings.HasPrefix(target, "syslog:"):
+		a.w, err = dialSyslog(strings.TrimPrefix(target, "syslog:"), facility, "audit")
+	case strings.HasPrefix(target, "tcp://"):
+		a.network, a.address = "tcp", strings.TrimPrefix(target, "tcp://")
+		err = a.dial()
+	case strings.HasPrefix(target, "unix://"):
+		a.network, a.address = "unix", strings.TrimPrefix(target, "unix://")
+		err = a.dial()
+	default:
+		a.w, err = os.OpenFile(target, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	go a.run()
+	return a, nil
+}
+
+func (a *auditLog) dial() error {
+	conn, err := net.Dial(a.network, a.address)
+	if err != nil {
+		return err
+	}
+
+	a.w = conn
+	return nil
+}
+
+type auditFields map[string]interface{}
+
+func (a *auditLog) record(event string, fields auditFields) {
+	if a == nil {
+		return
+	}
+
+	entry := make(auditFields, len(fields)+2)
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["event"] = event
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		logger.error("Audit log error", "error", err)
+		return
+	}
+
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if a.closed {
+		return
+	}
+
+	select {
+	case a.entries <- append(b, '\n'):
+	default:
+		// reported once per burst of drops
+		if atomic.AddUint64(&a.dropped, 1) == 1 {
+			logger.error("Audit log queue full, dropping entries")
+		}
+	}
+}
+
+// run writes the queued entries until the log is closed
+func (a *auditLog) run() {
+	defer close(a.done)
+
+	for b := range a.entries {
+		if !a.write(b) {
+			return
+		}
+	}
+}
+
+// write writes b, retrying until it succeeds or the log is closed
+func (a *auditLog) write(b []byte) bool {
+	delay := auditRetryMin
+	for {
+		err := net.ErrClosed
+		if a.w != nil || a.dial() == nil {
+			if conn, ok := a.w.(net.Conn); ok {
+				conn.SetWriteDeadline(time.Now().Add(auditWriteTimeout))
+			}
+			_, err = a.w.Write(b)
+		}
+
+		if err == nil {
+			if dropped := atomic.SwapUint64(&a.dropped, 0); dropped > 0 {
+				logger.warn("Audit log entries dropped", "count", dropped)
+			}
+			return true
+		}
+
+		// stream sockets are redialed by the next attempt
+		if len(a.network) > 0 && a.w != nil {
+			a.w.Close()
+			a.w = nil
+		}
+
+		logger.error("Audit log error", "error", err, "retry", delay)
+
+		select {
+		case <-time.After(delay):
+		case <-a.closing:
+			return false
+		}
+
+		if delay *= 2; delay > auditRetryMax {
+			delay = auditRetryMax
+		}
+	}
+}
+
+// close writes the queued entries, waiting auditCloseTimeout at most
+func (a *auditLog) close() error {
+	if a == nil {
+		return nil
+	}
+
+	a.lock.Lock()
+	if a.closed {
+		a.lock.Unlock()
+		return nil
+	}
+	a.closed = true
+	close(a.entries)
+	a.lock.Unlock()
+
+	select {
+	case <-a.done:
+	case <-time.After(auditCloseTimeout):
+		close(a.closing)
+		<-a.done
+	}
+
+	if a.w == nil {
+		return nil
+	}
+	return a.w.Close()
+}
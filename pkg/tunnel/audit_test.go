@@ -0,0 +1,84 @@
+package tunnel
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLogRedial(t *testing.T) {
+	assert := require.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	defer l.Close()
+
+	a, err := openAuditLog("tcp://"+l.Addr().String(), 0)
+	assert.NoError(err)
+	defer a.close()
+
+	event := func(conn net.Conn) string {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, err := bufio.NewReader(conn).ReadBytes('\n')
+		assert.NoError(err)
+
+		var entry auditFields
+		assert.NoError(json.Unmarshal(line, &entry))
+		return entry["event"].(string)
+	}
+
+	conn, err := l.Accept()
+	assert.NoError(err)
+	a.record("tunnel_up", auditFields{"identity": "alice"})
+	assert.Equal("tunnel_up", event(conn))
+
+	// the collector goes away, entries are written once it is redialed
+	conn.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+
+	// writes to the closed connection may still succeed at first
+	for conn = nil; conn == nil; {
+		a.record("tunnel_down", nil)
+
+		select {
+		case conn = <-accepted:
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	defer conn.Close()
+	assert.Equal("tunnel_down", event(conn))
+}
+
+func TestAuditLogQueueFull(t *testing.T) {
+	assert := require.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	defer l.Close()
+
+	a, err := openAuditLog("tcp://"+l.Addr().String(), 0)
+	assert.NoError(err)
+
+	// the collector never reads, recording must not block
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*auditQueueLength; i++ {
+			a.record("data_connection", auditFields{"pad": string(make([]byte, 1024))})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		assert.Fail("record blocked on a stalled audit target")
+	}
+}
@@ -0,0 +1,176 @@
+package tunnel
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// identity assigned to clients when the provider runs without authentication
+const anonymousIdentity = "*"
+
+const (
+	authNonceLength = 32
+
+	// an authentication challenge must be answered within this period
+	authChallengeLifetime = 30 * time.Second
+)
+
+// authChallenge is a single use, server generated nonce and timestamp a
+// client has to sign with its token. Binding every AuthRequest to a fresh
+// challenge prevents captured handshakes from being replayed.
+type authChallenge struct {
+	nonce     []byte
+	timestamp uint64
+	issued    time.Time
+}
+
+func newAuthChallenge() (*authChallenge, error) {
+	nonce := make([]byte, authNonceLength)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &authChallenge{
+		nonce:     nonce,
+		timestamp: uint64(now.Unix()),
+		issued:    now,
+	}, nil
+}
+
+func (c *authChallenge) verify(nonce []byte, timestamp uint64) error {
+	if !hmac.Equal(c.nonce, nonce) || c.timestamp != timestamp {
+		return fmt.Errorf("authentication challenge mismatch")
+	}
+
+	if time.Since(c.issued) > authChallengeLifetime {
+		return fmt.Errorf("authentication challenge expired")
+	}
+
+	return nil
+}
+
+// authMac signs the challenge and, with payload encryption, the key
+// transcript of the handshake, so that a listener only accepts the client
+// when both agreed on the payload keys
+func authMac(identity string, token string, nonce []byte, timestamp uint64, transcript []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(identity))
+	mac.Write(nonce)
+
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, timestamp)
+	mac.Write(b)
+	mac.Write(transcript)
+
+	return mac.Sum(nil)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// Credentials answer the authentication challenge of the provider: the
+// identity a client claims and a MAC over the challenge keyed with its
+// secret, which is never sent. JWT is set instead of the MAC when the client
+// authenticates with a JWT over TLS, Authenticators validate it themselves.
+type Credentials struct {
+	Identity string
+	JWT      string
+
+	nonce      []byte
+	timestamp  uint64
+	transcript []byte
+	mac        []byte
+}
+
+// Verify reports whether the client keyed its MAC with secret, i.e. holds it
+func (c Credentials) Verify(secret string) bool {
+	return hmac.Equal(authMac(c.Identity, secret, c.nonce, c.timestamp, c.transcript), c.mac)
+}
+
+// Authenticator decides which identity a client authenticating from
+// remoteAddr acts as, or refuses it with an error reported to the client.
+// The provider calls it during the handshake, after checking the challenge
+// is fresh; JWTs of a trusted issuer are validated by the provider instead.
+type Authenticator interface {
+	Authenticate(credentials Credentials, remoteAddr net.Addr) (string, error)
+}
+
+// Namespacer is implemented by Authenticators that place identities into
+// namespaces. Clients register and look up service names within the
+// namespace of their identity only, "" is the namespace of everyone else.
+type Namespacer interface {
+	Namespace(identity string) string
+}
+
+var errAuthenticationFailed = errors.New("authentication failed")
+
+// NewTokenAuthenticator returns the pre-shared token authenticator: the
+// client identity must be a key of tokens and the MAC keyed with its token
+func NewTokenAuthenticator(tokens map[string]string) Authenticator {
+	return &tokenAuthenticator{tokens: tokens}
+}
+
+type tokenAuthenticator struct {
+	// map identity -> token
+	tokens map[string]string
+
+	// map identity -> namespace, of identities placed into one
+	namespaces map[string]string
+}
+
+// loadTokenAuthenticator loads "identity token [namespace]" entries, one per
+// line, tokens may be secret references like env:NAME
+func loadTokenAuthenticator(path string) (*tokenAuthenticator, error) {
+	lines, err := readConfigFields(path)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &tokenAuthenticator{
+		tokens:     make(map[string]string),
+		namespaces: make(map[string]string),
+	}
+
+	for i, fields := range lines {
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fmt.Errorf("%s: entry %d: expected \"identity token [namespace]\"", path, i+1)
+		}
+
+		if len(fields) == 3 {
+			if !validServiceName(fields[2]) {
+				return nil, fmt.Errorf("%s: entry %d: invalid namespace %q", path, i+1, fields[2])
+			}
+			a.namespaces[fields[0]] = strings.ToLower(fields[2])
+		}
+
+		token, err := ResolveSecret(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: entry %d: %v", path, i+1, err)
+		}
+
+		a.tokens[fields[0]] = token
+	}
+
+	return a, nil
+}
+
+func (a *tokenAuthenticator) Authenticate(c Credentials, remoteAddr net.Addr) (string, error) {
+	token, ok := a.tokens[c.Identity]
+	if !ok || !c.Verify(token) {
+		return "", errAuthenticationFailed
+	}
+
+	return c.Identity, nil
+}
+
+func (a *tokenAuthenticator) Namespace(identity string) string {
+	return a.namespaces[identity]
+}
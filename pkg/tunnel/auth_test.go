@@ -0,0 +1,108 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthChallenge(t *testing.T) {
+	assert := require.New(t)
+
+	a := &tokenAuthenticator{
+		tokens: map[string]string{"alice": "s3cr3t"},
+	}
+
+	challenge, err := newAuthChallenge()
+	assert.NoError(err)
+
+	mac := authMac("alice", "s3cr3t", challenge.nonce, challenge.timestamp, nil)
+	assert.NoError(challenge.verify(challenge.nonce, challenge.timestamp))
+
+	credentials := Credentials{Identity: "alice", nonce: challenge.nonce, timestamp: challenge.timestamp, mac: mac}
+	identity, err := a.Authenticate(credentials, nil)
+	assert.NoError(err)
+	assert.Equal("alice", identity)
+
+	credentials.Identity = "bob"
+	_, err = a.Authenticate(credentials, nil)
+	assert.Error(err)
+
+	credentials.Identity, credentials.timestamp = "alice", challenge.timestamp+1
+	_, err = a.Authenticate(credentials, nil)
+	assert.Error(err)
+
+	// the MAC covers the payload key exchange of the handshake
+	credentials.timestamp, credentials.transcript = challenge.timestamp, []byte("keys")
+	_, err = a.Authenticate(credentials, nil)
+	assert.Error(err)
+
+	// a handshake captured on another connection answers a different challenge
+	other, err := newAuthChallenge()
+	assert.NoError(err)
+	assert.Error(other.verify(challenge.nonce, challenge.timestamp))
+
+	challenge.issued = time.Now().Add(-2 * authChallengeLifetime)
+	assert.Error(challenge.verify(challenge.nonce, challenge.timestamp))
+}
+
+// userStore authenticates against passwords of an application, acting as
+// "user:NAME"
+type userStore map[string]string
+
+func (s userStore) Authenticate(c Credentials, remoteAddr net.Addr) (string, error) {
+	if remoteAddr == nil {
+		return "", errors.New("unknown remote address")
+	}
+
+	password, ok := s[c.Identity]
+	if !ok || !c.Verify(password) {
+		return "", errors.New("unknown user or wrong password")
+	}
+
+	return "user:" + c.Identity, nil
+}
+
+func TestCustomAuthenticator(t *testing.T) {
+	assert := require.New(t)
+
+	_, err := NewProvider(Config{TokenFile: "tokens.txt", Authenticator: userStore{}})
+	assert.Error(err)
+
+	hooks := &recordingHooks{}
+	p, err := NewProvider(Config{Authenticator: userStore{"alice": "pw"}, Hooks: hooks})
+	assert.NoError(err)
+	defer p.Close()
+	addr, err := p.StartListener(0)
+	assert.NoError(err)
+
+	client := newProvider()
+	defer client.Close()
+	config := ConnectorConfig{
+		ProviderAddress: fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port),
+		Identity:        "alice",
+		Token:           "wrong",
+		Target:          "127.0.0.1:80",
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err = client.Connect(ctx, config)
+	assert.Error(err)
+
+	config.Token = "pw"
+	tun, err := client.Connect(context.Background(), config)
+	assert.NoError(err)
+	defer tun.Close()
+
+	assert.Eventually(func() bool { return len(hooks.recorded()) > 0 }, 5*time.Second, 10*time.Millisecond)
+	hooks.lock.Lock()
+	defer hooks.lock.Unlock()
+	assert.Equal([]string{"tunnel_up"}, hooks.events)
+	assert.Equal("user:alice", hooks.tunnelUp.Identity)
+}
@@ -0,0 +1,156 @@
+package tunnel
+
+import (
+	"context"
+	"sync"
+)
+
+// memoryBudget caps the bytes of data frames queued for tunnel writes across
+// the whole process. Data connections stop reading while it is used up, so
+// that an incast burst is absorbed by TCP flow control rather than the heap.
+// A nil budget is unlimited.
+type memoryBudget struct {
+	lock sync.Mutex
+
+	max  int
+	used int
+
+	// closed and replaced whenever bytes are released while someone waits
+	freed   chan struct{}
+	waiters int
+}
+
+func newMemoryBudget(max int) *memoryBudget {
+	if max <= 0 {
+		return nil
+	}
+
+	return &memoryBudget{
+		max:   max,
+		freed: make(chan struct{}),
+	}
+}
+
+// acquire takes n bytes out of the budget, waiting until they are available
+// or ctx is done. A single request larger than the budget is let through
+// when nothing else is in flight.
+func (b *memoryBudget) acquire(ctx context.Context, n int) error {
+	if b == nil {
+		return nil
+	}
+
+	for {
+		b.lock.Lock()
+		if b.used+n <= b.max || b.used == 0 {
+			b.used += n
+			b.lock.Unlock()
+			return nil
+		}
+
+		freed := b.freed
+		b.waiters++
+		b.lock.Unlock()
+
+		select {
+		case <-freed:
+			b.lock.Lock()
+			b.waiters--
+			b.lock.Unlock()
+
+		case <-ctx.Done():
+			b.lock.Lock()
+			b.waiters--
+			b.lock.Unlock()
+			return errTunnelClosed
+		}
+	}
+}
+
+func (b *memoryBudget) release(n int) {
+	if b == nil || n == 0 {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.used -= n
+	if b.waiters > 0 {
+		close(b.freed)
+		b.freed = make(chan struct{})
+	}
+}
+
+// exhausted reports whether the budget is used up
+func (b *memoryBudget) exhausted() bool {
+	if b == nil {
+		return false
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.used >= b.max
+}
+
+// budgetAccount is the share of a memoryBudget held by one tunnel
+// connection. Frames still queued when the connection closes are never
+// written, close gives their bytes back.
+type budgetAccount struct {
+	budget *memoryBudget
+
+	lock    sync.Mutex
+	charged int
+	closed  bool
+}
+
+func (a *budgetAccount) charge(ctx context.Context, n int) error {
+	if a.budget == nil {
+		return nil
+	}
+
+	if err := a.budget.acquire(ctx, n); err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.closed {
+		a.budget.release(n)
+		return errTunnelClosed
+	}
+
+	a.charged += n
+	return nil
+}
+
+func (a *budgetAccount) release(n int) {
+	if a.budget == nil {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// already given back by close
+	if a.closed {
+		return
+	}
+
+	a.charged -= n
+	a.budget.release(n)
+}
+
+func (a *budgetAccount) close() {
+	if a.budget == nil {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.closed = true
+	a.budget.release(a.charged)
+	a.charged = 0
+}
@@ -0,0 +1,68 @@
+package tunnel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	assert := require.New(t)
+
+	b := newMemoryBudget(100)
+	ctx := context.Background()
+
+	assert.Nil(b.acquire(ctx, 60))
+	assert.False(b.exhausted())
+	assert.Nil(b.acquire(ctx, 40))
+	assert.True(b.exhausted())
+
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- b.acquire(ctx, 50)
+	}()
+
+	select {
+	case <-acquired:
+		assert.Fail("acquire did not wait for the budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b.release(60)
+	assert.Nil(<-acquired)
+
+	// waiting acquires give up with their tunnel
+	cancelled, cancel := context.WithCancel(ctx)
+	go func() {
+		acquired <- b.acquire(cancelled, 80)
+	}()
+	cancel()
+	assert.Equal(errTunnelClosed, <-acquired)
+
+	// nil budgets are unlimited
+	var none *memoryBudget
+	assert.Nil(none.acquire(ctx, 1<<30))
+	assert.False(none.exhausted())
+}
+
+func TestBudgetAccountClose(t *testing.T) {
+	assert := require.New(t)
+
+	b := newMemoryBudget(100)
+	a := &budgetAccount{budget: b}
+	ctx := context.Background()
+
+	assert.Nil(a.charge(ctx, 30))
+	assert.Nil(a.charge(ctx, 30))
+	a.release(30)
+
+	// bytes of frames dropped with the connection are given back once
+	a.close()
+	a.release(30)
+	assert.Equal(0, b.used)
+
+	assert.Equal(errTunnelClosed, a.charge(ctx, 10))
+	assert.Equal(0, b.used)
+}
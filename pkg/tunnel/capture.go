@@ -0,0 +1,269 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// pcapng block types and the link type of raw IP packets
+const (
+	pcapngSectionHeader    = 0x0A0D0D0A
+	pcapngInterface        = 0x00000001
+	pcapngEnhancedPacket   = 0x00000006
+	pcapngByteOrderMagic   = 0x1A2B3C4D
+	pcapngLinkTypeRaw      = 101
+	captureMaxSegment      = 65535 - 40
+	captureIPHeaderLength  = 20
+	captureTCPHeaderLength = 20
+)
+
+// TCP flags of synthesized segments
+const (
+	tcpFin = 1 << 0
+	tcpSyn = 1 << 1
+	tcpPsh = 1 << 3
+	tcpAck = 1 << 4
+)
+
+// capture writes the payload of data connections to a pcapng file as the
+// TCP segments of a connection between the consumer and the target, with
+// synthesized IPv4 and TCP headers, so that the protocol dissectors of
+// Wireshark decode traffic only seen through the tunnel. Every data
+// connection starts with a handshake and ends with a FIN of each side.
+type capture struct {
+	lock sync.Mutex
+	file *os.File
+	err  error
+}
+
+func newCapture(name string) (*capture, error) {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &capture{file: file}
+
+	// a section of any length, of one raw IP interface
+	shb := make([]byte, 28)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngSectionHeader)
+	binary.LittleEndian.PutUint32(shb[4:], uint32(len(shb)))
+	binary.LittleEndian.PutUint32(shb[8:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[12:], 1)
+	binary.LittleEndian.PutUint64(shb[16:], ^uint64(0))
+	binary.LittleEndian.PutUint32(shb[24:], uint32(len(shb)))
+
+	idb := make([]byte, 20)
+	binary.LittleEndian.PutUint32(idb[0:], pcapngInterface)
+	binary.LittleEndian.PutUint32(idb[4:], uint32(len(idb)))
+	binary.LittleEndian.PutUint16(idb[8:], pcapngLinkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[16:], uint32(len(idb)))
+
+	if _, err := file.Write(append(shb, idb...)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *capture) close() {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.file.Close()
+}
+
+// writePacket appends an enhanced packet block of packet, captured at t
+func (c *capture) writePacket(t time.Time, packet []byte) {
+	padded := (len(packet) + 3) &^ 3
+	block := make([]byte, 32+padded)
+	binary.LittleEndian.PutUint32(block[0:], pcapngEnhancedPacket)
+	binary.LittleEndian.PutUint32(block[4:], uint32(len(block)))
+
+	// microseconds, the default resolution of an interface
+	us := uint64(t.UnixNano() / 1000)
+	binary.LittleEndian.PutUint32(block[12:], uint32(us>>32))
+	binary.LittleEndian.PutUint32(block[16:], uint32(us))
+	binary.LittleEndian.PutUint32(block[20:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(block[24:], uint32(len(packet)))
+	copy(block[28:], packet)
+	binary.LittleEndian.PutUint32(block[28+padded:], uint32(len(block)))
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// stops at the first error, e.g. a full disk, logged once
+	if c.err != nil {
+		return
+	}
+	if _, c.err = c.file.Write(block); c.err != nil {
+		logger.error("Capture write error", "error", c.err)
+	}
+}
+
+// start begins the TCP connection of dc in the capture
+func (c *capture) start(dc *DataConnection) *capturedStream {
+	s := &capturedStream{capture: c}
+	s.client = captureEndpoint(dc.clientAddress, 49152+int(dc.handle%16384))
+	s.server = captureEndpoint(dc.targetAddress(), 0)
+
+	// conn of a data connection opened for a TunnelConnectRequest leads to
+	// the target, otherwise to the consumer
+	s.serverSide = dc.toTarget
+
+	s.segment(true, tcpSyn, nil)
+	s.segment(false, tcpSyn|tcpAck, nil)
+	s.segment(true, tcpAck, nil)
+	return s
+}
+
+type captureAddress struct {
+	ip   net.IP
+	port int
+}
+
+// captureEndpoint returns the IPv4 address and port of address, host:port.
+// Hosts without an IPv4 address are given one of 10.0.0.0/8 derived from
+// their name, a missing port is port.
+func captureEndpoint(address string, port int) captureAddress {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	} else if p, err := strconv.Atoi(portString); err == nil {
+		port = p
+	}
+
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		h := fnv.New32a()
+		h.Write([]byte(host))
+		sum := h.Sum32()
+		ip = net.IPv4(10, byte(sum>>16), byte(sum>>8), byte(sum)).To4()
+	}
+
+	return captureAddress{ip: ip, port: port}
+}
+
+// capturedStream is the TCP connection of a data connection in the capture,
+// written by its reader and by the reader of its tunnel
+type capturedStream struct {
+	capture *capture
+
+	client, server captureAddress
+
+	// the data connection relays for the target side, rx is sent by the
+	// server then
+	serverSide bool
+
+	// next sequence number of the client and of the server
+	lock sync.Mutex
+	seq  [2]uint32
+	done bool
+}
+
+// payload captures data read from (rx) or written to the conn of the data
+// connection
+func (s *capturedStream) payload(rx bool, data []byte) {
+	fromClient := rx != s.serverSide
+
+	for len(data) > 0 {
+		n := len(data)
+		if n > captureMaxSegment {
+			n = captureMaxSegment
+		}
+		s.segment(fromClient, tcpPsh|tcpAck, data[:n])
+		data = data[n:]
+	}
+}
+
+// close ends the TCP connection with a FIN of each side
+func (s *capturedStream) close() {
+	s.lock.Lock()
+	done := s.done
+	s.done = true
+	s.lock.Unlock()
+
+	if !done {
+		s.segment(true, tcpFin|tcpAck, nil)
+		s.segment(false, tcpFin|tcpAck, nil)
+	}
+}
+
+// segment writes a TCP segment with flags and payload, sent by the client
+// if fromClient, by the server otherwise
+func (s *capturedStream) segment(fromClient bool, flags byte, payload []byte) {
+	src, dst, from := s.client, s.server, 0
+	if !fromClient {
+		src, dst, from = s.server, s.client, 1
+	}
+
+	s.lock.Lock()
+	seq, ack := s.seq[from], s.seq[1-from]
+	s.seq[from] += uint32(len(payload))
+	if flags&(tcpSyn|tcpFin) != 0 {
+		s.seq[from]++
+	}
+	s.lock.Unlock()
+
+	packet := make([]byte, captureIPHeaderLength+captureTCPHeaderLength+len(payload))
+
+	ip := packet[:captureIPHeaderLength]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(packet)))
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:16], src.ip)
+	copy(ip[16:20], dst.ip)
+	binary.BigEndian.PutUint16(ip[10:], internetChecksum(0, ip))
+
+	tcp := packet[captureIPHeaderLength:]
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.port))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	if flags&tcpAck != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], ack)
+	}
+	tcp[12] = captureTCPHeaderLength / 4 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[captureTCPHeaderLength:], payload)
+
+	// over the pseudo header and the segment
+	var pseudo [12]byte
+	copy(pseudo[0:4], src.ip)
+	copy(pseudo[4:8], dst.ip)
+	pseudo[9] = 6
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+	binary.BigEndian.PutUint16(tcp[16:], internetChecksum(internetSum(0, pseudo[:]), tcp))
+
+	s.capture.writePacket(time.Now(), packet)
+}
+
+// internetSum adds b to the ones' complement sum
+func internetSum(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+// internetChecksum returns the checksum of RFC 1071 over b, continuing sum
+func internetChecksum(sum uint32, b []byte) uint16 {
+	sum = internetSum(sum, b)
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,80 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapture(t *testing.T) {
+	assert := require.New(t)
+
+	name := filepath.Join(t.TempDir(), "tunnel.pcapng")
+	p, err := NewProvider(Config{CaptureFile: name})
+	assert.Nil(err)
+	defer p.Close()
+
+	tunnelLocal, tunnelRemote := net.Pipe()
+	defer tunnelRemote.Close()
+	tc := p.newTunnelConnection(tunnelLocal)
+
+	dataLocal, dataRemote := net.Pipe()
+	defer dataRemote.Close()
+	dc := p.newDataConnection(tc, dataLocal)
+	dc.clientAddress = "192.0.2.1:4000"
+	dc.target = "db:5432"
+
+	// read from the consumer, sent by the client
+	dc.record(true, []byte("hello"))
+	dc.record(false, []byte("world!"))
+	dc.close(false)
+
+	data, err := ioutil.ReadFile(name)
+	assert.Nil(err)
+
+	le := binary.LittleEndian
+	assert.Equal(uint32(pcapngSectionHeader), le.Uint32(data))
+	assert.Equal(uint32(pcapngByteOrderMagic), le.Uint32(data[8:]))
+	data = data[le.Uint32(data[4:]):]
+	assert.Equal(uint32(pcapngInterface), le.Uint32(data))
+	assert.Equal(uint16(pcapngLinkTypeRaw), le.Uint16(data[8:]))
+	data = data[le.Uint32(data[4:]):]
+
+	var packets [][]byte
+	for len(data) > 0 {
+		assert.Equal(uint32(pcapngEnhancedPacket), le.Uint32(data))
+		packets = append(packets, data[28:28+le.Uint32(data[20:])])
+		data = data[le.Uint32(data[4:]):]
+	}
+
+	// handshake, a segment each way and a FIN each
+	assert.Len(packets, 7)
+	flags := []byte{tcpSyn, tcpSyn | tcpAck, tcpAck, tcpPsh | tcpAck, tcpPsh | tcpAck, tcpFin | tcpAck, tcpFin | tcpAck}
+	for i, packet := range packets {
+		ip, tcp := packet[:20], packet[20:]
+		assert.Equal(uint16(0), internetChecksum(0, ip), i)
+
+		var pseudo [12]byte
+		copy(pseudo[:8], ip[12:20])
+		pseudo[9] = 6
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+		assert.Equal(uint16(0), internetChecksum(internetSum(0, pseudo[:]), tcp), i)
+
+		assert.Equal(flags[i], tcp[13], i)
+	}
+
+	hello, world := packets[3], packets[4]
+	assert.Equal(net.IPv4(192, 0, 2, 1).To4(), net.IP(hello[12:16]))
+	assert.Equal(uint16(4000), binary.BigEndian.Uint16(hello[20:]))
+	assert.Equal(uint16(5432), binary.BigEndian.Uint16(hello[22:]))
+	assert.Equal("hello", string(hello[40:]))
+	assert.Equal(hello[16:20], world[12:16])
+	assert.Equal("world!", string(world[40:]))
+
+	// the server acknowledges what the client sent
+	assert.Equal(binary.BigEndian.Uint32(hello[24:])+5, binary.BigEndian.Uint32(world[28:]))
+}
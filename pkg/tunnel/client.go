@@ -0,0 +1,201 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+var (
+	errDialNotSupported     = errors.New("provider does not allow dialing")
+	errDatagramNotSupported = errors.New("provider does not relay datagrams")
+	errDatagramTooLarge     = errors.New("datagram exceeds the maximum message size")
+)
+
+// Client opens tunnels at a provider for an embedding application, with the
+// credentials of its ConnectorConfig
+type Client struct {
+	provider *Provider
+	config   ConnectorConfig
+
+	// signaling connection shared by DialContext, opened on first use and
+	// again once lost
+	lock sync.Mutex
+	dial *TunnelConnection
+}
+
+// NewClient returns a client of the provider at config.ProviderAddress.
+// The signaling connection options, TLS and obfuscation, are those of p.
+func (p *Provider) NewClient(config ConnectorConfig) *Client {
+	return &Client{provider: p, config: config}
+}
+
+// DialContext connects to address from the provider, carried over the
+// signaling connection, so that the client can serve as the Dial function
+// of e.g. an http.Transport. The provider must allow dialing, and its ACL
+// the target for the client identity.
+func (c *Client) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" {
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+
+	return c.dialTarget(ctx, address, 0)
+}
+
+// DialDatagram connects to address like DialContext, but keeps message
+// boundaries from end to end: each Write of up to 64 KiB is relayed as one
+// message and each Read returns one, given a buffer large enough. The
+// provider writes each message to the target at once and relays each read of
+// the target as one, so a target that keeps boundaries of its own, e.g. over
+// a MemoryTransport, sees the messages as written.
+func (c *Client) DialDatagram(ctx context.Context, address string) (net.Conn, error) {
+	conn, err := c.dialTarget(ctx, address, CONNECT_DATAGRAM)
+	if err != nil {
+		return nil, err
+	}
+	return &datagramConn{conn}, nil
+}
+
+// dialTarget connects to address from the provider with the CONNECT_XXX flags
+func (c *Client) dialTarget(ctx context.Context, address string, flags uint32) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q", address)
+	}
+
+	tc, err := c.dialConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// providers that do not grant the capability, older ones included,
+	// would refuse every connect request
+	if tc.capabilities&CAPABILITY_DIAL == 0 {
+		return nil, errDialNotSupported
+	}
+	if flags&CONNECT_DATAGRAM != 0 && tc.capabilities&CAPABILITY_DATAGRAM == 0 {
+		return nil, errDatagramNotSupported
+	}
+
+	local, remote := net.Pipe()
+	dc := c.provider.newDataConnection(tc, local)
+	dc.target = address
+	dc.datagram = flags&CONNECT_DATAGRAM != 0
+	dc.dialing = make(chan struct{})
+
+	dc.awaitConnect()
+	tc.send(&TunnelConnectRequest{
+		dataConnectionHandle: dc.handle,
+		proxyAddress:         host,
+		proxyPort:            portNumber,
+		flags:                flags,
+	})
+
+	select {
+	case <-dc.dialing:
+		return &tunneledConn{Conn: remote, local: tc.conn.LocalAddr(), remote: tunnelAddr(address)}, nil
+
+	case <-dc.ctx.Done():
+		remote.Close()
+		if len(dc.dialErr) > 0 {
+			return nil, fmt.Errorf("dial %s: %s", address, dc.dialErr)
+		}
+		return nil, fmt.Errorf("dial %s: connection refused by the provider", address)
+
+	case <-ctx.Done():
+		// the provider is told to close its end once it answers
+		dc.close(false)
+		remote.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// Lookup returns the address of the tunnel port the provider registered
+// under the service name, host:port with the host of ProviderAddress, or of
+// the provider of its cluster holding the tunnel. It is asked over the
+// signaling connection of DialContext.
+func (c *Client) Lookup(ctx context.Context, service string) (string, error) {
+	tc, err := c.dialConnection(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	host, port, err := tc.lookup(ctx, service)
+	if err != nil {
+		return "", err
+	}
+
+	if len(host) == 0 {
+		if host, _, err = net.SplitHostPort(c.config.ProviderAddress); err != nil {
+			host = c.config.ProviderAddress
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// dialConnection returns the signaling connection DialContext carries
+// connections over, opening it if needed
+func (c *Client) dialConnection(ctx context.Context) (*TunnelConnection, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.dial != nil && c.dial.ctx.Err() == nil {
+		return c.dial, nil
+	}
+
+	o := c.config.options(c.provider)
+	o.dialOnly = true
+	o.capabilities |= CAPABILITY_DIAL
+
+	tc, err := c.provider.requestTunnel(o, "")
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-tc.opened:
+	case <-tc.ctx.Done():
+		return nil, errTunnelClosed
+	case <-ctx.Done():
+		tc.conn.Close()
+		return nil, ctx.Err()
+	}
+
+	c.dial = tc
+	return tc, nil
+}
+
+// Close closes the signaling connection of DialContext and with it the
+// connections dialed, listeners are closed on their own
+func (c *Client) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.dial == nil {
+		return nil
+	}
+
+	err := c.dial.conn.Close()
+	c.dial = nil
+	return err
+}
+
+// datagramConn is a connection of DialDatagram, refusing messages larger
+// than its data connection relays whole
+type datagramConn struct {
+	net.Conn
+}
+
+func (c *datagramConn) Write(p []byte) (int, error) {
+	if len(p) > maxDatagramSize {
+		return 0, errDatagramTooLarge
+	}
+	return c.Conn.Write(p)
+}
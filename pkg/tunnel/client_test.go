@@ -0,0 +1,142 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientDialContext(t *testing.T) {
+	assert := require.New(t)
+
+	target, err := startEchoServer()
+	assert.Nil(err)
+
+	f, err := ioutil.TempFile("", "acl")
+	assert.Nil(err)
+	defer os.Remove(f.Name())
+	f.WriteString(fmt.Sprintf("* %s\n", target))
+	f.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := newProvider()
+	defer client.Close()
+
+	// dialing is off by default
+	off, err := NewProvider(Config{})
+	assert.Nil(err)
+	defer off.Close()
+	addr, err := off.StartListener(0)
+	assert.Nil(err)
+
+	c := client.NewClient(ConnectorConfig{ProviderAddress: fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port)})
+	_, err = c.DialContext(ctx, "tcp", target.String())
+	assert.Equal(errDialNotSupported, err)
+	c.Close()
+
+	p, err := NewProvider(Config{ACLFile: f.Name(), AllowDial: true})
+	assert.Nil(err)
+	defer p.Close()
+	addr, err = p.StartListener(0)
+	assert.Nil(err)
+
+	c = client.NewClient(ConnectorConfig{ProviderAddress: fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port)})
+	defer c.Close()
+
+	conn, err := c.DialContext(ctx, "tcp", target.String())
+	assert.Nil(err)
+	defer conn.Close()
+	assert.Equal(target.String(), conn.RemoteAddr().String())
+
+	_, err = conn.Write([]byte("ping"))
+	assert.Nil(err)
+	reply := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, reply)
+	assert.Nil(err)
+	assert.Equal("ping", string(reply))
+
+	// the ACL applies
+	_, err = c.DialContext(ctx, "tcp", "127.0.0.1:1")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "not allowed")
+
+	// the signaling connection is shared
+	assert.Equal(1, p.tunnelConnections.len())
+	tunnels, _ := p.connectionSnapshot()
+	assert.Equal([]string{"dial"}, tunnels[0].Directions)
+}
+
+func TestClientDialDatagram(t *testing.T) {
+	assert := require.New(t)
+
+	transport := NewMemoryTransport()
+
+	// answers each message read with its size, one message per read
+	target, err := transport.Listen("tcp4", ":0")
+	assert.Nil(err)
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		b := make([]byte, maxDatagramSize)
+		for {
+			n, err := conn.Read(b)
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(fmt.Sprint(n)))
+		}
+	}()
+
+	f := writeTenantFile(t, fmt.Sprintf("* %s\n", target.Addr()))
+	p, err := NewProvider(Config{Transport: transport, Dialer: transport, ACLFile: f, AllowDial: true})
+	assert.Nil(err)
+	defer p.Close()
+	addr, err := p.StartListener(0)
+	assert.Nil(err)
+
+	client, err := NewProvider(Config{Transport: transport, CompressMin: 16})
+	assert.Nil(err)
+	defer client.Close()
+	c := client.NewClient(ConnectorConfig{ProviderAddress: addr.String(), Encrypt: true})
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := c.DialDatagram(ctx, target.Addr().String())
+	assert.Nil(err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// messages larger than a stream read arrive whole, replies too
+	sizes := []int{1, 5000, 40000, maxDatagramSize}
+	go func() {
+		for _, size := range sizes {
+			conn.Write(make([]byte, size))
+		}
+	}()
+
+	b := make([]byte, maxDatagramSize)
+	for _, size := range sizes {
+		n, err := conn.Read(b)
+		assert.Nil(err)
+		assert.Equal(fmt.Sprint(size), string(b[:n]))
+	}
+
+	_, err = conn.Write(make([]byte, maxDatagramSize+1))
+	assert.Equal(errDatagramTooLarge, err)
+}
@@ -0,0 +1,260 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	clusterKeyPrefix = "tunnel:services:"
+
+	// registrations of a provider that stopped refreshing them expire after
+	// this period, they are refreshed three times as often
+	clusterTTL = 30 * time.Second
+)
+
+// clusterEntry is a service registration shared with the other providers of
+// a cluster, Address is where consumers reach its tunnel port
+type clusterEntry struct {
+	ServiceInfo
+
+	// instance ID of the provider holding the tunnel
+	Provider      string `json:"provider"`
+	Authenticated bool   `json:"authenticated"`
+}
+
+// cluster shares the service registrations of the provider with the other
+// providers using the same store, so that clients may connect to any of
+// them behind a load balancer while consumers still find every tunnel.
+// Tunnel ports and sessions stay with the provider a client connected to,
+// only the names are shared. The store is Redis, entries expire unless
+// their provider keeps refreshing them.
+type cluster struct {
+	store *redisClient
+
+	// random instance ID, tells own entries from those of other providers
+	id string
+
+	// host consumers reach the tunnel ports of this provider at
+	advertise string
+}
+
+func newCluster(storeURL string, advertise string) (*cluster, error) {
+	if len(advertise) == 0 {
+		return nil, errors.New("a cluster store requires the address the provider is reached at")
+	}
+
+	store, err := newRedisClient(storeURL)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	return &cluster{store: store, id: hex.EncodeToString(id), advertise: advertise}, nil
+}
+
+func (c *cluster) entryOf(b serviceBacker) clusterEntry {
+	info := b.info()
+	info.Address = net.JoinHostPort(c.advertise, strconv.Itoa(info.TunnelPort))
+
+	return clusterEntry{ServiceInfo: info, Provider: c.id, Authenticated: b.tc.authenticated}
+}
+
+func (c *cluster) get(key string) (*clusterEntry, error) {
+	reply, err := c.store.do("GET", clusterKeyPrefix+key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	var e clusterEntry
+	if err := json.Unmarshal([]byte(reply.(string)), &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// The registrations are changed by Lua scripts, which Redis runs
+// atomically: another provider cannot claim a name between the check of
+// who holds it and the write. Entries are JSON clusterEntry values, their
+// provider is the ID of the instance holding them.
+const (
+	// KEYS[1] key, ARGV[1] entry, ARGV[2] TTL in milliseconds, ARGV[3]
+	// provider ID, ARGV[4] identity when authenticated, ARGV[5] "1" to take
+	// the name over. Returns 1 when the entry is stored, 0 when the name is
+	// held by another provider.
+	clusterClaimScript = `
+local current = redis.call('GET', KEYS[1])
+if current then
+	local e = cjson.decode(current)
+	if e.provider ~= ARGV[3] and ARGV[5] ~= '1' and
+		not (ARGV[4] ~= '' and e.authenticated and e.identity == ARGV[4]) then
+		return 0
+	end
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return 1`
+
+	// KEYS[1] key, ARGV[1] entry, ARGV[2] TTL in milliseconds, ARGV[3]
+	// provider ID. Returns 1 when the entry is stored, 0 when another
+	// provider took the name over.
+	clusterRefreshScript = `
+local current = redis.call('GET', KEYS[1])
+if current and cjson.decode(current).provider ~= ARGV[3] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return 1`
+
+	// KEYS[1] key, ARGV[1] provider ID. Returns the number of entries
+	// removed.
+	clusterReleaseScript = `
+local current = redis.call('GET', KEYS[1])
+if current and cjson.decode(current).provider == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`
+)
+
+// eval runs one of the cluster scripts on key and reports whether it
+// returned 1
+func (c *cluster) eval(script string, key string, args ...string) (bool, error) {
+	reply, err := c.store.do(append([]string{"EVAL", script, "1", clusterKeyPrefix + key}, args...)...)
+	if err != nil {
+		return false, err
+	}
+
+	n, _ := reply.(int64)
+	return n == 1, nil
+}
+
+func (c *cluster) encode(e clusterEntry) (string, error) {
+	data, err := json.Marshal(e)
+	return string(data), err
+}
+
+// claim shares the registration of b under key unless another provider
+// holds the name, which only a client resuming its session, takeover, or
+// authenticated with the same identity takes over
+func (c *cluster) claim(key string, b serviceBacker, takeover bool) error {
+	e := c.entryOf(b)
+	data, err := c.encode(e)
+	if err != nil {
+		return err
+	}
+
+	identity := ""
+	if e.Authenticated {
+		identity = e.Identity
+	}
+	takeoverArg := "0"
+	if takeover {
+		takeoverArg = "1"
+	}
+
+	ok, err := c.eval(clusterClaimScript, key, data, clusterTTLArg(), c.id, identity, takeoverArg)
+	if err == nil && !ok {
+		err = errServiceTaken
+	}
+	return err
+}
+
+// release removes the registration under key if this provider still holds
+// it
+func (c *cluster) release(key string) error {
+	_, err := c.eval(clusterReleaseScript, key, c.id)
+	return err
+}
+
+// refresh extends the registration under key of the service b backs, if
+// this provider still holds it
+func (c *cluster) refresh(key string, b serviceBacker) error {
+	data, err := c.encode(c.entryOf(b))
+	if err != nil {
+		return err
+	}
+
+	ok, err := c.eval(clusterRefreshScript, key, data, clusterTTLArg(), c.id)
+	if err == nil && !ok {
+		err = errServiceTaken
+	}
+	return err
+}
+
+func clusterTTLArg() string {
+	return strconv.FormatInt(clusterTTL.Milliseconds(), 10)
+}
+
+// lookup returns the registration under key held by another provider
+func (c *cluster) lookup(key string) (ServiceInfo, bool, error) {
+	e, err := c.get(key)
+	if err != nil || e == nil || e.Provider == c.id {
+		return ServiceInfo{}, false, err
+	}
+
+	return e.ServiceInfo, true, nil
+}
+
+// list returns the registrations held by other providers
+func (c *cluster) list() ([]ServiceInfo, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := c.store.do("SCAN", cursor, "MATCH", clusterKeyPrefix+"*", "COUNT", "100")
+		if err != nil {
+			return nil, err
+		}
+
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return nil, errors.New("unexpected SCAN reply")
+		}
+		cursor, _ = page[0].(string)
+		items, _ := page[1].([]interface{})
+		for _, item := range items {
+			if key, ok := item.(string); ok {
+				keys = append(keys, key)
+			}
+		}
+
+		if cursor == "0" {
+			break
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	reply, err := c.store.do(append([]string{"MGET"}, keys...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var services []ServiceInfo
+	values, _ := reply.([]interface{})
+	for _, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			continue
+		}
+
+		var e clusterEntry
+		if json.Unmarshal([]byte(data), &e) == nil && e.Provider != c.id {
+			services = append(services, e.ServiceInfo)
+		}
+	}
+	return services, nil
+}
+
+func (c *cluster) close() {
+	c.store.close()
+}
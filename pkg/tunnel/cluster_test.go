@@ -0,0 +1,279 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRedis serves the commands of the cluster store from memory, without
+// expiry. EVAL runs the Go equivalent of the cluster scripts.
+type fakeRedis struct {
+	lock sync.Mutex
+	data map[string]string
+}
+
+func startFakeRedis(t *testing.T) (*fakeRedis, string) {
+	assert := require.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+
+	r := &fakeRedis{data: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+
+	t.Cleanup(func() { l.Close() })
+	return r, "redis://" + l.Addr().String()
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for {
+		reply, err := readRedisReply(reader)
+		if err != nil {
+			return
+		}
+
+		items := reply.([]interface{})
+		args := make([]string, len(items))
+		for i := range items {
+			args[i] = items[i].(string)
+		}
+
+		if _, err := conn.Write([]byte(r.do(args))); err != nil {
+			return
+		}
+	}
+}
+
+func bulkString(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func (r *fakeRedis) do(args []string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "SET":
+		if _, ok := r.data[args[1]]; ok && strings.ToUpper(args[len(args)-1]) == "NX" {
+			return "$-1\r\n"
+		}
+		r.data[args[1]] = args[2]
+		return "+OK\r\n"
+
+	case "GET":
+		v, ok := r.data[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulkString(v)
+
+	case "DEL":
+		_, ok := r.data[args[1]]
+		delete(r.data, args[1])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+
+	case "SCAN":
+		prefix := strings.TrimSuffix(args[3], "*")
+		var keys []string
+		for key := range r.data {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, bulkString(key))
+			}
+		}
+		return "*2\r\n" + bulkString("0") + "*" + strconv.Itoa(len(keys)) + "\r\n" + strings.Join(keys, "")
+
+	case "MGET":
+		reply := "*" + strconv.Itoa(len(args)-1) + "\r\n"
+		for _, key := range args[1:] {
+			if v, ok := r.data[key]; ok {
+				reply += bulkString(v)
+			} else {
+				reply += "$-1\r\n"
+			}
+		}
+		return reply
+
+	case "EVAL":
+		return r.eval(args[1], args[3], args[4:])
+	}
+
+	return "-ERR unknown command\r\n"
+}
+
+func (r *fakeRedis) eval(script string, key string, args []string) string {
+	var current *clusterEntry
+	if v, ok := r.data[key]; ok {
+		current = &clusterEntry{}
+		if err := json.Unmarshal([]byte(v), current); err != nil {
+			return "-ERR " + err.Error() + "\r\n"
+		}
+	}
+
+	switch script {
+	case clusterClaimScript:
+		if current != nil && current.Provider != args[2] && args[4] != "1" &&
+			!(len(args[3]) > 0 && current.Authenticated && current.Identity == args[3]) {
+			return ":0\r\n"
+		}
+		r.data[key] = args[0]
+		return ":1\r\n"
+
+	case clusterRefreshScript:
+		if current != nil && current.Provider != args[2] {
+			return ":0\r\n"
+		}
+		r.data[key] = args[0]
+		return ":1\r\n"
+
+	case clusterReleaseScript:
+		if current != nil && current.Provider == args[0] {
+			delete(r.data, key)
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	}
+
+	return "-NOSCRIPT unknown script\r\n"
+}
+
+func TestNewRedisClient(t *testing.T) {
+	assert := require.New(t)
+
+	c, err := newRedisClient("redis://:secret@localhost:6379/2")
+	assert.Nil(err)
+	assert.Equal("localhost:6379", c.address)
+	assert.Equal("secret", c.password)
+	assert.Equal(2, c.db)
+
+	for _, url := range []string{"etcd://localhost:2379", "redis://localhost", "redis://localhost:6379/x"} {
+		_, err := newRedisClient(url)
+		assert.NotNil(err, url)
+	}
+}
+
+func TestClusterServices(t *testing.T) {
+	assert := require.New(t)
+
+	store, storeURL := startFakeRedis(t)
+
+	a := newProvider()
+	defer a.Close()
+	assert.Nil(a.configure(Config{ClusterStore: storeURL, ClusterAdvertise: "10.0.0.1"}))
+
+	b := newProvider()
+	defer b.Close()
+	assert.Nil(b.configure(Config{ClusterStore: storeURL, ClusterAdvertise: "10.0.0.2"}))
+
+	_, err := newCluster(storeURL, "")
+	assert.NotNil(err)
+
+	alice := &TunnelConnection{handle: 1, identity: "alice", authenticated: true, log: logger}
+	web := forward{proxyAddress: "localhost", proxyPort: 8080, tunnelPort: 40000, service: "web"}
+	assert.Nil(a.services.register(alice, web, false))
+
+	// found at the other provider, reached at the advertised host
+	service, ok := b.services.lookup("", "web")
+	assert.True(ok)
+	assert.Equal("10.0.0.1:40000", service.Address)
+	assert.Equal(40000, service.TunnelPort)
+	assert.Equal("alice", service.Identity)
+
+	service, ok = a.services.lookup("", "web")
+	assert.True(ok)
+	assert.Empty(service.Address)
+
+	assert.Len(a.services.list(), 1)
+	assert.Len(b.services.list(), 1)
+
+	// held by another identity at another provider
+	bob := &TunnelConnection{handle: 1, identity: "bob", authenticated: true}
+	assert.NotNil(b.services.register(bob, web, false))
+
+	// the same identity takes over, the previous provider gives the name up
+	// with its next refresh
+	aliceAgain := &TunnelConnection{handle: 2, identity: "alice", authenticated: true, log: logger}
+	assert.Nil(b.services.register(aliceAgain, web, false))
+	a.services.refresh(serviceKey("", "web"), a.services.services[serviceKey("", "web")])
+	service, _ = a.services.lookup("", "web")
+	assert.Equal("10.0.0.2:40000", service.Address)
+	assert.Empty(a.services.unregister(alice))
+
+	assert.Equal([]string{"web"}, b.services.unregister(aliceAgain))
+	_, ok = a.services.lookup("", "web")
+	assert.False(ok)
+
+	store.lock.Lock()
+	assert.Empty(store.data)
+	store.lock.Unlock()
+}
+
+func TestClusterLookup(t *testing.T) {
+	assert := require.New(t)
+
+	_, storeURL := startFakeRedis(t)
+
+	target, err := startEchoServer()
+	assert.Nil(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	a, err := NewProvider(Config{ClusterStore: storeURL, ClusterAdvertise: "127.0.0.1"})
+	assert.Nil(err)
+	defer a.Close()
+	addrA, err := a.StartListener(0)
+	assert.Nil(err)
+
+	b, err := NewProvider(Config{ClusterStore: storeURL, ClusterAdvertise: "127.0.0.2"})
+	assert.Nil(err)
+	defer b.Close()
+	addrB, err := b.StartListener(0)
+	assert.Nil(err)
+
+	client := newProvider()
+	defer client.Close()
+
+	tun, err := client.Connect(ctx, ConnectorConfig{
+		ProviderAddress: fmt.Sprintf("127.0.0.1:%d", addrA.(*net.TCPAddr).Port),
+		Target:          "web=" + target.String(),
+	})
+	assert.Nil(err)
+	defer tun.Close()
+
+	assert.Eventually(func() bool {
+		_, ok := b.services.lookup("", "web")
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// asked at the other provider, the consumer is sent to the first
+	c := client.NewClient(ConnectorConfig{ProviderAddress: fmt.Sprintf("localhost:%d", addrB.(*net.TCPAddr).Port)})
+	defer c.Close()
+
+	address, err := c.Lookup(ctx, "web")
+	assert.Nil(err)
+	assert.Equal(fmt.Sprintf("127.0.0.1:%d", tun.Port()), address)
+}
@@ -0,0 +1,61 @@
+package tunnel
+
+import (
+	"errors"
+
+	"github.com/golang/snappy"
+)
+
+// payload markers, prefixed to every data payload once CAPABILITY_COMPRESSION
+// is negotiated
+const (
+	payloadRaw        = 0
+	payloadCompressed = 1
+)
+
+// decompressed payloads never exceed the data connection read buffer, bound
+// them generously to reject decompression bombs
+const maxDecompressedPayload = 1 << 20
+
+var errInvalidCompressedPayload = errors.New("invalid compressed payload")
+
+// compressPayload snappy compresses data of at least minSize bytes when that
+// makes it smaller, and frames the result with a payload marker. The storage
+// of dst is reused when large enough.
+func compressPayload(dst []byte, data []byte, minSize int) []byte {
+	if len(data) >= minSize {
+		out := resizeBuffer(dst, 1+snappy.MaxEncodedLen(len(data)))
+		if compressed := snappy.Encode(out[1:], data); len(compressed) < len(data) {
+			out[0] = payloadCompressed
+			return out[:1+len(compressed)]
+		}
+	}
+
+	out := resizeBuffer(dst, len(data)+1)
+	out[0] = payloadRaw
+	copy(out[1:], data)
+	return out
+}
+
+// decompressPayload returns the payload framed by compressPayload, raw
+// payloads alias data, compressed ones reuse the storage of dst when large
+// enough
+func decompressPayload(dst []byte, data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errInvalidCompressedPayload
+	}
+
+	switch data[0] {
+	case payloadRaw:
+		return data[1:], nil
+
+	case payloadCompressed:
+		n, err := snappy.DecodedLen(data[1:])
+		if err != nil || n > maxDecompressedPayload {
+			return nil, errInvalidCompressedPayload
+		}
+		return snappy.Decode(resizeBuffer(dst, n), data[1:])
+	}
+
+	return nil, errInvalidCompressedPayload
+}
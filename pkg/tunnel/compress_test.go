@@ -0,0 +1,52 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressPayload(t *testing.T) {
+	assert := require.New(t)
+
+	text := bytes.Repeat([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), 64)
+
+	compressed := compressPayload(nil, text, 256)
+	assert.Equal(byte(payloadCompressed), compressed[0])
+	assert.Less(len(compressed), len(text))
+
+	data, err := decompressPayload(nil, compressed)
+	assert.Nil(err)
+	assert.Equal(text, data)
+
+	// below the threshold payloads are sent as is
+	small := compressPayload(nil, text[:100], 256)
+	assert.Equal(byte(payloadRaw), small[0])
+	data, err = decompressPayload(nil, small)
+	assert.Nil(err)
+	assert.Equal(text[:100], data)
+
+	// incompressible payloads are sent as is
+	random := make([]byte, 4096)
+	rand.Read(random)
+	raw := compressPayload(nil, random, 256)
+	assert.Equal(byte(payloadRaw), raw[0])
+	data, err = decompressPayload(nil, raw)
+	assert.Nil(err)
+	assert.Equal(random, data)
+}
+
+func TestDecompressPayloadInvalid(t *testing.T) {
+	assert := require.New(t)
+
+	_, err := decompressPayload(nil, nil)
+	assert.Equal(errInvalidCompressedPayload, err)
+
+	_, err = decompressPayload(nil, []byte{7, 1, 2})
+	assert.Equal(errInvalidCompressedPayload, err)
+
+	_, err = decompressPayload(nil, []byte{payloadCompressed, 0xff, 0xff, 0xff, 0xff, 0x0f})
+	assert.Equal(errInvalidCompressedPayload, err)
+}
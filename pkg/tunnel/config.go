@@ -0,0 +1,79 @@
+package tunnel
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readConfigFields reads a line oriented configuration file and returns the
+// whitespace separated fields of every non-empty, non-comment line
+func readConfigFields(path string) ([][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines [][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+
+		if len(line) == 0 {
+			continue
+		}
+
+		lines = append(lines, strings.Fields(line))
+	}
+
+	return lines, scanner.Err()
+}
+
+// ParseByteSize parses sizes like 512, 64K, 10M or 2G (powers of 1024)
+func ParseByteSize(s string) (uint64, error) {
+	units := map[byte]uint64{
+		'K': 1 << 10,
+		'M': 1 << 20,
+		'G': 1 << 30,
+		'T': 1 << 40,
+	}
+
+	v := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	multiplier := uint64(1)
+	if len(v) > 0 {
+		if m, ok := units[v[len(v)-1]]; ok {
+			multiplier = m
+			v = v[:len(v)-1]
+		}
+	}
+
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	return n * multiplier, nil
+}
+
+// FormatByteSize is the inverse of ParseByteSize, rounded to one decimal
+func FormatByteSize(n uint64) string {
+	units := "KMGT"
+	if n < 1<<10 {
+		return strconv.FormatUint(n, 10)
+	}
+
+	v := float64(n) / (1 << 10)
+	i := 0
+	for v >= 1<<10 && i < len(units)-1 {
+		v /= 1 << 10
+		i++
+	}
+
+	return strconv.FormatFloat(v, 'f', 1, 64) + units[i:i+1]
+}
@@ -0,0 +1,90 @@
+package tunnel
+
+import "sync"
+
+// shards of a handleMap, a power of two
+const handleMapShards = 64
+
+// handleMap maps handles to connections. It is sharded by handle so that
+// thousands of data connections opening and closing concurrently do not all
+// contend on a single lock; handles are allocated sequentially and spread
+// evenly across the shards.
+type handleMap struct {
+	shards [handleMapShards]handleMapShard
+}
+
+type handleMapShard struct {
+	lock  sync.Mutex
+	items map[Handle]interface{}
+}
+
+func newHandleMap() *handleMap {
+	m := &handleMap{}
+	for i := range m.shards {
+		m.shards[i].items = make(map[Handle]interface{})
+	}
+	return m
+}
+
+func (m *handleMap) shard(handle Handle) *handleMapShard {
+	return &m.shards[handle&(handleMapShards-1)]
+}
+
+func (m *handleMap) store(handle Handle, v interface{}) {
+	s := m.shard(handle)
+	s.lock.Lock()
+	s.items[handle] = v
+	s.lock.Unlock()
+}
+
+// load returns the value of handle, nil if there is none
+func (m *handleMap) load(handle Handle) interface{} {
+	s := m.shard(handle)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.items[handle]
+}
+
+// loadAndDelete removes handle and returns its value, nil if there was none
+func (m *handleMap) loadAndDelete(handle Handle) interface{} {
+	s := m.shard(handle)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	v, ok := s.items[handle]
+	if ok {
+		delete(s.items, handle)
+	}
+	return v
+}
+
+// values returns a snapshot of all values
+func (m *handleMap) values() []interface{} {
+	var values []interface{}
+
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.lock.Lock()
+		for _, v := range s.items {
+			values = append(values, v)
+		}
+		s.lock.Unlock()
+	}
+
+	return values
+}
+
+// len returns the number of values
+func (m *handleMap) len() int {
+	n := 0
+
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.lock.Lock()
+		n += len(s.items)
+		s.lock.Unlock()
+	}
+
+	return n
+}
@@ -0,0 +1,68 @@
+package tunnel
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleMap(t *testing.T) {
+	assert := require.New(t)
+
+	m := newHandleMap()
+
+	for h := Handle(1); h <= 200; h++ {
+		m.store(h, int(h))
+	}
+
+	assert.Equal(7, m.load(7))
+	assert.Nil(m.load(1000))
+
+	assert.Equal(130, m.loadAndDelete(130))
+	assert.Nil(m.load(130))
+	assert.Nil(m.loadAndDelete(130))
+
+	// handles of neighbouring shards are unaffected
+	assert.Equal(129, m.load(129))
+	assert.Equal(131, m.load(131))
+}
+
+// open/lookup/close churn as generated by many short data connections,
+// compare with BenchmarkLockedMap for the single lock the provider used to
+// guard its maps with
+func BenchmarkHandleMap(b *testing.B) {
+	m := newHandleMap()
+	var next uint32
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			h := Handle(atomic.AddUint32(&next, 1))
+			m.store(h, h)
+			m.load(h)
+			m.loadAndDelete(h)
+		}
+	})
+}
+
+func BenchmarkLockedMap(b *testing.B) {
+	var lock sync.Mutex
+	m := make(map[Handle]interface{})
+	var next uint32
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			h := Handle(atomic.AddUint32(&next, 1))
+			lock.Lock()
+			m[h] = h
+			lock.Unlock()
+			lock.Lock()
+			_ = m[h]
+			lock.Unlock()
+			lock.Lock()
+			delete(m, h)
+			lock.Unlock()
+		}
+	})
+}
@@ -0,0 +1,520 @@
+package tunnel
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	sessionKeyLength = 32
+
+	// explicit per-payload nonce: the 4 byte handle of the data connection +
+	// its 8 byte payload counter, prefixed by the 4 byte key epoch
+	payloadNonceLength = 12
+)
+
+// AEADs payloads are sealed with, the handshake always starts with
+// AES-256-GCM, peers may rotate to another one with RenegotiateRequest
+const (
+	CIPHER_AES_256_GCM       = 0
+	CIPHER_CHACHA20_POLY1305 = 1
+)
+
+var cipherSuiteNames = map[uint32]string{
+	CIPHER_AES_256_GCM:       "aes-256-gcm",
+	CIPHER_CHACHA20_POLY1305: "chacha20-poly1305",
+}
+
+// parseCipherSuite returns the cipher suite named name, false if there is
+// none
+func parseCipherSuite(name string) (uint32, bool) {
+	for suite, n := range cipherSuiteNames {
+		if n == name {
+			return suite, true
+		}
+	}
+	return 0, false
+}
+
+// sessionKeyExchange holds one side's ephemeral X25519 key pair
+type sessionKeyExchange struct {
+	privateKey []byte
+	publicKey  []byte
+}
+
+func newSessionKeyExchange() (*sessionKeyExchange, error) {
+	privateKey := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, privateKey); err != nil {
+		return nil, err
+	}
+
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sessionKeyExchange{
+		privateKey: privateKey,
+		publicKey:  publicKey,
+	}, nil
+}
+
+// deriveCipher derives independent keys of the cipher suite for both
+// directions from the X25519 shared secret, salted with both public keys in
+// connector, listener order so that both sides derive the same key schedule.
+// Exchanges renegotiating the keys pass the binding of the handshake cipher,
+// mixed into the secret so that only the peers of the handshake derive the
+// new keys.
+func (kx *sessionKeyExchange) deriveCipher(peerKey []byte, isConnector bool, suite uint32, binding []byte) (*payloadCipher, error) {
+	secret, err := curve25519.X25519(kx.privateKey, peerKey)
+	if err != nil {
+		return nil, err
+	}
+	secret = append(secret, binding...)
+
+	connectorKey, listenerKey := kx.publicKey, peerKey
+	if !isConnector {
+		connectorKey, listenerKey = peerKey, kx.publicKey
+	}
+
+	return newPayloadCipher(secret, keyTranscript(connectorKey, listenerKey), isConnector, suite)
+}
+
+// keyTranscript returns the public keys of a key exchange in connector,
+// listener order. Clients sign it when authenticating, so that a key
+// exchanged with anyone but the listener fails authentication.
+func keyTranscript(connectorKey []byte, listenerKey []byte) []byte {
+	return append(append([]byte{}, connectorKey...), listenerKey...)
+}
+
+// transcript returns the key transcript of the exchange of kx with peerKey
+func (kx *sessionKeyExchange) transcript(peerKey []byte, isConnector bool) []byte {
+	if isConnector {
+		return keyTranscript(kx.publicKey, peerKey)
+	}
+	return keyTranscript(peerKey, kx.publicKey)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// payloadCipher encrypts TunnelDataIndication payloads of a tunnel connection.
+// Each direction has its own chain key which is ratcheted forward through
+// HKDF on every rekey, every payload carries the key epoch it was sealed with
+// so that payloads still in flight across a rekey can be opened. Payloads
+// are bound to their direction and data connection as associated data, and
+// carry a counter of the data connection that must increase, so that a
+// payload cannot be replayed, reordered or moved to another data connection.
+type payloadCipher struct {
+	lock sync.Mutex
+
+	// the payloads of the connector are sealed with direction 0, those of
+	// the listener with 1
+	isConnector bool
+
+	sendChainKey []byte
+	sendEpoch    uint32
+	sendSuite    uint32
+	seal         cipher.AEAD
+
+	// bytes sealed under the current send key
+	sentBytes uint64
+
+	// payloads sealed for a writer and not yet written, under the current
+	// send key and under earlier ones. The peer only keeps the previous
+	// receive key, a rekey waits until the earlier ones are written.
+	queued        int
+	queuedEarlier int
+
+	receiveChainKey []byte
+	receiveEpoch    uint32
+	receiveSuite    uint32
+	open            cipher.AEAD
+
+	// receive key of receiveEpoch - 1, kept for payloads sealed before a rekey
+	previousOpen cipher.AEAD
+
+	// secret of the exchange the cipher was derived from, binds the key
+	// exchanges of renegotiations to it
+	binding []byte
+}
+
+func newPayloadCipher(secret []byte, salt []byte, isConnector bool, suite uint32) (*payloadCipher, error) {
+	kdf := hkdf.New(sha256.New, secret, salt, []byte("tunnel payload keys"))
+
+	connectorKey := make([]byte, sessionKeyLength)
+	listenerKey := make([]byte, sessionKeyLength)
+	binding := make([]byte, sessionKeyLength)
+	for _, key := range [][]byte{connectorKey, listenerKey, binding} {
+		if _, err := io.ReadFull(kdf, key); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &payloadCipher{
+		binding:         binding,
+		isConnector:     isConnector,
+		sendChainKey:    listenerKey,
+		sendSuite:       suite,
+		receiveChainKey: connectorKey,
+		receiveSuite:    suite,
+	}
+	if isConnector {
+		c.sendChainKey, c.receiveChainKey = connectorKey, listenerKey
+	}
+
+	var err error
+	if c.seal, err = newAEAD(suite, c.sendChainKey); err != nil {
+		return nil, err
+	}
+	if c.open, err = newAEAD(suite, c.receiveChainKey); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func newAEAD(suite uint32, key []byte) (cipher.AEAD, error) {
+	switch suite {
+	case CIPHER_AES_256_GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+
+	case CIPHER_CHACHA20_POLY1305:
+		return chacha20poly1305.New(key)
+	}
+
+	return nil, fmt.Errorf("unknown cipher suite %d", suite)
+}
+
+func ratchetKey(chainKey []byte) ([]byte, error) {
+	next := make([]byte, sessionKeyLength)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, chainKey, nil, []byte("tunnel payload rekey")), next); err != nil {
+		return nil, err
+	}
+
+	return next, nil
+}
+
+// payloadAD returns the associated data of a payload sent by the connector
+// or the listener for the data connection handle, the handle of the receiver
+func payloadAD(fromConnector bool, handle Handle) []byte {
+	ad := make([]byte, 5)
+	if !fromConnector {
+		ad[0] = 1
+	}
+	binary.BigEndian.PutUint32(ad[1:], handle)
+	return ad
+}
+
+// encrypt returns epoch || nonce || ciphertext || tag of the payload number
+// counter of the data connection handle, the handle of the peer, reusing the
+// storage of dst when large enough. Safe for concurrent use, the counters of
+// a data connection must start at 1 and increase.
+func (c *payloadCipher) encrypt(dst []byte, plain []byte, handle Handle, counter uint64) []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.encryptLocked(dst, plain, handle, counter)
+}
+
+// encryptQueued is encrypt for a payload queued for a writer, it returns the
+// epoch of the send key, to hand back through written once the payload is
+// written or dropped
+func (c *payloadCipher) encryptQueued(dst []byte, plain []byte, handle Handle, counter uint64) ([]byte, uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.queued++
+	return c.encryptLocked(dst, plain, handle, counter), c.sendEpoch
+}
+
+// written hands back n queued payloads sealed under the send key of epoch
+func (c *payloadCipher) written(epoch uint32, n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if epoch == c.sendEpoch {
+		c.queued -= n
+	} else {
+		c.queuedEarlier -= n
+	}
+}
+
+func (c *payloadCipher) encryptLocked(dst []byte, plain []byte, handle Handle, counter uint64) []byte {
+	out := resizeBuffer(dst, 4+payloadNonceLength)
+	binary.BigEndian.PutUint32(out, c.sendEpoch)
+
+	// unique per key as the peer never reuses handles
+	nonce := out[4:]
+	binary.BigEndian.PutUint32(nonce, handle)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+
+	c.sentBytes += uint64(len(plain))
+
+	return c.seal.Seal(out, nonce, plain, payloadAD(c.isConnector, handle))
+}
+
+// decrypt opens the payload of the data connection handle in place, data is
+// overwritten. It returns the payload counter, payloads with a counter below
+// minCounter are refused as replayed or reordered.
+func (c *payloadCipher) decrypt(data []byte, handle Handle, minCounter uint64) ([]byte, uint64, error) {
+	if len(data) < 4+payloadNonceLength {
+		return nil, 0, errors.New("encrypted payload too short")
+	}
+
+	epoch := binary.BigEndian.Uint32(data)
+	nonce := data[4 : 4+payloadNonceLength]
+
+	counter := binary.BigEndian.Uint64(nonce[4:])
+	if binary.BigEndian.Uint32(nonce) != handle || counter < minCounter {
+		return nil, 0, fmt.Errorf("payload %d replayed or out of order", counter)
+	}
+
+	c.lock.Lock()
+	var aead cipher.AEAD
+	var nextKey []byte
+	switch {
+	case epoch == c.receiveEpoch:
+		aead = c.open
+	case epoch+1 == c.receiveEpoch && c.previousOpen != nil:
+		aead = c.previousOpen
+	case epoch == c.receiveEpoch+1:
+		// payloads sealed under the next key may overtake the rekey PDU, the
+		// key only rotates once one of them authenticates
+		var err error
+		if nextKey, aead, err = c.nextReceiveKey(); err != nil {
+			c.lock.Unlock()
+			return nil, 0, err
+		}
+	}
+	c.lock.Unlock()
+
+	if aead == nil {
+		return nil, 0, fmt.Errorf("payload sealed with unknown key epoch %d", epoch)
+	}
+
+	ciphertext := data[4+payloadNonceLength:]
+	plain, err := aead.Open(ciphertext[:0], nonce, ciphertext, payloadAD(!c.isConnector, handle))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if nextKey != nil {
+		c.lock.Lock()
+		if epoch == c.receiveEpoch+1 {
+			c.commitReceiveKey(nextKey, aead)
+		}
+		c.lock.Unlock()
+	}
+
+	return plain, counter, nil
+}
+
+// sentSinceRekey returns the number of plaintext bytes sealed with the current key
+func (c *payloadCipher) sentSinceRekey() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.sentBytes
+}
+
+// rotateSendKey advances the send key once at least minBytes have been sealed
+// with the current one and returns the new epoch, which the peer is told
+// about through a RekeyIndication. The key is kept while payloads sealed
+// under the previous one are queued: the indication may overtake them, and
+// after a second one the peer could no longer open them.
+func (c *payloadCipher) rotateSendKey(minBytes uint64) (uint32, bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.sentBytes < minBytes || c.queuedEarlier > 0 {
+		return c.sendEpoch, false, nil
+	}
+
+	next, err := ratchetKey(c.sendChainKey)
+	if err != nil {
+		return 0, false, err
+	}
+
+	seal, err := newAEAD(c.sendSuite, next)
+	if err != nil {
+		return 0, false, err
+	}
+
+	c.sendChainKey = next
+	c.seal = seal
+	c.sendEpoch++
+	c.sentBytes = 0
+	c.queuedEarlier, c.queued = c.queued, 0
+
+	return c.sendEpoch, true, nil
+}
+
+// rotateReceiveKey advances the receive key up to epoch, a no-op when the key
+// has already been advanced by an overtaking payload
+func (c *payloadCipher) rotateReceiveKey(epoch uint32) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.rotateReceiveKeyUnLocked(epoch)
+}
+
+func (c *payloadCipher) rotateReceiveKeyUnLocked(epoch uint32) error {
+	if epoch <= c.receiveEpoch {
+		return nil
+	}
+
+	if epoch != c.receiveEpoch+1 {
+		return fmt.Errorf("rekey skips from epoch %d to %d", c.receiveEpoch, epoch)
+	}
+
+	next, open, err := c.nextReceiveKey()
+	if err != nil {
+		return err
+	}
+
+	c.commitReceiveKey(next, open)
+	return nil
+}
+
+// nextReceiveKey ratchets the receive chain key without rotating to it
+func (c *payloadCipher) nextReceiveKey() ([]byte, cipher.AEAD, error) {
+	next, err := ratchetKey(c.receiveChainKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	open, err := newAEAD(c.receiveSuite, next)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return next, open, nil
+}
+
+func (c *payloadCipher) commitReceiveKey(next []byte, open cipher.AEAD) {
+	c.receiveChainKey = next
+	c.previousOpen = c.open
+	c.open = open
+	c.receiveEpoch++
+}
+
+func (c *payloadCipher) suite() uint32 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.sendSuite
+}
+
+// nextSendEpoch returns the epoch the send key after the current one starts
+func (c *payloadCipher) nextSendEpoch() uint32 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.sendEpoch + 1
+}
+
+// replaceSendKey seals payloads with the send key of next from epoch on,
+// rather than with a key ratcheted from the current one
+func (c *payloadCipher) replaceSendKey(next *payloadCipher, epoch uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.sendChainKey = next.sendChainKey
+	c.sendSuite = next.sendSuite
+	c.seal = next.seal
+	c.sendEpoch = epoch
+	c.sentBytes = 0
+	c.queuedEarlier += c.queued
+	c.queued = 0
+}
+
+// replaceReceiveKey opens payloads of epoch with the receive key of next,
+// the current key still opens those the peer sealed before it replaced its
+// key. epoch must follow the current one: the peer announces its rekeys in
+// the class of renegotiation PDUs, they all arrived before.
+func (c *payloadCipher) replaceReceiveKey(next *payloadCipher, epoch uint32) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if epoch != c.receiveEpoch+1 {
+		return fmt.Errorf("renegotiated key skips from epoch %d to %d", c.receiveEpoch, epoch)
+	}
+
+	c.receiveChainKey = next.receiveChainKey
+	c.receiveSuite = next.receiveSuite
+	c.previousOpen = c.open
+	c.open = next.open
+	c.receiveEpoch = epoch
+
+	return nil
+}
+
+// sealedAccount counts the payloads of a payloadCipher queued on one tunnel
+// connection. Payloads still queued when the connection closes are never
+// written, close hands them back to the cipher.
+type sealedAccount struct {
+	lock   sync.Mutex
+	cipher *payloadCipher
+	queued map[uint32]int
+	closed bool
+}
+
+// hold counts a payload c sealed under the send key of epoch as queued, false
+// once the connection is closed
+func (a *sealedAccount) hold(c *payloadCipher, epoch uint32) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.closed {
+		return false
+	}
+
+	if a.queued == nil {
+		a.queued = make(map[uint32]int)
+	}
+	a.cipher = c
+	a.queued[epoch]++
+	return true
+}
+
+// release hands a written or dropped payload back to its cipher
+func (a *sealedAccount) release(epoch uint32) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// already handed back by close
+	if a.closed {
+		return
+	}
+
+	if a.queued[epoch]--; a.queued[epoch] == 0 {
+		delete(a.queued, epoch)
+	}
+	a.cipher.written(epoch, 1)
+}
+
+func (a *sealedAccount) close() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.closed = true
+	for epoch, n := range a.queued {
+		a.cipher.written(epoch, n)
+	}
+	a.queued = nil
+}
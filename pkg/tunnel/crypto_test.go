@@ -0,0 +1,112 @@
+package tunnel
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPayloadCipher(t *testing.T) {
+	assert := require.New(t)
+
+	connector, err := newSessionKeyExchange()
+	assert.NoError(err)
+	listener, err := newSessionKeyExchange()
+	assert.NoError(err)
+
+	connectorCipher, err := connector.deriveCipher(listener.publicKey, true, CIPHER_AES_256_GCM, nil)
+	assert.NoError(err)
+	listenerCipher, err := listener.deriveCipher(connector.publicKey, false, CIPHER_AES_256_GCM, nil)
+	assert.NoError(err)
+
+	data := connectorCipher.encrypt(nil, []byte("hello"), 7, 1)
+	plain, counter, err := listenerCipher.decrypt(append([]byte(nil), data...), 7, 1)
+	assert.NoError(err)
+	assert.Equal("hello", string(plain))
+	assert.Equal(uint64(1), counter)
+
+	// replayed, or spliced into another data connection
+	_, _, err = listenerCipher.decrypt(append([]byte(nil), data...), 7, 2)
+	assert.Error(err)
+	_, _, err = listenerCipher.decrypt(append([]byte(nil), data...), 8, 1)
+	assert.Error(err)
+
+	data = listenerCipher.encrypt(nil, []byte("world"), 7, 1)
+	plain, _, err = connectorCipher.decrypt(data, 7, 1)
+	assert.NoError(err)
+	assert.Equal("world", string(plain))
+
+	// each direction has its own key
+	_, _, err = listenerCipher.decrypt(listenerCipher.encrypt(nil, []byte("x"), 7, 2), 7, 2)
+	assert.Error(err)
+
+	data = listenerCipher.encrypt(nil, []byte("world"), 7, 2)
+	data[len(data)-1] ^= 1
+	_, _, err = connectorCipher.decrypt(data, 7, 2)
+	assert.Error(err)
+}
+
+func TestPayloadCipherBinding(t *testing.T) {
+	assert := require.New(t)
+
+	connector, err := newSessionKeyExchange()
+	assert.NoError(err)
+	listener, err := newSessionKeyExchange()
+	assert.NoError(err)
+
+	assert.Equal(connector.transcript(listener.publicKey, true), listener.transcript(connector.publicKey, false))
+
+	sender, err := connector.deriveCipher(listener.publicKey, true, CIPHER_AES_256_GCM, []byte("binding"))
+	assert.NoError(err)
+	receiver, err := listener.deriveCipher(connector.publicKey, false, CIPHER_AES_256_GCM, []byte("other"))
+	assert.NoError(err)
+
+	_, _, err = receiver.decrypt(sender.encrypt(nil, []byte("x"), 1, 1), 1, 1)
+	assert.Error(err)
+}
+
+func TestPayloadCipherRekey(t *testing.T) {
+	assert := require.New(t)
+
+	connector, err := newSessionKeyExchange()
+	assert.NoError(err)
+	listener, err := newSessionKeyExchange()
+	assert.NoError(err)
+
+	sender, err := connector.deriveCipher(listener.publicKey, true, CIPHER_AES_256_GCM, nil)
+	assert.NoError(err)
+	receiver, err := listener.deriveCipher(connector.publicKey, false, CIPHER_AES_256_GCM, nil)
+	assert.NoError(err)
+
+	_, rotated, err := sender.rotateSendKey(10)
+	assert.NoError(err)
+	assert.False(rotated)
+
+	beforeRekey := sender.encrypt(nil, []byte("0123456789"), 1, 1)
+
+	epoch, rotated, err := sender.rotateSendKey(10)
+	assert.NoError(err)
+	assert.True(rotated)
+	assert.Equal(uint32(1), epoch)
+
+	// a forged payload of the next epoch does not rotate the key
+	forged := sender.encrypt(nil, []byte("forged"), 2, 1)
+	forged[len(forged)-1] ^= 1
+	_, _, err = receiver.decrypt(forged, 2, 1)
+	assert.Error(err)
+	assert.Equal(uint32(0), receiver.receiveEpoch)
+
+	// payload sealed with the new key overtakes the rekey indication
+	plain, _, err := receiver.decrypt(sender.encrypt(nil, []byte("after"), 2, 1), 2, 1)
+	assert.NoError(err)
+	assert.Equal("after", string(plain))
+
+	assert.NoError(receiver.rotateReceiveKey(epoch))
+
+	// payload sealed with the old key is still accepted
+	plain, _, err = receiver.decrypt(beforeRekey, 1, 1)
+	assert.NoError(err)
+	assert.Equal("0123456789", string(plain))
+
+	assert.Error(receiver.rotateReceiveKey(epoch + 2))
+}
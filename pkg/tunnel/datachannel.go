@@ -0,0 +1,278 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"net"
+)
+
+// data channels a tunnel connection holds at most
+const maxDataChannels = 8
+
+// length of the random token data channels present
+const channelTokenLength = 16
+
+// Data channels are secondary connections of the connector to the listener
+// that carry the PDUs of data connections, their payload and disconnect
+// requests, while the signaling connection keeps tunnel control PDUs and
+// connect requests and responses. Bulk transfers then no longer queue ahead
+// of the signaling of other data connections.
+//
+// Each data connection is assigned a channel when it is created and sends
+// all its PDUs that order behind its payload over it. A connect response
+// crosses the signaling connection and may be overtaken by payload on a
+// channel, which is delivered nonetheless. Losing a channel loses the
+// payload queued on it, so the tunnel connection is closed with it.
+
+// assignChannel returns the connection a new data connection sends its
+// payload over, the data channels in turn or tc itself while it has none
+func (tc *TunnelConnection) assignChannel() *TunnelConnection {
+	tc.channelLock.Lock()
+	defer tc.channelLock.Unlock()
+
+	if len(tc.channels) == 0 {
+		return tc
+	}
+
+	tc.nextChannel = (tc.nextChannel + 1) % len(tc.channels)
+	return tc.channels[tc.nextChannel]
+}
+
+// attachChannel adds ch to the data channels of tc, false once tc holds
+// maxDataChannels
+func (tc *TunnelConnection) attachChannel(ch *TunnelConnection) bool {
+	tc.channelLock.Lock()
+	defer tc.channelLock.Unlock()
+
+	if len(tc.channels) >= maxDataChannels {
+		return false
+	}
+	tc.channels = append(tc.channels, ch)
+	return true
+}
+
+// detachChannel removes ch from the data channels of tc, false if it was
+// not attached
+func (tc *TunnelConnection) detachChannel(ch *TunnelConnection) bool {
+	tc.channelLock.Lock()
+	defer tc.channelLock.Unlock()
+
+	for i, c := range tc.channels {
+		if c == ch {
+			tc.channels = append(tc.channels[:i], tc.channels[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (tc *TunnelConnection) channelCount() int {
+	tc.channelLock.Lock()
+	defer tc.channelLock.Unlock()
+
+	return len(tc.channels)
+}
+
+// primary returns the tunnel connection a data channel belongs to, tc
+// itself otherwise
+func (tc *TunnelConnection) primary() *TunnelConnection {
+	if tc.owner != nil {
+		return tc.owner
+	}
+	return tc
+}
+
+// grantDataChannels registers a token for the data channels of tc and
+// returns it
+func (tc *TunnelConnection) grantDataChannels() ([]byte, error) {
+	token := make([]byte, channelTokenLength)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	p := tc.provider
+	p.channelLock.Lock()
+	defer p.channelLock.Unlock()
+
+	if len(tc.channelToken) > 0 {
+		delete(p.channelOwners, tc.channelToken)
+	}
+	tc.channelToken = string(token)
+	p.channelOwners[tc.channelToken] = tc
+
+	return token, nil
+}
+
+// revokeDataChannels closes the data channels of a closing tunnel
+// connection and forgets its token
+func (tc *TunnelConnection) revokeDataChannels() {
+	p := tc.provider
+	p.channelLock.Lock()
+	if len(tc.channelToken) > 0 && p.channelOwners[tc.channelToken] == tc {
+		delete(p.channelOwners, tc.channelToken)
+	}
+	p.channelLock.Unlock()
+
+	tc.channelLock.Lock()
+	channels := tc.channels
+	tc.channels = nil
+	tc.channelLock.Unlock()
+
+	for _, ch := range channels {
+		ch.conn.Close()
+	}
+}
+
+// openDataChannels dials the data channels the connector asked for, once
+// the listener has granted them with token. Data connections stay on the
+// signaling connection should a channel fail to open.
+func (tc *TunnelConnection) openDataChannels(token []byte) {
+	for i := 0; i < tc.dataChannels; i++ {
+		conn, err := tc.provider.dialProvider(tc.providerAddress)
+		if err != nil {
+			tc.log.warn("Data channel dial error", "error", err)
+			return
+		}
+
+		ch := tc.provider.newDataChannel(tc, conn)
+		ch.open()
+		ch.send(&DataChannelRequest{token: token})
+	}
+}
+
+// newDataChannel returns a data channel of owner over conn. Unlike tunnel
+// connections it is not registered with the provider.
+func (p *Provider) newDataChannel(owner *TunnelConnection, conn net.Conn) *TunnelConnection {
+	ch := p.initTunnelConnection(conn)
+	ch.owner = owner
+	ch.handle = p.getNextHandle()
+	ch.log = owner.log.with("channel", ch.handle)
+	ch.span = owner.span.child("tunnel.data_channel", "channel", ch.handle)
+	ch.establish = ch.span.child("tunnel.establish")
+
+	return ch
+}
+
+// onDataChannelRequest turns a freshly accepted connection into a data
+// channel of the tunnel connection the token was granted to
+func (tc *TunnelConnection) onDataChannelRequest(pdu *DataChannelRequest) {
+	p := tc.provider
+	p.channelLock.Lock()
+	owner := p.channelOwners[string(pdu.token)]
+	p.channelLock.Unlock()
+
+	switch {
+	case owner == nil || owner.ctx.Err() != nil:
+		tc.log.warn("Refuse data channel, unknown token")
+		tc.send(&DataChannelResponse{code: ERROR_ACCESS_DENIED})
+		return
+
+	// a connection that said hello is a tunnel connection of its own
+	case tc.capabilities != 0 || len(tc.forwardList()) > 0 || len(tc.dataConnections()) > 0:
+		tc.log.warn("Refuse data channel on a tunnel connection")
+		tc.send(&DataChannelResponse{code: ERROR_ACCESS_DENIED})
+		return
+	}
+
+	if handle, ok := pdu.ext[EXT_CHANNEL_DEDICATED]; ok {
+		tc.acceptDedicated(owner, handle)
+		return
+	}
+
+	if !owner.attachChannel(tc) {
+		owner.log.warn("Refuse data channel, too many", "channels", maxDataChannels)
+		tc.send(&DataChannelResponse{code: ERROR_RESOURCE_EXHAUSTED})
+		return
+	}
+
+	// handled by the reader of tc, which sees the owner from the next frame
+	if p.tunnelConnections.loadAndDelete(tc.handle) != nil {
+		metrics.tunnelsActive.Add(-1)
+	}
+	tc.owner = owner
+
+	owner.log.info("Attach data channel", "channel", tc.handle, "remote", tc.conn.RemoteAddr())
+	tc.send(&DataChannelResponse{})
+}
+
+func (tc *TunnelConnection) onDataChannelResponse(pdu *DataChannelResponse) {
+	if pdu.code != 0 {
+		tc.log.warn("Data channel refused", "code", pdu.code)
+		tc.conn.Close()
+		return
+	}
+
+	if dc := tc.promoted; dc != nil {
+		if !dc.attachDedicated(tc) {
+			tc.conn.Close()
+			return
+		}
+		dc.log.info("Promote data connection to a data channel", "channel", tc.handle)
+		return
+	}
+
+	if !tc.owner.attachChannel(tc) {
+		tc.conn.Close()
+		return
+	}
+
+	tc.log.info("Data channel attached")
+}
+
+// onChannelPacket handles the PDUs a data channel carries, those of data
+// connections on behalf of its tunnel connection
+func (tc *TunnelConnection) onChannelPacket(pdu Serializable) {
+	switch pdu := pdu.(type) {
+	case *TunnelDataIndication:
+		tc.onTunnelDataIndication(pdu)
+
+	case *TunnelDatagramIndication:
+		tc.onTunnelDatagramIndication(pdu)
+
+	case *TunnelDisconnectRequest:
+		// ordered behind the payload held on a dedicated data channel
+		if dc := tc.promoted; dc != nil && !dc.awaitSwitch() {
+			return
+		}
+		tc.owner.onTunnelDisconnectRequest(pdu)
+
+	case *ChannelSwitchIndication:
+		tc.onChannelSwitchIndication(pdu)
+
+	case *KeepaliveRequest:
+		tc.onKeepaliveRequest(pdu)
+
+	case *KeepaliveResponse:
+		// any frame read proves the channel alive
+
+	case *DataChannelResponse:
+		tc.onDataChannelResponse(pdu)
+
+	default:
+		tc.log.warn("Drop PDU on a data channel", "type", pduNames[pdu.GetSerialType()])
+	}
+}
+
+// closeDataChannel tears a data channel down, and its tunnel connection with
+// it if attached, or the data connection it is dedicated to
+func (p *Provider) closeDataChannel(ch *TunnelConnection) {
+	ch.cancel()
+	ch.conn.Close()
+	ch.budget.close()
+	ch.sealed.close()
+
+	if dc := ch.promoted; dc != nil {
+		dc.channelLock.Lock()
+		dedicated := dc.dedicated == ch
+		dc.channelLock.Unlock()
+
+		if dedicated {
+			dc.close(false)
+		}
+	} else if ch.owner.detachChannel(ch) {
+		ch.owner.log.warn("Data channel lost, close tunnel connection", "channel", ch.handle)
+		ch.owner.conn.Close()
+	}
+
+	ch.establish.finish()
+	ch.span.finish()
+}
@@ -0,0 +1,192 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDataChannels(t *testing.T) {
+	assert := require.New(t)
+
+	target, err := startEchoServer()
+	assert.Nil(err)
+
+	p, err := NewProvider(Config{CompressMin: 16})
+	assert.Nil(err)
+	defer p.Close()
+	addr, err := p.StartListener(0)
+	assert.Nil(err)
+
+	client, err := NewProvider(Config{CompressMin: 16})
+	assert.Nil(err)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tun, err := client.Connect(ctx, ConnectorConfig{
+		ProviderAddress: fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port),
+		Target:          target.String(),
+		Encrypt:         true,
+		DataChannels:    2,
+	})
+	assert.Nil(err)
+	defer tun.Close()
+
+	// attached by the provider before it answers
+	assert.Eventually(func() bool {
+		return tun.tc.channelCount() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// channels are not tunnel connections of their own
+	tunnels, _ := p.connectionSnapshot()
+	assert.Len(tunnels, 1)
+	tc := p.getTunnelConnection(tunnels[0].Handle)
+	assert.Equal(2, tunnelView(tc).DataChannels)
+
+	// bulk and small transfers side by side, each over a channel
+	echo := func(size int) {
+		consumer, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", tun.Port()))
+		assert.Nil(err)
+		defer consumer.Close()
+
+		payload := bytes.Repeat([]byte("d"), size)
+		go consumer.Write(payload)
+
+		reply := make([]byte, size)
+		consumer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(consumer, reply)
+		assert.Nil(err)
+		assert.Equal(payload, reply)
+
+		for _, dc := range tc.dataConnections() {
+			assert.True(dc.channel != tc)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		echo(4 << 20)
+		close(done)
+	}()
+	echo(100)
+	<-done
+
+	assert.Equal(errRotateDataChannels, tun.Renegotiate(ctx, Renegotiation{CipherSuite: "chacha20-poly1305"}))
+
+	// a channel of an unknown token is refused
+	conn, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port))
+	assert.Nil(err)
+	defer conn.Close()
+	conn.Write(encodePdu(&DataChannelRequest{token: []byte("guess")}))
+	response := readTestPdu(t, conn).(*DataChannelResponse)
+	assert.Equal(uint32(ERROR_ACCESS_DENIED), response.code)
+
+	// losing a channel closes the tunnel
+	tc.channelLock.Lock()
+	ch := tc.channels[0]
+	tc.channelLock.Unlock()
+	ch.conn.Close()
+
+	select {
+	case <-tun.Done():
+	case <-time.After(5 * time.Second):
+		assert.Fail("tunnel outlived its data channel")
+	}
+}
+
+func TestPromoteDataConnection(t *testing.T) {
+	assert := require.New(t)
+
+	target, err := startEchoServer()
+	assert.Nil(err)
+
+	p, err := NewProvider(Config{CompressMin: 16})
+	assert.Nil(err)
+	defer p.Close()
+	addr, err := p.StartListener(0)
+	assert.Nil(err)
+
+	client, err := NewProvider(Config{CompressMin: 16})
+	assert.Nil(err)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tun, err := client.Connect(ctx, ConnectorConfig{
+		ProviderAddress: fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port),
+		Target:          target.String(),
+		Encrypt:         true,
+		PromoteRate:     1,
+	})
+	assert.Nil(err)
+	defer tun.Close()
+
+	tunnels, _ := p.connectionSnapshot()
+	assert.Len(tunnels, 1)
+	tc := p.getTunnelConnection(tunnels[0].Handle)
+
+	consumer, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", tun.Port()))
+	assert.Nil(err)
+	defer consumer.Close()
+	consumer.SetDeadline(time.Now().Add(10 * time.Second))
+
+	dedicated := func(tc *TunnelConnection) bool {
+		for _, dc := range tc.dataConnections() {
+			if dataConnectionView(dc).Dedicated {
+				return true
+			}
+		}
+		return false
+	}
+
+	// payload keeps flowing, in order, while both sides switch over
+	after := 10
+	for i := 0; after > 0; i++ {
+		if i > 100 {
+			assert.Fail("data connection not promoted")
+		}
+
+		payload := bytes.Repeat([]byte{byte('a' + i%26)}, 32*1024)
+		go consumer.Write(payload)
+
+		reply := make([]byte, len(payload))
+		_, err = io.ReadFull(consumer, reply)
+		assert.Nil(err)
+		assert.Equal(payload, reply)
+
+		if dedicated(tc) && dedicated(tun.tc) {
+			after--
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// the dedicated channel is no tunnel connection of its own
+	tunnels, _ = p.connectionSnapshot()
+	assert.Len(tunnels, 1)
+
+	// and closes with its data connection
+	dcs := tc.dataConnections()
+	assert.Len(dcs, 1)
+	dcs[0].channelLock.Lock()
+	ch := dcs[0].dedicated
+	dcs[0].channelLock.Unlock()
+
+	consumer.Close()
+	assert.Eventually(func() bool {
+		return len(tc.dataConnections()) == 0 && ch.ctx.Err() != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	select {
+	case <-tun.Done():
+		assert.Fail("tunnel closed with the dedicated channel")
+	default:
+	}
+}
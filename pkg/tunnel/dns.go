@@ -0,0 +1,281 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsTTL is the TTL of the records answered, short as tunnel ports change
+// whenever a client reconnects after its session expired
+const dnsTTL = 5
+
+// dnsResponder answers queries for the services registered at the provider
+// within zone, those of a namespace within its subdomain:
+//
+//	name[.namespace].zone          A or AAAA, the provider address
+//	_name._tcp[.namespace].zone    SRV, the tunnel port at name[.namespace].zone
+//
+// Services held by another provider of the cluster resolve to its advertised
+// address, when that is an IP.
+//
+// Names outside the zone are refused, there is no recursion.
+type dnsResponder struct {
+	services *serviceRegistry
+
+	// lower case, fully qualified
+	zone string
+
+	// provider address answered, IPv4 in A and IPv6 in AAAA records
+	ip net.IP
+}
+
+// StartDNSServer answers DNS queries over UDP on address for the services
+// registered at the provider, as names within zone resolving to ip. Returns
+// the bound address.
+func (p *Provider) StartDNSServer(address string, zone string, ip net.IP) (net.Addr, error) {
+	if len(strings.Trim(zone, ".")) == 0 {
+		return nil, errors.New("DNS zone is empty")
+	}
+	if ip == nil {
+		return nil, errors.New("DNS answers need the provider IP address")
+	}
+
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &dnsResponder{
+		services: p.services,
+		zone:     strings.ToLower(strings.Trim(zone, ".")) + ".",
+		ip:       ip,
+	}
+
+	go d.serve(conn)
+
+	go func() {
+		<-p.ctx.Done()
+		conn.Close()
+	}()
+
+	logger.info("DNS server listening", "address", conn.LocalAddr(), "zone", d.zone)
+	return conn.LocalAddr(), nil
+}
+
+func (d *dnsResponder) serve(conn net.PacketConn) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.error("DNS server error", "error", err)
+			}
+			return
+		}
+
+		response, err := d.answer(buf[:n])
+		if err != nil {
+			logger.debug("Drop DNS query", "client", addr, "error", err)
+			continue
+		}
+
+		if _, err := conn.WriteTo(response, addr); err != nil {
+			logger.debug("DNS reply error", "client", addr, "error", err)
+		}
+	}
+}
+
+// answer returns the response to the query message
+func (d *dnsResponder) answer(query []byte) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	if header.Response {
+		return nil, errors.New("not a query")
+	}
+
+	question, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	response := dnsmessage.Header{
+		ID:               header.ID,
+		Response:         true,
+		OpCode:           header.OpCode,
+		RecursionDesired: header.RecursionDesired,
+	}
+
+	var answers, additionals []dnsmessage.Resource
+	switch {
+	case header.OpCode != 0:
+		response.RCode = dnsmessage.RCodeNotImplemented
+	case question.Class != dnsmessage.ClassINET:
+		response.RCode = dnsmessage.RCodeRefused
+	default:
+		answers, additionals, response.RCode = d.resolve(question)
+	}
+	response.Authoritative = response.RCode == dnsmessage.RCodeSuccess || response.RCode == dnsmessage.RCodeNameError
+
+	b := dnsmessage.NewBuilder(nil, response)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(question); err != nil {
+		return nil, err
+	}
+
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	for _, r := range answers {
+		if err := d.appendResource(&b, r); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := b.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	for _, r := range additionals {
+		if err := d.appendResource(&b, r); err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Finish()
+}
+
+// resolve returns the answer and additional records of question
+func (d *dnsResponder) resolve(question dnsmessage.Question) ([]dnsmessage.Resource, []dnsmessage.Resource, dnsmessage.RCode) {
+	name := strings.ToLower(question.Name.String())
+	if name != d.zone && !strings.HasSuffix(name, "."+d.zone) {
+		return nil, nil, dnsmessage.RCodeRefused
+	}
+
+	// the zone apex exists, without records of its own
+	if name == d.zone {
+		return nil, nil, dnsmessage.RCodeSuccess
+	}
+
+	namespace, service, srv, ok := parseServiceName(strings.TrimSuffix(name, "."+d.zone))
+	if !ok {
+		return nil, nil, dnsmessage.RCodeNameError
+	}
+
+	info, ok := d.services.lookup(namespace, service)
+	if !ok {
+		return nil, nil, dnsmessage.RCodeNameError
+	}
+
+	if !srv {
+		if r, ok := d.addressRecord(question.Name, question.Type, d.ipOf(info)); ok {
+			return []dnsmessage.Resource{r}, nil, dnsmessage.RCodeSuccess
+		}
+		return nil, nil, dnsmessage.RCodeSuccess
+	}
+
+	if question.Type != dnsmessage.TypeSRV {
+		return nil, nil, dnsmessage.RCodeSuccess
+	}
+
+	host := strings.ToLower(info.Name) + "."
+	if len(namespace) > 0 {
+		host += namespace + "."
+	}
+	target, err := dnsmessage.NewName(host + d.zone)
+	if err != nil {
+		return nil, nil, dnsmessage.RCodeServerFailure
+	}
+
+	answer := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: dnsTTL},
+		Body:   &dnsmessage.SRVResource{Port: uint16(info.TunnelPort), Target: target},
+	}
+
+	var additionals []dnsmessage.Resource
+	for _, t := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		if r, ok := d.addressRecord(target, t, d.ipOf(info)); ok {
+			additionals = append(additionals, r)
+		}
+	}
+	return []dnsmessage.Resource{answer}, additionals, dnsmessage.RCodeSuccess
+}
+
+// parseServiceName splits the lower case name relative to the zone into
+// namespace and service name, srv is set for _name._tcp names
+func parseServiceName(name string) (string, string, bool, bool) {
+	labels := strings.Split(name, ".")
+
+	srv := len(labels) >= 2 && labels[1] == "_tcp" && strings.HasPrefix(labels[0], "_")
+	if srv {
+		labels = append([]string{strings.TrimPrefix(labels[0], "_")}, labels[2:]...)
+	}
+
+	switch len(labels) {
+	case 1:
+		return "", labels[0], srv, true
+	case 2:
+		return labels[1], labels[0], srv, true
+	}
+
+	return "", "", false, false
+}
+
+// ipOf returns the address of the provider holding the tunnel port of info,
+// nil if it is advertised by host name
+func (d *dnsResponder) ipOf(info ServiceInfo) net.IP {
+	if len(info.Address) == 0 {
+		return d.ip
+	}
+
+	host, _, err := net.SplitHostPort(info.Address)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// addressRecord returns the A or AAAA record of ip for name, false if t is
+// neither, ip is nil or of the other family
+func (d *dnsResponder) addressRecord(name dnsmessage.Name, t dnsmessage.Type, ip net.IP) (dnsmessage.Resource, bool) {
+	header := dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: dnsTTL}
+	if ip == nil {
+		return dnsmessage.Resource{}, false
+	}
+
+	ip4 := ip.To4()
+	switch {
+	case t == dnsmessage.TypeA && ip4 != nil:
+		r := &dnsmessage.AResource{}
+		copy(r.A[:], ip4)
+		return dnsmessage.Resource{Header: header, Body: r}, true
+
+	case t == dnsmessage.TypeAAAA && ip4 == nil:
+		r := &dnsmessage.AAAAResource{}
+		copy(r.AAAA[:], ip.To16())
+		return dnsmessage.Resource{Header: header, Body: r}, true
+	}
+
+	return dnsmessage.Resource{}, false
+}
+
+func (d *dnsResponder) appendResource(b *dnsmessage.Builder, r dnsmessage.Resource) error {
+	switch body := r.Body.(type) {
+	case *dnsmessage.AResource:
+		return b.AResource(r.Header, *body)
+	case *dnsmessage.AAAAResource:
+		return b.AAAAResource(r.Header, *body)
+	case *dnsmessage.SRVResource:
+		return b.SRVResource(r.Header, *body)
+	}
+
+	return fmt.Errorf("unexpected DNS record %T", r.Body)
+}
@@ -0,0 +1,66 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSServer(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+	defer p.Close()
+
+	tc := &TunnelConnection{handle: 1, identity: "alice"}
+	assert.Nil(p.services.register(tc, forward{proxyAddress: "localhost", proxyPort: 8080, tunnelPort: 40000, service: "Web"}, false))
+
+	addr, err := p.StartDNSServer("127.0.0.1:0", "tunnel.internal.", net.ParseIP("10.0.0.1"))
+	assert.Nil(err)
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return net.Dial("udp", addr.String())
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	hosts, err := resolver.LookupHost(ctx, "web.tunnel.internal")
+	assert.Nil(err)
+	assert.Equal([]string{"10.0.0.1"}, hosts)
+
+	target, srvs, err := resolver.LookupSRV(ctx, "web", "tcp", "tunnel.internal")
+	assert.Nil(err)
+	assert.Equal("_web._tcp.tunnel.internal.", target)
+	assert.Len(srvs, 1)
+	assert.Equal(uint16(40000), srvs[0].Port)
+	assert.Equal("web.tunnel.internal.", srvs[0].Target)
+
+	acme := &TunnelConnection{handle: 2, identity: "carol", namespace: "acme"}
+	assert.Nil(p.services.register(acme, forward{proxyAddress: "localhost", proxyPort: 22, tunnelPort: 40001, service: "ssh"}, false))
+
+	_, srvs, err = resolver.LookupSRV(ctx, "ssh", "tcp", "acme.tunnel.internal")
+	assert.Nil(err)
+	assert.Equal(uint16(40001), srvs[0].Port)
+	assert.Equal("ssh.acme.tunnel.internal.", srvs[0].Target)
+	_, err = resolver.LookupHost(ctx, "ssh.tunnel.internal")
+	assert.NotNil(err)
+
+	_, err = resolver.LookupHost(ctx, "db.tunnel.internal")
+	assert.NotNil(err)
+	assert.True(err.(*net.DNSError).IsNotFound)
+
+	// gone along with the tunnel
+	p.services.unregister(tc)
+	_, _, err = resolver.LookupSRV(ctx, "web", "tcp", "tunnel.internal")
+	assert.NotNil(err)
+
+	_, err = p.StartDNSServer("127.0.0.1:0", "", net.ParseIP("10.0.0.1"))
+	assert.NotNil(err)
+}
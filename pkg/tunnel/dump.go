@@ -0,0 +1,60 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// DumpConnections logs the table of all tunnel connections and data
+// connections
+func (p *Provider) DumpConnections() {
+	tunnels, connections := p.connectionSnapshot()
+
+	var b bytes.Buffer
+	WriteConnectionTable(&b, tunnels, connections)
+	logger.lines(levelInfo, "Connection table", b.String(),
+		"tunnels", len(tunnels), "data_connections", len(connections))
+}
+
+// WriteConnectionTable prints tunnel connections and data connections as
+// aligned columns
+func WriteConnectionTable(w io.Writer, tunnels []TunnelInfo, connections []DataConnectionInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TUNNEL\tIDENTITY\tREMOTE\tTARGET\tPORT\tCONNS\tRX\tTX\tPEER\tAGE\tLABELS")
+	for _, t := range tunnels {
+		port := ""
+		if t.TunnelPort != 0 {
+			port = strconv.Itoa(t.TunnelPort)
+		}
+
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n", t.Handle, t.Identity, t.Remote, t.Target, port,
+			t.DataConnections, FormatByteSize(t.RxBytes), FormatByteSize(t.TxBytes), formatPeerStats(t.Peer),
+			formatAge(t.Created), FormatLabels(t.Labels))
+	}
+
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "CONNECTION\tPEER\tTUNNEL\tCLIENT\tTARGET\tOPENED\tRX\tTX\tAGE")
+	for _, dc := range connections {
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%s\t%s\t%t\t%s\t%s\t%s\n", dc.Handle, dc.PeerHandle, dc.Tunnel, dc.Client, dc.Target,
+			dc.Opened, FormatByteSize(dc.RxBytes), FormatByteSize(dc.TxBytes), formatAge(dc.Created))
+	}
+
+	return tw.Flush()
+}
+
+// formatPeerStats prints the data connections, rx/tx and errors the peer
+// reported, - until it has
+func formatPeerStats(s *PeerStats) string {
+	if s == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%d conns %s/%s %d errors", s.DataConnections, FormatByteSize(s.RxBytes), FormatByteSize(s.TxBytes), s.Errors)
+}
+
+func formatAge(created time.Time) string {
+	return time.Since(created).Round(time.Second).String()
+}
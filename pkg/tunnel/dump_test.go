@@ -0,0 +1,61 @@
+package tunnel
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpConnections(t *testing.T) {
+	assert := require.New(t)
+
+	var out bytes.Buffer
+	logger.setOutput(&out)
+	defer logger.setOutput(os.Stdout)
+
+	p := newProvider()
+	defer p.Close()
+
+	tunnelLocal, tunnelRemote := net.Pipe()
+	defer tunnelRemote.Close()
+	tc := p.newTunnelConnection(tunnelLocal)
+	tc.identity = "alice"
+
+	dataLocal, dataRemote := net.Pipe()
+	defer dataRemote.Close()
+	dc := p.newDataConnection(tc, dataLocal)
+	dc.clientAddress = "192.0.2.1:4000"
+
+	out.Reset()
+	p.DumpConnections()
+
+	lines := strings.Split(strings.TrimRight(out.String(), "\n"), "\n")
+	assert.Contains(lines[0], "INFO Connection table tunnels=1 data_connections=1")
+	assert.True(strings.HasPrefix(lines[1], "  TUNNEL "))
+	assert.Contains(out.String(), "alice")
+	assert.Contains(out.String(), "192.0.2.1:4000")
+}
+
+func TestLoggerLinesJSON(t *testing.T) {
+	assert := require.New(t)
+
+	var out bytes.Buffer
+	l := newLogger(&out)
+	l.setJSON(true)
+
+	l.lines(levelInfo, "Connection table", "A  B\n1  2\n")
+	assert.Contains(out.String(), `"lines":["A  B","1  2"]`)
+}
+
+func TestFormatByteSize(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Equal("512", FormatByteSize(512))
+	assert.Equal("1.5K", FormatByteSize(1536))
+	assert.Equal("10.0M", FormatByteSize(10<<20))
+	assert.Equal("2.0T", FormatByteSize(2<<40))
+}
@@ -0,0 +1,60 @@
+package tunnel
+
+// payloads queued for a data connection whose writes wait for the egress
+// rate limit or a quota, before the tunnel reader waits for room
+const egressQueueLength = 64
+
+// queueEgress queues a copy of data for the egress writer of dc, returns
+// false once dc is closed. The queue is bounded, a peer outpacing the limits
+// is held up by TCP flow control of the tunnel once it is full.
+func (dc *DataConnection) queueEgress(data []byte) bool {
+	return dc.enqueueEgress(append([]byte(nil), data...))
+}
+
+// closeAfterEgress closes dc for the peer once the payloads queued for it
+// are written
+func (dc *DataConnection) closeAfterEgress() {
+	if tc := dc.tunnelConnection; tc.provider.egressLimiter != nil || tc.quota != nil {
+		dc.enqueueEgress(nil)
+		return
+	}
+
+	dc.close(false)
+}
+
+func (dc *DataConnection) enqueueEgress(data []byte) bool {
+	dc.egressOnce.Do(func() {
+		dc.egress = make(chan []byte, egressQueueLength)
+		go dc.egressLoop()
+	})
+
+	select {
+	case dc.egress <- data:
+		return true
+	case <-dc.ctx.Done():
+		return false
+	}
+}
+
+// egressLoop writes the queued payloads of dc, a nil payload closes it
+func (dc *DataConnection) egressLoop() {
+	defer recoverPanic("data connection writer", func() { dc.close(true) })
+
+	tc := dc.tunnelConnection
+	for {
+		select {
+		case data := <-dc.egress:
+			if data == nil {
+				dc.close(false)
+				return
+			}
+
+			if !tc.throttledWrite(dc, data) {
+				return
+			}
+
+		case <-dc.ctx.Done():
+			return
+		}
+	}
+}
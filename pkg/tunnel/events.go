@@ -0,0 +1,102 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// tunnel state changes, in the order of the Event.Type enum of admin.proto
+const (
+	eventTunnelUp = iota + 1
+	eventTunnelDown
+	eventConnectionOpen
+	eventConnectionClose
+	eventAuthFailure
+)
+
+// events buffered per subscriber, subscribers falling further behind are
+// dropped
+const eventQueueLength = 1024
+
+type tunnelEvent struct {
+	kind int
+	time time.Time
+
+	tunnel     Handle
+	connection Handle
+
+	identity   string
+	remote     string
+	target     string
+	client     string
+	tunnelPort int
+
+	// totals of the tunnel or data connection and how long it lasted, set
+	// on eventTunnelDown and eventConnectionClose
+	traffic  TrafficSnapshot
+	duration time.Duration
+
+	// why authentication failed, set on eventAuthFailure
+	reason string
+}
+
+// eventHub fans tunnel state changes out to subscribers, e.g. admin event
+// streams, and to the hooks of the embedding application. A nil hub
+// publishes nothing.
+type eventHub struct {
+	lock        sync.Mutex
+	subscribers map[chan *tunnelEvent]struct{}
+
+	// optional, called synchronously by publish
+	hooks Hooks
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		subscribers: make(map[chan *tunnelEvent]struct{}),
+	}
+}
+
+// subscribe returns a channel receiving every event published from now on.
+// It is closed by unsubscribe, or when the subscriber does not keep up.
+func (h *eventHub) subscribe() chan *tunnelEvent {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	ch := make(chan *tunnelEvent, eventQueueLength)
+	h.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan *tunnelEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if _, ok := h.subscribers[ch]; ok {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (h *eventHub) publish(e *tunnelEvent) {
+	if h == nil {
+		return
+	}
+
+	e.time = time.Now()
+	h.notify(e)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- e:
+		default:
+			// a gap would leave the subscriber with a wrong picture, it has
+			// to resubscribe and resync instead
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
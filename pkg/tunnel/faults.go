@@ -0,0 +1,151 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// the retransmission a payload of a stream lost to an injected fault waits
+// for, doubling with every further loss, and the losses after which the
+// stream is reset like a TCP connection giving up
+const (
+	faultRetransmitTimeout = 200 * time.Millisecond
+	faultMaxRetransmits    = 5
+)
+
+var errFaultReset = errors.New("injected data connection reset")
+
+// faultAction is what an injected fault does to a payload
+type faultAction int
+
+const (
+	faultRelay faultAction = iota
+
+	// the payload of a datagram connection is lost, or the data connection
+	// closed while the payload was held
+	faultDrop
+
+	// the stream lost the payload too many times and is reset
+	faultReset
+)
+
+// faultInjector degrades the tunnels of a provider on purpose, to test how
+// applications and the reconnect logic cope: payload read from data
+// connections is delayed by latency plus or minus jitter and lost with
+// dropRate, and tunnel connections are reset after a random time averaging
+// resetInterval. Lost datagrams are dropped, streams retransmit lost
+// payload after a backoff rather than relay it with a gap, and are reset
+// after too many losses in a row. A nil injector injects nothing.
+type faultInjector struct {
+	latency       time.Duration
+	jitter        time.Duration
+	dropRate      float64
+	resetInterval time.Duration
+
+	// faultRetransmitTimeout, shortened by tests
+	retransmitTimeout time.Duration
+
+	lock   sync.Mutex
+	random *rand.Rand
+}
+
+func newFaultInjector(latency, jitter time.Duration, dropRate float64, resetInterval time.Duration) (*faultInjector, error) {
+	if dropRate < 0 || dropRate > 1 {
+		return nil, errors.New("fault drop rate must be between 0 and 1")
+	}
+	if latency <= 0 && jitter <= 0 && dropRate == 0 && resetInterval <= 0 {
+		return nil, nil
+	}
+
+	logger.warn("Fault injection enabled", "latency", latency, "jitter", jitter, "drop_rate", dropRate,
+		"reset_interval", resetInterval)
+
+	return &faultInjector{
+		latency:       latency,
+		jitter:        jitter,
+		dropRate:      dropRate,
+		resetInterval: resetInterval,
+
+		retransmitTimeout: faultRetransmitTimeout,
+		random:            rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+// float64 returns a random number in [0, 1)
+func (f *faultInjector) float64() float64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.random.Float64()
+}
+
+// payload applies the faults to a payload read from a data connection,
+// datagram or stream: it sleeps for the latency, and the retransmissions of
+// a stream, then reports what to do with the payload
+func (f *faultInjector) payload(ctx context.Context, datagram bool) faultAction {
+	if f == nil {
+		return faultRelay
+	}
+
+	delay := f.latency
+	if f.jitter > 0 {
+		delay += time.Duration((2*f.float64() - 1) * float64(f.jitter))
+	}
+
+	action := faultRelay
+	if datagram {
+		if f.lost() {
+			action = faultDrop
+		}
+	} else {
+		timeout := f.retransmitTimeout
+		for retransmits := 0; f.lost(); retransmits++ {
+			if retransmits == faultMaxRetransmits {
+				action = faultReset
+				break
+			}
+
+			delay += timeout
+			timeout *= 2
+		}
+	}
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return faultDrop
+		}
+	}
+
+	return action
+}
+
+// lost reports whether a payload is lost to the drop rate
+func (f *faultInjector) lost() bool {
+	return f.dropRate > 0 && f.float64() < f.dropRate
+}
+
+// scheduleReset closes tc after a random time of up to twice the reset
+// interval, as if the connection to the peer was lost
+func (f *faultInjector) scheduleReset(tc *TunnelConnection) {
+	if f == nil || f.resetInterval <= 0 {
+		return
+	}
+
+	after := time.Duration(2 * f.float64() * float64(f.resetInterval))
+	timer := time.AfterFunc(after, func() {
+		tc.log.warn("Inject tunnel reset", "after", after.Round(time.Millisecond))
+		tc.conn.Close()
+	})
+
+	go func() {
+		<-tc.ctx.Done()
+		timer.Stop()
+	}()
+}
@@ -0,0 +1,109 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultInjector(t *testing.T) {
+	assert := require.New(t)
+
+	_, err := newFaultInjector(0, 0, 1.5, 0)
+	assert.NotNil(err)
+
+	f, err := newFaultInjector(0, 0, 0, 0)
+	assert.Nil(err)
+	assert.Nil(f)
+	assert.Equal(faultRelay, f.payload(context.Background(), false))
+
+	// lost datagrams are dropped after the latency
+	f, err = newFaultInjector(20*time.Millisecond, 10*time.Millisecond, 1, 0)
+	assert.Nil(err)
+	start := time.Now()
+	assert.Equal(faultDrop, f.payload(context.Background(), true))
+	assert.True(time.Since(start) >= 10*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f.latency = time.Hour
+	assert.Equal(faultDrop, f.payload(ctx, false))
+}
+
+func TestFaultInjectorStreams(t *testing.T) {
+	assert := require.New(t)
+
+	// streams never lose payload, it is held for the retransmissions until
+	// the stream gives up
+	f, err := newFaultInjector(0, 0, 1, 0)
+	assert.Nil(err)
+	f.retransmitTimeout = time.Millisecond
+	start := time.Now()
+	assert.Equal(faultReset, f.payload(context.Background(), false))
+	assert.True(time.Since(start) >= (1<<faultMaxRetransmits-1)*time.Millisecond)
+
+	f, err = newFaultInjector(0, 0, 0.5, 0)
+	assert.Nil(err)
+	f.retransmitTimeout = time.Millisecond
+	f.random = rand.New(rand.NewSource(1))
+	relayed := 0
+	for i := 0; i < 20; i++ {
+		if action := f.payload(context.Background(), false); action == faultRelay {
+			relayed++
+		} else {
+			assert.Equal(faultReset, action)
+		}
+	}
+	assert.True(relayed > 0)
+}
+
+func TestFaultLatencyAndReset(t *testing.T) {
+	assert := require.New(t)
+
+	target, err := startEchoServer()
+	assert.Nil(err)
+
+	p := newProvider()
+	defer p.Close()
+	addr, err := p.StartListener(0)
+	assert.Nil(err)
+
+	client, err := NewProvider(Config{FaultLatency: 100 * time.Millisecond, FaultResetInterval: time.Second})
+	assert.Nil(err)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tun, err := client.Connect(ctx, ConnectorConfig{
+		ProviderAddress: fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port),
+		Target:          target.String(),
+	})
+	assert.Nil(err)
+	defer tun.Close()
+
+	consumer, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", tun.Port()))
+	assert.Nil(err)
+	defer consumer.Close()
+
+	// delayed on the way back, read by the client from the target
+	start := time.Now()
+	consumer.Write([]byte("hello"))
+	reply := make([]byte, 5)
+	consumer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(consumer, reply)
+	assert.Nil(err)
+	assert.True(time.Since(start) >= 100*time.Millisecond)
+
+	select {
+	case <-tun.Done():
+	case <-time.After(5 * time.Second):
+		assert.Fail("tunnel not reset")
+	}
+}
@@ -0,0 +1,128 @@
+package tunnel
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// forward is a target tunneled over a tunnel connection and the tunnel port
+// the listener opened for it, 0 while it is requested. A connector may
+// request several forwards over one signaling connection, each gets a tunnel
+// port of its own.
+type forward struct {
+	proxyAddress string
+	proxyPort    int
+	tunnelPort   int
+
+	// optional, name the listener registers the tunnel port under
+	service string
+
+	// class the data connections of the forward are scheduled in
+	priority priority
+}
+
+// parseForward returns the forward of target, [service=]host:port[/priority]
+// with port 443 if omitted
+func parseForward(target string) forward {
+	var service string
+	if i := strings.Index(target, "="); i >= 0 {
+		service, target = target[:i], target[i+1:]
+	}
+
+	class := priorityNormal
+	if i := strings.LastIndex(target, "/"); i >= 0 {
+		var ok bool
+		if class, ok = parsePriority(target[i+1:]); !ok {
+			logger.warn("Unknown priority, forward is scheduled as normal", "target", target)
+		}
+		target = target[:i]
+	}
+
+	addr := strings.Split(target, ":")
+	port := 443
+	if len(addr) > 1 {
+		port, _ = strconv.Atoi(addr[1])
+	}
+
+	return forward{proxyAddress: addr[0], proxyPort: port, service: service, priority: class}
+}
+
+func (f forward) target() string {
+	return net.JoinHostPort(f.proxyAddress, strconv.Itoa(f.proxyPort))
+}
+
+// ForwardInfo is a target of a tunnel connection and its tunnel port, 0
+// while the connector waits for the listener to open it
+type ForwardInfo struct {
+	Target     string `json:"target"`
+	TunnelPort int    `json:"tunnel_port,omitempty"`
+	Service    string `json:"service,omitempty"`
+	Priority   string `json:"priority"`
+}
+
+func (f forward) info() ForwardInfo {
+	return ForwardInfo{Target: f.target(), TunnelPort: f.tunnelPort, Service: f.service, Priority: f.priority.String()}
+}
+
+// addForward records a target of tc. The first one is also the target of tc
+// itself, as reported where a tunnel connection has a single target.
+func (tc *TunnelConnection) addForward(f forward) {
+	tc.forwardLock.Lock()
+	defer tc.forwardLock.Unlock()
+
+	if len(tc.forwards) == 0 {
+		tc.proxyAddress = f.proxyAddress
+		tc.proxyPort = f.proxyPort
+		tc.tunnelPort = f.tunnelPort
+	}
+
+	tc.forwards = append(tc.forwards, f)
+}
+
+// openForward sets the tunnel port of the forward of the target and returns
+// it, false when tc does not forward it
+func (tc *TunnelConnection) openForward(proxyAddress string, proxyPort int, tunnelPort int) (forward, bool) {
+	tc.forwardLock.Lock()
+	defer tc.forwardLock.Unlock()
+
+	for i := range tc.forwards {
+		f := &tc.forwards[i]
+		if f.proxyAddress == proxyAddress && f.proxyPort == proxyPort {
+			f.tunnelPort = tunnelPort
+			if i == 0 {
+				tc.tunnelPort = tunnelPort
+			}
+			return *f, true
+		}
+	}
+
+	return forward{}, false
+}
+
+// isForwarded reports whether the target is a forward of tc
+func (tc *TunnelConnection) isForwarded(proxyAddress string, proxyPort int) bool {
+	_, ok := tc.forwardOf(proxyAddress, proxyPort)
+	return ok
+}
+
+// forwardOf returns the forward of tc for the target, false if there is none
+func (tc *TunnelConnection) forwardOf(proxyAddress string, proxyPort int) (forward, bool) {
+	tc.forwardLock.Lock()
+	defer tc.forwardLock.Unlock()
+
+	for _, f := range tc.forwards {
+		if f.proxyAddress == proxyAddress && f.proxyPort == proxyPort {
+			return f, true
+		}
+	}
+
+	return forward{}, false
+}
+
+func (tc *TunnelConnection) forwardList() []forward {
+	tc.forwardLock.Lock()
+	defer tc.forwardLock.Unlock()
+
+	return append([]forward(nil), tc.forwards...)
+}
@@ -0,0 +1,317 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// gRPC status codes
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcUnauthenticated   = 16
+)
+
+// request messages are tiny, larger ones are refused
+const maxGRPCRequestLength = 64 * 1024
+
+// grpcServer serves the Admin service of admin.proto. gRPC is plain HTTP/2
+// with length prefixed protobuf messages and the status in trailers; the
+// single streaming call does not justify the gRPC and protobuf runtimes.
+type grpcServer struct {
+	provider *Provider
+	token    string
+}
+
+// StartGRPCServer serves the admin gRPC service on address, over TLS when
+// the provider signaling is and cleartext HTTP/2 otherwise, and returns the
+// bound address
+func (p *Provider) StartGRPCServer(address string, token string) (net.Addr, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	var handler http.Handler = &grpcServer{provider: p, token: token}
+	if p.tlsConfig != nil {
+		tlsConfig := p.tlsConfig.Clone()
+
+		// gRPC clients authenticate with the token, not a certificate
+		tlsConfig.ClientAuth = tls.NoClientCert
+		tlsConfig.NextProtos = []string{"h2"}
+		l = tls.NewListener(l, tlsConfig)
+	} else {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+
+	server := &http.Server{Handler: handler}
+	go func() {
+		if err := server.Serve(l); err != nil && p.ctx.Err() == nil {
+			logger.error("Admin gRPC error", "error", err)
+		}
+	}()
+
+	go func() {
+		<-p.ctx.Done()
+		server.Close()
+	}()
+
+	logger.info("Admin gRPC listening", "address", l.Addr())
+	return l.Addr(), nil
+}
+
+func (s *grpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+
+	if !bearerTokenValid(r, s.token) {
+		grpcStatus(w, grpcUnauthenticated, "missing or invalid API token")
+		return
+	}
+
+	switch r.URL.Path {
+	case "/tunnel.admin.v1.Admin/Events":
+		s.events(w, r)
+	default:
+		grpcStatus(w, grpcUnimplemented, "unknown method "+r.URL.Path)
+	}
+}
+
+func (s *grpcServer) events(w http.ResponseWriter, r *http.Request) {
+	message, err := readGRPCMessage(r.Body)
+	if err != nil {
+		grpcStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+
+	types, err := decodeEventsRequest(message)
+	if err != nil {
+		grpcStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+
+	events := s.provider.events.subscribe()
+	defer s.provider.events.unsubscribe(events)
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				grpcStatus(w, grpcResourceExhausted, "event stream fell behind")
+				return
+			}
+
+			if len(types) > 0 && !types[e.kind] {
+				continue
+			}
+
+			if _, err := w.Write(grpcFrame(encodeEvent(e))); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+
+		case <-r.Context().Done():
+			return
+
+		case <-s.provider.ctx.Done():
+			grpcStatus(w, grpcOK, "")
+			return
+		}
+	}
+}
+
+// grpcStatus ends the call, as a trailers-only response unless the headers
+// have been written
+func grpcStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Grpc-Status", fmt.Sprint(code))
+	if len(message) > 0 {
+		w.Header().Set("Grpc-Message", message)
+	}
+}
+
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, fmt.Errorf("reading request: %w", err)
+	}
+
+	if prefix[0] != 0 {
+		return nil, errors.New("compressed requests are not supported")
+	}
+
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if length > maxGRPCRequestLength {
+		return nil, fmt.Errorf("request of %d bytes exceeds the limit", length)
+	}
+
+	message := make([]byte, length)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, fmt.Errorf("reading request: %w", err)
+	}
+
+	// unary request, drain the half-closed stream
+	io.Copy(ioutil.Discard, r)
+	return message, nil
+}
+
+func grpcFrame(message []byte) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// protobuf wire format of the admin.proto messages
+
+const (
+	protoVarint = 0
+	protoBytes  = 2
+)
+
+// decodeEventsRequest returns the requested event types, packed or not
+func decodeEventsRequest(b []byte) (map[int]bool, error) {
+	types := make(map[int]bool)
+
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("malformed EventsRequest")
+		}
+		b = b[n:]
+
+		field, wireType := key>>3, key&7
+		switch {
+		case field == 1 && wireType == protoVarint:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return nil, errors.New("malformed EventsRequest")
+			}
+			types[int(v)] = true
+			b = b[n:]
+
+		case field == 1 && wireType == protoBytes:
+			packed, rest, err := protoLengthDelimited(b)
+			if err != nil {
+				return nil, err
+			}
+			for len(packed) > 0 {
+				v, n := binary.Uvarint(packed)
+				if n <= 0 {
+					return nil, errors.New("malformed EventsRequest")
+				}
+				types[int(v)] = true
+				packed = packed[n:]
+			}
+			b = rest
+
+		default:
+			rest, err := protoSkip(b, wireType)
+			if err != nil {
+				return nil, err
+			}
+			b = rest
+		}
+	}
+
+	return types, nil
+}
+
+func protoLengthDelimited(b []byte) ([]byte, []byte, error) {
+	length, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < length {
+		return nil, nil, errors.New("malformed protobuf message")
+	}
+
+	return b[n : n+int(length)], b[n+int(length):], nil
+}
+
+// protoSkip skips the value of an unknown field
+func protoSkip(b []byte, wireType uint64) ([]byte, error) {
+	switch wireType {
+	case protoVarint:
+		if _, n := binary.Uvarint(b); n > 0 {
+			return b[n:], nil
+		}
+	case 1:
+		if len(b) >= 8 {
+			return b[8:], nil
+		}
+	case protoBytes:
+		_, rest, err := protoLengthDelimited(b)
+		return rest, err
+	case 5:
+		if len(b) >= 4 {
+			return b[4:], nil
+		}
+	}
+
+	return nil, errors.New("malformed protobuf message")
+}
+
+func encodeEvent(e *tunnelEvent) []byte {
+	var b []byte
+	b = appendProtoVarint(b, 1, uint64(e.kind))
+	b = appendProtoVarint(b, 2, uint64(e.time.UnixNano()))
+	b = appendProtoVarint(b, 3, uint64(e.tunnel))
+	b = appendProtoVarint(b, 4, uint64(e.connection))
+	b = appendProtoString(b, 5, e.identity)
+	b = appendProtoString(b, 6, e.remote)
+	b = appendProtoString(b, 7, e.target)
+	b = appendProtoString(b, 8, e.client)
+	b = appendProtoVarint(b, 9, uint64(e.tunnelPort))
+	b = appendProtoVarint(b, 10, e.traffic.RxBytes)
+	b = appendProtoVarint(b, 11, e.traffic.TxBytes)
+	b = appendProtoString(b, 12, e.reason)
+	return b
+}
+
+// appendProtoVarint appends a varint field, omitted when zero as in proto3
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+
+	b = appendUvarint(b, uint64(field)<<3|protoVarint)
+	return appendUvarint(b, v)
+}
+
+func appendProtoString(b []byte, field int, s string) []byte {
+	if len(s) == 0 {
+		return b
+	}
+
+	b = appendUvarint(b, uint64(field)<<3|protoBytes)
+	b = appendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
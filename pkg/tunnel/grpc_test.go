@@ -0,0 +1,125 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+func TestGRPCEvents(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+	defer p.Close()
+	p.events = newEventHub()
+
+	addr, err := p.StartGRPCServer("127.0.0.1:0", "secret")
+	assert.Nil(err)
+
+	// cleartext HTTP/2
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network string, addr string, config *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+
+	call := func(token string, request []byte) *http.Response {
+		req, err := http.NewRequest("POST", "http://"+addr.String()+"/tunnel.admin.v1.Admin/Events",
+			bytes.NewReader(grpcFrame(request)))
+		assert.Nil(err)
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := client.Do(req)
+		assert.Nil(err)
+		return resp
+	}
+
+	resp := call("wrong", nil)
+	resp.Body.Close()
+	assert.Equal("16", resp.Header.Get("Grpc-Status"))
+
+	// packed types = [TUNNEL_UP, TUNNEL_DOWN]
+	resp = call("secret", []byte{0x0a, 0x02, eventTunnelUp, eventTunnelDown})
+	defer resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	// the stream is subscribed once the headers are in
+	p.events.publish(&tunnelEvent{kind: eventConnectionOpen, tunnel: 1, connection: 2})
+	p.events.publish(&tunnelEvent{kind: eventTunnelUp, tunnel: 1, identity: "alice", tunnelPort: 20000})
+
+	var prefix [5]byte
+	_, err = io.ReadFull(resp.Body, prefix[:])
+	assert.Nil(err)
+	message := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	_, err = io.ReadFull(resp.Body, message)
+	assert.Nil(err)
+
+	fields := decodeTestMessage(t, message)
+	assert.Equal(uint64(eventTunnelUp), fields[1])
+	assert.Equal(uint64(1), fields[3])
+	assert.Equal("alice", fields[5])
+	assert.Equal(uint64(20000), fields[9])
+
+	// the stream ends cleanly with the provider
+	p.Close()
+	_, err = io.Copy(io.Discard, resp.Body)
+	assert.Nil(err)
+	assert.Equal("0", resp.Trailer.Get("Grpc-Status"))
+}
+
+func TestEventHubDropsSlowSubscribers(t *testing.T) {
+	assert := require.New(t)
+
+	h := newEventHub()
+	slow := h.subscribe()
+
+	for i := 0; i < eventQueueLength+1; i++ {
+		h.publish(&tunnelEvent{kind: eventConnectionOpen})
+	}
+
+	n := 0
+	for range slow {
+		n++
+	}
+	assert.Equal(eventQueueLength, n)
+
+	// unsubscribing after the drop is harmless
+	h.unsubscribe(slow)
+}
+
+// decodeTestMessage decodes varint and string fields of a protobuf message
+func decodeTestMessage(t *testing.T, b []byte) map[uint64]interface{} {
+	assert := require.New(t)
+
+	fields := make(map[uint64]interface{})
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		assert.True(n > 0)
+		b = b[n:]
+
+		switch key & 7 {
+		case protoVarint:
+			v, n := binary.Uvarint(b)
+			assert.True(n > 0)
+			fields[key>>3] = v
+			b = b[n:]
+		case protoBytes:
+			s, rest, err := protoLengthDelimited(b)
+			assert.Nil(err)
+			fields[key>>3] = string(s)
+			b = rest
+		default:
+			assert.Failf("unexpected wire type", "wire type %d", key&7)
+		}
+	}
+	return fields
+}
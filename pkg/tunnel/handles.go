@@ -0,0 +1,65 @@
+package tunnel
+
+import "sync/atomic"
+
+// peerDataConnection returns the data connection of tc a PDU of type
+// pduType references by handle, nil if the PDU is to be dropped. Handles
+// are never reused: an unknown handle is one closed already, as when the
+// peer raced the close, and only logged at debug level. A handle of another
+// tunnel connection is a peer bug or a probe, the PDU must not reach it.
+func (tc *TunnelConnection) peerDataConnection(handle Handle, pduType int) *DataConnection {
+	dc := tc.provider.getDataConnection(handle)
+	if dc == nil {
+		metrics.staleHandles.Add(1)
+		tc.log.debug("Drop PDU for a closed data connection", "type", pduNames[pduType], "handle", handle)
+		return nil
+	}
+
+	if dc.tunnelConnection != tc {
+		metrics.invalidHandles.Add(1)
+		tc.log.warn("Drop PDU for a data connection of another tunnel", "type", pduNames[pduType], "handle", handle)
+		return nil
+	}
+
+	return dc
+}
+
+// openedDataConnection returns the data connection payload is delivered to.
+// The peer sends payload only after the connect response, payload for a
+// data connection still waiting for it closes the data connection.
+func (tc *TunnelConnection) openedDataConnection(handle Handle) *DataConnection {
+	dc := tc.peerDataConnection(handle, PDU_TUNNEL_DATA_INDICATION)
+	if dc == nil || atomic.LoadUint32(&dc.opened) != 0 {
+		return dc
+	}
+
+	metrics.invalidHandles.Add(1)
+	dc.log.warn("Payload before the connect response, close data connection")
+	dc.close(false)
+	return nil
+}
+
+// payloadConnection returns the data connection payload read from tc is
+// delivered to. On a data channel it may overtake the connect response on
+// the signaling connection, and is delivered before the response opens it.
+// On a dedicated data channel it waits for the peer to switch to it.
+func (tc *TunnelConnection) payloadConnection(handle Handle) *DataConnection {
+	if tc.owner == nil {
+		return tc.openedDataConnection(handle)
+	}
+
+	dc := tc.owner.peerDataConnection(handle, PDU_TUNNEL_DATA_INDICATION)
+	if dc == nil || tc.promoted == nil {
+		return dc
+	}
+
+	if dc != tc.promoted {
+		metrics.invalidHandles.Add(1)
+		tc.log.warn("Drop PDU for another data connection on a dedicated data channel", "handle", handle)
+		return nil
+	}
+	if !dc.awaitSwitch() {
+		return nil
+	}
+	return dc
+}
@@ -0,0 +1,64 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerDataConnectionHandles(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	tc := p.newTunnelConnection(local)
+	go tc.writeLoop()
+
+	otherLocal, otherRemote := net.Pipe()
+	defer otherRemote.Close()
+	other := p.newTunnelConnection(otherLocal)
+	foreign := newKeepaliveDataConnection(p, other, 7)
+
+	// handles of other tunnels are never touched
+	tc.onTunnelDisconnectRequest(&TunnelDisconnectRequest{peerConnectionHandle: foreign.handle})
+	assert.NotNil(p.getDataConnection(foreign.handle))
+
+	// the peer end of a response nothing waits for is closed
+	tc.onTunnelConnectResponse(&TunnelConnectResponse{dataConnectionHandle: p.getNextHandle(), proxyConnectionHandle: 9})
+	assert.Equal(&TunnelDisconnectRequest{peerConnectionHandle: 9}, readTestPdu(t, remote))
+
+	opened := newKeepaliveDataConnection(p, tc, 5)
+	tc.onTunnelConnectResponse(&TunnelConnectResponse{dataConnectionHandle: opened.handle, proxyConnectionHandle: 6})
+	assert.Equal(&TunnelDisconnectRequest{peerConnectionHandle: 6}, readTestPdu(t, remote))
+	assert.Equal(Handle(5), opened.peerHandle)
+
+	// payload before the connect response breaks the protocol
+	dataLocal, dataRemote := net.Pipe()
+	defer dataRemote.Close()
+	pending := p.newDataConnection(tc, dataLocal)
+	tc.onTunnelDataIndication(&TunnelDataIndication{peerConnectionHandle: pending.handle, data: []byte("x")})
+	assert.Nil(p.getDataConnection(pending.handle))
+}
+
+func readTestPdu(t *testing.T, conn net.Conn) Serializable {
+	assert := require.New(t)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	head := make([]byte, 4)
+	_, err := io.ReadFull(conn, head)
+	assert.Nil(err)
+
+	body := make([]byte, binary.BigEndian.Uint32(head))
+	_, err = io.ReadFull(conn, body)
+	assert.Nil(err)
+	return serializePduFrom(bytes.NewBuffer(body))
+}
@@ -0,0 +1,79 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// healthStatus is the reply of the health probes
+type healthStatus struct {
+	Status          string `json:"status"`
+	Listeners       int    `json:"listeners"`
+	Tunnels         int    `json:"tunnels"`
+	DataConnections int    `json:"data_connections"`
+}
+
+// StartHealthServer serves the health probes on address without
+// authentication, so that load balancers and orchestrators can reach them.
+// Returns the bound address.
+func (p *Provider) StartHealthServer(address string) (net.Addr, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{Handler: p.newHealthMux()}
+	go func() {
+		if err := server.Serve(l); err != nil && p.ctx.Err() == nil {
+			logger.error("Health server error", "error", err)
+		}
+	}()
+
+	go func() {
+		<-p.ctx.Done()
+		server.Close()
+	}()
+
+	logger.info("Health server listening", "address", l.Addr())
+	return l.Addr(), nil
+}
+
+// newHealthMux routes the probes:
+//
+//	/healthz  the provider is running
+//	/readyz   the provider is running and accepts signaling connections
+//
+// Both reply 200 or 503 with the listener and connection counts.
+func (p *Provider) newHealthMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		p.replyHealth(w, r, p.ctx.Err() == nil)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		p.replyHealth(w, r, p.Ready())
+	})
+
+	return mux
+}
+
+func (p *Provider) replyHealth(w http.ResponseWriter, r *http.Request, healthy bool) {
+	status := healthStatus{
+		Status:          "ok",
+		Listeners:       int(atomic.LoadInt32(&p.acceptLoops)),
+		Tunnels:         p.tunnelConnections.len(),
+		DataConnections: p.dataConnections.len(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !healthy {
+		status.Status = "unavailable"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	if r.Method != http.MethodHead {
+		json.NewEncoder(w).Encode(status)
+	}
+}
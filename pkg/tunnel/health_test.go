@@ -0,0 +1,48 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthProbes(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+	defer p.Close()
+
+	mux := p.newHealthMux()
+	probe := func(path string) (int, healthStatus) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+		var status healthStatus
+		assert.Nil(json.NewDecoder(w.Body).Decode(&status))
+		return w.Code, status
+	}
+
+	code, _ := probe("/healthz")
+	assert.Equal(http.StatusOK, code)
+	code, status := probe("/readyz")
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal("unavailable", status.Status)
+
+	_, err := p.StartListener(0)
+	assert.Nil(err)
+
+	code, status = probe("/readyz")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("ok", status.Status)
+	assert.Equal(1, status.Listeners)
+	assert.Equal(0, status.Tunnels)
+
+	p.Close()
+	code, _ = probe("/healthz")
+	assert.Equal(http.StatusServiceUnavailable, code)
+	code, _ = probe("/readyz")
+	assert.Equal(http.StatusServiceUnavailable, code)
+}
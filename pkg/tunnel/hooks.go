@@ -0,0 +1,97 @@
+package tunnel
+
+import "time"
+
+// Hooks observe the connection lifecycle of a provider, on the listener side
+// and the connector side alike. They are called synchronously from the
+// connection goroutines, so they must not block; embed NopHooks to implement
+// only some of them.
+type Hooks interface {
+	OnTunnelUp(TunnelEvent)
+	OnTunnelDown(TunnelEvent)
+	OnDataConnOpen(ConnectionEvent)
+	OnDataConnClose(ConnectionEvent)
+}
+
+// TunnelEvent is a tunnel port opened or closed
+type TunnelEvent struct {
+	Time       time.Time
+	Handle     Handle
+	Identity   string
+	Remote     string
+	Target     string
+	TunnelPort int
+
+	// payload relayed by all data connections of the tunnel and how long it
+	// was up, set when it goes down
+	TrafficSnapshot
+	Duration time.Duration
+}
+
+// ConnectionEvent is a data connection opened or closed
+type ConnectionEvent struct {
+	Time     time.Time
+	Handle   Handle
+	Tunnel   Handle
+	Identity string
+	Client   string
+	Target   string
+
+	// payload relayed and how long the connection was open, set when it
+	// closes
+	TrafficSnapshot
+	Duration time.Duration
+}
+
+// NopHooks ignores every event
+type NopHooks struct{}
+
+func (NopHooks) OnTunnelUp(TunnelEvent)          {}
+func (NopHooks) OnTunnelDown(TunnelEvent)        {}
+func (NopHooks) OnDataConnOpen(ConnectionEvent)  {}
+func (NopHooks) OnDataConnClose(ConnectionEvent) {}
+
+// notify calls the hook of e, if any
+func (h *eventHub) notify(e *tunnelEvent) {
+	if h.hooks == nil {
+		return
+	}
+
+	switch e.kind {
+	case eventTunnelUp, eventTunnelDown:
+		event := TunnelEvent{
+			Time:            e.time,
+			Handle:          e.tunnel,
+			Identity:        e.identity,
+			Remote:          e.remote,
+			Target:          e.target,
+			TunnelPort:      e.tunnelPort,
+			TrafficSnapshot: e.traffic,
+			Duration:        e.duration,
+		}
+
+		if e.kind == eventTunnelUp {
+			h.hooks.OnTunnelUp(event)
+		} else {
+			h.hooks.OnTunnelDown(event)
+		}
+
+	case eventConnectionOpen, eventConnectionClose:
+		event := ConnectionEvent{
+			Time:            e.time,
+			Handle:          e.connection,
+			Tunnel:          e.tunnel,
+			Identity:        e.identity,
+			Client:          e.client,
+			Target:          e.target,
+			TrafficSnapshot: e.traffic,
+			Duration:        e.duration,
+		}
+
+		if e.kind == eventConnectionOpen {
+			h.hooks.OnDataConnOpen(event)
+		} else {
+			h.hooks.OnDataConnClose(event)
+		}
+	}
+}
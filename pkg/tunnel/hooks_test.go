@@ -0,0 +1,115 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordingHooks records the order of the events and the last of each kind
+type recordingHooks struct {
+	lock   sync.Mutex
+	events []string
+
+	tunnelUp   TunnelEvent
+	tunnelDown TunnelEvent
+	connClose  ConnectionEvent
+}
+
+func (h *recordingHooks) record(name string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.events = append(h.events, name)
+}
+
+func (h *recordingHooks) recorded() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]string(nil), h.events...)
+}
+
+func (h *recordingHooks) OnTunnelUp(e TunnelEvent) {
+	h.lock.Lock()
+	h.tunnelUp = e
+	h.lock.Unlock()
+	h.record("tunnel_up")
+}
+
+func (h *recordingHooks) OnTunnelDown(e TunnelEvent) {
+	h.lock.Lock()
+	h.tunnelDown = e
+	h.lock.Unlock()
+	h.record("tunnel_down")
+}
+
+func (h *recordingHooks) OnDataConnOpen(e ConnectionEvent) { h.record("conn_open") }
+
+func (h *recordingHooks) OnDataConnClose(e ConnectionEvent) {
+	h.lock.Lock()
+	h.connClose = e
+	h.lock.Unlock()
+	h.record("conn_close")
+}
+
+func TestHooks(t *testing.T) {
+	assert := require.New(t)
+
+	target, err := startEchoServer()
+	assert.Nil(err)
+
+	listenerHooks := &recordingHooks{}
+	p, err := NewProvider(Config{Hooks: listenerHooks})
+	assert.Nil(err)
+	defer p.Close()
+	addr, err := p.StartListener(0)
+	assert.Nil(err)
+
+	connectorHooks := &recordingHooks{}
+	client, err := NewProvider(Config{Hooks: connectorHooks})
+	assert.Nil(err)
+	defer client.Close()
+
+	tun, err := client.Connect(context.Background(), ConnectorConfig{
+		ProviderAddress: fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port),
+		Target:          target.String(),
+	})
+	assert.Nil(err)
+
+	consumer, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", tun.Port()))
+	assert.Nil(err)
+	_, err = consumer.Write([]byte("ping"))
+	assert.Nil(err)
+	_, err = io.ReadFull(consumer, make([]byte, 4))
+	assert.Nil(err)
+	consumer.Close()
+
+	expected := []string{"tunnel_up", "conn_open", "conn_close"}
+	for _, h := range []*recordingHooks{listenerHooks, connectorHooks} {
+		h := h
+		assert.Eventually(func() bool { return len(h.recorded()) == len(expected) }, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(expected, h.recorded())
+
+		h.lock.Lock()
+		assert.Equal(target.String(), h.connClose.Target)
+		assert.Equal(uint64(4), h.connClose.RxBytes)
+		assert.Equal(uint64(4), h.connClose.TxBytes)
+		h.lock.Unlock()
+	}
+
+	tun.Close()
+	for _, h := range []*recordingHooks{listenerHooks, connectorHooks} {
+		h := h
+		assert.Eventually(func() bool { return len(h.recorded()) == 4 }, 5*time.Second, 10*time.Millisecond)
+
+		h.lock.Lock()
+		assert.Equal(tun.Port(), h.tunnelDown.TunnelPort)
+		assert.Equal(uint64(4), h.tunnelDown.RxBytes)
+		h.lock.Unlock()
+	}
+}
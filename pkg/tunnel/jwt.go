@@ -0,0 +1,412 @@
+package tunnel
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jwtClockSkew = time.Minute
+
+	// unknown key ids trigger a JWKS refresh at most this often
+	jwksMinRefreshInterval = 30 * time.Second
+	jwksMaxAge             = time.Hour
+)
+
+// jwtValidator validates OIDC style JWTs against the issuer's JWKS
+type jwtValidator struct {
+	issuer        string
+	audience      string
+	jwksURL       string
+	identityClaim string
+
+	client *http.Client
+
+	lock        sync.Mutex
+	keys        map[string]crypto.PublicKey
+	lastRefresh time.Time
+
+	// held while fetching the JWKS, so that concurrent handshakes fetch it
+	// once
+	refreshLock sync.Mutex
+	refreshing  bool
+}
+
+// newJWTValidator creates a validator, jwksURL is discovered through the
+// issuer's /.well-known/openid-configuration when empty
+func newJWTValidator(issuer string, audience string, jwksURL string, identityClaim string) (*jwtValidator, error) {
+	v := &jwtValidator{
+		issuer:        issuer,
+		audience:      audience,
+		jwksURL:       jwksURL,
+		identityClaim: identityClaim,
+		client:        &http.Client{Timeout: 10 * time.Second},
+	}
+
+	if len(v.identityClaim) == 0 {
+		v.identityClaim = "sub"
+	}
+
+	if len(v.jwksURL) == 0 {
+		if len(issuer) == 0 {
+			return nil, errors.New("JWT validation needs an issuer or a JWKS URL")
+		}
+
+		var discovery struct {
+			JwksURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, err
+		}
+		v.jwksURL = discovery.JwksURI
+	}
+
+	if err := v.refreshKeys(); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (v *jwtValidator) getJSON(url string, out interface{}) error {
+	resp, err := v.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+func (v *jwtValidator) refreshKeys() error {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := v.getJSON(v.jwksURL, &set); err != nil {
+		return err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for i := range set.Keys {
+		if set.Keys[i].Use != "" && set.Keys[i].Use != "sig" {
+			continue
+		}
+
+		key, err := set.Keys[i].publicKey()
+		if err != nil {
+			logger.warn("Skip JWKS key", "kid", set.Keys[i].Kid, "error", err)
+			continue
+		}
+		keys[set.Keys[i].Kid] = key
+	}
+
+	v.lock.Lock()
+	v.keys = keys
+	v.lastRefresh = time.Now()
+	v.lock.Unlock()
+
+	return nil
+}
+
+// key returns the JWKS key kid. Stale keys are served while the JWKS is
+// refreshed in the background, only unknown key ids wait for a refresh.
+func (v *jwtValidator) key(kid string) (crypto.PublicKey, error) {
+	v.lock.Lock()
+	key, ok := v.keys[kid]
+	stale := time.Since(v.lastRefresh) > jwksMaxAge
+	v.lock.Unlock()
+
+	if ok {
+		if stale {
+			v.refreshInBackground()
+		}
+		return key, nil
+	}
+
+	v.refreshLock.Lock()
+	v.lock.Lock()
+	key, ok = v.keys[kid]
+	canRefresh := time.Since(v.lastRefresh) > jwksMinRefreshInterval
+	v.lock.Unlock()
+
+	var err error
+	if !ok && canRefresh {
+		if err = v.refreshKeys(); err == nil {
+			v.lock.Lock()
+			key, ok = v.keys[kid]
+			v.lock.Unlock()
+		}
+	}
+	v.refreshLock.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown JWT key id %q", kid)
+	}
+
+	return key, nil
+}
+
+func (v *jwtValidator) refreshInBackground() {
+	v.lock.Lock()
+	if v.refreshing {
+		v.lock.Unlock()
+		return
+	}
+	v.refreshing = true
+	v.lock.Unlock()
+
+	go func() {
+		v.refreshLock.Lock()
+		err := v.refreshKeys()
+		v.refreshLock.Unlock()
+
+		v.lock.Lock()
+		v.refreshing = false
+		v.lock.Unlock()
+
+		if err != nil {
+			logger.warn("JWKS refresh error, keep serving cached keys", "error", err)
+		}
+	}()
+}
+
+// validate verifies signature, issuer, audience and validity period of token
+// and returns the identity claim
+func (v *jwtValidator) validate(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return "", err
+	}
+
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return "", err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", err
+	}
+
+	if err := v.checkClaims(claims, time.Now()); err != nil {
+		return "", err
+	}
+
+	identity, ok := claims[v.identityClaim].(string)
+	if !ok || len(identity) == 0 {
+		return "", fmt.Errorf("JWT has no %s claim", v.identityClaim)
+	}
+
+	return identity, nil
+}
+
+func (v *jwtValidator) checkClaims(claims map[string]interface{}, now time.Time) error {
+	if len(v.issuer) > 0 && claims["iss"] != v.issuer {
+		return fmt.Errorf("JWT issuer %v is not trusted", claims["iss"])
+	}
+
+	if len(v.audience) > 0 {
+		found := false
+		switch aud := claims["aud"].(type) {
+		case string:
+			found = aud == v.audience
+		case []interface{}:
+			for _, a := range aud {
+				if a == v.audience {
+					found = true
+				}
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("JWT is not issued for audience %s", v.audience)
+		}
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("JWT has no expiry")
+	}
+	if now.Add(-jwtClockSkew).After(time.Unix(int64(exp), 0)) {
+		return errors.New("JWT has expired")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("JWT is not valid yet")
+	}
+
+	return nil
+}
+
+func decodeJWTPart(part string, out interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, out)
+}
+
+// curves of the ECDSA JWT algorithms
+var jwtCurves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported JWT algorithm %s", alg)
+	}
+
+	var h hash.Hash
+	var ch crypto.Hash
+	switch alg[2:] {
+	case "256":
+		h, ch = sha256.New(), crypto.SHA256
+	case "384":
+		h, ch = sha512.New384(), crypto.SHA384
+	case "512":
+		h, ch = sha512.New(), crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported JWT algorithm %s", alg)
+	}
+
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch {
+	case strings.HasPrefix(alg, "RS"):
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("JWT algorithm does not match key type")
+		}
+		return rsa.VerifyPKCS1v15(k, ch, digest, signature)
+
+	case strings.HasPrefix(alg, "PS"):
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("JWT algorithm does not match key type")
+		}
+		return rsa.VerifyPSS(k, ch, digest, signature, nil)
+
+	case strings.HasPrefix(alg, "ES"):
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok || k.Curve != jwtCurves[alg] {
+			return errors.New("JWT algorithm does not match key type")
+		}
+
+		// r || s, each as long as the curve order
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid JWT signature")
+		}
+
+		r := new(big.Int).SetBytes(signature[:len(signature)/2])
+		s := new(big.Int).SetBytes(signature[len(signature)/2:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid JWT signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported JWT algorithm %s", alg)
+}
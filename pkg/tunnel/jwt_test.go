@@ -0,0 +1,96 @@
+package tunnel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func signTestJWT(t *testing.T, key *ecdsa.PrivateKey, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": "k1"})
+	payload, _ := json.Marshal(claims)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	require.NoError(t, err)
+
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTValidator(t *testing.T) {
+	assert := require.New(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(err)
+
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "EC",
+			"kid": "k1",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+			"y":   base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+		}},
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwks)
+	}))
+	defer server.Close()
+
+	v, err := newJWTValidator("https://idp.example.com", "tunnel", server.URL, "")
+	assert.NoError(err)
+
+	claims := map[string]interface{}{
+		"iss": "https://idp.example.com",
+		"aud": []string{"tunnel"},
+		"sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+
+	identity, err := v.validate(signTestJWT(t, key, claims))
+	assert.NoError(err)
+	assert.Equal("alice", identity)
+
+	claims["aud"] = "other"
+	_, err = v.validate(signTestJWT(t, key, claims))
+	assert.Error(err)
+
+	claims["aud"] = "tunnel"
+	claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	_, err = v.validate(signTestJWT(t, key, claims))
+	assert.Error(err)
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(err)
+	claims["exp"] = time.Now().Add(time.Hour).Unix()
+	_, err = v.validate(signTestJWT(t, other, claims))
+	assert.Error(err)
+
+	// an ES384 header does not verify with a P-256 key
+	assert.Error(verifyJWTSignature("ES384", &key.PublicKey, "a.b", make([]byte, 96)))
+
+	// stale keys are served while the issuer is unreachable
+	server.Close()
+	v.lock.Lock()
+	v.lastRefresh = time.Now().Add(-2 * jwksMaxAge)
+	v.lock.Unlock()
+	identity, err = v.validate(signTestJWT(t, key, claims))
+	assert.NoError(err)
+	assert.Equal("alice", identity)
+}
@@ -0,0 +1,95 @@
+package tunnel
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// keepalive intervals without a single frame from the peer after which the
+// tunnel connection is considered dead
+const maxIdleKeepalives = 3
+
+// startKeepaliveTimer probes the tunnel every keepalive interval. Each probe
+// lists the data connections of the tunnel, the peer answers with those it no
+// longer knows so that both ends of a connection whose disconnect got lost
+// are reaped.
+func (tc *TunnelConnection) startKeepaliveTimer() {
+	interval := tc.provider.keepaliveInterval
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				tc.keepalive(interval)
+
+			case <-tc.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (tc *TunnelConnection) keepalive(interval time.Duration) {
+	// the peer answers every probe, silence means the connection is gone
+	// without the socket noticing
+	if atomic.AddInt32(&tc.idleKeepalives, 1) > maxIdleKeepalives {
+		tc.log.warn("Tunnel peer silent, close tunnel connection", "keepalives", maxIdleKeepalives)
+
+		tc.conn.Close()
+		return
+	}
+
+	pdu := &KeepaliveRequest{}
+	for _, dc := range tc.dataConnections() {
+		if atomic.LoadUint32(&dc.opened) == 0 {
+			// the peer never answered the TunnelConnectRequest
+			if time.Since(dc.created) > interval {
+				dc.log.warn("Reap unanswered data connection")
+				dc.close(false)
+			}
+			continue
+		}
+
+		pdu.peerConnectionHandles = append(pdu.peerConnectionHandles, dc.peerHandle)
+	}
+
+	tc.send(pdu)
+}
+
+func (tc *TunnelConnection) onKeepaliveRequest(pdu *KeepaliveRequest) {
+	response := &KeepaliveResponse{}
+
+	for _, handle := range pdu.peerConnectionHandles {
+		if dc := tc.provider.getDataConnection(handle); dc == nil || dc.tunnelConnection != tc {
+			response.unknownHandles = append(response.unknownHandles, handle)
+		}
+	}
+
+	tc.send(response)
+}
+
+// onKeepaliveResponse closes the data connections whose peer is gone.
+// Handles are never reused, a handle unknown to the peer stays unknown.
+func (tc *TunnelConnection) onKeepaliveResponse(pdu *KeepaliveResponse) {
+	if len(pdu.unknownHandles) == 0 {
+		return
+	}
+
+	unknown := make(map[Handle]bool, len(pdu.unknownHandles))
+	for _, handle := range pdu.unknownHandles {
+		unknown[handle] = true
+	}
+
+	for _, dc := range tc.dataConnections() {
+		if atomic.LoadUint32(&dc.opened) != 0 && unknown[dc.peerHandle] {
+			dc.log.warn("Reap half-open data connection", "peer_handle", dc.peerHandle)
+			dc.close(false)
+		}
+	}
+}
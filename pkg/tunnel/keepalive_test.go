@@ -0,0 +1,95 @@
+package tunnel
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newKeepaliveDataConnection(p *Provider, tc *TunnelConnection, peerHandle Handle) *DataConnection {
+	local, remote := net.Pipe()
+	go io.Copy(ioutil.Discard, remote)
+
+	dc := p.newDataConnection(tc, local)
+	dc.peerHandle = peerHandle
+	atomic.StoreUint32(&dc.opened, 1)
+
+	return dc
+}
+
+func TestKeepaliveReapsHalfOpenDataConnections(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+
+	local, remote := net.Pipe()
+	connector := p.newTunnelConnection(local)
+	listener := p.newTunnelConnection(remote)
+	connector.open()
+	listener.open()
+	defer local.Close()
+	defer remote.Close()
+
+	peer := newKeepaliveDataConnection(p, listener, 0)
+	alive := newKeepaliveDataConnection(p, connector, peer.handle)
+	peer.peerHandle = alive.handle
+
+	// the peer of orphan is gone without its disconnect arriving
+	orphan := newKeepaliveDataConnection(p, connector, p.getNextHandle())
+
+	connector.keepalive(time.Minute)
+
+	assert.Eventually(func() bool {
+		return p.getDataConnection(orphan.handle) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NotNil(p.getDataConnection(alive.handle))
+	assert.NotNil(p.getDataConnection(peer.handle))
+}
+
+func TestKeepaliveReapsUnansweredDataConnections(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go io.Copy(ioutil.Discard, remote)
+	tc := p.newTunnelConnection(local)
+
+	dataLocal, dataRemote := net.Pipe()
+	defer dataRemote.Close()
+	pending := p.newDataConnection(tc, dataLocal)
+
+	tc.keepalive(time.Minute)
+	assert.NotNil(p.getDataConnection(pending.handle))
+
+	pending.created = time.Now().Add(-2 * time.Minute)
+	tc.keepalive(time.Minute)
+	assert.Nil(p.getDataConnection(pending.handle))
+}
+
+func TestKeepaliveClosesSilentTunnel(t *testing.T) {
+	assert := require.New(t)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go io.Copy(ioutil.Discard, remote)
+
+	tc := newProvider().newTunnelConnection(local)
+	go tc.writeLoop()
+
+	for i := 0; i < maxIdleKeepalives; i++ {
+		tc.keepalive(time.Minute)
+	}
+	_, err := local.Write(nil)
+	assert.Nil(err)
+
+	tc.keepalive(time.Minute)
+	_, err = local.Write(nil)
+	assert.NotNil(err)
+}
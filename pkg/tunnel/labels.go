@@ -0,0 +1,129 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// limits of the labels a client reports in its handshake
+const (
+	maxLabels           = 16
+	maxLabelKeyLength   = 63
+	maxLabelValueLength = 255
+)
+
+// ValidateLabels checks the labels a connector reports to the provider: at
+// most 16, keys of letters, digits, '.', '_', '-' and '/' up to 63 bytes,
+// printable values up to 255 bytes
+func ValidateLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("too many labels, at most %d", maxLabels)
+	}
+
+	for key, value := range labels {
+		if len(key) == 0 || len(key) > maxLabelKeyLength {
+			return fmt.Errorf("invalid label key %q", key)
+		}
+		for _, c := range key {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			case c == '.', c == '_', c == '-', c == '/':
+			default:
+				return fmt.Errorf("invalid label key %q", key)
+			}
+		}
+
+		if len(value) > maxLabelValueLength {
+			return fmt.Errorf("label %s: value longer than %d bytes", key, maxLabelValueLength)
+		}
+		for _, c := range value {
+			if c < ' ' || c == 0x7f {
+				return fmt.Errorf("label %s: value has control characters", key)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ParseLabel parses key=value
+func ParseLabel(s string) (string, string, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid label %q, expected key=value", s)
+	}
+
+	key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	if err := ValidateLabels(map[string]string{key: value}); err != nil {
+		return "", "", err
+	}
+	return key, value, nil
+}
+
+// FormatLabels formats labels as key=value pairs ordered by key, separated by
+// commas
+func FormatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "=" + labels[key]
+	}
+	return strings.Join(pairs, ",")
+}
+
+// matchLabels reports whether labels carry every key=value of selector
+func matchLabels(labels map[string]string, selector map[string]string) bool {
+	for key, value := range selector {
+		if v, ok := labels[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+func getLabelsSerialLength(labels map[string]string) uint32 {
+	n := uint32(4)
+	for key, value := range labels {
+		n += getStringSerialLength(key) + getStringSerialLength(value)
+	}
+	return n
+}
+
+// serializeLabelsTo writes the count and the key, value pairs ordered by key
+func serializeLabelsTo(labels map[string]string, w *bytes.Buffer) {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	serializeUInt32To(uint32(len(keys)), w)
+	for _, key := range keys {
+		serializeStringTo(key, w)
+		serializeStringTo(labels[key], w)
+	}
+}
+
+// serializeLabelsFrom reads labels, none when the PDU of an older peer ends
+// before them. Counts beyond the limit are cut short, the pairs are
+// validated by the receiver.
+func serializeLabelsFrom(r *bytes.Buffer) map[string]string {
+	n := serializeUInt32From(r)
+	if n == 0 {
+		return nil
+	}
+
+	labels := make(map[string]string)
+	for i := uint32(0); i < n && i <= maxLabels && r.Len() > 0; i++ {
+		key := serializeStringFrom(r)
+		labels[key] = serializeStringFrom(r)
+	}
+	return labels
+}
@@ -0,0 +1,99 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateLabels(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Nil(ValidateLabels(map[string]string{"hostname": "edge-17", "app.kubernetes.io/name": "web", "empty": ""}))
+
+	for _, labels := range []map[string]string{
+		{"": "x"},
+		{"host name": "x"},
+		{strings.Repeat("k", maxLabelKeyLength+1): "x"},
+		{"env": strings.Repeat("v", maxLabelValueLength+1)},
+		{"env": "prod\n"},
+	} {
+		assert.NotNil(ValidateLabels(labels), fmt.Sprint(labels))
+	}
+
+	many := make(map[string]string)
+	for i := 0; i <= maxLabels; i++ {
+		many[fmt.Sprintf("k%d", i)] = "v"
+	}
+	assert.NotNil(ValidateLabels(many))
+
+	key, value, err := ParseLabel(" env = prod ")
+	assert.Nil(err)
+	assert.Equal("env", key)
+	assert.Equal("prod", value)
+	_, _, err = ParseLabel("env")
+	assert.NotNil(err)
+
+	assert.Equal("env=prod,hostname=edge-17", FormatLabels(map[string]string{"hostname": "edge-17", "env": "prod"}))
+}
+
+func TestHelloRequestLabels(t *testing.T) {
+	assert := require.New(t)
+
+	pdu := &HelloRequest{capabilities: CAPABILITY_COMPRESSION, sessionID: []byte("s"), labels: map[string]string{"env": "prod"}}
+
+	var b bytes.Buffer
+	pdu.SerializeTo(&b)
+	assert.Equal(int(pdu.GetSerialLength()), b.Len())
+
+	var decoded HelloRequest
+	decoded.SerializeFrom(&b)
+	assert.Equal(pdu.labels, decoded.labels)
+
+	// older connectors end the hello before the labels
+	b.Reset()
+	serializeUInt32To(0, &b)
+	serializeBytesTo(nil, &b)
+	serializeBytesTo([]byte("s"), &b)
+
+	decoded = HelloRequest{}
+	decoded.SerializeFrom(&b)
+	assert.Equal([]byte("s"), decoded.sessionID)
+	assert.Nil(decoded.labels)
+}
+
+func TestClientLabels(t *testing.T) {
+	assert := require.New(t)
+
+	target, err := startEchoServer()
+	assert.Nil(err)
+
+	p := newProvider()
+	defer p.Close()
+	addr, err := p.StartListener(0)
+	assert.Nil(err)
+
+	client := newProvider()
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tun, err := client.Connect(ctx, ConnectorConfig{
+		ProviderAddress: fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port),
+		Target:          target.String(),
+		Labels:          map[string]string{"hostname": "edge-17", "env": "prod"},
+	})
+	assert.Nil(err)
+	defer tun.Close()
+
+	tunnels, _ := p.connectionSnapshot()
+	assert.Len(tunnels, 1)
+	assert.Equal(map[string]string{"hostname": "edge-17", "env": "prod"}, tunnels[0].Labels)
+}
@@ -0,0 +1,130 @@
+package tunnel
+
+import "sync"
+
+type clientUsage struct {
+	tunnels         int
+	dataConnections int
+}
+
+// connectionLimits caps the tunnel listeners and simultaneous data
+// connections each client identity may hold, 0 means unlimited
+type connectionLimits struct {
+	lock sync.Mutex
+
+	// caps of identities without a tenant entry
+	maxTunnels         int
+	maxDataConnections int
+
+	// optional, map identity -> tenant, identity "*" applies to clients
+	// without an entry
+	tenants map[string]tenantSpec
+
+	// map identity -> *clientUsage
+	usage map[string]*clientUsage
+}
+
+func newConnectionLimits(maxTunnels int, maxDataConnections int) *connectionLimits {
+	return &connectionLimits{
+		maxTunnels:         maxTunnels,
+		maxDataConnections: maxDataConnections,
+		usage:              make(map[string]*clientUsage),
+	}
+}
+
+// limitsOf returns the caps of identity
+func (l *connectionLimits) limitsOf(identity string) (int, int) {
+	if l == nil {
+		return 0, 0
+	}
+
+	spec, ok := l.tenants[identity]
+	if !ok {
+		if spec, ok = l.tenants[anonymousIdentity]; !ok {
+			return l.maxTunnels, l.maxDataConnections
+		}
+	}
+	return spec.maxTunnels, spec.maxDataConnections
+}
+
+func (l *connectionLimits) usageOfUnLocked(identity string) *clientUsage {
+	u, ok := l.usage[identity]
+	if !ok {
+		u = &clientUsage{}
+		l.usage[identity] = u
+	}
+
+	return u
+}
+
+func (l *connectionLimits) releaseUnLocked(identity string, u *clientUsage) {
+	if u.tunnels == 0 && u.dataConnections == 0 {
+		delete(l.usage, identity)
+	}
+}
+
+func (l *connectionLimits) acquireTunnel(identity string) bool {
+	if l == nil {
+		return true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	maxTunnels, _ := l.limitsOf(identity)
+	u := l.usageOfUnLocked(identity)
+	if maxTunnels > 0 && u.tunnels >= maxTunnels {
+		l.releaseUnLocked(identity, u)
+		return false
+	}
+
+	u.tunnels++
+	return true
+}
+
+func (l *connectionLimits) releaseTunnel(identity string) {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if u, ok := l.usage[identity]; ok && u.tunnels > 0 {
+		u.tunnels--
+		l.releaseUnLocked(identity, u)
+	}
+}
+
+func (l *connectionLimits) acquireDataConnection(identity string) bool {
+	if l == nil {
+		return true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	_, maxDataConnections := l.limitsOf(identity)
+	u := l.usageOfUnLocked(identity)
+	if maxDataConnections > 0 && u.dataConnections >= maxDataConnections {
+		l.releaseUnLocked(identity, u)
+		return false
+	}
+
+	u.dataConnections++
+	return true
+}
+
+func (l *connectionLimits) releaseDataConnection(identity string) {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if u, ok := l.usage[identity]; ok && u.dataConnections > 0 {
+		u.dataConnections--
+		l.releaseUnLocked(identity, u)
+	}
+}
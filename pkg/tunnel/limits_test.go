@@ -0,0 +1,30 @@
+package tunnel
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectionLimits(t *testing.T) {
+	assert := require.New(t)
+
+	l := newConnectionLimits(1, 2)
+
+	assert.True(l.acquireTunnel("alice"))
+	assert.False(l.acquireTunnel("alice"))
+	assert.True(l.acquireTunnel("bob"))
+
+	assert.True(l.acquireDataConnection("alice"))
+	assert.True(l.acquireDataConnection("alice"))
+	assert.False(l.acquireDataConnection("alice"))
+
+	l.releaseDataConnection("alice")
+	assert.True(l.acquireDataConnection("alice"))
+
+	l.releaseTunnel("alice")
+	assert.True(l.acquireTunnel("alice"))
+
+	var none *connectionLimits
+	assert.True(none.acquireDataConnection("alice"))
+}
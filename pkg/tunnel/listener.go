@@ -0,0 +1,149 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// listenBacklog is the number of tunneled connections queued for Accept,
+// more are refused
+const listenBacklog = 128
+
+// Listen requests a tunnel port from the provider and returns a listener
+// whose Accept yields the connections tunneled from it. The provider
+// allocates tunnel ports, so address must leave the port 0, e.g. ":0".
+// The listener fails once the signaling connection is lost, it does not
+// reconnect.
+func (c *Client) Listen(ctx context.Context, network string, address string) (net.Listener, error) {
+	if network != "tcp" && network != "tcp4" {
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if len(port) > 0 && port != "0" {
+		return nil, fmt.Errorf("cannot listen on %s, the provider allocates tunnel ports", address)
+	}
+
+	l := &tunnelListener{
+		accepted: make(chan net.Conn, listenBacklog),
+		closed:   make(chan struct{}),
+	}
+
+	o := c.config.options(c.provider)
+	if len(c.config.Target) == 0 {
+		o.forwards = []forward{{}}
+	}
+	o.listener = l
+
+	tc, err := c.provider.requestTunnel(o, "")
+	if err != nil {
+		return nil, err
+	}
+	l.tc = tc
+
+	select {
+	case <-tc.opened:
+	case <-tc.ctx.Done():
+		return nil, errTunnelClosed
+	case <-ctx.Done():
+		tc.conn.Close()
+		return nil, ctx.Err()
+	}
+
+	host, _, err := net.SplitHostPort(c.config.ProviderAddress)
+	if err != nil {
+		host = c.config.ProviderAddress
+	}
+	l.addr = tunnelAddr(net.JoinHostPort(host, strconv.Itoa(tc.tunnelPort)))
+
+	return l, nil
+}
+
+// tunnelListener is the net.Listener of Client.Listen
+type tunnelListener struct {
+	tc   *TunnelConnection
+	addr net.Addr
+
+	accepted chan net.Conn
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// deliver queues a tunneled connection from client for Accept and returns
+// the end relayed by its data connection
+func (l *tunnelListener) deliver(client string) (net.Conn, error) {
+	local, remote := net.Pipe()
+	conn := &tunneledConn{Conn: remote, local: l.addr, remote: tunnelAddr(client)}
+
+	select {
+	case <-l.closed:
+	case l.accepted <- conn:
+		return local, nil
+	default:
+		local.Close()
+		remote.Close()
+		return nil, errors.New("accept backlog is full")
+	}
+
+	local.Close()
+	remote.Close()
+	return nil, net.ErrClosed
+}
+
+func (l *tunnelListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-l.tc.ctx.Done():
+		// closing the listener tears the tunnel down as well
+		select {
+		case <-l.closed:
+			return nil, net.ErrClosed
+		default:
+			return nil, errTunnelClosed
+		}
+	}
+}
+
+// Close gives the tunnel port back, tunneled connections already accepted
+// are closed with it
+func (l *tunnelListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		// the reader tears the tunnel down
+		l.tc.conn.Close()
+	})
+	return nil
+}
+
+// Addr is the tunnel port at the provider
+func (l *tunnelListener) Addr() net.Addr {
+	return l.addr
+}
+
+// tunnelAddr is a host:port address at the far end of a tunnel
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "tcp" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+// tunneledConn is a connection accepted from a tunnelListener, addressed by
+// the tunnel port and the client that connected to it
+type tunneledConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *tunneledConn) LocalAddr() net.Addr  { return c.local }
+func (c *tunneledConn) RemoteAddr() net.Addr { return c.remote }
@@ -0,0 +1,71 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientListen(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+	defer p.Close()
+	addr, err := p.StartListener(0)
+	assert.Nil(err)
+
+	client := newProvider()
+	defer client.Close()
+	c := client.NewClient(ConnectorConfig{ProviderAddress: fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port)})
+
+	_, err = c.Listen(context.Background(), "udp", ":0")
+	assert.NotNil(err)
+	_, err = c.Listen(context.Background(), "tcp", ":8080")
+	assert.NotNil(err)
+
+	l, err := c.Listen(context.Background(), "tcp", ":0")
+	assert.Nil(err)
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	assert.Nil(err)
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	consumer, err := net.Dial("tcp4", "127.0.0.1:"+port)
+	assert.Nil(err)
+	defer consumer.Close()
+
+	_, err = consumer.Write([]byte("ping"))
+	assert.Nil(err)
+	reply := make([]byte, 4)
+	consumer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(consumer, reply)
+	assert.Nil(err)
+	assert.Equal("ping", string(reply))
+
+	// closing the listener gives the tunnel port back
+	assert.Nil(l.Close())
+	_, err = l.Accept()
+	assert.Equal(net.ErrClosed, err)
+
+	_, err = io.ReadFull(consumer, reply)
+	assert.NotNil(err)
+	assert.Eventually(func() bool {
+		l, err := net.Listen("tcp4", "127.0.0.1:"+port)
+		if err == nil {
+			l.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+}
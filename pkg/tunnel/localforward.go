@@ -0,0 +1,106 @@
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// localForward is the listener of StartLocalForward and the connections
+// relayed from it
+type localForward struct {
+	listener net.Listener
+
+	lock   sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// StartLocalForward relays connections accepted on listenAddress to
+// targetAddress directly from this host, without a tunnel provider. Closing
+// the returned closer stops the listener and the relayed connections
+func StartLocalForward(listenAddress string, targetAddress string) (io.Closer, error) {
+	l, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.info("Local forward", "listen", l.Addr(), "target", targetAddress)
+
+	f := &localForward{listener: l, conns: make(map[net.Conn]struct{})}
+
+	supervise("local forward accept loop", func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					logger.error("Local forward accept error", "error", err)
+				}
+				break
+			}
+
+			go func() {
+				defer recoverPanic("local forward relay", func() { conn.Close() })
+
+				target, err := net.Dial("tcp", targetAddress)
+				if err != nil {
+					logger.error("Local forward dial error", "client", conn.RemoteAddr(), "error", err)
+					conn.Close()
+					return
+				}
+
+				if !f.track(conn, target) {
+					conn.Close()
+					target.Close()
+					return
+				}
+				defer f.untrack(conn, target)
+
+				sent, received := relay(conn, target)
+				logger.debug("Close local forward", "client", conn.RemoteAddr(), "sent", sent, "received", received)
+			}()
+		}
+
+		l.Close()
+	})
+
+	return f, nil
+}
+
+// track registers conns for Close, false once the forward is closed
+func (f *localForward) track(conns ...net.Conn) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.closed {
+		return false
+	}
+	for _, conn := range conns {
+		f.conns[conn] = struct{}{}
+	}
+	return true
+}
+
+func (f *localForward) untrack(conns ...net.Conn) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, conn := range conns {
+		delete(f.conns, conn)
+	}
+}
+
+// Close stops accepting and closes the connections being relayed
+func (f *localForward) Close() error {
+	f.lock.Lock()
+	f.closed = true
+	conns := f.conns
+	f.conns = make(map[net.Conn]struct{})
+	f.lock.Unlock()
+
+	for conn := range conns {
+		conn.Close()
+	}
+	return f.listener.Close()
+}
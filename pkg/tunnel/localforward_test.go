@@ -0,0 +1,52 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalForwardClose(t *testing.T) {
+	assert := require.New(t)
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer target.Close()
+
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	closer, err := StartLocalForward("127.0.0.1:0", target.Addr().String())
+	assert.Nil(err)
+	address := closer.(*localForward).listener.Addr().String()
+
+	conn, err := net.Dial("tcp", address)
+	assert.Nil(err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("ping"))
+	assert.Nil(err)
+	echoed := make([]byte, 4)
+	_, err = io.ReadFull(conn, echoed)
+	assert.Nil(err)
+	assert.Equal("ping", string(echoed))
+
+	// the relayed connection and the listener close with the forward
+	assert.Nil(closer.Close())
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(echoed)
+	assert.Equal(io.EOF, err)
+
+	_, err = net.Dial("tcp", address)
+	assert.NotNil(err)
+}
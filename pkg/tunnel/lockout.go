@@ -0,0 +1,110 @@
+package tunnel
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	authFailureBaseDelay = 100 * time.Millisecond
+	authFailureMaxDelay  = 10 * time.Second
+)
+
+type lockoutEntry struct {
+	failures    int
+	lastFailure time.Time
+	bannedUntil time.Time
+}
+
+// authLockout tracks failed authentication attempts per source IP. Every
+// failure is answered after an exponentially growing delay, maxFailures in a
+// row ban the source for banDuration.
+type authLockout struct {
+	lock sync.Mutex
+
+	// map source IP -> *lockoutEntry
+	entries map[string]*lockoutEntry
+
+	maxFailures int
+	banDuration time.Duration
+}
+
+func newAuthLockout(maxFailures int, banDuration time.Duration) *authLockout {
+	return &authLockout{
+		entries:     make(map[string]*lockoutEntry),
+		maxFailures: maxFailures,
+		banDuration: banDuration,
+	}
+}
+
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
+
+// bannedUntil returns the end of the ban of ip, zero if it is not banned
+func (l *authLockout) bannedUntil(ip string) time.Time {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if e, ok := l.entries[ip]; ok && time.Now().Before(e.bannedUntil) {
+		return e.bannedUntil
+	}
+
+	return time.Time{}
+}
+
+// onFailure records a failed attempt from ip and returns the delay to apply
+// before answering, the number of consecutive failures and whether ip is now
+// banned
+func (l *authLockout) onFailure(ip string) (time.Duration, int, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	l.expireUnLocked(now)
+
+	e, ok := l.entries[ip]
+	if !ok {
+		e = &lockoutEntry{}
+		l.entries[ip] = e
+	}
+
+	e.failures++
+	e.lastFailure = now
+
+	delay := authFailureBaseDelay << uint(e.failures-1)
+	if delay > authFailureMaxDelay || delay <= 0 {
+		delay = authFailureMaxDelay
+	}
+
+	failures := e.failures
+	if l.maxFailures > 0 && e.failures >= l.maxFailures {
+		e.bannedUntil = now.Add(l.banDuration)
+		e.failures = 0
+		return delay, failures, true
+	}
+
+	return delay, failures, false
+}
+
+func (l *authLockout) onSuccess(ip string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	delete(l.entries, ip)
+}
+
+// expireUnLocked forgets sources that are neither banned nor failed recently
+func (l *authLockout) expireUnLocked(now time.Time) {
+	for ip, e := range l.entries {
+		if now.After(e.bannedUntil) && now.Sub(e.lastFailure) > l.banDuration {
+			delete(l.entries, ip)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthLockout(t *testing.T) {
+	assert := require.New(t)
+
+	l := newAuthLockout(3, time.Minute)
+
+	delay, failures, banned := l.onFailure("10.0.0.1")
+	assert.Equal(authFailureBaseDelay, delay)
+	assert.Equal(1, failures)
+	assert.False(banned)
+
+	delay, _, banned = l.onFailure("10.0.0.1")
+	assert.Equal(2*authFailureBaseDelay, delay)
+	assert.False(banned)
+	assert.True(l.bannedUntil("10.0.0.1").IsZero())
+
+	_, failures, banned = l.onFailure("10.0.0.1")
+	assert.Equal(3, failures)
+	assert.True(banned)
+	assert.False(l.bannedUntil("10.0.0.1").IsZero())
+	assert.True(l.bannedUntil("10.0.0.2").IsZero())
+
+	l.onFailure("10.0.0.2")
+	l.onSuccess("10.0.0.2")
+	_, failures, _ = l.onFailure("10.0.0.2")
+	assert.Equal(1, failures)
+}
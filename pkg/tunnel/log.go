@@ -0,0 +1,332 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+type logLevel int32
+
+const (
+	// levelTrace adds every frame, levelDebug every data connection to the
+	// lifecycle events of levelInfo
+	levelTrace logLevel = iota
+	levelDebug
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"TRACE", "DEBUG", "INFO", "WARN", "ERROR"}
+
+func (level logLevel) String() string {
+	return logLevelNames[level]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+
+	return levelInfo, fmt.Errorf("unknown log level %q, use trace, debug, info, warn or error", s)
+}
+
+// Logger receives the log events of the package instead of its own output:
+// a message and alternating key/value fields, as passed to the methods of
+// *slog.Logger, which satisfies it
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+}
+
+// logSink is the output shared by a logger and the loggers derived from it
+type logSink struct {
+	lock sync.Mutex
+	w    io.Writer
+	json bool
+
+	// optional, replaces w
+	external Logger
+
+	// logLevel, accessed atomically
+	level int32
+}
+
+// leveledLogger writes one line per event: time, level, message and
+// key/value fields, as logfmt style text or as JSON objects. Fields bound
+// with with, e.g. connection handles, are added to every event.
+type leveledLogger struct {
+	sink   *logSink
+	fields []interface{}
+}
+
+// logger is the process wide logger, configured with SetLogLevel,
+// SetLogFormat and SetLogOutput
+var logger = newLogger(os.Stdout)
+
+func newLogger(w io.Writer) *leveledLogger {
+	return &leveledLogger{
+		sink: &logSink{w: w, level: int32(levelInfo)},
+	}
+}
+
+// SetLogLevel sets the least severe level logged: trace (every frame),
+// debug (every data connection), info (tunnel lifecycle), warn or error
+func SetLogLevel(name string) error {
+	level, err := parseLogLevel(name)
+	if err != nil {
+		return err
+	}
+
+	logger.setLevel(level)
+	return nil
+}
+
+// SetLogFormat selects the log line format: text (logfmt) or json
+func SetLogFormat(format string) error {
+	switch format {
+	case "text":
+		logger.setJSON(false)
+	case "json":
+		logger.setJSON(true)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	return nil
+}
+
+// SetLogOutput redirects the log, stdout by default
+func SetLogOutput(w io.Writer) {
+	logger.setOutput(w)
+}
+
+// SetLogger hands log events to l instead of writing them, nil restores the
+// log output. Events below the SetLogLevel level are still dropped first.
+func SetLogger(l Logger) {
+	logger.setExternal(l)
+}
+
+// LogInfo, LogWarn and LogError log an event with key/value fields
+func LogInfo(msg string, kv ...interface{}) {
+	logger.log(levelInfo, msg, kv)
+}
+
+func LogWarn(msg string, kv ...interface{}) {
+	logger.log(levelWarn, msg, kv)
+}
+
+func LogError(msg string, kv ...interface{}) {
+	logger.log(levelError, msg, kv)
+}
+
+// with returns a logger adding the given key/value pairs to every event
+func (l *leveledLogger) with(kv ...interface{}) *leveledLogger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+
+	return &leveledLogger{
+		sink:   l.sink,
+		fields: append(fields, kv...),
+	}
+}
+
+func (l *leveledLogger) setLevel(level logLevel) {
+	atomic.StoreInt32(&l.sink.level, int32(level))
+}
+
+func (l *leveledLogger) setOutput(w io.Writer) {
+	l.sink.lock.Lock()
+	defer l.sink.lock.Unlock()
+
+	l.sink.w = w
+}
+
+func (l *leveledLogger) setExternal(external Logger) {
+	l.sink.lock.Lock()
+	defer l.sink.lock.Unlock()
+
+	l.sink.external = external
+}
+
+func (l *leveledLogger) setJSON(json bool) {
+	l.sink.lock.Lock()
+	defer l.sink.lock.Unlock()
+
+	l.sink.json = json
+}
+
+// enabled reports whether events of level are written, guards expensive
+// debug fields
+func (l *leveledLogger) enabled(level logLevel) bool {
+	return int32(level) >= atomic.LoadInt32(&l.sink.level)
+}
+
+func (l *leveledLogger) trace(msg string, kv ...interface{}) {
+	l.log(levelTrace, msg, kv)
+}
+
+func (l *leveledLogger) debug(msg string, kv ...interface{}) {
+	l.log(levelDebug, msg, kv)
+}
+
+func (l *leveledLogger) info(msg string, kv ...interface{}) {
+	l.log(levelInfo, msg, kv)
+}
+
+func (l *leveledLogger) warn(msg string, kv ...interface{}) {
+	l.log(levelWarn, msg, kv)
+}
+
+func (l *leveledLogger) error(msg string, kv ...interface{}) {
+	l.log(levelError, msg, kv)
+}
+
+// lines logs an event followed by lines of text, e.g. a table: indented
+// below the event line in text format, as a "lines" array in JSON
+func (l *leveledLogger) lines(level logLevel, msg string, text string, kv ...interface{}) {
+	l.write(level, msg, kv, strings.Split(strings.TrimRight(text, "\n"), "\n"))
+}
+
+func (l *leveledLogger) log(level logLevel, msg string, kv []interface{}) {
+	l.write(level, msg, kv, nil)
+}
+
+func (l *leveledLogger) write(level logLevel, msg string, kv []interface{}, lines []string) {
+	if level == levelError {
+		metrics.errors.Add(1)
+	}
+
+	if !l.enabled(level) {
+		return
+	}
+
+	l.sink.lock.Lock()
+	external := l.sink.external
+	l.sink.lock.Unlock()
+
+	if external != nil {
+		l.forward(external, level, msg, kv, lines)
+		return
+	}
+
+	now := time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+
+	l.sink.lock.Lock()
+	defer l.sink.lock.Unlock()
+
+	var b bytes.Buffer
+	if l.sink.json {
+		b.WriteString(`{"time":"` + now + `","level":"` + level.String() + `","msg":`)
+		writeJSONValue(&b, msg)
+		writeLogFields(&b, l.fields, true)
+		writeLogFields(&b, kv, true)
+		if lines != nil {
+			writeLogFields(&b, []interface{}{"lines", lines}, true)
+		}
+		b.WriteString("}\n")
+	} else {
+		// syslog headers carry the time and level
+		if _, ok := l.sink.w.(levelWriter); !ok {
+			b.WriteString(now + " " + level.String() + " ")
+		}
+		b.WriteString(msg)
+		writeLogFields(&b, l.fields, false)
+		writeLogFields(&b, kv, false)
+		b.WriteByte('\n')
+		for _, line := range lines {
+			if len(line) > 0 {
+				b.WriteString("  " + line)
+			}
+			b.WriteByte('\n')
+		}
+	}
+
+	if w, ok := l.sink.w.(levelWriter); ok {
+		w.writeLevel(level, b.Bytes())
+	} else {
+		l.sink.w.Write(b.Bytes())
+	}
+}
+
+// forward hands an event to an external logger, bound fields first
+func (l *leveledLogger) forward(external Logger, level logLevel, msg string, kv []interface{}, lines []string) {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv)+2)
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	if lines != nil {
+		fields = append(fields, "lines", lines)
+	}
+
+	switch level {
+	case levelTrace, levelDebug:
+		external.Debug(msg, fields...)
+	case levelInfo:
+		external.Info(msg, fields...)
+	case levelWarn:
+		external.Warn(msg, fields...)
+	default:
+		external.Error(msg, fields...)
+	}
+}
+
+func writeLogFields(b *bytes.Buffer, kv []interface{}, asJSON bool) {
+	for i := 0; i < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		var value interface{} = "(missing)"
+		if i+1 < len(kv) {
+			value = kv[i+1]
+		}
+
+		switch v := value.(type) {
+		case error:
+			value = v.Error()
+		case time.Duration:
+			value = v.String()
+		case fmt.Stringer:
+			value = v.String()
+		}
+
+		if asJSON {
+			b.WriteByte(',')
+			writeJSONValue(b, key)
+			b.WriteByte(':')
+			writeJSONValue(b, value)
+		} else {
+			b.WriteString(" " + key + "=" + formatLogValue(value))
+		}
+	}
+}
+
+func writeJSONValue(b *bytes.Buffer, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		out, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(out)
+}
+
+// formatLogValue quotes values that would otherwise be ambiguous in logfmt
+func formatLogValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if len(s) == 0 || strings.IndexFunc(s, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '"' || r == '=' || !unicode.IsPrint(r)
+	}) >= 0 {
+		return strconv.Quote(s)
+	}
+
+	return s
+}
@@ -0,0 +1,153 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoggerText(t *testing.T) {
+	assert := require.New(t)
+
+	var out bytes.Buffer
+	l := newLogger(&out)
+
+	tl := l.with("tunnel", 3)
+	tl.info("Open data connection", "handle", 7, "target", "example.com:80")
+	tl.warn("AUTH_FAILURE", "reason", "bad token", "error", errors.New("x=y"))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(lines, 2)
+	assert.True(strings.HasSuffix(lines[0], " INFO Open data connection tunnel=3 handle=7 target=example.com:80"), lines[0])
+	assert.True(strings.HasSuffix(lines[1], ` WARN AUTH_FAILURE tunnel=3 reason="bad token" error="x=y"`), lines[1])
+}
+
+func TestLoggerLevel(t *testing.T) {
+	assert := require.New(t)
+
+	var out bytes.Buffer
+	l := newLogger(&out)
+
+	assert.False(l.enabled(levelDebug))
+	l.debug("hidden")
+	assert.Empty(out.String())
+
+	level, err := parseLogLevel("debug")
+	assert.Nil(err)
+	l.with("tunnel", 1).setLevel(level)
+
+	// the level is shared with derived loggers
+	assert.True(l.enabled(levelDebug))
+	l.debug("shown")
+	assert.Contains(out.String(), "DEBUG shown")
+
+	// frames are only traced below debug
+	assert.False(l.enabled(levelTrace))
+	level, err = parseLogLevel("trace")
+	assert.Nil(err)
+	l.setLevel(level)
+	l.trace("frame")
+	assert.Contains(out.String(), "TRACE frame")
+
+	_, err = parseLogLevel("verbose")
+	assert.NotNil(err)
+}
+
+func TestLoggerJSON(t *testing.T) {
+	assert := require.New(t)
+
+	var out bytes.Buffer
+	l := newLogger(&out)
+	l.setJSON(true)
+
+	l.with("tunnel", 3).error("Tunnel write error", "error", errors.New("broken pipe"))
+
+	var event map[string]interface{}
+	assert.Nil(json.Unmarshal(out.Bytes(), &event))
+	assert.Equal("ERROR", event["level"])
+	assert.Equal("Tunnel write error", event["msg"])
+	assert.Equal(float64(3), event["tunnel"])
+	assert.Equal("broken pipe", event["error"])
+	assert.NotEmpty(event["time"])
+}
+
+// recordingLogger records events as "LEVEL msg fields..."
+type recordingLogger struct {
+	events []string
+}
+
+func (r *recordingLogger) record(level string, msg string, kv []interface{}) {
+	r.events = append(r.events, strings.TrimSpace(level+" "+msg+" "+strings.Trim(fmt.Sprint(kv), "[]")))
+}
+
+func (r *recordingLogger) Debug(msg string, kv ...interface{}) { r.record("DEBUG", msg, kv) }
+func (r *recordingLogger) Info(msg string, kv ...interface{})  { r.record("INFO", msg, kv) }
+func (r *recordingLogger) Warn(msg string, kv ...interface{})  { r.record("WARN", msg, kv) }
+func (r *recordingLogger) Error(msg string, kv ...interface{}) { r.record("ERROR", msg, kv) }
+
+func TestLoggerExternal(t *testing.T) {
+	assert := require.New(t)
+
+	var out bytes.Buffer
+	l := newLogger(&out)
+
+	external := &recordingLogger{}
+	l.setExternal(external)
+
+	tl := l.with("tunnel", 3)
+	tl.info("Open data connection", "handle", 7)
+	tl.debug("hidden")
+	tl.error("Tunnel write error", "error", "broken pipe")
+
+	assert.Empty(out.String())
+	assert.Equal([]string{
+		"INFO Open data connection tunnel 3 handle 7",
+		"ERROR Tunnel write error tunnel 3 error broken pipe",
+	}, external.events)
+
+	l.setExternal(nil)
+	tl.info("Close data connection")
+	assert.Contains(out.String(), "INFO Close data connection tunnel=3")
+}
+
+func TestTracePdus(t *testing.T) {
+	assert := require.New(t)
+
+	var out bytes.Buffer
+	logger.setOutput(&out)
+	defer logger.setOutput(os.Stdout)
+	logger.setLevel(levelTrace)
+	defer logger.setLevel(levelInfo)
+
+	p, err := NewProvider(Config{TraceBytes: 6})
+	assert.Nil(err)
+	defer p.Close()
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	tc := p.newTunnelConnection(local)
+
+	pdu := &TunnelConnectResponse{dataConnectionHandle: 7, proxyConnectionHandle: 9}
+	tc.send(pdu)
+
+	assert.Contains(out.String(), "TRACE PDU sent")
+	assert.Contains(out.String(), "type=TunnelConnectResponse length=8 handle=7 peer_handle=9")
+	assert.Contains(out.String(), "dump="+hex.EncodeToString(encodePdu(pdu)[4:10]))
+
+	// credentials never show in the dump
+	out.Reset()
+	tc.send(&AuthRequest{identity: "alice", credential: "eyJhbGciOi"})
+	tc.send(&DataChannelRequest{token: []byte("channel-token")})
+	assert.Contains(out.String(), "type=AuthRequest")
+	assert.Contains(out.String(), "type=DataChannelRequest")
+	assert.Equal(2, strings.Count(out.String(), "dump=redacted"))
+	assert.NotContains(out.String(), hex.EncodeToString([]byte("eyJ")))
+}
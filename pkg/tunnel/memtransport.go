@@ -0,0 +1,163 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Transport carries the signaling connections and tunnel ports of a provider
+// in place of TCP sockets. Listeners must report *net.TCPAddr addresses.
+type Transport interface {
+	Listen(network string, address string) (net.Listener, error)
+	DialContext(ctx context.Context, network string, address string) (net.Conn, error)
+}
+
+// MemoryTransport wires providers, clients and their targets together
+// within the process over net.Pipe, without sockets, e.g. for tests or a
+// single binary embedding both sides. Addresses are told apart by port only,
+// port 0 allocates a free one. As a Dialer it also reaches targets
+// listening on the transport.
+type MemoryTransport struct {
+	lock      sync.Mutex
+	listeners map[int]*memoryListener
+	lastPort  int
+}
+
+// NewMemoryTransport returns a transport without listeners
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{
+		listeners: make(map[int]*memoryListener),
+	}
+}
+
+func memoryPort(address string) (int, error) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(port) == 0 {
+		return 0, nil
+	}
+	return strconv.Atoi(port)
+}
+
+// nextPort returns the next port no listener holds, 0 if all are taken
+func (t *MemoryTransport) nextPort() int {
+	for i := 0; i < 65535; i++ {
+		t.lastPort = t.lastPort%65535 + 1
+		if t.listeners[t.lastPort] == nil {
+			return t.lastPort
+		}
+	}
+
+	return 0
+}
+
+// Listen listens on the port of address
+func (t *MemoryTransport) Listen(network string, address string) (net.Listener, error) {
+	port, err := memoryPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if port == 0 {
+		if port = t.nextPort(); port == 0 {
+			return nil, fmt.Errorf("listen %s: no free port", address)
+		}
+	} else if t.listeners[port] != nil {
+		return nil, fmt.Errorf("listen %s: address already in use", address)
+	}
+
+	l := &memoryListener{
+		transport: t,
+		addr:      &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port},
+		accepted:  make(chan net.Conn, listenBacklog),
+		closed:    make(chan struct{}),
+	}
+	t.listeners[port] = l
+
+	return l, nil
+}
+
+// DialContext connects to the listener on the port of address. Like a TCP
+// connect it completes before the connection is accepted, it is refused
+// when the backlog of the listener is full.
+func (t *MemoryTransport) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	port, err := memoryPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	l := t.listeners[port]
+	if l == nil {
+		return nil, fmt.Errorf("dial %s: connection refused", address)
+	}
+
+	// clients get ports of their own, so that their addresses differ
+	clientAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: t.nextPort()}
+
+	local, remote := net.Pipe()
+	select {
+	case l.accepted <- &tunneledConn{Conn: remote, local: l.addr, remote: clientAddr}:
+		return &tunneledConn{Conn: local, local: clientAddr, remote: l.addr}, nil
+	default:
+		local.Close()
+		remote.Close()
+		return nil, fmt.Errorf("dial %s: connection refused, backlog full", address)
+	}
+}
+
+// memoryListener is a listener of a MemoryTransport
+type memoryListener struct {
+	transport *MemoryTransport
+	addr      *net.TCPAddr
+
+	accepted chan net.Conn
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close frees the port, connections not accepted yet are closed
+func (l *memoryListener) Close() error {
+	l.closeOnce.Do(func() {
+		// no more connections are queued once unregistered
+		l.transport.lock.Lock()
+		delete(l.transport.listeners, l.addr.Port)
+		l.transport.lock.Unlock()
+
+		close(l.closed)
+		for {
+			select {
+			case conn := <-l.accepted:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,74 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryTransport(t *testing.T) {
+	assert := require.New(t)
+
+	transport := NewMemoryTransport()
+
+	// echo target on the transport
+	target, err := transport.Listen("tcp4", ":0")
+	assert.Nil(err)
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	p, err := NewProvider(Config{Transport: transport})
+	assert.Nil(err)
+	defer p.Close()
+	addr, err := p.StartListener(0)
+	assert.Nil(err)
+
+	client, err := NewProvider(Config{Transport: transport, Dialer: transport})
+	assert.Nil(err)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tun, err := client.Connect(ctx, ConnectorConfig{
+		ProviderAddress: fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port),
+		Target:          target.Addr().String(),
+	})
+	assert.Nil(err)
+
+	consumer, err := transport.DialContext(ctx, "tcp4", fmt.Sprintf("127.0.0.1:%d", tun.Port()))
+	assert.Nil(err)
+	defer consumer.Close()
+
+	_, err = consumer.Write([]byte("ping"))
+	assert.Nil(err)
+	reply := make([]byte, 4)
+	consumer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(consumer, reply)
+	assert.Nil(err)
+	assert.Equal("ping", string(reply))
+
+	// ports are taken until closed
+	_, err = transport.Listen("tcp4", target.Addr().String())
+	assert.NotNil(err)
+	target.Close()
+	_, err = transport.DialContext(ctx, "tcp4", target.Addr().String())
+	assert.NotNil(err)
+}
@@ -0,0 +1,243 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// chunk flags of MessageConn, a chunk with neither continues its message
+const (
+	chunkBegin = 1 << 0
+	chunkEnd   = 1 << 1
+)
+
+// chunk header: 1 byte flags and a 4 byte big endian length
+const chunkHeaderLength = 5
+
+// DefaultChunkSize is the chunk size of a MessageConn created with 0
+const DefaultChunkSize = 32 * 1024
+
+// ErrTruncatedMessage is returned by the reader of a message whose stream
+// ended before its last chunk, e.g. because the tunnel was lost
+var ErrTruncatedMessage = errors.New("message truncated, the stream ended before its end chunk")
+
+// MessageConn relays messages over a stream, e.g. a connection of
+// Client.DialContext or Client.Listen, in chunks flagged as beginning,
+// continuing or ending a message. Messages of any size are written and read
+// incrementally, a chunk at a time, and a reader tells a message cut short
+// by the stream dying from a complete one. Both ends must use MessageConn.
+type MessageConn struct {
+	conn      io.ReadWriter
+	chunkSize int
+
+	// one message is written at a time
+	writeLock sync.Mutex
+
+	// reader of the message being read, drained by NextMessage
+	readLock sync.Mutex
+	current  *messageReader
+}
+
+// NewMessageConn relays messages over conn in chunks of up to chunkSize
+// bytes, DefaultChunkSize if 0
+func NewMessageConn(conn io.ReadWriter, chunkSize int) *MessageConn {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	return &MessageConn{conn: conn, chunkSize: chunkSize}
+}
+
+func (c *MessageConn) writeChunk(flags byte, data []byte) error {
+	var header [chunkHeaderLength]byte
+	header[0] = flags
+	binary.BigEndian.PutUint32(header[1:], uint32(len(data)))
+
+	if _, err := c.conn.Write(header[:]); err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		if _, err := c.conn.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteMessage writes p as one message
+func (c *MessageConn) WriteMessage(p []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	flags := byte(chunkBegin)
+	for {
+		n := len(p)
+		if n > c.chunkSize {
+			n = c.chunkSize
+		} else {
+			flags |= chunkEnd
+		}
+
+		if err := c.writeChunk(flags, p[:n]); err != nil {
+			return err
+		}
+		if flags&chunkEnd != 0 {
+			return nil
+		}
+
+		p = p[n:]
+		flags = 0
+	}
+}
+
+// NewWriter returns a writer of one message of unknown size, each Write is
+// sent on as it is made and Close ends the message. Other messages are not
+// written until it is closed.
+func (c *MessageConn) NewWriter() io.WriteCloser {
+	c.writeLock.Lock()
+	return &messageWriter{conn: c, flags: chunkBegin}
+}
+
+type messageWriter struct {
+	conn   *MessageConn
+	flags  byte
+	closed bool
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("message writer closed")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > w.conn.chunkSize {
+			n = w.conn.chunkSize
+		}
+
+		if err := w.conn.writeChunk(w.flags, p[:n]); err != nil {
+			return written, err
+		}
+		w.flags = 0
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close ends the message with an empty end chunk
+func (w *messageWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.conn.writeLock.Unlock()
+
+	return w.conn.writeChunk(w.flags|chunkEnd, nil)
+}
+
+// NextMessage returns a reader of the next message, the rest of the message
+// read before is skipped. Returns io.EOF once the stream ends between
+// messages.
+func (c *MessageConn) NextMessage() (io.Reader, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	if c.current != nil {
+		if _, err := io.Copy(ioutil.Discard, c.current); err != nil {
+			return nil, err
+		}
+	}
+
+	flags, length, err := c.readChunkHeader()
+	if err == io.ErrUnexpectedEOF {
+		return nil, ErrTruncatedMessage
+	} else if err != nil {
+		return nil, err
+	}
+	if flags&chunkBegin == 0 {
+		return nil, errors.New("message framing error, chunk continues no message")
+	}
+
+	c.current = &messageReader{conn: c, flags: flags, remaining: length}
+	return c.current, nil
+}
+
+// ReadMessage returns the next message whole, refusing messages larger than
+// limit bytes
+func (c *MessageConn) ReadMessage(limit int) ([]byte, error) {
+	r, err := c.NextMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > limit {
+		return nil, fmt.Errorf("message exceeds %d bytes", limit)
+	}
+	return data, nil
+}
+
+func (c *MessageConn) readChunkHeader() (byte, uint32, error) {
+	var header [chunkHeaderLength]byte
+	if _, err := io.ReadFull(c.conn, header[:]); err != nil {
+		return 0, 0, err
+	}
+	return header[0], binary.BigEndian.Uint32(header[1:]), nil
+}
+
+type messageReader struct {
+	conn      *MessageConn
+	flags     byte
+	remaining uint32
+	err       error
+}
+
+func (r *messageReader) Read(p []byte) (int, error) {
+	for r.remaining == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.flags&chunkEnd != 0 {
+			r.err = io.EOF
+			return 0, io.EOF
+		}
+
+		flags, length, err := r.conn.readChunkHeader()
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			r.err = ErrTruncatedMessage
+		case err != nil:
+			r.err = err
+		case flags&chunkBegin != 0:
+			r.err = errors.New("message framing error, chunk begins a message within another")
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		r.flags, r.remaining = flags, length
+	}
+
+	if uint32(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.conn.conn.Read(p)
+	r.remaining -= uint32(n)
+
+	if err == io.EOF && r.remaining > 0 {
+		err = ErrTruncatedMessage
+	}
+	if err != nil && err != io.EOF {
+		r.err = err
+		return n, err
+	}
+	return n, nil
+}
@@ -0,0 +1,125 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageConn(t *testing.T) {
+	assert := require.New(t)
+
+	var stream bytes.Buffer
+	c := NewMessageConn(&stream, 4)
+
+	assert.Nil(c.WriteMessage([]byte("hello world")))
+	assert.Nil(c.WriteMessage(nil))
+
+	w := c.NewWriter()
+	for _, part := range []string{"str", "eamed ", "message"} {
+		_, err := w.Write([]byte(part))
+		assert.Nil(err)
+	}
+	assert.Nil(w.Close())
+	assert.Nil(c.WriteMessage([]byte("last")))
+
+	data, err := c.ReadMessage(100)
+	assert.Nil(err)
+	assert.Equal("hello world", string(data))
+
+	data, err = c.ReadMessage(100)
+	assert.Nil(err)
+	assert.Empty(data)
+
+	// the rest of a message read in part is skipped
+	r, err := c.NextMessage()
+	assert.Nil(err)
+	part := make([]byte, 3)
+	_, err = io.ReadFull(r, part)
+	assert.Nil(err)
+	assert.Equal("str", string(part))
+
+	_, err = c.ReadMessage(2)
+	assert.NotNil(err)
+
+	_, err = c.NextMessage()
+	assert.Equal(io.EOF, err)
+}
+
+func TestMessageConnTruncated(t *testing.T) {
+	assert := require.New(t)
+
+	var stream bytes.Buffer
+	assert.Nil(NewMessageConn(&stream, 4).WriteMessage([]byte("hello world")))
+
+	for _, cut := range []int{3, 8, stream.Len() - 1} {
+		c := NewMessageConn(bytes.NewBuffer(stream.Bytes()[:cut]), 4)
+		r, err := c.NextMessage()
+		if err == nil {
+			_, err = ioutil.ReadAll(r)
+		}
+		assert.Equal(ErrTruncatedMessage, err, cut)
+	}
+}
+
+func TestMessageConnTunneled(t *testing.T) {
+	assert := require.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer l.Close()
+
+	// answers a message with its first half only, then hangs up
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		c := NewMessageConn(conn, 1024)
+		data, err := c.ReadMessage(1 << 20)
+		if err != nil {
+			return
+		}
+
+		w := c.NewWriter()
+		w.Write(data[:len(data)/2])
+	}()
+
+	f := writeTenantFile(t, fmt.Sprintf("* %s\n", l.Addr()))
+	p, err := NewProvider(Config{ACLFile: f, AllowDial: true})
+	assert.Nil(err)
+	defer p.Close()
+	addr, err := p.StartListener(0)
+	assert.Nil(err)
+
+	client := newProvider()
+	defer client.Close()
+	dialer := client.NewClient(ConnectorConfig{ProviderAddress: fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port)})
+	defer dialer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, "tcp", l.Addr().String())
+	assert.Nil(err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// relayed a chunk at a time, the cut is detected
+	c := NewMessageConn(conn, 1024)
+	assert.Nil(c.WriteMessage(bytes.Repeat([]byte("m"), 100*1024)))
+
+	r, err := c.NextMessage()
+	assert.Nil(err)
+	data, err := ioutil.ReadAll(r)
+	assert.Equal(ErrTruncatedMessage, err)
+	assert.Len(data, 50*1024)
+}
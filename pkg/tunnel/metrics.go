@@ -0,0 +1,138 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"expvar"
+	"strconv"
+	"sync"
+)
+
+// metrics are the process wide counters, published with expvar as the
+// "tunnel" map and served at /debug/vars of the admin server
+var metrics = struct {
+	tunnelsOpened *expvar.Int
+	tunnelsActive *expvar.Int
+
+	dataConnectionsOpened *expvar.Int
+	dataConnectionsActive *expvar.Int
+
+	// payload read from / written to data connections, and the data frames
+	// carrying it through tunnels
+	bytesReceived  *expvar.Int
+	bytesSent      *expvar.Int
+	framesReceived *expvar.Int
+	framesSent     *expvar.Int
+
+	// events logged at error level, and targets the connector failed to dial
+	errors     *expvar.Int
+	dialErrors *expvar.Int
+
+	// PDUs dropped for referencing data connections closed already, and
+	// those of other tunnels or in the wrong state
+	staleHandles   *expvar.Int
+	invalidHandles *expvar.Int
+
+	// seconds from sending a TunnelConnectRequest to its response, and the
+	// payload bytes per second of each data connection over its lifetime,
+	// both directions together
+	connectSeconds    *histogram
+	throughputPerConn *histogram
+}{
+	tunnelsOpened:         new(expvar.Int),
+	tunnelsActive:         new(expvar.Int),
+	dataConnectionsOpened: new(expvar.Int),
+	dataConnectionsActive: new(expvar.Int),
+	bytesReceived:         new(expvar.Int),
+	bytesSent:             new(expvar.Int),
+	framesReceived:        new(expvar.Int),
+	framesSent:            new(expvar.Int),
+	errors:                new(expvar.Int),
+	dialErrors:            new(expvar.Int),
+	staleHandles:          new(expvar.Int),
+	invalidHandles:        new(expvar.Int),
+	connectSeconds:        newHistogram(0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10),
+	throughputPerConn:     newHistogram(1<<10, 4<<10, 16<<10, 64<<10, 256<<10, 1<<20, 4<<20, 16<<20, 64<<20, 256<<20, 1<<30),
+}
+
+func init() {
+	m := expvar.NewMap("tunnel")
+	m.Set("tunnels_opened", metrics.tunnelsOpened)
+	m.Set("tunnels_active", metrics.tunnelsActive)
+	m.Set("data_connections_opened", metrics.dataConnectionsOpened)
+	m.Set("data_connections_active", metrics.dataConnectionsActive)
+	m.Set("bytes_received", metrics.bytesReceived)
+	m.Set("bytes_sent", metrics.bytesSent)
+	m.Set("frames_received", metrics.framesReceived)
+	m.Set("frames_sent", metrics.framesSent)
+	m.Set("errors", metrics.errors)
+	m.Set("dial_errors", metrics.dialErrors)
+	m.Set("stale_handles", metrics.staleHandles)
+	m.Set("invalid_handles", metrics.invalidHandles)
+
+	// apart from the counters, whose consumers expect numbers only
+	h := expvar.NewMap("tunnel_histograms")
+	h.Set("connect_seconds", metrics.connectSeconds)
+	h.Set("throughput_bytes_per_second", metrics.throughputPerConn)
+}
+
+// histogram counts observations by the upper bounds of its buckets. It is
+// published like a Prometheus histogram, with cumulative bucket counts, the
+// last bucket "+Inf", and the number and sum of all observations.
+type histogram struct {
+	bounds []float64
+
+	lock   sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+type histogramBucket struct {
+	Le    string `json:"le"`
+	Count uint64 `json:"count"`
+}
+
+// String implements expvar.Var
+func (h *histogram) String() string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var value struct {
+		Buckets []histogramBucket `json:"buckets"`
+		Count   uint64            `json:"count"`
+		Sum     float64           `json:"sum"`
+	}
+
+	var cumulative uint64
+	for i, n := range h.counts {
+		cumulative += n
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		value.Buckets = append(value.Buckets, histogramBucket{Le: le, Count: cumulative})
+	}
+	value.Count = h.count
+	value.Sum = h.sum
+
+	b, _ := json.Marshal(value)
+	return string(b)
+}
@@ -0,0 +1,49 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+)
+
+// StreamMiddleware wraps the stream of a data connection, the consumer
+// connection on the listener side and the target connection on the connector
+// side. Reads from the returned stream are relayed through the tunnel, writes
+// carry what arrives from it, e.g. to throttle, record or sniff protocols.
+// Closing it must close the stream it wraps.
+type StreamMiddleware func(stream io.ReadWriteCloser) io.ReadWriteCloser
+
+// middlewareConn is a connection whose payload passes through middleware,
+// addresses and deadlines are those of the connection it wraps
+type middlewareConn struct {
+	net.Conn
+	stream io.ReadWriteCloser
+}
+
+// wrapStream applies middleware to conn in order, the last one is outermost
+func wrapStream(conn net.Conn, middleware []StreamMiddleware) net.Conn {
+	if len(middleware) == 0 {
+		return conn
+	}
+
+	var stream io.ReadWriteCloser = conn
+	for _, m := range middleware {
+		stream = m(stream)
+	}
+
+	return &middlewareConn{Conn: conn, stream: stream}
+}
+
+func (c *middlewareConn) Read(b []byte) (int, error) {
+	return c.stream.Read(b)
+}
+
+func (c *middlewareConn) Write(b []byte) (int, error) {
+	return c.stream.Write(b)
+}
+
+// Close closes the connection even if the middleware fails to
+func (c *middlewareConn) Close() error {
+	err := c.stream.Close()
+	c.Conn.Close()
+	return err
+}
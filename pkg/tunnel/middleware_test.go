@@ -0,0 +1,111 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordingStream records what is read from and written to the stream
+type recordingStream struct {
+	io.ReadWriteCloser
+
+	lock          sync.Mutex
+	read, written bytes.Buffer
+	closed        bool
+}
+
+func (s *recordingStream) Read(b []byte) (int, error) {
+	n, err := s.ReadWriteCloser.Read(b)
+	s.lock.Lock()
+	s.read.Write(b[:n])
+	s.lock.Unlock()
+	return n, err
+}
+
+func (s *recordingStream) Write(b []byte) (int, error) {
+	s.lock.Lock()
+	s.written.Write(b)
+	s.lock.Unlock()
+	return s.ReadWriteCloser.Write(b)
+}
+
+func (s *recordingStream) Close() error {
+	s.lock.Lock()
+	s.closed = true
+	s.lock.Unlock()
+	return s.ReadWriteCloser.Close()
+}
+
+// upperStream upper-cases what is written to the stream
+type upperStream struct {
+	io.ReadWriteCloser
+}
+
+func (s upperStream) Write(b []byte) (int, error) {
+	return s.ReadWriteCloser.Write(bytes.ToUpper(b))
+}
+
+func TestStreamMiddleware(t *testing.T) {
+	assert := require.New(t)
+
+	target, err := startEchoServer()
+	assert.Nil(err)
+
+	p := newProvider()
+	defer p.Close()
+	addr, err := p.StartListener(0)
+	assert.Nil(err)
+
+	streams := make(chan *recordingStream, 1)
+	client, err := NewProvider(Config{StreamMiddleware: []StreamMiddleware{
+		func(stream io.ReadWriteCloser) io.ReadWriteCloser {
+			return upperStream{stream}
+		},
+		func(stream io.ReadWriteCloser) io.ReadWriteCloser {
+			s := &recordingStream{ReadWriteCloser: stream}
+			streams <- s
+			return s
+		},
+	}})
+	assert.Nil(err)
+	defer client.Close()
+
+	tun, err := client.Connect(context.Background(), ConnectorConfig{
+		ProviderAddress: fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port),
+		Target:          target.String(),
+	})
+	assert.Nil(err)
+
+	consumer, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", tun.Port()))
+	assert.Nil(err)
+
+	_, err = consumer.Write([]byte("ping"))
+	assert.Nil(err)
+	reply := make([]byte, 4)
+	consumer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(consumer, reply)
+	assert.Nil(err)
+	assert.Equal("PING", string(reply))
+
+	// the outermost middleware sees the stream before upper-casing
+	s := <-streams
+	s.lock.Lock()
+	assert.Equal("ping", s.written.String())
+	assert.Equal("PING", s.read.String())
+	s.lock.Unlock()
+
+	consumer.Close()
+	assert.Eventually(func() bool {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return s.closed
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,170 @@
+package tunnel
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// pollEngine reads data connections on epoll readiness instead of parking a
+// goroutine and a read buffer on every connection, for tunnels multiplexing
+// tens of thousands of mostly idle connections. Sockets are armed one shot,
+// so that each connection has at most one read in flight, and re-armed once
+// the payload has been handed to the tunnel.
+type pollEngine struct {
+	epfd int
+
+	lock  sync.Mutex
+	conns map[int]*DataConnection
+
+	buffers sync.Pool
+}
+
+type pollBuffer struct {
+	b       [dataReadSize]byte
+	scratch dataScratch
+}
+
+func newPollEngine() (*pollEngine, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &pollEngine{
+		epfd:  epfd,
+		conns: make(map[int]*DataConnection),
+		buffers: sync.Pool{
+			New: func() interface{} {
+				return new(pollBuffer)
+			},
+		},
+	}
+
+	supervise("poll engine", e.loop)
+	return e, nil
+}
+
+func (e *pollEngine) register(dc *DataConnection) error {
+	tcp, ok := dc.conn.(*net.TCPConn)
+	if !ok {
+		return errors.New("not a TCP connection")
+	}
+
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	fd := -1
+	if err := raw.Control(func(s uintptr) { fd = int(s) }); err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	dc.pollFd = fd
+	e.conns[fd] = dc
+
+	event := unix.EpollEvent{Events: unix.EPOLLIN | unix.EPOLLRDHUP | unix.EPOLLONESHOT, Fd: int32(fd)}
+	if err := unix.EpollCtl(e.epfd, unix.EPOLL_CTL_ADD, fd, &event); err != nil {
+		delete(e.conns, fd)
+		return err
+	}
+
+	return nil
+}
+
+// remove stops polling dc, must be called before its socket is closed so
+// that the descriptor is not reused while still registered
+func (e *pollEngine) remove(dc *DataConnection) {
+	if e == nil {
+		return
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.conns[dc.pollFd] == dc {
+		delete(e.conns, dc.pollFd)
+		unix.EpollCtl(e.epfd, unix.EPOLL_CTL_DEL, dc.pollFd, nil)
+	}
+}
+
+func (e *pollEngine) rearm(dc *DataConnection) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.conns[dc.pollFd] == dc {
+		event := unix.EpollEvent{Events: unix.EPOLLIN | unix.EPOLLRDHUP | unix.EPOLLONESHOT, Fd: int32(dc.pollFd)}
+		unix.EpollCtl(e.epfd, unix.EPOLL_CTL_MOD, dc.pollFd, &event)
+	}
+}
+
+func (e *pollEngine) loop() {
+	events := make([]unix.EpollEvent, 256)
+
+	for {
+		n, err := unix.EpollWait(e.epfd, events, -1)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+
+			logger.error("Poll engine error", "error", err)
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			e.lock.Lock()
+			dc := e.conns[int(events[i].Fd)]
+			e.lock.Unlock()
+
+			if dc != nil {
+				go e.onReadable(dc)
+			}
+		}
+	}
+}
+
+func (e *pollEngine) onReadable(dc *DataConnection) {
+	buf := e.buffers.Get().(*pollBuffer)
+	defer e.buffers.Put(buf)
+	defer recoverPanic("data connection reader", func() { dc.close(true) })
+
+	tcp := dc.conn.(*net.TCPConn)
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		dc.close(true)
+		return
+	}
+
+	// reads through the connection rather than the descriptor number, which
+	// may have been reused once the connection is closed
+	var n int
+	var readErr error
+	if err := raw.Read(func(fd uintptr) bool {
+		n, readErr = unix.Read(int(fd), buf.b[:])
+		return true
+	}); err != nil {
+		dc.close(true)
+		return
+	}
+
+	if readErr == unix.EAGAIN {
+		e.rearm(dc)
+		return
+	}
+
+	if n <= 0 || readErr != nil {
+		dc.close(true)
+		return
+	}
+
+	if dc.forward(buf.b[:n], &buf.scratch) {
+		e.rearm(dc)
+	}
+}
@@ -0,0 +1,74 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPollEngine(t *testing.T) {
+	assert := require.New(t)
+
+	engine, err := newPollEngine()
+	assert.NoError(err)
+
+	p := newProvider()
+	p.pollEngine = engine
+
+	tunnelLocal, tunnelRemote := net.Pipe()
+	defer tunnelRemote.Close()
+	tc := p.newTunnelConnection(tunnelLocal)
+	defer tc.cancel()
+	go tc.writeLoop()
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(err)
+	defer l.Close()
+
+	consumer, err := net.Dial("tcp4", l.Addr().String())
+	assert.NoError(err)
+	accepted, err := l.Accept()
+	assert.NoError(err)
+
+	dc := p.newDataConnection(tc, accepted)
+	dc.open(5)
+
+	engine.lock.Lock()
+	assert.Equal(dc, engine.conns[dc.pollFd])
+	engine.lock.Unlock()
+
+	for _, message := range []string{"hello", "again"} {
+		_, err = consumer.Write([]byte(message))
+		assert.NoError(err)
+
+		var length [4]byte
+		_, err = io.ReadFull(tunnelRemote, length[:])
+		assert.NoError(err)
+		frame := make([]byte, binary.BigEndian.Uint32(length[:]))
+		_, err = io.ReadFull(tunnelRemote, frame)
+		assert.NoError(err)
+
+		pdu := serializePduFrom(bytes.NewBuffer(frame)).(*TunnelDataIndication)
+		assert.Equal(Handle(5), pdu.peerConnectionHandle)
+		assert.Equal(message, string(pdu.data))
+	}
+
+	// hang up is noticed through the engine as well
+	consumer.Close()
+	go io.Copy(io.Discard, tunnelRemote)
+
+	deadline := time.Now().Add(time.Second)
+	for p.getDataConnection(dc.handle) != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Nil(p.getDataConnection(dc.handle))
+
+	engine.lock.Lock()
+	assert.Empty(engine.conns)
+	engine.lock.Unlock()
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package tunnel
+
+import "errors"
+
+// pollEngine is only implemented on Linux, elsewhere every data connection
+// is read by its own goroutine
+type pollEngine struct{}
+
+func newPollEngine() (*pollEngine, error) {
+	return nil, errors.New("the epoll I/O engine is only supported on Linux")
+}
+
+func (e *pollEngine) register(dc *DataConnection) error {
+	return errors.New("the epoll I/O engine is only supported on Linux")
+}
+
+func (e *pollEngine) remove(dc *DataConnection) {
+}
@@ -0,0 +1,206 @@
+package tunnel
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	obfsSaltLength = 16
+
+	// largest payload of a chunk, as in shadowsocks
+	obfsMaxChunk = 0x3fff
+)
+
+// obfsConn hides the signaling stream, including the 4 byte length framing,
+// behind AES-256-GCM keyed from a pre-shared key, framed like shadowsocks
+// AEAD ciphers. Every direction starts with a random salt the key is derived
+// from, followed by chunks of a sealed 2 byte length and the sealed payload,
+// each with a nonce counting up from zero. The stream is indistinguishable
+// from random bytes to DPI boxes, and tampering with it fails the read.
+type obfsConn struct {
+	net.Conn
+	psk []byte
+
+	readLock  sync.Mutex
+	open      cipher.AEAD
+	readNonce []byte
+	readBuf   []byte
+
+	// opened payload not yet returned by Read
+	pending []byte
+
+	writeLock  sync.Mutex
+	seal       cipher.AEAD
+	writeNonce []byte
+	writeBuf   []byte
+}
+
+var errObfsChunk = errors.New("obfuscated chunk authentication failed")
+
+func newObfsConn(conn net.Conn, psk []byte) net.Conn {
+	return &obfsConn{
+		Conn: conn,
+		psk:  psk,
+	}
+}
+
+func (c *obfsConn) newAEAD(salt []byte) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, c.psk, salt, []byte("tunnel obfuscation")), key); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// incrementNonce counts nonce up as a little endian integer
+func incrementNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func (c *obfsConn) Read(b []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	if len(c.pending) == 0 {
+		if err := c.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *obfsConn) readChunk() error {
+	if c.open == nil {
+		salt := make([]byte, obfsSaltLength)
+		if _, err := io.ReadFull(c.Conn, salt); err != nil {
+			return err
+		}
+
+		aead, err := c.newAEAD(salt)
+		if err != nil {
+			return err
+		}
+		c.open = aead
+		c.readNonce = make([]byte, aead.NonceSize())
+		c.readBuf = make([]byte, obfsMaxChunk+aead.Overhead())
+	}
+
+	overhead := c.open.Overhead()
+
+	header := c.readBuf[:2+overhead]
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
+		return err
+	}
+	header, err := c.open.Open(header[:0], c.readNonce, header, nil)
+	if err != nil {
+		return errObfsChunk
+	}
+	incrementNonce(c.readNonce)
+
+	length := int(binary.BigEndian.Uint16(header)) & obfsMaxChunk
+	chunk := c.readBuf[:length+overhead]
+	if _, err := io.ReadFull(c.Conn, chunk); err != nil {
+		return err
+	}
+	if c.pending, err = c.open.Open(chunk[:0], c.readNonce, chunk, nil); err != nil {
+		return errObfsChunk
+	}
+	incrementNonce(c.readNonce)
+
+	return nil
+}
+
+func (c *obfsConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	out := c.writeBuf[:0]
+	if c.seal == nil {
+		salt := make([]byte, obfsSaltLength)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return 0, err
+		}
+
+		aead, err := c.newAEAD(salt)
+		if err != nil {
+			return 0, err
+		}
+		c.seal = aead
+		c.writeNonce = make([]byte, aead.NonceSize())
+
+		// the salt goes out with the first data to avoid a telltale small write
+		out = append(out, salt...)
+	}
+
+	var length [2]byte
+	for rest := b; len(rest) > 0; {
+		chunk := rest
+		if len(chunk) > obfsMaxChunk {
+			chunk = chunk[:obfsMaxChunk]
+		}
+		rest = rest[len(chunk):]
+
+		binary.BigEndian.PutUint16(length[:], uint16(len(chunk)))
+		out = c.seal.Seal(out, c.writeNonce, length[:], nil)
+		incrementNonce(c.writeNonce)
+		out = c.seal.Seal(out, c.writeNonce, chunk, nil)
+		incrementNonce(c.writeNonce)
+	}
+
+	// kept for the next write, unless a bulk write inflated it
+	if cap(out) <= 4*(obfsMaxChunk+64) {
+		c.writeBuf = out
+	}
+
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+type obfsListener struct {
+	net.Listener
+	psk []byte
+}
+
+func newObfsListener(l net.Listener, psk []byte) net.Listener {
+	return &obfsListener{
+		Listener: l,
+		psk:      psk,
+	}
+}
+
+func (l *obfsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return newObfsConn(conn, l.psk), nil
+}
@@ -0,0 +1,63 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestObfsConn(t *testing.T) {
+	assert := require.New(t)
+
+	left, right := net.Pipe()
+	a := newObfsConn(left, []byte("psk"))
+	b := newObfsConn(right, []byte("psk"))
+
+	msg := []byte("\x00\x00\x00\x05hello")
+
+	go func() {
+		a.Write(msg)
+		a.Write(msg)
+	}()
+
+	got := make([]byte, 2*len(msg))
+	_, err := io.ReadFull(b, got)
+	assert.NoError(err)
+	assert.Equal(append(append([]byte{}, msg...), msg...), got)
+
+	// writes beyond a chunk are split
+	big := bytes.Repeat([]byte("x"), 3*obfsMaxChunk)
+	go a.Write(big)
+	got = make([]byte, len(big))
+	_, err = io.ReadFull(b, got)
+	assert.NoError(err)
+	assert.Equal(big, got)
+
+	// the raw stream does not carry the plaintext framing
+	raw, tap := net.Pipe()
+	c := newObfsConn(raw, []byte("psk"))
+	go c.Write(msg)
+
+	wire := make([]byte, obfsSaltLength+len(msg))
+	_, err = io.ReadFull(tap, wire)
+	assert.NoError(err)
+	assert.False(bytes.Contains(wire, msg))
+
+	// a tampered stream fails to read
+	raw, tap = net.Pipe()
+	c = newObfsConn(raw, []byte("psk"))
+	go c.Write(msg)
+
+	wire = make([]byte, obfsSaltLength+2+len(msg)+2*16)
+	_, err = io.ReadFull(tap, wire)
+	assert.NoError(err)
+	wire[len(wire)-1] ^= 1
+
+	sender, receiver := net.Pipe()
+	go sender.Write(wire)
+	_, err = newObfsConn(receiver, []byte("psk")).Read(got)
+	assert.Equal(errObfsChunk, err)
+}
@@ -0,0 +1,257 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// onDemandPort is a tunnel port the provider opens from its configuration
+// rather than for a client. No client holds it: each consumer is handed to
+// a standby client forwarding its target, chosen when the consumer connects.
+type onDemandPort struct {
+	port         int
+	proxyAddress string
+	proxyPort    int
+
+	// labels the standby client must carry, any client if empty
+	selector map[string]string
+
+	listeners []net.Listener
+}
+
+func (o *onDemandPort) target() string {
+	return net.JoinHostPort(o.proxyAddress, strconv.Itoa(o.proxyPort))
+}
+
+// onDemandTable is the on-demand ports of a provider. Standby clients only
+// announce their targets, they hold no tunnel port and no session, and are
+// only asked to connect once a consumer arrives. Consumers wait up to wait
+// for a standby client to connect when none is.
+type onDemandTable struct {
+	ports []*onDemandPort
+	wait  time.Duration
+
+	// closed and replaced whenever a standby client announces a target
+	lock    sync.Mutex
+	changed chan struct{}
+}
+
+// loadOnDemandFile loads "port host:port [key=value ...]" entries, the labels
+// select the standby clients serving the port
+func loadOnDemandFile(path string, wait time.Duration) (*onDemandTable, error) {
+	lines, err := readConfigFields(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &onDemandTable{wait: wait, changed: make(chan struct{})}
+	ports := make(map[int]bool)
+	for i, fields := range lines {
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s: entry %d: expected \"port host:port [key=value ...]\"", path, i+1)
+		}
+
+		port, err := strconv.Atoi(fields[0])
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("%s: entry %d: invalid port %q", path, i+1, fields[0])
+		}
+		if ports[port] {
+			return nil, fmt.Errorf("%s: entry %d: port %d is listed twice", path, i+1, port)
+		}
+		ports[port] = true
+
+		host, p, err := net.SplitHostPort(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: entry %d: %v", path, i+1, err)
+		}
+		proxyPort, err := strconv.Atoi(p)
+		if err != nil || proxyPort < 1 || proxyPort > 65535 {
+			return nil, fmt.Errorf("%s: entry %d: invalid target port %q", path, i+1, p)
+		}
+
+		o := &onDemandPort{port: port, proxyAddress: host, proxyPort: proxyPort}
+		for _, pair := range fields[2:] {
+			key, value, err := ParseLabel(pair)
+			if err != nil {
+				return nil, fmt.Errorf("%s: entry %d: %v", path, i+1, err)
+			}
+			if o.selector == nil {
+				o.selector = make(map[string]string)
+			}
+			o.selector[key] = value
+		}
+
+		t.ports = append(t.ports, o)
+	}
+
+	return t, nil
+}
+
+// portFor returns the on-demand port serving the target for a standby
+// client with labels, nil if there is none
+func (t *onDemandTable) portFor(proxyAddress string, proxyPort int, labels map[string]string) *onDemandPort {
+	if t == nil {
+		return nil
+	}
+
+	for _, o := range t.ports {
+		if o.proxyAddress == proxyAddress && o.proxyPort == proxyPort && matchLabels(labels, o.selector) {
+			return o
+		}
+	}
+	return nil
+}
+
+// notify wakes the consumers waiting for a standby client
+func (t *onDemandTable) notify() {
+	t.lock.Lock()
+	close(t.changed)
+	t.changed = make(chan struct{})
+	t.lock.Unlock()
+}
+
+func (t *onDemandTable) changedChannel() <-chan struct{} {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.changed
+}
+
+// startOnDemandPorts binds the on-demand ports, they close along with the
+// provider
+func (p *Provider) startOnDemandPorts() error {
+	for _, o := range p.onDemand.ports {
+		listeners, err := p.bind(fmt.Sprintf(":%d", o.port))
+		if err != nil {
+			for _, bound := range p.onDemand.ports {
+				for _, l := range bound.listeners {
+					l.Close()
+				}
+			}
+			return fmt.Errorf("on-demand port %d: %v", o.port, err)
+		}
+		o.listeners = listeners
+
+		for _, l := range listeners {
+			l, o := l, o
+			supervise("on-demand port accept loop", func() { p.acceptOnDemand(o, l) })
+		}
+
+		logger.info("On-demand port is open", "tunnel_port", o.port, "target", o.target())
+	}
+
+	go func() {
+		<-p.ctx.Done()
+		for _, o := range p.onDemand.ports {
+			for _, l := range o.listeners {
+				l.Close()
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (p *Provider) acceptOnDemand(o *onDemandPort, l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if p.ctx.Err() == nil {
+				logger.error("On-demand port accept error", "tunnel_port", o.port, "error", err)
+			}
+			return
+		}
+		p.socketOptions.apply(c)
+
+		go p.onOnDemandConnection(o, c)
+	}
+}
+
+// onOnDemandConnection hands the consumer to the least busy standby client
+// serving the port, waiting for one to connect if there is none
+func (p *Provider) onOnDemandConnection(o *onDemandPort, c net.Conn) {
+	defer recoverPanic("on-demand data connection", func() { c.Close() })
+
+	timer := time.NewTimer(p.onDemand.wait)
+	defer timer.Stop()
+
+	for {
+		changed := p.onDemand.changedChannel()
+		if tc := p.standbyClientFor(o); tc != nil {
+			// the service the standby client named decides on TLS termination
+			f := forward{proxyAddress: o.proxyAddress, proxyPort: o.proxyPort, tunnelPort: o.port}
+			if known, ok := tc.forwardOf(o.proxyAddress, o.proxyPort); ok {
+				f.service = known.service
+			}
+			tc.onIncomingConnection(f, c)
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			logger.warn("No standby client for on-demand port, reject data connection", "tunnel_port", o.port,
+				"target", o.target(), "client", c.RemoteAddr())
+			c.Close()
+			return
+		case <-p.ctx.Done():
+			c.Close()
+			return
+		}
+	}
+}
+
+// standbyClientFor returns the standby client forwarding the target of o
+// with the fewest data connections, nil if none is connected
+func (p *Provider) standbyClientFor(o *onDemandPort) *TunnelConnection {
+	var selected *TunnelConnection
+	least := 0
+	for _, tc := range p.tunnelConnectionList() {
+		if atomic.LoadInt32(&tc.standby) == 0 || tc.ctx.Err() != nil || !tc.isForwarded(o.proxyAddress, o.proxyPort) ||
+			!matchLabels(tc.labels, o.selector) {
+			continue
+		}
+
+		if n := len(tc.dataConnections()); selected == nil || n < least {
+			selected, least = tc, n
+		}
+	}
+	return selected
+}
+
+// onStandbyRequest records a target the standby client tc serves for an
+// on-demand port, no tunnel port is opened for it
+func (tc *TunnelConnection) onStandbyRequest(pdu *ListenRequest) {
+	target := net.JoinHostPort(pdu.proxyAddress, strconv.Itoa(pdu.proxyPort))
+
+	o := tc.provider.onDemand.portFor(pdu.proxyAddress, pdu.proxyPort, tc.labels)
+	if o == nil {
+		tc.log.warn("Reject standby request, no on-demand port serves the target", "identity", tc.identity, "target", target)
+
+		tc.sendError(0, ERROR_NOT_FOUND, fmt.Sprintf("no on-demand port serves target %s", target))
+		return
+	}
+
+	// read by the data connections of on-demand ports from then on
+	if atomic.LoadInt32(&tc.standby) == 0 {
+		tc.quota = tc.provider.quotas.quotaFor(tc.identity)
+	}
+
+	tc.addForward(forward{proxyAddress: pdu.proxyAddress, proxyPort: pdu.proxyPort, tunnelPort: o.port,
+		service: pdu.service, priority: priorityFrom(pdu.ext)})
+	atomic.StoreInt32(&tc.standby, 1)
+	tc.log.info("Standby for on-demand port", "identity", tc.identity, "target", target, "tunnel_port", o.port)
+
+	tc.send(&ListenResponse{
+		tunnelAddress: "0.0.0.0",
+		tunnelPort:    o.port,
+		proxyAddress:  pdu.proxyAddress,
+		proxyPort:     pdu.proxyPort,
+	})
+
+	tc.provider.onDemand.notify()
+}
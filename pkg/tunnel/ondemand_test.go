@@ -0,0 +1,144 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadOnDemandFile(t *testing.T) {
+	assert := require.New(t)
+
+	path := writeTenantFile(t, "8443 localhost:443 env=prod site=fra1 # edge web\n2222 10.0.0.5:22\n")
+	defer os.Remove(path)
+
+	table, err := loadOnDemandFile(path, time.Second)
+	assert.Nil(err)
+	assert.Len(table.ports, 2)
+	assert.Equal("localhost:443", table.ports[0].target())
+	assert.Equal(map[string]string{"env": "prod", "site": "fra1"}, table.ports[0].selector)
+
+	assert.Equal(8443, table.portFor("localhost", 443, map[string]string{"env": "prod", "site": "fra1", "hostname": "edge-17"}).port)
+	assert.Nil(table.portFor("localhost", 443, map[string]string{"env": "dev"}))
+	assert.Equal(2222, table.portFor("10.0.0.5", 22, nil).port)
+
+	for _, content := range []string{"8443\n", "http localhost:443\n", "8443 localhost\n", "8443 localhost:443 env\n", "8443 a:1\n8443 b:2\n"} {
+		path := writeTenantFile(t, content)
+		_, err := loadOnDemandFile(path, time.Second)
+		assert.NotNil(err, content)
+		os.Remove(path)
+	}
+}
+
+func TestOnDemandPort(t *testing.T) {
+	assert := require.New(t)
+
+	target, err := startEchoServer()
+	assert.Nil(err)
+
+	l, err := net.Listen("tcp4", ":0")
+	assert.Nil(err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	path := writeTenantFile(t, fmt.Sprintf("%d %s env=prod\n", port, target.String()))
+	defer os.Remove(path)
+
+	p, err := NewProvider(Config{OnDemandFile: path, OnDemandWait: 5 * time.Second})
+	assert.Nil(err)
+	defer p.Close()
+	addr, err := p.StartListener(0)
+	assert.Nil(err)
+
+	// the consumer arrives first and waits for a standby client
+	consumer, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+	assert.Nil(err)
+	defer consumer.Close()
+
+	client := newProvider()
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tun, err := client.Connect(ctx, ConnectorConfig{
+		ProviderAddress: fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port),
+		Target:          target.String(),
+		Labels:          map[string]string{"env": "prod"},
+		Standby:         true,
+	})
+	assert.Nil(err)
+	defer tun.Close()
+	assert.Equal(port, tun.Port())
+
+	_, err = consumer.Write([]byte("ping"))
+	assert.Nil(err)
+	reply := make([]byte, 4)
+	consumer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(consumer, reply)
+	assert.Nil(err)
+	assert.Equal("ping", string(reply))
+
+	// no tunnel port of its own
+	tenants := p.tenantSnapshot()
+	assert.Equal(0, tenants[0].Tunnels)
+}
+
+func TestOnDemandServiceTLS(t *testing.T) {
+	assert := require.New(t)
+
+	target, err := startEchoServer()
+	assert.Nil(err)
+
+	l, err := net.Listen("tcp4", ":0")
+	assert.Nil(err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	onDemand := writeTenantFile(t, fmt.Sprintf("%d %s\n", port, target.String()))
+	defer os.Remove(onDemand)
+	serviceTLS := writeTenantFile(t, "web plain\n")
+	defer os.Remove(serviceTLS)
+
+	p, err := NewProvider(Config{OnDemandFile: onDemand, OnDemandWait: 5 * time.Second, ServiceTLSFile: serviceTLS})
+	assert.Nil(err)
+	defer p.Close()
+	addr, err := p.StartListener(0)
+	assert.Nil(err)
+	assert.Nil(p.serviceTLS.upload("", "web", newTestCertificatePEM(t, "web.example.com")))
+
+	client := newProvider()
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tun, err := client.Connect(ctx, ConnectorConfig{
+		ProviderAddress: fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port),
+		Target:          "web=" + target.String(),
+		Standby:         true,
+	})
+	assert.Nil(err)
+	defer tun.Close()
+
+	// the provider terminates TLS for the service the standby client named
+	consumer, err := tls.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{InsecureSkipVerify: true})
+	assert.Nil(err)
+	defer consumer.Close()
+	assert.Equal("CN=web.example.com", consumer.ConnectionState().PeerCertificates[0].Subject.String())
+
+	_, err = consumer.Write([]byte("ping"))
+	assert.Nil(err)
+	reply := make([]byte, 4)
+	consumer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(consumer, reply)
+	assert.Nil(err)
+	assert.Equal("ping", string(reply))
+}
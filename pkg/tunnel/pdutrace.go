@@ -0,0 +1,76 @@
+package tunnel
+
+import "encoding/hex"
+
+// trace logs pdu at trace level with the handles it references and, with
+// TraceBytes set, a hex dump of the leading bytes of frame, its encoding
+// from the type on. PDUs carrying credentials are never dumped.
+func (tc *TunnelConnection) trace(event string, pdu Serializable, frame []byte) {
+	if !tc.log.enabled(levelTrace) {
+		return
+	}
+
+	kv := append([]interface{}{"type", pduNames[pdu.GetSerialType()], "length", pdu.GetSerialLength()},
+		traceHandles(pdu)...)
+
+	if n := tc.provider.traceBytes; n > 0 && traceSecret(pdu) {
+		kv = append(kv, "dump", "redacted")
+	} else if n > 0 {
+		if n > len(frame) {
+			n = len(frame)
+		}
+		kv = append(kv, "dump", hex.EncodeToString(frame[:n]))
+	}
+
+	tc.log.trace(event, kv...)
+}
+
+// traceHandles returns the data connection handles pdu references as log
+// key/value pairs
+func traceHandles(pdu Serializable) []interface{} {
+	switch pdu := pdu.(type) {
+	case *TunnelDataIndication:
+		return []interface{}{"handle", pdu.peerConnectionHandle}
+
+	case *TunnelDatagramIndication:
+		return []interface{}{"handle", pdu.peerConnectionHandle}
+
+	case *TunnelConnectRequest:
+		return []interface{}{"handle", pdu.dataConnectionHandle}
+
+	case *TunnelConnectResponse:
+		return []interface{}{"handle", pdu.dataConnectionHandle, "peer_handle", pdu.proxyConnectionHandle}
+
+	case *TunnelDisconnectRequest:
+		return []interface{}{"handle", pdu.peerConnectionHandle}
+
+	case *TunnelDisconnectResponse:
+		return []interface{}{"handle", pdu.peerConnectionHandle}
+
+	case *ErrorIndication:
+		return []interface{}{"handle", pdu.peerConnectionHandle, "code", pdu.code}
+
+	case *ChannelSwitchIndication:
+		return []interface{}{"handle", pdu.peerConnectionHandle}
+
+	case *KeepaliveRequest:
+		return []interface{}{"handles", len(pdu.peerConnectionHandles)}
+
+	case *KeepaliveResponse:
+		return []interface{}{"handles", len(pdu.unknownHandles)}
+	}
+
+	return nil
+}
+
+// traceSecret reports whether pdu carries credentials: the JWT or MAC of an
+// AuthRequest, the data channel token of a HelloResponse or
+// DataChannelRequest
+func traceSecret(pdu Serializable) bool {
+	switch pdu.(type) {
+	case *AuthRequest, *HelloResponse, *DataChannelRequest:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,55 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// portRange restricts dynamically allocated tunnel ports, the zero value
+// lets the OS pick any ephemeral port
+type portRange struct {
+	min int
+	max int
+}
+
+// parsePortRange parses "20000-21000"
+func parsePortRange(s string) (portRange, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return portRange{}, fmt.Errorf("invalid port range %q, expected min-max", s)
+	}
+
+	min, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port range %q: %v", s, err)
+	}
+
+	max, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port range %q: %v", s, err)
+	}
+
+	if min < 1 || max > 65535 || min > max {
+		return portRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+
+	return portRange{min: min, max: max}, nil
+}
+
+// listen binds the lowest free port of the range with bind
+func (r portRange) listen(bind func(address string) ([]net.Listener, error)) ([]net.Listener, error) {
+	if r.min == 0 {
+		return bind(":0")
+	}
+
+	for port := r.min; port <= r.max; port++ {
+		listeners, err := bind(fmt.Sprintf(":%d", port))
+		if err == nil {
+			return listeners, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no free tunnel port in range %d-%d", r.min, r.max)
+}
@@ -0,0 +1,31 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortRange(t *testing.T) {
+	assert := require.New(t)
+
+	_, err := parsePortRange("21000-20000")
+	assert.Error(err)
+
+	// find two adjacent free ports to build a range from
+	probe, err := net.Listen("tcp4", ":0")
+	assert.NoError(err)
+	port := probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+
+	p := newProvider()
+	r := portRange{min: port, max: port}
+	l, err := r.listen(p.bind)
+	assert.NoError(err)
+	assert.Equal(port, l[0].Addr().(*net.TCPAddr).Port)
+
+	_, err = r.listen(p.bind)
+	assert.Error(err)
+	l[0].Close()
+}
@@ -0,0 +1,100 @@
+package tunnel
+
+// priority is the class a data connection is scheduled in by the writer of
+// its tunnel connection. Frames of higher classes are written ahead of those
+// queued in lower ones, so that e.g. SSH sessions stay responsive while a
+// backup saturates the link. The zero value is the default class.
+type priority int
+
+const (
+	priorityNormal priority = iota
+	priorityHigh
+	priorityLow
+
+	priorityClasses = 3
+)
+
+// the order the writer drains the classes in when the class of the turn has
+// nothing queued
+var prioritySchedule = [priorityClasses]priority{priorityHigh, priorityNormal, priorityLow}
+
+// the class each turn of the writer favors, weighing high, normal and low
+// 4:2:1 while all of them have frames queued. Lower classes are slowed down
+// rather than starved: their data frames are sealed when queued, under
+// payload keys the peer drops two rekeys later.
+var priorityTurns = [...]priority{
+	priorityHigh, priorityNormal, priorityHigh, priorityLow, priorityHigh, priorityNormal, priorityHigh,
+}
+
+var priorityNames = map[priority]string{
+	priorityNormal: "normal",
+	priorityHigh:   "high",
+	priorityLow:    "low",
+}
+
+func (c priority) String() string {
+	return priorityNames[c]
+}
+
+// parsePriority returns the class named name, false if there is none
+func parsePriority(name string) (priority, bool) {
+	for c, n := range priorityNames {
+		if n == name {
+			return c, true
+		}
+	}
+	return priorityNormal, false
+}
+
+// priorityFrom decodes the EXT_LISTEN_PRIORITY extension of a ListenRequest,
+// unknown classes of newer peers are scheduled as normal
+func priorityFrom(ext extensions) priority {
+	value := ext[EXT_LISTEN_PRIORITY]
+	if len(value) != 1 || int(value[0]) >= priorityClasses {
+		return priorityNormal
+	}
+	return priority(value[0])
+}
+
+// dequeue returns the next frame to write, taking it from the class of the
+// turn, or else the highest class with frames queued. Unless wait is set it
+// returns false rather than block when nothing is queued; waiting it returns
+// false once tc is closed.
+func (tc *TunnelConnection) dequeue(wait bool) (outboundFrame, bool) {
+	turn := priorityTurns[tc.turn]
+	tc.turn = (tc.turn + 1) % len(priorityTurns)
+
+	select {
+	case frame := <-tc.outbound[turn]:
+		return frame, true
+
+	default:
+	}
+
+	for _, c := range prioritySchedule {
+		select {
+		case frame := <-tc.outbound[c]:
+			return frame, true
+
+		default:
+		}
+	}
+
+	if !wait {
+		return outboundFrame{}, false
+	}
+
+	select {
+	case frame := <-tc.outbound[priorityHigh]:
+		return frame, true
+
+	case frame := <-tc.outbound[priorityNormal]:
+		return frame, true
+
+	case frame := <-tc.outbound[priorityLow]:
+		return frame, true
+
+	case <-tc.ctx.Done():
+		return outboundFrame{}, false
+	}
+}
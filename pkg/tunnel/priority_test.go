@@ -0,0 +1,102 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseForwardPriority(t *testing.T) {
+	assert := require.New(t)
+
+	f := parseForward("ssh=localhost:22/high")
+	assert.Equal("ssh", f.service)
+	assert.Equal("localhost:22", f.target())
+	assert.Equal(priorityHigh, f.priority)
+
+	assert.Equal(priorityLow, parseForward("backup:873/low").priority)
+	assert.Equal(priorityNormal, parseForward("localhost:8080").priority)
+	assert.Equal(priorityNormal, parseForward("localhost:8080/urgent").priority)
+	assert.Equal("high", f.info().Priority)
+}
+
+func TestListenRequestPriority(t *testing.T) {
+	assert := require.New(t)
+
+	pdu := &ListenRequest{proxyAddress: "localhost", proxyPort: 22, ext: extensions{EXT_LISTEN_PRIORITY: {byte(priorityHigh)}}}
+	clone := serializePduFrom(bytes.NewBuffer(encodePdu(pdu)[4:])).(*ListenRequest)
+	assert.Equal(priorityHigh, priorityFrom(clone.ext))
+
+	// requests of older connectors, and classes of newer ones
+	assert.Equal(priorityNormal, priorityFrom(nil))
+	assert.Equal(priorityNormal, priorityFrom(extensions{EXT_LISTEN_PRIORITY: {9}}))
+}
+
+func TestWriteLoopPriority(t *testing.T) {
+	assert := require.New(t)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	tc := newProvider().newTunnelConnection(local)
+	defer tc.cancel()
+
+	// bulk holds all of its credits, interactive frames still get through
+	low := &TunnelDataIndication{peerConnectionHandle: 1, data: []byte("backup")}
+	for i := 0; i < dataSendCredits; i++ {
+		assert.Nil(tc.sendData(low, priorityLow))
+	}
+	normal := &TunnelDisconnectRequest{peerConnectionHandle: 2}
+	assert.Nil(tc.send(normal))
+	high := &TunnelDataIndication{peerConnectionHandle: 3, data: []byte("keystroke")}
+	assert.Nil(tc.sendData(high, priorityHigh))
+
+	go tc.writeLoop()
+
+	expected := append(encodePdu(high), encodePdu(normal)...)
+	for i := 0; i < dataSendCredits; i++ {
+		expected = append(expected, encodePdu(low)...)
+	}
+
+	buf := make([]byte, len(expected))
+	_, err := io.ReadFull(remote, buf)
+	assert.Nil(err)
+	assert.Equal(expected, buf)
+}
+
+func TestWriteLoopPriorityNoStarvation(t *testing.T) {
+	assert := require.New(t)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	tc := newProvider().newTunnelConnection(local)
+	defer tc.cancel()
+
+	high := &TunnelDataIndication{peerConnectionHandle: 3, data: []byte("keystroke")}
+	for i := 0; i < 20; i++ {
+		assert.Nil(tc.sendAt(high, priorityHigh))
+	}
+	low := &TunnelDataIndication{peerConnectionHandle: 1, data: []byte("backup")}
+	assert.Nil(tc.sendData(low, priorityLow))
+
+	go tc.writeLoop()
+
+	// the fourth turn is the low class', the normal turn falls to high
+	var expected []byte
+	for i := 0; i < 3; i++ {
+		expected = append(expected, encodePdu(high)...)
+	}
+	expected = append(expected, encodePdu(low)...)
+	for i := 3; i < 20; i++ {
+		expected = append(expected, encodePdu(high)...)
+	}
+
+	buf := make([]byte, len(expected))
+	_, err := io.ReadFull(remote, buf)
+	assert.Nil(err)
+	assert.Equal(expected, buf)
+}
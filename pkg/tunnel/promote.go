@@ -0,0 +1,159 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+// the connector measures the throughput of its data connections this often
+const promoteInterval = time.Second
+
+// A busy data connection is promoted to a data channel of its own: the
+// connector dials it with EXT_CHANNEL_DEDICATED once the data connection
+// relays more than its promote rate, and both ends move the PDUs of the data
+// connection onto it. Each end switches with the next PDU it sends, after a
+// ChannelSwitchIndication over the connection used so far; the receiver
+// holds what arrives over the dedicated channel until that indication, so
+// that payload stays in order. The dedicated channel closes with its data
+// connection, losing it closes the data connection only.
+
+// promoteLoop promotes the data connections of tc relaying more than
+// tc.promoteRate bytes per second, in both directions together
+func (tc *TunnelConnection) promoteLoop(token []byte) {
+	ticker := time.NewTicker(promoteInterval)
+	defer ticker.Stop()
+
+	// bytes relayed by each data connection at the previous tick
+	relayed := make(map[*DataConnection]uint64)
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-tc.ctx.Done():
+			return
+		}
+
+		seen := make(map[*DataConnection]uint64)
+		for _, dc := range tc.dataConnections() {
+			counters := dc.snapshot()
+			total := counters.RxBytes + counters.TxBytes
+			seen[dc] = total
+
+			last, ok := relayed[dc]
+			if !ok || dc.promoting || atomic.LoadUint32(&dc.opened) == 0 {
+				continue
+			}
+
+			rate := float64(total-last) / promoteInterval.Seconds()
+			if rate >= float64(tc.promoteRate) {
+				dc.promoting = true
+				go tc.promote(dc, token)
+			}
+		}
+		relayed = seen
+	}
+}
+
+// promote dials a data channel dedicated to dc
+func (tc *TunnelConnection) promote(dc *DataConnection, token []byte) {
+	conn, err := tc.provider.dialProvider(tc.providerAddress)
+	if err != nil {
+		dc.log.warn("Data channel dial error", "error", err)
+		return
+	}
+
+	var handle [4]byte
+	binary.BigEndian.PutUint32(handle[:], dc.peerHandle)
+
+	ch := tc.provider.newDataChannel(tc, conn)
+	ch.promoted = dc
+	ch.open()
+	ch.send(&DataChannelRequest{token: token, ext: extensions{EXT_CHANNEL_DEDICATED: handle[:]}})
+}
+
+// acceptDedicated turns tc, a freshly accepted connection, into the
+// dedicated data channel of the data connection of owner handle names. The
+// response goes out ahead of any PDU of the data connection.
+func (tc *TunnelConnection) acceptDedicated(owner *TunnelConnection, handle []byte) {
+	var dc *DataConnection
+	if len(handle) == 4 && owner.capabilities&CAPABILITY_PROMOTE != 0 {
+		dc = owner.provider.getDataConnection(binary.BigEndian.Uint32(handle))
+	}
+	if dc == nil || dc.tunnelConnection != owner {
+		tc.log.warn("Refuse dedicated data channel, unknown data connection")
+		tc.send(&DataChannelResponse{code: ERROR_NOT_FOUND})
+		return
+	}
+
+	if tc.provider.tunnelConnections.loadAndDelete(tc.handle) != nil {
+		metrics.tunnelsActive.Add(-1)
+	}
+	tc.owner = owner
+	tc.promoted = dc
+
+	tc.send(&DataChannelResponse{})
+	if !dc.attachDedicated(tc) {
+		tc.conn.Close()
+		return
+	}
+	dc.log.info("Promote data connection to a data channel", "channel", tc.handle, "remote", tc.conn.RemoteAddr())
+}
+
+// attachDedicated makes ch the dedicated data channel of dc, taken over by
+// the next PDU dc sends. False once dc is closed or has one.
+func (dc *DataConnection) attachDedicated(ch *TunnelConnection) bool {
+	dc.channelLock.Lock()
+	defer dc.channelLock.Unlock()
+
+	if dc.ctx.Err() != nil || dc.dedicated != nil {
+		return false
+	}
+	dc.dedicated = ch
+	return true
+}
+
+// sender returns the connection dc sends its PDUs over, switching to its
+// dedicated data channel first once it has one
+func (dc *DataConnection) sender() *TunnelConnection {
+	dc.channelLock.Lock()
+	defer dc.channelLock.Unlock()
+
+	if dc.dedicated != nil && dc.channel != dc.dedicated {
+		// queued behind everything dc sent over the previous connection
+		dc.channel.sendAt(&ChannelSwitchIndication{peerConnectionHandle: dc.peerHandle}, dc.priority)
+		dc.channel = dc.dedicated
+	}
+	return dc.channel
+}
+
+// closeDedicated closes the dedicated data channel of a closed data
+// connection once the PDUs queued on it are written
+func (dc *DataConnection) closeDedicated() {
+	dc.channelLock.Lock()
+	ch := dc.dedicated
+	dc.channelLock.Unlock()
+
+	if ch != nil {
+		ch.enqueue(outboundFrame{class: dc.priority, last: true})
+	}
+}
+
+// onChannelSwitchIndication releases the PDUs of the data connection held on
+// its dedicated data channel
+func (tc *TunnelConnection) onChannelSwitchIndication(pdu *ChannelSwitchIndication) {
+	if dc := tc.primary().peerDataConnection(pdu.peerConnectionHandle, PDU_CHANNEL_SWITCH_INDICATION); dc != nil {
+		dc.switchOnce.Do(func() { close(dc.switched) })
+	}
+}
+
+// awaitSwitch holds a PDU of dc read from its dedicated data channel until
+// the peer has switched to it, false once dc is closed
+func (dc *DataConnection) awaitSwitch() bool {
+	select {
+	case <-dc.switched:
+		return true
+	case <-dc.ctx.Done():
+		return false
+	}
+}
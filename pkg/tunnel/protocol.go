@@ -0,0 +1,1285 @@
+package tunnel
+
+// Wire format: every PDU is a frame of a 4 byte big endian length, then a
+// 1 byte type and the fields of the type. Peers of different versions
+// interoperate under these rules:
+//
+//   - A receiver skips frames of PDU types it does not know, the length
+//     keeps it in sync. A sender only sends a new PDU type once the peer
+//     offered or accepted the capability that introduced it.
+//   - Fields are never removed, reordered or retyped. A new fixed field is
+//     appended to its PDU, a receiver reads fields beyond the end of the PDU
+//     of an older peer as zero and ignores bytes past the fields it knows.
+//   - PDUs that may grow optional fields end with an extension area, see
+//     extensions. Once a PDU has one, new fields go into it rather than
+//     after it, and a receiver skips extension types it does not know.
+//
+// The payloads of TunnelDataIndication and TunnelDatagramIndication are
+// exempt, they end their PDU.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"sync"
+)
+
+const (
+	PDU_LISTEN_REQUEST             = 1
+	PDU_LISTEN_RESPONSE            = 2
+	PDU_TUNNEL_CONNECT_REQUEST     = 3
+	PDU_TUNNEL_CONNECT_RESPONSE    = 4
+	PDU_TUNNEL_DATA_INDICATION     = 5
+	PDU_TUNNEL_DISCONNECT_REQUEST  = 6
+	PDU_TUNNEL_DISCONNECT_RESPONSE = 7
+	PDU_AUTH_REQUEST               = 8
+	PDU_ERROR_INDICATION           = 9
+	PDU_HELLO_REQUEST              = 10
+	PDU_HELLO_RESPONSE             = 11
+	PDU_REKEY_INDICATION           = 12
+	PDU_KEEPALIVE_REQUEST          = 13
+	PDU_KEEPALIVE_RESPONSE         = 14
+	PDU_LOOKUP_REQUEST             = 15
+	PDU_LOOKUP_RESPONSE            = 16
+	PDU_RENEGOTIATE_REQUEST        = 17
+	PDU_RENEGOTIATE_RESPONSE       = 18
+	PDU_TUNNEL_DATAGRAM_INDICATION = 19
+	PDU_DATA_CHANNEL_REQUEST       = 20
+	PDU_DATA_CHANNEL_RESPONSE      = 21
+	PDU_CHANNEL_SWITCH_INDICATION  = 22
+	PDU_STATS_INDICATION           = 23
+)
+
+var pduNames = map[int]string{
+	PDU_LISTEN_REQUEST:             "ListenRequest",
+	PDU_LISTEN_RESPONSE:            "ListenResponse",
+	PDU_TUNNEL_CONNECT_REQUEST:     "TunnelConnectRequest",
+	PDU_TUNNEL_CONNECT_RESPONSE:    "TunnelConnectResponse",
+	PDU_TUNNEL_DATA_INDICATION:     "TunnelDataIndication",
+	PDU_TUNNEL_DISCONNECT_REQUEST:  "TunnelDisconnectRequest",
+	PDU_TUNNEL_DISCONNECT_RESPONSE: "TunnelDisconnectResponse",
+	PDU_AUTH_REQUEST:               "AuthRequest",
+	PDU_ERROR_INDICATION:           "ErrorIndication",
+	PDU_HELLO_REQUEST:              "HelloRequest",
+	PDU_HELLO_RESPONSE:             "HelloResponse",
+	PDU_REKEY_INDICATION:           "RekeyIndication",
+	PDU_KEEPALIVE_REQUEST:          "KeepaliveRequest",
+	PDU_KEEPALIVE_RESPONSE:         "KeepaliveResponse",
+	PDU_LOOKUP_REQUEST:             "LookupRequest",
+	PDU_LOOKUP_RESPONSE:            "LookupResponse",
+	PDU_RENEGOTIATE_REQUEST:        "RenegotiateRequest",
+	PDU_RENEGOTIATE_RESPONSE:       "RenegotiateResponse",
+	PDU_TUNNEL_DATAGRAM_INDICATION: "TunnelDatagramIndication",
+	PDU_DATA_CHANNEL_REQUEST:       "DataChannelRequest",
+	PDU_DATA_CHANNEL_RESPONSE:      "DataChannelResponse",
+	PDU_CHANNEL_SWITCH_INDICATION:  "ChannelSwitchIndication",
+	PDU_STATS_INDICATION:           "StatsIndication",
+}
+
+// capability flags negotiated through HelloRequest/HelloResponse
+const (
+	CAPABILITY_ENCRYPTION  = 1 << 0
+	CAPABILITY_COMPRESSION = 1 << 1
+
+	// the connector may send connect requests for targets the listener
+	// dials, granted when Config.AllowDial is set
+	CAPABILITY_DIAL = 1 << 2
+
+	// either peer may change payload processing of the live tunnel with
+	// RenegotiateRequest
+	CAPABILITY_RENEGOTIATE = 1 << 3
+
+	// data connections may relay payload as TunnelDatagramIndication,
+	// one message per PDU
+	CAPABILITY_DATAGRAM = 1 << 4
+
+	// the connector may open data channels, secondary connections carrying
+	// the PDUs of data connections, see DataChannelRequest
+	CAPABILITY_DATA_CHANNELS = 1 << 5
+
+	// the connector may move a busy data connection onto a data channel of
+	// its own, see EXT_CHANNEL_DEDICATED
+	CAPABILITY_PROMOTE = 1 << 6
+
+	// either peer may report its numbers of the tunnel with
+	// StatsIndication
+	CAPABILITY_STATS = 1 << 7
+
+	// the listener hands out an authentication challenge in HelloResponse,
+	// answered by the nonce, timestamp and mac of AuthRequest
+	CAPABILITY_AUTH_CHALLENGE = 1 << 8
+)
+
+// TunnelConnectRequest flags
+const (
+	// the data connection relays messages, both ends send each read as one
+	// TunnelDatagramIndication and write each one received at once
+	CONNECT_DATAGRAM = 1 << 0
+)
+
+// changes a RenegotiateRequest asks for and a RenegotiateResponse grants
+const (
+	RENEGOTIATE_COMPRESS_ON  = 1 << 0
+	RENEGOTIATE_COMPRESS_OFF = 1 << 1
+
+	// new payload keys of cipherSuite from a fresh key exchange, on
+	// encrypted tunnels only
+	RENEGOTIATE_ROTATE = 1 << 2
+)
+
+const (
+	ERROR_UNAUTHENTICATED    = 1
+	ERROR_ACCESS_DENIED      = 2
+	ERROR_ENCRYPTION         = 3
+	ERROR_QUOTA_EXCEEDED     = 4
+	ERROR_RESOURCE_EXHAUSTED = 5
+	ERROR_NOT_FOUND          = 6
+)
+
+type Serializable interface {
+	GetSerialType() int
+	GetSerialLength() uint32
+	SerializeTo(w *bytes.Buffer)
+	SerializeFrom(r *bytes.Buffer)
+}
+
+func serializeUInt32To(v uint32, w *bytes.Buffer) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.Write(b[:])
+}
+
+func serializeUInt32From(r *bytes.Buffer) uint32 {
+	var b [4]byte
+	r.Read(b[:])
+	return binary.BigEndian.Uint32(b[:])
+}
+
+func serializeUInt64To(v uint64, w *bytes.Buffer) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	w.Write(b[:])
+}
+
+func serializeUInt64From(r *bytes.Buffer) uint64 {
+	var b [8]byte
+	r.Read(b[:])
+	return binary.BigEndian.Uint64(b[:])
+}
+
+func getStringSerialLength(s string) uint32 {
+	return uint32(4 + len(s))
+}
+
+func serializeStringTo(s string, w *bytes.Buffer) {
+	serializeUInt32To(uint32(len(s)), w)
+	w.WriteString(s)
+}
+
+// serializeStringFrom reads a string, cut short to what is left of the PDU
+// should the peer's length exceed it
+func serializeStringFrom(r *bytes.Buffer) string {
+	l := int(serializeUInt32From(r))
+	if l > r.Len() {
+		l = r.Len()
+	}
+
+	b := make([]byte, l)
+	r.Read(b)
+	return string(b)
+}
+
+func getBytesSerialLength(b []byte) uint32 {
+	return uint32(4 + len(b))
+}
+
+func serializeBytesTo(b []byte, w *bytes.Buffer) {
+	serializeUInt32To(uint32(len(b)), w)
+	w.Write(b)
+}
+
+func serializeBytesFrom(r *bytes.Buffer) []byte {
+	l := int(serializeUInt32From(r))
+	if l > r.Len() {
+		l = r.Len()
+	}
+
+	b := make([]byte, l)
+	r.Read(b)
+	return b
+}
+
+func getHandlesSerialLength(handles []Handle) uint32 {
+	return uint32(4 + 4*len(handles))
+}
+
+func serializeHandlesTo(handles []Handle, w *bytes.Buffer) {
+	serializeUInt32To(uint32(len(handles)), w)
+	for _, h := range handles {
+		serializeUInt32To(h, w)
+	}
+}
+
+func serializeHandlesFrom(r *bytes.Buffer) []Handle {
+	l := int(serializeUInt32From(r))
+	if l > r.Len()/4 {
+		l = r.Len() / 4
+	}
+
+	handles := make([]Handle, l)
+	for i := range handles {
+		handles[i] = serializeUInt32From(r)
+	}
+	return handles
+}
+
+func getPduSerialLength(pdu Serializable) uint32 {
+	return 1 + pdu.GetSerialLength()
+}
+
+func serializePduTo(pdu Serializable, w *bytes.Buffer) {
+	w.WriteByte(byte(pdu.GetSerialType()))
+	pdu.SerializeTo(w)
+}
+
+func serializePduFrom(r *bytes.Buffer) Serializable {
+	t, _ := r.ReadByte()
+	switch int(t) {
+	case PDU_LISTEN_REQUEST:
+		pdu := &ListenRequest{}
+		pdu.SerializeFrom(r)
+		return pdu
+
+	case PDU_LISTEN_RESPONSE:
+		pdu := &ListenResponse{}
+		pdu.SerializeFrom(r)
+		return pdu
+
+	case PDU_TUNNEL_CONNECT_REQUEST:
+		pdu := &TunnelConnectRequest{}
+		pdu.SerializeFrom(r)
+		return pdu
+
+	case PDU_TUNNEL_CONNECT_RESPONSE:
+		pdu := &TunnelConnectResponse{}
+		pdu.SerializeFrom(r)
+		return pdu
+
+	case PDU_TUNNEL_DATA_INDICATION:
+		pdu := &TunnelDataIndication{}
+		pdu.SerializeFrom(r)
+		return pdu
+
+	case PDU_TUNNEL_DISCONNECT_REQUEST:
+		pdu := &TunnelDisconnectRequest{}
+		pdu.SerializeFrom(r)
+		return pdu
+
+	case PDU_TUNNEL_DISCONNECT_RESPONSE:
+		pdu := &TunnelDisconnectResponse{}
+		pdu.SerializeFrom(r)
+		return pdu
+
+	case PDU_AUTH_REQUEST:
+		pdu := &AuthRequest{}
+		pdu.SerializeFrom(r)
+		return pdu
+
+	case PDU_ERROR_INDICATION:
+		pdu := &ErrorIndication{}
+		pdu.SerializeFrom(r)
+		return pdu
+
+	case PDU_HELLO_REQUEST:
+		pdu := &HelloRequest{}
+		pdu.SerializeFrom(r)
+		return pdu
+
+	case PDU_HELLO_RESPONSE:
+		pdu := &HelloResponse{}
+		pdu.SerializeFrom(r)
+		return pdu
+
+	case PDU_REKEY_INDICATION:
+		pdu := &RekeyIndication{}
+		pdu.SerializeFrom(r)
+		return pdu
+
+	case PDU_KEEPALIVE_REQUEST:
+		pdu := &KeepaliveRequest{}
+		pdu.SerializeFrom(r)
+		return pdu
+
+	case PDU_KEEPALIVE_RESPONSE:
+		pdu := &KeepaliveResponse{}
+		pdu.SerializeFrom(r)
+		return pdu
+
+	case PDU_LOOKUP_REQUEST:
+		pdu := &LookupRequest{}
+		pdu.SerializeFrom(r)
+		return pdu
+
+	case PDU_LOOKUP_RESPONSE:
+		pdu := &LookupResponse{}
+		pdu.SerializeFrom(r)
+		return pdu
+
+	case PDU_RENEGOTIATE_REQUEST:
+		pdu := &RenegotiateRequest{}
+		pdu.SerializeFrom(r)
+		return pdu
+
+	case PDU_RENEGOTIATE_RESPONSE:
+		pdu := &RenegotiateResponse{}
+		pdu.SerializeFrom(r)
+		return pdu
+
+	case PDU_TUNNEL_DATAGRAM_INDICATION:
+		pdu := &TunnelDatagramIndication{}
+		pdu.SerializeFrom(r)
+		return pdu
+
+	case PDU_DATA_CHANNEL_REQUEST:
+		pdu := &DataChannelRequest{}
+		pdu.SerializeFrom(r)
+		return pdu
+
+	case PDU_DATA_CHANNEL_RESPONSE:
+		pdu := &DataChannelResponse{}
+		pdu.SerializeFrom(r)
+		return pdu
+
+	case PDU_CHANNEL_SWITCH_INDICATION:
+		pdu := &ChannelSwitchIndication{}
+		pdu.SerializeFrom(r)
+		return pdu
+
+	case PDU_STATS_INDICATION:
+		pdu := &StatsIndication{}
+		pdu.SerializeFrom(r)
+		return pdu
+	}
+
+	// unknown types of newer peers, skipped by onTunnelPacket at debug level
+	return nil
+}
+
+// buffers larger than this are left to the GC rather than pooled
+const maxPooledFrame = 64 * 1024
+
+var framePool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// resizeBuffer returns b resized to n bytes, reallocating only when its
+// capacity is too small
+func resizeBuffer(b []byte, n int) []byte {
+	if cap(b) < n {
+		return make([]byte, n)
+	}
+	return b[:n]
+}
+
+// encodePduTo writes the complete frame of pdu, 4 byte length, type and
+// body, to w, growing it once up front
+func encodePduTo(pdu Serializable, w *bytes.Buffer) {
+	l := getPduSerialLength(pdu)
+
+	w.Grow(int(4 + l))
+	serializeUInt32To(l, w)
+	serializePduTo(pdu, w)
+}
+
+// encodePdu returns the complete frame of pdu
+func encodePdu(pdu Serializable) []byte {
+	buf := new(bytes.Buffer)
+	encodePduTo(pdu, buf)
+
+	return buf.Bytes()
+}
+
+// newFrame encodes pdu into a pooled buffer, hand it back with releaseFrame
+// once written
+func newFrame(pdu Serializable) *bytes.Buffer {
+	buf := framePool.Get().(*bytes.Buffer)
+	buf.Reset()
+	encodePduTo(pdu, buf)
+
+	return buf
+}
+
+func releaseFrame(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledFrame {
+		framePool.Put(buf)
+	}
+}
+
+// extensions is the extension area ending a PDU: entries of a 2 byte
+// type, a 4 byte length and the value, up to the end of the PDU. Types are
+// assigned per PDU type; the PDU of an older peer has none, and handlers
+// look up the types they know only.
+type extensions map[uint16][]byte
+
+func getExtensionsSerialLength(e extensions) uint32 {
+	n := uint32(0)
+	for _, value := range e {
+		n += 6 + uint32(len(value))
+	}
+	return n
+}
+
+// serializeExtensionsTo writes the entries ordered by type
+func serializeExtensionsTo(e extensions, w *bytes.Buffer) {
+	kinds := make([]int, 0, len(e))
+	for kind := range e {
+		kinds = append(kinds, int(kind))
+	}
+	sort.Ints(kinds)
+
+	for _, kind := range kinds {
+		var b [2]byte
+		binary.BigEndian.PutUint16(b[:], uint16(kind))
+		w.Write(b[:])
+		serializeBytesTo(e[uint16(kind)], w)
+	}
+}
+
+// serializeExtensionsFrom reads the entries up to the end of the PDU, an
+// entry cut short ends them
+func serializeExtensionsFrom(r *bytes.Buffer) extensions {
+	var e extensions
+	for r.Len() >= 6 {
+		var b [2]byte
+		r.Read(b[:])
+		kind := binary.BigEndian.Uint16(b[:])
+
+		l := int(serializeUInt32From(r))
+		if l > r.Len() {
+			r.Reset()
+			break
+		}
+
+		if e == nil {
+			e = make(extensions)
+		}
+		e[kind] = append([]byte(nil), r.Next(l)...)
+	}
+	return e
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+type ListenRequest struct {
+	proxyAddress string
+	proxyPort    int
+
+	// optional, name to register the tunnel port under, empty when sent by
+	// older connectors
+	service string
+
+	// the connector serves the target for an on-demand port of the
+	// listener rather than requesting a tunnel port of its own
+	standby bool
+
+	// optional fields, see extensions and EXT_LISTEN_XXX
+	ext extensions
+}
+
+// extension types of ListenRequest
+const (
+	// 1 byte priority class the data connections of the forward are
+	// scheduled in, normal if absent
+	EXT_LISTEN_PRIORITY = 1
+)
+
+func (pdu *ListenRequest) GetSerialType() int {
+	return PDU_LISTEN_REQUEST
+}
+
+func (pdu *ListenRequest) GetSerialLength() uint32 {
+	return 8 + getStringSerialLength(pdu.proxyAddress) + getStringSerialLength(pdu.service) + getExtensionsSerialLength(pdu.ext)
+}
+
+func (pdu *ListenRequest) SerializeTo(w *bytes.Buffer) {
+	serializeStringTo(pdu.proxyAddress, w)
+	serializeUInt32To(uint32(pdu.proxyPort), w)
+	serializeStringTo(pdu.service, w)
+
+	var standby uint32
+	if pdu.standby {
+		standby = 1
+	}
+	serializeUInt32To(standby, w)
+	serializeExtensionsTo(pdu.ext, w)
+}
+
+func (pdu *ListenRequest) SerializeFrom(r *bytes.Buffer) {
+	pdu.proxyAddress = serializeStringFrom(r)
+	pdu.proxyPort = int(serializeUInt32From(r))
+	pdu.service = serializeStringFrom(r)
+	pdu.standby = serializeUInt32From(r) != 0
+	pdu.ext = serializeExtensionsFrom(r)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+type ListenResponse struct {
+	proxyAddress  string
+	proxyPort     int
+	tunnelAddress string
+	tunnelPort    int
+
+	// optional fields, see extensions
+	ext extensions
+}
+
+func (pdu *ListenResponse) GetSerialType() int {
+	return PDU_LISTEN_RESPONSE
+}
+
+func (pdu *ListenResponse) GetSerialLength() uint32 {
+	return 8 + getStringSerialLength(pdu.proxyAddress) + getStringSerialLength(pdu.tunnelAddress) + getExtensionsSerialLength(pdu.ext)
+}
+
+func (pdu *ListenResponse) SerializeTo(w *bytes.Buffer) {
+	serializeStringTo(pdu.proxyAddress, w)
+	serializeUInt32To(uint32(pdu.proxyPort), w)
+	serializeStringTo(pdu.tunnelAddress, w)
+	serializeUInt32To(uint32(pdu.tunnelPort), w)
+	serializeExtensionsTo(pdu.ext, w)
+}
+
+func (pdu *ListenResponse) SerializeFrom(r *bytes.Buffer) {
+	pdu.proxyAddress = serializeStringFrom(r)
+	pdu.proxyPort = int(serializeUInt32From(r))
+	pdu.tunnelAddress = serializeStringFrom(r)
+	pdu.tunnelPort = int(serializeUInt32From(r))
+	pdu.ext = serializeExtensionsFrom(r)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// listener -> proxy
+type TunnelConnectRequest struct {
+	dataConnectionHandle uint32
+	clientAddress        string
+
+	proxyAddress string
+	proxyPort    int
+
+	// CONNECT_XXX flags, CONNECT_DATAGRAM once CAPABILITY_DATAGRAM is
+	// negotiated
+	flags uint32
+}
+
+func (pdu *TunnelConnectRequest) GetSerialType() int {
+	return PDU_TUNNEL_CONNECT_REQUEST
+}
+
+func (pdu *TunnelConnectRequest) GetSerialLength() uint32 {
+	return 4 +
+		getStringSerialLength(pdu.clientAddress) +
+		getStringSerialLength(pdu.proxyAddress) +
+		4 + 4
+}
+
+func (pdu *TunnelConnectRequest) SerializeTo(w *bytes.Buffer) {
+	serializeUInt32To(uint32(pdu.dataConnectionHandle), w)
+	serializeStringTo(pdu.clientAddress, w)
+	serializeStringTo(pdu.proxyAddress, w)
+	serializeUInt32To(uint32(pdu.proxyPort), w)
+	serializeUInt32To(pdu.flags, w)
+}
+
+func (pdu *TunnelConnectRequest) SerializeFrom(r *bytes.Buffer) {
+	pdu.dataConnectionHandle = Handle(serializeUInt32From(r))
+	pdu.clientAddress = serializeStringFrom(r)
+	pdu.proxyAddress = serializeStringFrom(r)
+	pdu.proxyPort = int(serializeUInt32From(r))
+	pdu.flags = serializeUInt32From(r)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+type TunnelConnectResponse struct {
+	dataConnectionHandle  uint32
+	proxyConnectionHandle uint32
+}
+
+func (pdu *TunnelConnectResponse) GetSerialType() int {
+	return PDU_TUNNEL_CONNECT_RESPONSE
+}
+
+func (pdu *TunnelConnectResponse) GetSerialLength() uint32 {
+	return 8
+}
+
+func (pdu *TunnelConnectResponse) SerializeTo(w *bytes.Buffer) {
+	serializeUInt32To(uint32(pdu.dataConnectionHandle), w)
+	serializeUInt32To(uint32(pdu.proxyConnectionHandle), w)
+}
+
+func (pdu *TunnelConnectResponse) SerializeFrom(r *bytes.Buffer) {
+	pdu.dataConnectionHandle = serializeUInt32From(r)
+	pdu.proxyConnectionHandle = serializeUInt32From(r)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// TunnelDataIndication carries payload of a data connection. Decoded data
+// aliases the received frame and must not be retained past its handler.
+type TunnelDataIndication struct {
+	peerConnectionHandle uint32
+	data                 []byte
+}
+
+func (pdu *TunnelDataIndication) GetSerialType() int {
+	return PDU_TUNNEL_DATA_INDICATION
+}
+
+func (pdu *TunnelDataIndication) GetSerialLength() uint32 {
+	return uint32(4 + 4 + len(pdu.data))
+}
+
+func (pdu *TunnelDataIndication) SerializeTo(w *bytes.Buffer) {
+	serializeUInt32To(uint32(pdu.peerConnectionHandle), w)
+	serializeUInt32To(uint32(len(pdu.data)), w)
+	w.Write(pdu.data)
+}
+
+func (pdu *TunnelDataIndication) SerializeFrom(r *bytes.Buffer) {
+	pdu.peerConnectionHandle = serializeUInt32From(r)
+
+	// aliases the frame, see TunnelDataIndication
+	l := serializeUInt32From(r)
+	pdu.data = r.Next(int(l))
+}
+
+// decodeDataIndication decodes frame, type and body, into pdu when it is a
+// well formed TunnelDataIndication, without the allocations of
+// serializePduFrom
+func decodeDataIndication(frame []byte, pdu *TunnelDataIndication) bool {
+	if len(frame) < 9 || frame[0] != PDU_TUNNEL_DATA_INDICATION {
+		return false
+	}
+
+	l := binary.BigEndian.Uint32(frame[5:])
+	if uint64(l) > uint64(len(frame)-9) {
+		return false
+	}
+
+	pdu.peerConnectionHandle = binary.BigEndian.Uint32(frame[1:])
+	pdu.data = frame[9 : 9+l]
+	return true
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// TunnelDatagramIndication carries one message of a data connection opened
+// with CONNECT_DATAGRAM, it is never split or merged with another on the
+// way. Payload is processed like that of TunnelDataIndication.
+type TunnelDatagramIndication struct {
+	peerConnectionHandle uint32
+	data                 []byte
+}
+
+func (pdu *TunnelDatagramIndication) GetSerialType() int {
+	return PDU_TUNNEL_DATAGRAM_INDICATION
+}
+
+func (pdu *TunnelDatagramIndication) GetSerialLength() uint32 {
+	return uint32(4 + 4 + len(pdu.data))
+}
+
+func (pdu *TunnelDatagramIndication) SerializeTo(w *bytes.Buffer) {
+	serializeUInt32To(uint32(pdu.peerConnectionHandle), w)
+	serializeUInt32To(uint32(len(pdu.data)), w)
+	w.Write(pdu.data)
+}
+
+func (pdu *TunnelDatagramIndication) SerializeFrom(r *bytes.Buffer) {
+	pdu.peerConnectionHandle = serializeUInt32From(r)
+
+	// aliases the frame, see TunnelDataIndication
+	l := serializeUInt32From(r)
+	pdu.data = r.Next(int(l))
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+type TunnelDisconnectRequest struct {
+	peerConnectionHandle uint32
+}
+
+func (pdu *TunnelDisconnectRequest) GetSerialType() int {
+	return PDU_TUNNEL_DISCONNECT_REQUEST
+}
+
+func (pdu *TunnelDisconnectRequest) GetSerialLength() uint32 {
+	return 4
+}
+
+func (pdu *TunnelDisconnectRequest) SerializeTo(w *bytes.Buffer) {
+	serializeUInt32To(uint32(pdu.peerConnectionHandle), w)
+}
+
+func (pdu *TunnelDisconnectRequest) SerializeFrom(r *bytes.Buffer) {
+	pdu.peerConnectionHandle = serializeUInt32From(r)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+type TunnelDisconnectResponse struct {
+	peerConnectionHandle uint32
+}
+
+func (pdu *TunnelDisconnectResponse) GetSerialType() int {
+	return PDU_TUNNEL_DISCONNECT_RESPONSE
+}
+
+func (pdu *TunnelDisconnectResponse) GetSerialLength() uint32 {
+	return 4
+}
+
+func (pdu *TunnelDisconnectResponse) SerializeTo(w *bytes.Buffer) {
+	serializeUInt32To(uint32(pdu.peerConnectionHandle), w)
+}
+
+func (pdu *TunnelDisconnectResponse) SerializeFrom(r *bytes.Buffer) {
+	pdu.peerConnectionHandle = serializeUInt32From(r)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// connector -> listener, answers the challenge carried in HelloResponse with
+// mac = HMAC-SHA256(token, identity || nonce || timestamp). Bearer
+// credentials the listener has to see, e.g. JWTs, are sent in credential
+// instead of a mac, over TLS only. The challenge fields follow token, which clients
+// of CAPABILITY_AUTH_CHALLENGE leave empty.
+type AuthRequest struct {
+	identity   string
+	token      string
+	nonce      []byte
+	timestamp  uint64
+	mac        []byte
+	credential string
+}
+
+func (pdu *AuthRequest) GetSerialType() int {
+	return PDU_AUTH_REQUEST
+}
+
+func (pdu *AuthRequest) GetSerialLength() uint32 {
+	return getStringSerialLength(pdu.identity) +
+		getStringSerialLength(pdu.token) +
+		getBytesSerialLength(pdu.nonce) +
+		8 +
+		getBytesSerialLength(pdu.mac) +
+		getStringSerialLength(pdu.credential)
+}
+
+func (pdu *AuthRequest) SerializeTo(w *bytes.Buffer) {
+	serializeStringTo(pdu.identity, w)
+	serializeStringTo(pdu.token, w)
+	serializeBytesTo(pdu.nonce, w)
+	serializeUInt64To(pdu.timestamp, w)
+	serializeBytesTo(pdu.mac, w)
+	serializeStringTo(pdu.credential, w)
+}
+
+func (pdu *AuthRequest) SerializeFrom(r *bytes.Buffer) {
+	pdu.identity = serializeStringFrom(r)
+	pdu.token = serializeStringFrom(r)
+	pdu.nonce = serializeBytesFrom(r)
+	pdu.timestamp = serializeUInt64From(r)
+	pdu.mac = serializeBytesFrom(r)
+	pdu.credential = serializeStringFrom(r)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// peerConnectionHandle is 0 when the error applies to the tunnel connection
+// as a whole rather than to a single data connection
+type ErrorIndication struct {
+	peerConnectionHandle uint32
+	code                 uint32
+	message              string
+}
+
+func (pdu *ErrorIndication) GetSerialType() int {
+	return PDU_ERROR_INDICATION
+}
+
+func (pdu *ErrorIndication) GetSerialLength() uint32 {
+	return 8 + getStringSerialLength(pdu.message)
+}
+
+func (pdu *ErrorIndication) SerializeTo(w *bytes.Buffer) {
+	serializeUInt32To(pdu.peerConnectionHandle, w)
+	serializeUInt32To(pdu.code, w)
+	serializeStringTo(pdu.message, w)
+}
+
+func (pdu *ErrorIndication) SerializeFrom(r *bytes.Buffer) {
+	pdu.peerConnectionHandle = serializeUInt32From(r)
+	pdu.code = serializeUInt32From(r)
+	pdu.message = serializeStringFrom(r)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// connector -> listener, offers capabilities
+type HelloRequest struct {
+	capabilities uint32
+
+	// X25519 public key, present when CAPABILITY_ENCRYPTION is offered
+	publicKey []byte
+
+	// session of a previous connection to resume, empty for a new session
+	sessionID []byte
+
+	// optional, labels describing the connector, none when sent by older
+	// connectors
+	labels map[string]string
+
+	// optional fields, see extensions
+	ext extensions
+}
+
+func (pdu *HelloRequest) GetSerialType() int {
+	return PDU_HELLO_REQUEST
+}
+
+func (pdu *HelloRequest) GetSerialLength() uint32 {
+	return 4 + getBytesSerialLength(pdu.publicKey) + getBytesSerialLength(pdu.sessionID) + getLabelsSerialLength(pdu.labels) + getExtensionsSerialLength(pdu.ext)
+}
+
+func (pdu *HelloRequest) SerializeTo(w *bytes.Buffer) {
+	serializeUInt32To(pdu.capabilities, w)
+	serializeBytesTo(pdu.publicKey, w)
+	serializeBytesTo(pdu.sessionID, w)
+	serializeLabelsTo(pdu.labels, w)
+	serializeExtensionsTo(pdu.ext, w)
+}
+
+func (pdu *HelloRequest) SerializeFrom(r *bytes.Buffer) {
+	pdu.capabilities = serializeUInt32From(r)
+	pdu.publicKey = serializeBytesFrom(r)
+	pdu.sessionID = serializeBytesFrom(r)
+	pdu.labels = serializeLabelsFrom(r)
+	pdu.ext = serializeExtensionsFrom(r)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// listener -> connector, capabilities accepted out of the offered ones
+type HelloResponse struct {
+	capabilities uint32
+	publicKey    []byte
+
+	// single use authentication challenge with CAPABILITY_AUTH_CHALLENGE,
+	// empty when the listener does not require authentication. timestamp is
+	// in unix seconds.
+	authNonce     []byte
+	authTimestamp uint64
+
+	// session the connector may resume after reconnecting, empty when the
+	// listener does not keep sessions
+	sessionID []byte
+
+	// optional fields, see extensions and EXT_HELLO_XXX
+	ext extensions
+}
+
+// extension types of HelloResponse
+const (
+	// token a data channel presents in its DataChannelRequest, with
+	// CAPABILITY_DATA_CHANNELS
+	EXT_HELLO_CHANNEL_TOKEN = 1
+)
+
+func (pdu *HelloResponse) GetSerialType() int {
+	return PDU_HELLO_RESPONSE
+}
+
+func (pdu *HelloResponse) GetSerialLength() uint32 {
+	return 4 + getBytesSerialLength(pdu.publicKey) + getBytesSerialLength(pdu.authNonce) + 8 + getBytesSerialLength(pdu.sessionID) + getExtensionsSerialLength(pdu.ext)
+}
+
+func (pdu *HelloResponse) SerializeTo(w *bytes.Buffer) {
+	serializeUInt32To(pdu.capabilities, w)
+	serializeBytesTo(pdu.publicKey, w)
+	serializeBytesTo(pdu.authNonce, w)
+	serializeUInt64To(pdu.authTimestamp, w)
+	serializeBytesTo(pdu.sessionID, w)
+	serializeExtensionsTo(pdu.ext, w)
+}
+
+func (pdu *HelloResponse) SerializeFrom(r *bytes.Buffer) {
+	pdu.capabilities = serializeUInt32From(r)
+	pdu.publicKey = serializeBytesFrom(r)
+	pdu.authNonce = serializeBytesFrom(r)
+	pdu.authTimestamp = serializeUInt64From(r)
+	pdu.sessionID = serializeBytesFrom(r)
+	pdu.ext = serializeExtensionsFrom(r)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// sender has rotated its payload send key to epoch
+type RekeyIndication struct {
+	epoch uint32
+}
+
+func (pdu *RekeyIndication) GetSerialType() int {
+	return PDU_REKEY_INDICATION
+}
+
+func (pdu *RekeyIndication) GetSerialLength() uint32 {
+	return 4
+}
+
+func (pdu *RekeyIndication) SerializeTo(w *bytes.Buffer) {
+	serializeUInt32To(pdu.epoch, w)
+}
+
+func (pdu *RekeyIndication) SerializeFrom(r *bytes.Buffer) {
+	pdu.epoch = serializeUInt32From(r)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// periodic probe of a tunnel connection, lists the peer handles of the
+// sender's open data connections
+type KeepaliveRequest struct {
+	peerConnectionHandles []Handle
+}
+
+func (pdu *KeepaliveRequest) GetSerialType() int {
+	return PDU_KEEPALIVE_REQUEST
+}
+
+func (pdu *KeepaliveRequest) GetSerialLength() uint32 {
+	return getHandlesSerialLength(pdu.peerConnectionHandles)
+}
+
+func (pdu *KeepaliveRequest) SerializeTo(w *bytes.Buffer) {
+	serializeHandlesTo(pdu.peerConnectionHandles, w)
+}
+
+func (pdu *KeepaliveRequest) SerializeFrom(r *bytes.Buffer) {
+	pdu.peerConnectionHandles = serializeHandlesFrom(r)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// answers a KeepaliveRequest with the listed handles the sender has no data
+// connection for, their peers are half-open
+type KeepaliveResponse struct {
+	unknownHandles []Handle
+}
+
+func (pdu *KeepaliveResponse) GetSerialType() int {
+	return PDU_KEEPALIVE_RESPONSE
+}
+
+func (pdu *KeepaliveResponse) GetSerialLength() uint32 {
+	return getHandlesSerialLength(pdu.unknownHandles)
+}
+
+func (pdu *KeepaliveResponse) SerializeTo(w *bytes.Buffer) {
+	serializeHandlesTo(pdu.unknownHandles, w)
+}
+
+func (pdu *KeepaliveResponse) SerializeFrom(r *bytes.Buffer) {
+	pdu.unknownHandles = serializeHandlesFrom(r)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// connector -> listener, asks for the tunnel port of a registered service
+type LookupRequest struct {
+	requestID uint32
+	service   string
+
+	// optional fields, see extensions
+	ext extensions
+}
+
+func (pdu *LookupRequest) GetSerialType() int {
+	return PDU_LOOKUP_REQUEST
+}
+
+func (pdu *LookupRequest) GetSerialLength() uint32 {
+	return 4 + getStringSerialLength(pdu.service) + getExtensionsSerialLength(pdu.ext)
+}
+
+func (pdu *LookupRequest) SerializeTo(w *bytes.Buffer) {
+	serializeUInt32To(pdu.requestID, w)
+	serializeStringTo(pdu.service, w)
+	serializeExtensionsTo(pdu.ext, w)
+}
+
+func (pdu *LookupRequest) SerializeFrom(r *bytes.Buffer) {
+	pdu.requestID = serializeUInt32From(r)
+	pdu.service = serializeStringFrom(r)
+	pdu.ext = serializeExtensionsFrom(r)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// answers the LookupRequest of requestID, code is 0 when the service is
+// found, ERROR_XXX otherwise
+type LookupResponse struct {
+	requestID  uint32
+	code       uint32
+	tunnelPort int
+
+	// optional, host of the provider holding the tunnel port when it is
+	// another one of the cluster, empty for the answering provider
+	tunnelAddress string
+
+	// optional fields, see extensions
+	ext extensions
+}
+
+func (pdu *LookupResponse) GetSerialType() int {
+	return PDU_LOOKUP_RESPONSE
+}
+
+func (pdu *LookupResponse) GetSerialLength() uint32 {
+	return 12 + getStringSerialLength(pdu.tunnelAddress) + getExtensionsSerialLength(pdu.ext)
+}
+
+func (pdu *LookupResponse) SerializeTo(w *bytes.Buffer) {
+	serializeUInt32To(pdu.requestID, w)
+	serializeUInt32To(pdu.code, w)
+	serializeUInt32To(uint32(pdu.tunnelPort), w)
+	serializeStringTo(pdu.tunnelAddress, w)
+	serializeExtensionsTo(pdu.ext, w)
+}
+
+func (pdu *LookupResponse) SerializeFrom(r *bytes.Buffer) {
+	pdu.requestID = serializeUInt32From(r)
+	pdu.code = serializeUInt32From(r)
+	pdu.tunnelPort = int(serializeUInt32From(r))
+	pdu.tunnelAddress = serializeStringFrom(r)
+	pdu.ext = serializeExtensionsFrom(r)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// asks the peer to change payload processing of the tunnel connection
+// without closing its data connections
+type RenegotiateRequest struct {
+	// RENEGOTIATE_XXX changes asked for
+	flags uint32
+
+	// with RENEGOTIATE_ROTATE, the cipher suite of the new keys, the X25519
+	// public key of the sender and the epoch its new send key starts at
+	cipherSuite uint32
+	publicKey   []byte
+	epoch       uint32
+
+	// optional fields, see extensions
+	ext extensions
+}
+
+func (pdu *RenegotiateRequest) GetSerialType() int {
+	return PDU_RENEGOTIATE_REQUEST
+}
+
+func (pdu *RenegotiateRequest) GetSerialLength() uint32 {
+	return 12 + getBytesSerialLength(pdu.publicKey) + getExtensionsSerialLength(pdu.ext)
+}
+
+func (pdu *RenegotiateRequest) SerializeTo(w *bytes.Buffer) {
+	serializeUInt32To(pdu.flags, w)
+	serializeUInt32To(pdu.cipherSuite, w)
+	serializeBytesTo(pdu.publicKey, w)
+	serializeUInt32To(pdu.epoch, w)
+	serializeExtensionsTo(pdu.ext, w)
+}
+
+func (pdu *RenegotiateRequest) SerializeFrom(r *bytes.Buffer) {
+	pdu.flags = serializeUInt32From(r)
+	pdu.cipherSuite = serializeUInt32From(r)
+	pdu.publicKey = serializeBytesFrom(r)
+	pdu.epoch = serializeUInt32From(r)
+	pdu.ext = serializeExtensionsFrom(r)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// answers a RenegotiateRequest with the changes made, none when the peer
+// declines, e.g. to a request crossing its own
+type RenegotiateResponse struct {
+	// RENEGOTIATE_XXX changes made
+	flags uint32
+
+	// with RENEGOTIATE_ROTATE, the cipher suite of the new keys, the X25519
+	// public key of the sender and the epoch its new send key starts at
+	cipherSuite uint32
+	publicKey   []byte
+	epoch       uint32
+
+	// optional fields, see extensions
+	ext extensions
+}
+
+func (pdu *RenegotiateResponse) GetSerialType() int {
+	return PDU_RENEGOTIATE_RESPONSE
+}
+
+func (pdu *RenegotiateResponse) GetSerialLength() uint32 {
+	return 12 + getBytesSerialLength(pdu.publicKey) + getExtensionsSerialLength(pdu.ext)
+}
+
+func (pdu *RenegotiateResponse) SerializeTo(w *bytes.Buffer) {
+	serializeUInt32To(pdu.flags, w)
+	serializeUInt32To(pdu.cipherSuite, w)
+	serializeBytesTo(pdu.publicKey, w)
+	serializeUInt32To(pdu.epoch, w)
+	serializeExtensionsTo(pdu.ext, w)
+}
+
+func (pdu *RenegotiateResponse) SerializeFrom(r *bytes.Buffer) {
+	pdu.flags = serializeUInt32From(r)
+	pdu.cipherSuite = serializeUInt32From(r)
+	pdu.publicKey = serializeBytesFrom(r)
+	pdu.epoch = serializeUInt32From(r)
+	pdu.ext = serializeExtensionsFrom(r)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// first PDU on a data channel, attaches the connection to the tunnel
+// connection whose HelloResponse carried the token
+type DataChannelRequest struct {
+	token []byte
+
+	// optional fields, see extensions and EXT_CHANNEL_XXX
+	ext extensions
+}
+
+// extension types of DataChannelRequest
+const (
+	// 4 byte handle of the listener's data connection the channel is
+	// dedicated to, with CAPABILITY_PROMOTE. Absent for channels shared by
+	// data connections.
+	EXT_CHANNEL_DEDICATED = 1
+)
+
+func (pdu *DataChannelRequest) GetSerialType() int {
+	return PDU_DATA_CHANNEL_REQUEST
+}
+
+func (pdu *DataChannelRequest) GetSerialLength() uint32 {
+	return getBytesSerialLength(pdu.token) + getExtensionsSerialLength(pdu.ext)
+}
+
+func (pdu *DataChannelRequest) SerializeTo(w *bytes.Buffer) {
+	serializeBytesTo(pdu.token, w)
+	serializeExtensionsTo(pdu.ext, w)
+}
+
+func (pdu *DataChannelRequest) SerializeFrom(r *bytes.Buffer) {
+	pdu.token = serializeBytesFrom(r)
+	pdu.ext = serializeExtensionsFrom(r)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// answers a DataChannelRequest, the channel is attached unless code is an
+// ERROR_XXX
+type DataChannelResponse struct {
+	code uint32
+
+	// optional fields, see extensions
+	ext extensions
+}
+
+func (pdu *DataChannelResponse) GetSerialType() int {
+	return PDU_DATA_CHANNEL_RESPONSE
+}
+
+func (pdu *DataChannelResponse) GetSerialLength() uint32 {
+	return 4 + getExtensionsSerialLength(pdu.ext)
+}
+
+func (pdu *DataChannelResponse) SerializeTo(w *bytes.Buffer) {
+	serializeUInt32To(pdu.code, w)
+	serializeExtensionsTo(pdu.ext, w)
+}
+
+func (pdu *DataChannelResponse) SerializeFrom(r *bytes.Buffer) {
+	pdu.code = serializeUInt32From(r)
+	pdu.ext = serializeExtensionsFrom(r)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// sent over the connection a data connection used so far, the sender sends
+// its PDUs over the dedicated data channel of the data connection from now on
+type ChannelSwitchIndication struct {
+	peerConnectionHandle uint32
+}
+
+func (pdu *ChannelSwitchIndication) GetSerialType() int {
+	return PDU_CHANNEL_SWITCH_INDICATION
+}
+
+func (pdu *ChannelSwitchIndication) GetSerialLength() uint32 {
+	return 4
+}
+
+func (pdu *ChannelSwitchIndication) SerializeTo(w *bytes.Buffer) {
+	serializeUInt32To(pdu.peerConnectionHandle, w)
+}
+
+func (pdu *ChannelSwitchIndication) SerializeFrom(r *bytes.Buffer) {
+	pdu.peerConnectionHandle = serializeUInt32From(r)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// sent periodically by either peer, its numbers of the tunnel. rx is read
+// from its data connections, tx written to them, errors counts the
+// ErrorIndications it sent.
+type StatsIndication struct {
+	dataConnections uint32
+	rxBytes         uint64
+	txBytes         uint64
+	rxFrames        uint64
+	txFrames        uint64
+	errors          uint64
+}
+
+func (pdu *StatsIndication) GetSerialType() int {
+	return PDU_STATS_INDICATION
+}
+
+func (pdu *StatsIndication) GetSerialLength() uint32 {
+	return 4 + 5*8
+}
+
+func (pdu *StatsIndication) SerializeTo(w *bytes.Buffer) {
+	serializeUInt32To(pdu.dataConnections, w)
+	serializeUInt64To(pdu.rxBytes, w)
+	serializeUInt64To(pdu.txBytes, w)
+	serializeUInt64To(pdu.rxFrames, w)
+	serializeUInt64To(pdu.txFrames, w)
+	serializeUInt64To(pdu.errors, w)
+}
+
+func (pdu *StatsIndication) SerializeFrom(r *bytes.Buffer) {
+	pdu.dataConnections = serializeUInt32From(r)
+	pdu.rxBytes = serializeUInt64From(r)
+	pdu.txBytes = serializeUInt64From(r)
+	pdu.rxFrames = serializeUInt64From(r)
+	pdu.txFrames = serializeUInt64From(r)
+	pdu.errors = serializeUInt64From(r)
+}
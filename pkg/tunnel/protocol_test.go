@@ -0,0 +1,172 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSerializePdu(t *testing.T) {
+	assert := require.New(t)
+
+	pdu := &ListenRequest{
+		proxyAddress: "www.google.com",
+		proxyPort:    443,
+		service:      "web",
+	}
+
+	b := bytes.NewBuffer(nil)
+	serializePduTo(pdu, b)
+
+	pduClone := serializePduFrom(bytes.NewBuffer(b.Bytes()))
+	assert.True(pduClone != nil)
+	assert.True(pduClone.(*ListenRequest).proxyAddress == "www.google.com")
+	assert.True(pduClone.(*ListenRequest).proxyPort == 443)
+	assert.True(pduClone.(*ListenRequest).service == "web")
+
+	// requests of older connectors carry no service name
+	b = bytes.NewBuffer(nil)
+	serializePduTo(&ListenRequest{proxyAddress: "www.google.com", proxyPort: 443}, b)
+	b.Truncate(b.Len() - 4)
+	pduClone = serializePduFrom(bytes.NewBuffer(b.Bytes()))
+	assert.True(pduClone.(*ListenRequest).proxyPort == 443)
+	assert.True(pduClone.(*ListenRequest).service == "")
+
+	// auth requests of clients that predate challenges end after the token
+	b = bytes.NewBuffer(nil)
+	serializeStringTo("alice", b)
+	serializeStringTo("s3cr3t", b)
+	auth := &AuthRequest{}
+	auth.SerializeFrom(b)
+	assert.Equal("s3cr3t", auth.token)
+	assert.Empty(auth.mac)
+}
+
+func TestExtensions(t *testing.T) {
+	assert := require.New(t)
+
+	pdu := &HelloRequest{
+		capabilities: 1,
+		labels:       map[string]string{"region": "eu"},
+		ext:          extensions{2: []byte("b"), 1: []byte("a")},
+	}
+
+	frame := encodePdu(pdu)
+	clone := serializePduFrom(bytes.NewBuffer(frame[4:])).(*HelloRequest)
+	assert.Equal("eu", clone.labels["region"])
+	assert.Equal(pdu.ext, clone.ext)
+
+	// PDUs of older peers end before the extension area
+	clone = serializePduFrom(bytes.NewBuffer(encodePdu(&HelloRequest{capabilities: 1})[4:])).(*HelloRequest)
+	assert.Nil(clone.ext)
+
+	// an entry cut short is dropped along with the rest of the area
+	frame = encodePdu(&ListenResponse{ext: extensions{1: []byte("a"), 2: []byte("long value")}})
+	r := bytes.NewBuffer(frame[4 : len(frame)-1])
+	resp := serializePduFrom(r).(*ListenResponse)
+	assert.Equal(extensions{1: []byte("a")}, resp.ext)
+	assert.Equal(0, r.Len())
+}
+
+func TestSerializeSkipsUnknown(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Nil(serializePduFrom(bytes.NewBuffer([]byte{0xff, 1, 2, 3})))
+	assert.Nil(serializePduFrom(bytes.NewBuffer(nil)))
+
+	// lengths beyond the end of the PDU are capped rather than trusted
+	b := bytes.NewBuffer(nil)
+	serializeUInt32To(1<<30, b)
+	b.WriteString("abc")
+	assert.Equal("abc", serializeStringFrom(b))
+}
+
+func TestEncodePdu(t *testing.T) {
+	assert := require.New(t)
+
+	pdu := &TunnelDataIndication{
+		peerConnectionHandle: 7,
+		data:                 []byte("hello"),
+	}
+
+	frame := encodePdu(pdu)
+	assert.Equal(int(4+getPduSerialLength(pdu)), len(frame))
+	assert.Equal(getPduSerialLength(pdu), binary.BigEndian.Uint32(frame))
+
+	pduClone := serializePduFrom(bytes.NewBuffer(frame[4:]))
+	assert.Equal(Handle(7), pduClone.(*TunnelDataIndication).peerConnectionHandle)
+	assert.Equal("hello", string(pduClone.(*TunnelDataIndication).data))
+}
+
+func TestDatagramPdus(t *testing.T) {
+	assert := require.New(t)
+
+	frame := encodePdu(&TunnelConnectRequest{dataConnectionHandle: 3, proxyAddress: "db", proxyPort: 53, flags: CONNECT_DATAGRAM})
+	request := serializePduFrom(bytes.NewBuffer(frame[4:])).(*TunnelConnectRequest)
+	assert.Equal(uint32(CONNECT_DATAGRAM), request.flags)
+
+	// requests of older connectors carry no flags
+	request = serializePduFrom(bytes.NewBuffer(frame[4 : len(frame)-4])).(*TunnelConnectRequest)
+	assert.Equal(53, request.proxyPort)
+	assert.Equal(uint32(0), request.flags)
+
+	// datagrams take the generic path, the streaming one would split them
+	frame = encodePdu(&TunnelDatagramIndication{peerConnectionHandle: 5, data: []byte("message")})
+	var data TunnelDataIndication
+	assert.False(decodeDataIndication(frame[4:], &data))
+	datagram := serializePduFrom(bytes.NewBuffer(frame[4:])).(*TunnelDatagramIndication)
+	assert.Equal(Handle(5), datagram.peerConnectionHandle)
+	assert.Equal("message", string(datagram.data))
+}
+
+func TestNewFrameReuse(t *testing.T) {
+	assert := require.New(t)
+
+	big := &TunnelDataIndication{peerConnectionHandle: 1, data: bytes.Repeat([]byte("x"), 1000)}
+	small := &TunnelDataIndication{peerConnectionHandle: 2, data: []byte("hi")}
+
+	frame := newFrame(big)
+	assert.Equal(encodePdu(big), frame.Bytes())
+	releaseFrame(frame)
+
+	// a recycled buffer carries nothing over from its previous frame
+	frame = newFrame(small)
+	assert.Equal(encodePdu(small), frame.Bytes())
+	releaseFrame(frame)
+}
+
+func TestDecodeDataIndication(t *testing.T) {
+	assert := require.New(t)
+
+	frame := encodePdu(&TunnelDataIndication{peerConnectionHandle: 9, data: []byte("payload")})
+
+	var pdu TunnelDataIndication
+	assert.True(decodeDataIndication(frame[4:], &pdu))
+	assert.Equal(Handle(9), pdu.peerConnectionHandle)
+	assert.Equal("payload", string(pdu.data))
+
+	// truncated frames and other PDU types take the generic path
+	assert.False(decodeDataIndication(frame[4:len(frame)-1], &pdu))
+	assert.False(decodeDataIndication(encodePdu(&RekeyIndication{epoch: 1})[4:], &pdu))
+}
+
+func BenchmarkDecodeDataIndication(b *testing.B) {
+	frame := encodePdu(&TunnelDataIndication{peerConnectionHandle: 1, data: make([]byte, 4096)})[4:]
+
+	var pdu TunnelDataIndication
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		decodeDataIndication(frame, &pdu)
+	}
+}
+
+func BenchmarkNewFrame(b *testing.B) {
+	pdu := &TunnelDataIndication{peerConnectionHandle: 1, data: make([]byte, 4096)}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		releaseFrame(newFrame(pdu))
+	}
+}
@@ -0,0 +1,695 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Config configures a Provider. Zero values disable the respective feature,
+// the tunnel command sets its flag defaults explicitly.
+type Config struct {
+	// signaling address Serve listens on, host:port
+	Address string
+
+	// TLSConfig carries signaling connections over TLS when set: the server
+	// configuration of a listener, the client configuration of a connector
+	TLSConfig *tls.Config
+
+	// ObfsKey obfuscates signaling connections, must match on both sides
+	ObfsKey []byte
+
+	// listener side authentication: "identity token" pairs or a custom
+	// Authenticator, and JWTs of a trusted issuer whose JWTClaim, "sub" if
+	// empty, is the identity
+	TokenFile     string
+	Authenticator Authenticator
+	JWTIssuer     string
+	JWTAudience   string
+	JWKSURL       string
+	JWTClaim      string
+
+	// failed authentications in a row before a source IP is banned for
+	// AuthBan, 0 disables bans
+	AuthMaxFailures int
+	AuthBan         time.Duration
+
+	// with mTLS, SPIFFE IDs of clients must belong to this trust domain
+	SPIFFETrustDomain string
+
+	// listener side files of targets each client may request and of
+	// bandwidth quotas
+	ACLFile   string
+	QuotaFile string
+
+	// let clients dial targets their ACL allows from the provider with
+	// Client.DialContext
+	AllowDial bool
+
+	// Dialer connects data connections to their targets, net.Dial if nil
+	Dialer Dialer
+
+	// Transport carries signaling connections and tunnel ports, TCP sockets
+	// if nil
+	Transport Transport
+
+	// StreamMiddleware wraps the stream of every data connection, in order
+	StreamMiddleware []StreamMiddleware
+
+	// caps per client identity, 0 means unlimited
+	MaxTunnelsPerClient int
+	MaxConnsPerClient   int
+
+	// listener side file of per identity tunnel and data connection caps and
+	// bandwidth quotas, replaces QuotaFile; the caps above apply to
+	// identities it does not list
+	TenantFile string
+
+	// range tunnel ports are allocated from, e.g. 20000-21000
+	PortRange string
+
+	// comma separated SNI patterns data connections must match / are
+	// refused for. Connections without SNI are refused unless SNIAllow
+	// lists "-".
+	SNIAllow string
+	SNIDeny  string
+
+	// file of "[namespace/]service plain|reencrypt" entries, the provider
+	// terminates TLS for the services listed with the certificates uploaded
+	// to ServiceCertDir or, without one, obtained from ACME for
+	// service[.namespace].ServiceACMEDomain
+	ServiceTLSFile    string
+	ServiceCertDir    string
+	ServiceACMEDomain string
+	ServiceACMECache  string
+	ServiceACMEEmail  string
+
+	// tunnel ports of clients that reconnect within SessionGrace are kept,
+	// and persisted in RegistryFile across restarts
+	SessionGrace time.Duration
+	RegistryFile string
+
+	// file of "port host:port [key=value ...]" tunnel ports opened at start
+	// and served by standby clients of the target and labels, consumers
+	// wait up to OnDemandWait for one to connect
+	OnDemandFile string
+	OnDemandWait time.Duration
+
+	// providers sharing ClusterStore, redis://[:password@]host:port[/db],
+	// share their service names, each reached by consumers at its
+	// ClusterAdvertise host
+	ClusterStore     string
+	ClusterAdvertise string
+
+	// tunnel ports of authenticated clients are reserved for their identity,
+	// in ReservationFile across restarts, until closed longer than
+	// ReservationTTL; 0 keeps them forever
+	Reservations    bool
+	ReservationFile string
+	ReservationTTL  time.Duration
+
+	// tunnels are probed this often and dropped after 3 silent probes
+	Keepalive time.Duration
+
+	// tunnels report their data connections, payload and errors to the
+	// peer this often, see Tunnel.PeerStats. 0 disables.
+	StatsInterval time.Duration
+
+	// every PDU sent and received is logged at trace level with its type,
+	// handles and length, and a hex dump of up to TraceBytes of its leading
+	// bytes, starting with the type. 0 dumps none, nor are PDUs carrying
+	// credentials ever dumped.
+	TraceBytes int
+
+	// RecordDir receives the cleartext payload of the data connections to
+	// the targets matching RecordTargets, comma separated host:port
+	// patterns, or all targets without any. Each gets a .rx file of what was read from it
+	// and a .tx file of what was written to it, of up to RecordMaxSize
+	// bytes each if set; only the newest RecordMaxFiles files are kept if
+	// set.
+	RecordDir      string
+	RecordTargets  string
+	RecordMaxSize  int64
+	RecordMaxFiles int
+
+	// CaptureFile receives the payload of the data connections RecordTargets
+	// selects as pcapng, TCP connections between the consumer and the
+	// target with synthesized headers, for Wireshark. Truncated when the
+	// provider starts.
+	CaptureFile string
+
+	// inject faults for testing: payload read from data connections is
+	// delayed by FaultLatency plus or minus FaultJitter and lost with the
+	// probability FaultDropRate, dropped by datagram connections and
+	// retransmitted after a backoff by streams, and tunnel connections are
+	// reset after a random time averaging FaultResetInterval
+	FaultLatency       time.Duration
+	FaultJitter        time.Duration
+	FaultDropRate      float64
+	FaultResetInterval time.Duration
+
+	// payload key rotation thresholds
+	RekeyInterval time.Duration
+	RekeyBytes    uint64
+
+	// data payloads of at least this many bytes are compressed
+	CompressMin int
+
+	// socket options of tunnel and data connections; TCPKeepAlive 0 keeps
+	// the system default, negative disables keepalive
+	Nagle         bool
+	TCPKeepAlive  time.Duration
+	SendBuffer    int
+	ReceiveBuffer int
+
+	// writes blocked longer than this close the connection
+	WriteTimeout time.Duration
+
+	// data connections whose peer does not answer the connect request
+	// within this long are closed along with their consumer
+	ConnectTimeout time.Duration
+
+	// cap on data queued for tunnel writes across all tunnels, with
+	// MemoryShed new data connections are refused while it is used up
+	MemoryBudget int
+	MemoryShed   bool
+
+	// data connection read engine, "goroutine" if empty or "epoll"
+	IOEngine string
+
+	// accept goroutines per listener, more than one use SO_REUSEPORT
+	Acceptors int
+
+	// aggregate bytes per second read from / written to data connections
+	MaxIngressRate uint64
+	MaxEgressRate  uint64
+
+	// AuditTarget records tunnels and data connections to a file, a stream
+	// socket or syslog, whose messages carry SyslogFacility
+	AuditTarget    string
+	SyslogFacility int
+
+	// AccessLog logs the data connections of tunnel ports to a file, stdout
+	// for "-", in AccessLogFormat "clf" or "json"
+	AccessLog       string
+	AccessLogFormat string
+
+	// Hooks observe tunnels and data connections going up and down
+	Hooks Hooks
+
+	// OTLPEndpoint exports spans to an OTLP/HTTP collector as OTLPService,
+	// "tunnel" if empty
+	OTLPEndpoint string
+	OTLPService  string
+}
+
+// NewProvider returns a provider configured by config. Listener side files
+// are loaded, on-demand ports opened and, with a registry, persisted
+// sessions restored.
+func NewProvider(config Config) (*Provider, error) {
+	p := newProvider()
+	if err := p.configure(config); err != nil {
+		p.Close()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *Provider) configure(c Config) error {
+	p.address = c.Address
+	p.tlsConfig = c.TLSConfig
+	p.obfsKey = c.ObfsKey
+	p.spiffeTrustDomain = c.SPIFFETrustDomain
+	p.allowDial = c.AllowDial
+	p.dialer = c.Dialer
+	p.transport = c.Transport
+	p.streamMiddleware = c.StreamMiddleware
+	p.rekeyInterval = c.RekeyInterval
+	p.rekeyBytes = c.RekeyBytes
+	p.compressMin = c.CompressMin
+	p.acceptors = c.Acceptors
+	p.writeTimeout = c.WriteTimeout
+	p.connectTimeout = c.ConnectTimeout
+	p.keepaliveInterval = c.Keepalive
+	p.statsInterval = c.StatsInterval
+	p.traceBytes = c.TraceBytes
+	p.sessions = newSessionTable(c.SessionGrace)
+	p.sessions.services = p.services
+	p.events = newEventHub()
+	p.events.hooks = c.Hooks
+
+	switch c.IOEngine {
+	case "", "goroutine":
+	case "epoll":
+		engine, err := newPollEngine()
+		if err != nil {
+			return err
+		}
+		p.pollEngine = engine
+	default:
+		return fmt.Errorf("unknown I/O engine %q", c.IOEngine)
+	}
+
+	if c.MemoryBudget > 0 {
+		p.memoryBudget = newMemoryBudget(c.MemoryBudget)
+		p.memoryShed = c.MemoryShed
+	}
+
+	if c.Nagle || c.TCPKeepAlive != 0 || c.SendBuffer > 0 || c.ReceiveBuffer > 0 {
+		p.socketOptions = &socketOptions{
+			nagle:         c.Nagle,
+			keepAlive:     c.TCPKeepAlive,
+			sendBuffer:    c.SendBuffer,
+			receiveBuffer: c.ReceiveBuffer,
+		}
+	}
+
+	p.ingressLimiter = newRateLimiter(c.MaxIngressRate)
+	p.egressLimiter = newRateLimiter(c.MaxEgressRate)
+
+	if len(c.AuditTarget) > 0 {
+		audit, err := openAuditLog(c.AuditTarget, c.SyslogFacility)
+		if err != nil {
+			return err
+		}
+		p.audit = audit
+	}
+
+	if len(c.AccessLog) > 0 {
+		accessLog, err := openAccessLog(c.AccessLog, c.AccessLogFormat)
+		if err != nil {
+			return err
+		}
+		p.accessLog = accessLog
+	}
+
+	recordTargets, err := splitPatterns(c.RecordTargets)
+	if err != nil {
+		return fmt.Errorf("record targets: %v", err)
+	}
+	p.recordTargets = recordTargets
+
+	if len(c.RecordDir) > 0 {
+		recorder, err := newRecorder(c.RecordDir, c.RecordMaxSize, c.RecordMaxFiles)
+		if err != nil {
+			return err
+		}
+		p.recorder = recorder
+	}
+
+	if len(c.CaptureFile) > 0 {
+		capture, err := newCapture(c.CaptureFile)
+		if err != nil {
+			return err
+		}
+		p.capture = capture
+	}
+
+	faults, err := newFaultInjector(c.FaultLatency, c.FaultJitter, c.FaultDropRate, c.FaultResetInterval)
+	if err != nil {
+		return err
+	}
+	p.faults = faults
+
+	if len(c.OTLPEndpoint) > 0 {
+		service := c.OTLPService
+		if len(service) == 0 {
+			service = "tunnel"
+		}
+		p.tracer = newTracer(c.OTLPEndpoint, service)
+	}
+
+	if len(c.TokenFile) > 0 && c.Authenticator != nil {
+		return errors.New("use either a token file or an authenticator")
+	}
+
+	p.authenticator = c.Authenticator
+	if len(c.TokenFile) > 0 {
+		a, err := loadTokenAuthenticator(c.TokenFile)
+		if err != nil {
+			return err
+		}
+		p.authenticator = a
+	}
+
+	if len(c.JWTIssuer) > 0 || len(c.JWKSURL) > 0 {
+		claim := c.JWTClaim
+		if len(claim) == 0 {
+			claim = "sub"
+		}
+
+		v, err := newJWTValidator(c.JWTIssuer, c.JWTAudience, c.JWKSURL, claim)
+		if err != nil {
+			return err
+		}
+		p.jwtValidator = v
+	}
+
+	if p.authRequired() {
+		p.lockout = newAuthLockout(c.AuthMaxFailures, c.AuthBan)
+	}
+
+	if len(c.ACLFile) > 0 {
+		acl, err := loadAccessControlList(c.ACLFile)
+		if err != nil {
+			return err
+		}
+		p.acl = acl
+	}
+
+	if len(c.QuotaFile) > 0 {
+		quotas, err := loadQuotaTable(c.QuotaFile)
+		if err != nil {
+			return err
+		}
+		p.quotas = quotas
+	}
+
+	if len(c.PortRange) > 0 {
+		r, err := parsePortRange(c.PortRange)
+		if err != nil {
+			return err
+		}
+		p.portRange = r
+	}
+
+	if c.MaxTunnelsPerClient > 0 || c.MaxConnsPerClient > 0 {
+		p.limits = newConnectionLimits(c.MaxTunnelsPerClient, c.MaxConnsPerClient)
+	}
+
+	if len(c.TenantFile) > 0 {
+		if len(c.QuotaFile) > 0 {
+			return errors.New("tenant file replaces the quota file, set either")
+		}
+
+		tenants, err := loadTenantFile(c.TenantFile)
+		if err != nil {
+			return err
+		}
+
+		quotas := make(map[string]quotaSpec)
+		for identity, spec := range tenants {
+			quotas[identity] = spec.quota
+		}
+		p.quotas = newQuotaTable(quotas)
+
+		p.limits = newConnectionLimits(c.MaxTunnelsPerClient, c.MaxConnsPerClient)
+		p.limits.tenants = tenants
+	}
+
+	if len(c.SNIAllow) > 0 || len(c.SNIDeny) > 0 {
+		policy, err := newSNIPatternPolicy(c.SNIAllow, c.SNIDeny)
+		if err != nil {
+			return err
+		}
+		p.sniPolicy = policy
+	}
+
+	if len(c.ServiceTLSFile) > 0 {
+		serviceTLS, err := loadServiceTLSFile(c.ServiceTLSFile, c.ServiceCertDir)
+		if err != nil {
+			return err
+		}
+		if len(c.ServiceACMEDomain) > 0 {
+			serviceTLS.enableACME(c.ServiceACMEDomain, c.ServiceACMECache, c.ServiceACMEEmail)
+		}
+		p.serviceTLS = serviceTLS
+	}
+
+	if c.Reservations || len(c.ReservationFile) > 0 {
+		reservations, err := loadReservationTable(c.ReservationFile, c.ReservationTTL)
+		if err != nil {
+			return err
+		}
+		p.sessions.reservations = reservations
+	}
+
+	if len(c.RegistryFile) > 0 {
+		if c.SessionGrace <= 0 {
+			return errors.New("a session registry requires a positive session grace period")
+		}
+
+		p.sessions.registry = newTunnelRegistry(c.RegistryFile)
+		if err := p.sessions.restore(p.bind); err != nil {
+			return err
+		}
+	}
+
+	if len(c.OnDemandFile) > 0 {
+		onDemand, err := loadOnDemandFile(c.OnDemandFile, c.OnDemandWait)
+		if err != nil {
+			return err
+		}
+		p.onDemand = onDemand
+		if err := p.startOnDemandPorts(); err != nil {
+			return err
+		}
+	}
+
+	if len(c.ClusterStore) > 0 {
+		cluster, err := newCluster(c.ClusterStore, c.ClusterAdvertise)
+		if err != nil {
+			return err
+		}
+		p.services.cluster = cluster
+		go p.services.refreshLoop(p.ctx)
+	}
+
+	return nil
+}
+
+// ErrProviderClosed is returned by Serve once the provider stopped
+// listening, and by listeners started after that
+var ErrProviderClosed = errors.New("tunnel provider closed")
+
+// Serve accepts signaling connections on the configured Address until ctx is
+// done, which closes the provider and returns ctx.Err(), or the provider is
+// shut down or closed, which returns ErrProviderClosed
+func (p *Provider) Serve(ctx context.Context) error {
+	if len(p.address) == 0 {
+		return errors.New("no signaling address configured")
+	}
+
+	if _, err := p.listen(p.address); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		p.Close()
+		return ctx.Err()
+	case <-p.listening.Done():
+		return ErrProviderClosed
+	}
+}
+
+// Shutdown stops accepting signaling connections and data connections, then
+// waits for the open data connections to finish before closing the provider.
+// When ctx is done first the remaining connections are closed and ctx.Err()
+// returned.
+func (p *Provider) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&p.draining, 1)
+	p.stopListening()
+	defer p.Close()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for p.dataConnections.len() > 0 {
+		select {
+		case <-ctx.Done():
+			logger.warn("Shutdown deadline reached, close remaining data connections", "data_connections", p.dataConnections.len())
+			return ctx.Err()
+		case <-p.ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// Close stops the provider: its signaling listeners, all tunnel connections
+// and with them their data connections and tunnel ports. Persisted sessions
+// are kept for the next start.
+func (p *Provider) Close() {
+	p.closeOnce.Do(func() {
+		p.cancel()
+		p.sessions.close()
+		p.services.close()
+
+		p.tracer.close()
+		p.audit.close()
+		p.accessLog.close()
+		p.capture.close()
+	})
+}
+
+// Done is closed once the provider is closed
+func (p *Provider) Done() <-chan struct{} {
+	return p.ctx.Done()
+}
+
+// Ready reports whether the provider runs and its signaling listeners accept
+// tunnel connections
+func (p *Provider) Ready() bool {
+	return p.listening.Err() == nil && atomic.LoadInt32(&p.acceptLoops) > 0
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// ConnectorConfig is the tunnel a connector requests from a provider
+type ConnectorConfig struct {
+	// signaling address of the provider, host:port
+	ProviderAddress string
+
+	// client credentials, the identity is anonymous if empty
+	Identity string
+	Token    string
+	JWT      string
+
+	// target the provider tunnels to, host:port, port 443 if omitted. As
+	// name=host:port the provider also registers the tunnel port under the
+	// service name, for Client.Lookup and its admin API. With
+	// Client.Listen it is only announced to the provider, for its ACL and
+	// logs, and may be empty
+	Target string
+
+	// more targets tunneled over the same signaling connection, each gets a
+	// tunnel port of its own
+	Forwards []string
+
+	// negotiate AES-GCM encryption of tunneled payloads
+	Encrypt bool
+
+	// secondary connections to the provider carrying the payload of data
+	// connections, so that bulk transfers do not delay connect and
+	// disconnect signaling. Up to 8, 0 keeps everything on the signaling
+	// connection.
+	DataChannels int
+
+	// data connections relaying more bytes per second, both directions
+	// together, are promoted to a data channel of their own. 0 never
+	// promotes.
+	PromoteRate uint64
+
+	// announce the targets to serve the on-demand ports of the provider
+	// for, rather than requesting tunnel ports of their own
+	Standby bool
+
+	// reported to the provider, which shows them in its admin API and logs
+	// so that operators tell similar clients apart, e.g. hostname, env and
+	// version. See ValidateLabels.
+	Labels map[string]string
+
+	// cap of the reconnect backoff of RunConnector, 0 returns once the
+	// connection is lost
+	MaxReconnectDelay time.Duration
+}
+
+func (c ConnectorConfig) options(p *Provider) connectorOptions {
+	forwards := []forward{parseForward(c.Target)}
+	for _, target := range c.Forwards {
+		forwards = append(forwards, parseForward(target))
+	}
+
+	capabilities := uint32(CAPABILITY_RENEGOTIATE | CAPABILITY_DATAGRAM | CAPABILITY_STATS | CAPABILITY_AUTH_CHALLENGE)
+	if c.Encrypt {
+		capabilities |= CAPABILITY_ENCRYPTION
+	}
+	if p.compressMin > 0 {
+		capabilities |= CAPABILITY_COMPRESSION
+	}
+
+	dataChannels := c.DataChannels
+	if dataChannels > maxDataChannels {
+		dataChannels = maxDataChannels
+	}
+	if dataChannels > 0 {
+		capabilities |= CAPABILITY_DATA_CHANNELS
+	}
+	if c.PromoteRate > 0 {
+		capabilities |= CAPABILITY_PROMOTE
+	}
+
+	return connectorOptions{
+		providerAddress:   c.ProviderAddress,
+		identity:          c.Identity,
+		token:             c.Token,
+		credential:        c.JWT,
+		labels:            c.Labels,
+		standby:           c.Standby,
+		forwards:          forwards,
+		capabilities:      capabilities,
+		dataChannels:      dataChannels,
+		promoteRate:       c.PromoteRate,
+		maxReconnectDelay: c.MaxReconnectDelay,
+	}
+}
+
+// RunConnector keeps the tunnel of config open, reconnecting whenever the
+// provider is lost. Returns when reconnecting is disabled, or ErrProviderClosed
+// once p is closed.
+func (p *Provider) RunConnector(config ConnectorConfig) error {
+	return p.runConnector(config.options(p))
+}
+
+// Tunnel is a tunnel opened by Connect
+type Tunnel struct {
+	tc *TunnelConnection
+}
+
+// Connect opens the tunnel of config once, without reconnecting, and
+// returns when the provider has opened the tunnel port of Target
+func (p *Provider) Connect(ctx context.Context, config ConnectorConfig) (*Tunnel, error) {
+	tc, err := p.requestTunnel(config.options(p), "")
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-tc.opened:
+		return &Tunnel{tc: tc}, nil
+	case <-tc.ctx.Done():
+		return nil, errTunnelClosed
+	case <-ctx.Done():
+		tc.conn.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// Port returns the tunnel port the provider opened for Target
+func (t *Tunnel) Port() int {
+	return t.tc.tunnelPort
+}
+
+// Forwards returns Target and the Forwards of the tunnel with their tunnel
+// ports, 0 until the provider opened them
+func (t *Tunnel) Forwards() []ForwardInfo {
+	var forwards []ForwardInfo
+	for _, f := range t.tc.forwardList() {
+		forwards = append(forwards, f.info())
+	}
+	return forwards
+}
+
+// Renegotiate turns payload compression on or off, or rotates to new payload
+// keys, without closing the data connections of the tunnel
+func (t *Tunnel) Renegotiate(ctx context.Context, r Renegotiation) error {
+	return t.tc.renegotiate(ctx, r)
+}
+
+// Done is closed once the tunnel is closed
+func (t *Tunnel) Done() <-chan struct{} {
+	return t.tc.ctx.Done()
+}
+
+// Close closes the tunnel and its data connections
+func (t *Tunnel) Close() error {
+	// the reader tears the tunnel down
+	return t.tc.conn.Close()
+}
@@ -0,0 +1,222 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeAndShutdown(t *testing.T) {
+	assert := require.New(t)
+
+	target, err := startEchoServer()
+	assert.Nil(err)
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.Nil(err)
+	signaling := l.Addr().String()
+	l.Close()
+
+	p, err := NewProvider(Config{Address: signaling})
+	assert.Nil(err)
+
+	served := make(chan error, 1)
+	go func() { served <- p.Serve(context.Background()) }()
+
+	client, err := NewProvider(Config{})
+	assert.Nil(err)
+	defer client.Close()
+
+	var tun *Tunnel
+	assert.Eventually(func() bool {
+		tun, err = client.Connect(context.Background(), ConnectorConfig{
+			ProviderAddress: signaling,
+			Target:          target.String(),
+		})
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	tunnel := fmt.Sprintf("127.0.0.1:%d", tun.Port())
+
+	consumer, err := net.Dial("tcp4", tunnel)
+	assert.Nil(err)
+	_, err = consumer.Write([]byte("ping"))
+	assert.Nil(err)
+	_, err = io.ReadFull(consumer, make([]byte, 4))
+	assert.Nil(err)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- p.Shutdown(context.Background()) }()
+
+	select {
+	case err := <-served:
+		assert.Equal(ErrProviderClosed, err)
+	case <-time.After(5 * time.Second):
+		assert.Fail("Serve did not return")
+	}
+	assert.False(p.Ready())
+
+	// new data connections are refused while the open one keeps working
+	refused, err := net.Dial("tcp4", tunnel)
+	assert.Nil(err)
+	refused.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = refused.Read(make([]byte, 1))
+	assert.Equal(io.EOF, err)
+	refused.Close()
+
+	_, err = consumer.Write([]byte("pong"))
+	assert.Nil(err)
+	_, err = io.ReadFull(consumer, make([]byte, 4))
+	assert.Nil(err)
+
+	select {
+	case <-shutdown:
+		assert.Fail("Shutdown returned before the data connection finished")
+	default:
+	}
+
+	consumer.Close()
+	select {
+	case err := <-shutdown:
+		assert.Nil(err)
+	case <-time.After(5 * time.Second):
+		assert.Fail("Shutdown did not return")
+	}
+
+	select {
+	case <-tun.Done():
+	case <-time.After(5 * time.Second):
+		assert.Fail("tunnel was not closed")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+	p.address = "127.0.0.1:0"
+
+	tunnelLocal, tunnelRemote := net.Pipe()
+	defer tunnelRemote.Close()
+	tc := p.newTunnelConnection(tunnelLocal)
+
+	dataLocal, dataRemote := net.Pipe()
+	defer dataRemote.Close()
+	p.newDataConnection(tc, dataLocal)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, p.Shutdown(ctx))
+
+	select {
+	case <-p.Done():
+	default:
+		assert.Fail("provider was not closed")
+	}
+	assert.Equal(ErrProviderClosed, p.Serve(context.Background()))
+}
+
+// pipeDialer connects every target to an in-process echo
+type pipeDialer struct {
+	dialed chan string
+}
+
+func (d *pipeDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	d.dialed <- address
+
+	local, remote := net.Pipe()
+	go func() {
+		defer remote.Close()
+		io.Copy(remote, remote)
+	}()
+	return local, nil
+}
+
+func TestCustomDialer(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+	defer p.Close()
+	addr, err := p.StartListener(0)
+	assert.Nil(err)
+
+	dialer := &pipeDialer{dialed: make(chan string, 1)}
+	client, err := NewProvider(Config{Dialer: dialer})
+	assert.Nil(err)
+	defer client.Close()
+
+	tun, err := client.Connect(context.Background(), ConnectorConfig{
+		ProviderAddress: fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port),
+		Target:          "service.internal:80",
+	})
+	assert.Nil(err)
+
+	consumer, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", tun.Port()))
+	assert.Nil(err)
+	defer consumer.Close()
+
+	_, err = consumer.Write([]byte("ping"))
+	assert.Nil(err)
+	reply := make([]byte, 4)
+	consumer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(consumer, reply)
+	assert.Nil(err)
+	assert.Equal("ping", string(reply))
+	assert.Equal("service.internal:80", <-dialer.dialed)
+}
+
+func TestMultipleForwards(t *testing.T) {
+	assert := require.New(t)
+
+	first, err := startEchoServer()
+	assert.Nil(err)
+	second, err := startEchoServer()
+	assert.Nil(err)
+
+	p := newProvider()
+	defer p.Close()
+	addr, err := p.StartListener(0)
+	assert.Nil(err)
+
+	client := newProvider()
+	defer client.Close()
+
+	tun, err := client.Connect(context.Background(), ConnectorConfig{
+		ProviderAddress: fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port),
+		Target:          first.String(),
+		Forwards:        []string{second.String(), "127.0.0.1:1"},
+	})
+	assert.Nil(err)
+
+	var forwards []ForwardInfo
+	assert.Eventually(func() bool {
+		forwards = tun.Forwards()
+		return forwards[1].TunnelPort > 0 && forwards[2].TunnelPort > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(first.String(), forwards[0].Target)
+	assert.Equal(tun.Port(), forwards[0].TunnelPort)
+	assert.Equal(second.String(), forwards[1].Target)
+
+	// one signaling connection, a tunnel port per forward
+	assert.Equal(1, p.tunnelConnections.len())
+	tunnels, _ := p.connectionSnapshot()
+	assert.Len(tunnels[0].Forwards, 3)
+
+	for _, f := range forwards[:2] {
+		consumer, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", f.TunnelPort))
+		assert.Nil(err)
+
+		_, err = consumer.Write([]byte("ping"))
+		assert.Nil(err)
+		reply := make([]byte, 4)
+		consumer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(consumer, reply)
+		assert.Nil(err)
+		assert.Equal("ping", string(reply))
+		consumer.Close()
+	}
+}
@@ -0,0 +1,168 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientQuota limits the traffic of one client identity across all of its
+// tunnels. Rate is enforced by throttling, the monthly transfer volume by
+// disconnecting data connections once it is used up.
+type clientQuota struct {
+	limiter *rateLimiter
+	spec    quotaSpec
+
+	lock         sync.Mutex
+	monthlyLimit uint64
+	used         uint64
+	month        string
+}
+
+// transfer accounts n bytes and returns false once the monthly volume is
+// exhausted, after throttling to the configured rate. Throttling ends early
+// once ctx is done.
+func (q *clientQuota) transfer(ctx context.Context, n int) bool {
+	if q == nil {
+		return true
+	}
+
+	q.limiter.wait(ctx, n)
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	month := time.Now().UTC().Format("2006-01")
+	if month != q.month {
+		q.month = month
+		q.used = 0
+	}
+
+	q.used += uint64(n)
+	return q.monthlyLimit == 0 || q.used <= q.monthlyLimit
+}
+
+func (q *clientQuota) exhausted() bool {
+	if q == nil {
+		return false
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.monthlyLimit > 0 && q.month == time.Now().UTC().Format("2006-01") && q.used >= q.monthlyLimit
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+type quotaSpec struct {
+	bytesPerSecond uint64
+	monthlyBytes   uint64
+}
+
+// quotaTable holds the configured quotas and the live per identity state.
+// Usage is kept in memory and starts over when the provider restarts.
+type quotaTable struct {
+	lock sync.Mutex
+
+	// map identity -> spec, identity "*" applies to clients without an entry
+	specs map[string]quotaSpec
+
+	// map identity -> *clientQuota
+	quotas map[string]*clientQuota
+}
+
+// loadQuotaTable loads "identity bytes_per_second monthly_bytes" entries,
+// sizes take K/M/G/T suffixes, 0 means unlimited
+func loadQuotaTable(path string) (*quotaTable, error) {
+	lines, err := readConfigFields(path)
+	if err != nil {
+		return nil, err
+	}
+
+	specs := make(map[string]quotaSpec)
+	for i, fields := range lines {
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s: entry %d: expected \"identity bytes_per_second monthly_bytes\"", path, i+1)
+		}
+
+		spec, err := parseQuotaSpec(fields[1], fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s: entry %d: %v", path, i+1, err)
+		}
+		specs[fields[0]] = spec
+	}
+
+	return newQuotaTable(specs), nil
+}
+
+func newQuotaTable(specs map[string]quotaSpec) *quotaTable {
+	return &quotaTable{
+		specs:  specs,
+		quotas: make(map[string]*clientQuota),
+	}
+}
+
+// parseQuotaSpec parses a rate like 1M or 1M/s and a monthly volume
+func parseQuotaSpec(rate string, monthly string) (quotaSpec, error) {
+	bytesPerSecond, err := ParseByteSize(strings.TrimSuffix(strings.ToUpper(rate), "/S"))
+	if err != nil {
+		return quotaSpec{}, err
+	}
+
+	monthlyBytes, err := ParseByteSize(monthly)
+	if err != nil {
+		return quotaSpec{}, err
+	}
+
+	return quotaSpec{bytesPerSecond: bytesPerSecond, monthlyBytes: monthlyBytes}, nil
+}
+
+// quotaFor returns the shared quota state of identity, nil if unlimited
+func (t *quotaTable) quotaFor(identity string) *clientQuota {
+	if t == nil {
+		return nil
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if q, ok := t.quotas[identity]; ok {
+		return q
+	}
+
+	spec, ok := t.specs[identity]
+	if !ok {
+		if spec, ok = t.specs[anonymousIdentity]; !ok {
+			return nil
+		}
+	}
+
+	q := &clientQuota{
+		limiter:      newRateLimiter(spec.bytesPerSecond),
+		spec:         spec,
+		monthlyLimit: spec.monthlyBytes,
+	}
+	t.quotas[identity] = q
+
+	return q
+}
+
+// usage returns the quota of identity and its transfer volume this month,
+// false if unlimited
+func (t *quotaTable) usage(identity string) (quotaSpec, uint64, bool) {
+	q := t.quotaFor(identity)
+	if q == nil {
+		return quotaSpec{}, 0, false
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.month != time.Now().UTC().Format("2006-01") {
+		return q.spec, 0, true
+	}
+	return q.spec, q.used, true
+}
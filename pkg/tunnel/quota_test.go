@@ -0,0 +1,78 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientQuota(t *testing.T) {
+	assert := require.New(t)
+
+	size, err := ParseByteSize("10MB")
+	assert.NoError(err)
+	assert.Equal(uint64(10<<20), size)
+
+	table := &quotaTable{
+		specs: map[string]quotaSpec{
+			"alice": {monthlyBytes: 100},
+			"*":     {bytesPerSecond: 1000},
+		},
+		quotas: make(map[string]*clientQuota),
+	}
+
+	q := table.quotaFor("alice")
+	assert.True(q == table.quotaFor("alice"))
+	assert.True(q.transfer(context.Background(), 60))
+	assert.False(q.exhausted())
+	assert.False(q.transfer(context.Background(), 60))
+	assert.True(q.exhausted())
+
+	// 1000 bytes burst, the next 500 take half a second
+	start := time.Now()
+	other := table.quotaFor("bob")
+	assert.True(other.transfer(context.Background(), 1000))
+	assert.True(other.transfer(context.Background(), 500))
+	assert.True(time.Since(start) >= 400*time.Millisecond)
+
+	var none *quotaTable
+	assert.Nil(none.quotaFor("alice"))
+}
+
+func TestQuotaDoesNotBlockReader(t *testing.T) {
+	assert := require.New(t)
+
+	p, err := NewProvider(Config{})
+	assert.NoError(err)
+	defer p.Close()
+
+	tunnelLocal, tunnelRemote := net.Pipe()
+	defer tunnelRemote.Close()
+	tc := p.newTunnelConnection(tunnelLocal)
+	tc.quota = &clientQuota{limiter: newRateLimiter(1000)}
+
+	dataLocal, dataRemote := net.Pipe()
+	defer dataRemote.Close()
+	dc := p.newDataConnection(tc, dataLocal)
+
+	// the payload beyond the burst takes half a second, the tunnel reader
+	// moves on
+	start := time.Now()
+	assert.True(tc.deliver(dc, make([]byte, 1000)))
+	assert.True(tc.deliver(dc, make([]byte, 500)))
+	assert.Less(int64(time.Since(start)), int64(100*time.Millisecond))
+
+	_, err = io.ReadFull(dataRemote, make([]byte, 1000))
+	assert.NoError(err)
+
+	// queued payload is written before the peer's disconnect closes dc
+	dc.closeAfterEgress()
+	b, err := ioutil.ReadAll(dataRemote)
+	assert.NoError(err)
+	assert.Len(b, 500)
+}
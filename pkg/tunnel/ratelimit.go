@@ -0,0 +1,65 @@
+package tunnel
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting a byte stream to rate bytes per
+// second with a burst of one second worth of bytes. A nil limiter never
+// blocks.
+type rateLimiter struct {
+	lock sync.Mutex
+
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond uint64) *rateLimiter {
+	if bytesPerSecond == 0 {
+		return nil
+	}
+
+	return &rateLimiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// wait takes n bytes out of the bucket, sleeping until they are available
+// or ctx is done
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	l.lock.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	// the bucket may go negative, later callers then wait for the debt too
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.lock.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(deficit / l.rate * float64(time.Second)))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
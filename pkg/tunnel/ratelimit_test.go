@@ -0,0 +1,60 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterWaitCancel(t *testing.T) {
+	assert := require.New(t)
+
+	l := newRateLimiter(1000)
+
+	// the burst is free, the debt beyond it takes ten seconds
+	assert.Nil(l.wait(context.Background(), 1000))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	start := time.Now()
+	assert.Equal(context.Canceled, l.wait(ctx, 10000))
+	assert.Less(int64(time.Since(start)), int64(5*time.Second))
+}
+
+func TestEgressLimitDoesNotBlockReader(t *testing.T) {
+	assert := require.New(t)
+
+	p, err := NewProvider(Config{MaxEgressRate: 1000})
+	assert.Nil(err)
+	defer p.Close()
+
+	tunnelLocal, tunnelRemote := net.Pipe()
+	defer tunnelRemote.Close()
+	tc := p.newTunnelConnection(tunnelLocal)
+
+	dataLocal, dataRemote := net.Pipe()
+	defer dataRemote.Close()
+	dc := p.newDataConnection(tc, dataLocal)
+
+	// the payload beyond the burst takes seconds, the tunnel reader moves on
+	start := time.Now()
+	assert.True(tc.deliver(dc, make([]byte, 1000)))
+	assert.True(tc.deliver(dc, make([]byte, 500)))
+	assert.Less(int64(time.Since(start)), int64(100*time.Millisecond))
+
+	b := make([]byte, 1000)
+	_, err = io.ReadFull(dataRemote, b)
+	assert.Nil(err)
+
+	// queued payload is written before the peer's disconnect closes dc
+	dc.closeAfterEgress()
+	b, err = ioutil.ReadAll(dataRemote)
+	assert.Nil(err)
+	assert.Len(b, 500)
+}
@@ -0,0 +1,140 @@
+package tunnel
+
+import (
+	"math/rand"
+	"time"
+)
+
+// first delay before re-dialing a lost provider, doubled on every failed
+// attempt up to the configured maximum
+const minReconnectDelay = time.Second
+
+// connectorOptions is everything the connector needs to set up its tunnel,
+// again after every reconnect
+type connectorOptions struct {
+	providerAddress string
+
+	identity   string
+	token      string
+	credential string
+
+	// reported to the provider in the hello
+	labels map[string]string
+
+	// targets to request tunnel ports for, only announced to the provider
+	// with a listener
+	forwards     []forward
+	capabilities uint32
+
+	// optional, tunneled connections are accepted from it instead of dialed
+	// to the target
+	listener *tunnelListener
+
+	// only dial through the signaling connection, request no tunnel port
+	dialOnly bool
+
+	// data channels to open besides the signaling connection
+	dataChannels int
+
+	// promote data connections relaying more bytes per second to a data
+	// channel of their own
+	promoteRate uint64
+
+	// serve the forwards for on-demand ports of the provider
+	standby bool
+
+	// cap of the exponential backoff, 0 gives up once the connection is lost
+	maxReconnectDelay time.Duration
+}
+
+// requestTunnel connects to the provider and starts the handshake, the
+// tunnel is requested once it completes. sessionID resumes a previous
+// session when not empty.
+func (p *Provider) requestTunnel(o connectorOptions, sessionID string) (*TunnelConnection, error) {
+	tc, err := p.startConnector(o.providerAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(o.identity) > 0 {
+		tc.identity = o.identity
+	}
+	tc.token = o.token
+	tc.providerAddress = o.providerAddress
+	tc.dataChannels = o.dataChannels
+	tc.promoteRate = o.promoteRate
+	tc.credential = o.credential
+	tc.labels = o.labels
+
+	for _, f := range o.forwards {
+		tc.addForward(f)
+	}
+	tc.sessionID = sessionID
+	tc.listener = o.listener
+	tc.dialOnly = o.dialOnly
+	if o.standby {
+		tc.standby = 1
+	}
+
+	if err := tc.hello(o.capabilities); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// runConnector connects to the provider and requests the tunnel. Whenever
+// the signaling connection is lost, or cannot be established, it re-dials
+// with jittered exponential backoff and requests the tunnel anew, resuming
+// the previous session so that the tunnel port is kept when the provider
+// still holds it. Returns when reconnecting is disabled, or ErrProviderClosed
+// once the provider is closed, which also cuts a pending backoff short.
+func (p *Provider) runConnector(o connectorOptions) error {
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	delay := minReconnectDelay
+	if o.maxReconnectDelay > 0 && o.maxReconnectDelay < delay {
+		delay = o.maxReconnectDelay
+	}
+
+	var sessionID string
+	for {
+		if p.ctx.Err() != nil {
+			return ErrProviderClosed
+		}
+
+		tc, err := p.requestTunnel(o, sessionID)
+		if err == nil {
+			select {
+			case <-tc.opened:
+				// healthy again, start over with short delays
+				delay = minReconnectDelay
+				if o.maxReconnectDelay < delay {
+					delay = o.maxReconnectDelay
+				}
+				<-tc.ctx.Done()
+
+			case <-tc.ctx.Done():
+			}
+			sessionID = tc.sessionID
+
+			err = errTunnelClosed
+		}
+
+		if o.maxReconnectDelay <= 0 {
+			return err
+		}
+
+		// full jitter in [delay/2, delay) keeps clients of a restarted
+		// provider from reconnecting in lockstep
+		wait := delay/2 + time.Duration(random.Int63n(int64(delay/2)+1))
+		logger.warn("Provider connection lost, reconnecting", "error", err, "delay", wait.Round(time.Millisecond))
+		select {
+		case <-time.After(wait):
+		case <-p.ctx.Done():
+			return ErrProviderClosed
+		}
+
+		if delay *= 2; delay > o.maxReconnectDelay {
+			delay = o.maxReconnectDelay
+		}
+	}
+}
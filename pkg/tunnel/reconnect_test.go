@@ -0,0 +1,47 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunConnectorWithoutReconnect(t *testing.T) {
+	assert := require.New(t)
+
+	// nothing listens on a just released port
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.Nil(err)
+	address := l.Addr().String()
+	l.Close()
+
+	err = newProvider().runConnector(connectorOptions{providerAddress: address})
+	assert.NotNil(err)
+}
+
+func TestRunConnectorStopsOnClose(t *testing.T) {
+	assert := require.New(t)
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.Nil(err)
+	address := l.Addr().String()
+	l.Close()
+
+	p := newProvider()
+	done := make(chan error, 1)
+	go func() {
+		done <- p.runConnector(connectorOptions{providerAddress: address, maxReconnectDelay: time.Hour})
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	p.Close()
+
+	select {
+	case err := <-done:
+		assert.Equal(ErrProviderClosed, err)
+	case <-time.After(5 * time.Second):
+		assert.Fail("connector kept reconnecting after close")
+	}
+}
@@ -0,0 +1,184 @@
+package tunnel
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// recorder writes the cleartext payload of recorded data connections to
+// files in dir, for debugging what applications exchange through the
+// tunnel. Every recorded data connection gets a .rx file of the bytes read
+// from it and a .tx file of those written to it, each capped at maxSize.
+// Only the newest maxFiles files are kept.
+type recorder struct {
+	dir      string
+	maxSize  int64
+	maxFiles int
+
+	// serializes creating and pruning files
+	lock sync.Mutex
+}
+
+func newRecorder(dir string, maxSize int64, maxFiles int) (*recorder, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &recorder{dir: dir, maxSize: maxSize, maxFiles: maxFiles}, nil
+}
+
+// start opens the files of dc, nil on error
+func (r *recorder) start(dc *DataConnection) *recording {
+	target := dc.targetAddress()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// sortable by creation, and unique as handles are never reused
+	name := fmt.Sprintf("%s-%d-%d-%s", dc.created.UTC().Format("20060102T150405.000"),
+		dc.tunnelConnection.handle, dc.handle, strings.NewReplacer(":", "_", "/", "_").Replace(target))
+	base := filepath.Join(r.dir, name)
+
+	rx, err := os.OpenFile(base+".rx", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		dc.log.error("Recording error", "error", err)
+		return nil
+	}
+	tx, err := os.OpenFile(base+".tx", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		rx.Close()
+		os.Remove(rx.Name())
+		dc.log.error("Recording error", "error", err)
+		return nil
+	}
+
+	r.prune()
+	dc.log.info("Record data connection", "file", base)
+
+	return &recording{maxSize: r.maxSize, rx: recordedStream{file: rx}, tx: recordedStream{file: tx}}
+}
+
+// prune removes the oldest recordings beyond maxFiles
+func (r *recorder) prune() {
+	if r.maxFiles <= 0 {
+		return
+	}
+
+	var files []string
+	for _, ext := range []string{"*.rx", "*.tx"} {
+		matches, _ := filepath.Glob(filepath.Join(r.dir, ext))
+		files = append(files, matches...)
+	}
+	if len(files) <= r.maxFiles {
+		return
+	}
+
+	sort.Strings(files)
+	for _, f := range files[:len(files)-r.maxFiles] {
+		os.Remove(f)
+	}
+}
+
+// recording holds the files of a recorded data connection, written by its
+// reader and by the reader of its tunnel
+type recording struct {
+	maxSize int64
+
+	lock   sync.Mutex
+	rx, tx recordedStream
+	closed bool
+}
+
+type recordedStream struct {
+	file    *os.File
+	written int64
+}
+
+// write appends data to the rx or tx file up to the size cap, the rest of
+// the stream is not recorded
+func (r *recording) write(rx bool, data []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	s := &r.tx
+	if rx {
+		s = &r.rx
+	}
+	if r.closed || s.file == nil {
+		return
+	}
+
+	if r.maxSize > 0 && s.written+int64(len(data)) > r.maxSize {
+		data = data[:r.maxSize-s.written]
+	}
+	n, err := s.file.Write(data)
+	s.written += int64(n)
+
+	if err != nil || (r.maxSize > 0 && s.written >= r.maxSize) {
+		s.file.Close()
+		s.file = nil
+	}
+}
+
+func (r *recording) close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.closed = true
+	for _, s := range []*recordedStream{&r.rx, &r.tx} {
+		if s.file != nil {
+			s.file.Close()
+			s.file = nil
+		}
+	}
+}
+
+// recordsTarget reports whether the data connections to target are
+// recorded and captured, all of them without RecordTargets
+func (p *Provider) recordsTarget(target string) bool {
+	return len(p.recordTargets) == 0 || matchAny(p.recordTargets, strings.ToLower(target))
+}
+
+// record appends cleartext payload of dc, read from it if rx, written to it
+// otherwise, to its recording and capture. Both start with the first
+// payload, once the target of dc is known.
+func (dc *DataConnection) record(rx bool, data []byte) {
+	p := dc.tunnelConnection.provider
+	if p.recorder == nil && p.capture == nil {
+		return
+	}
+
+	dc.recordOnce.Do(func() {
+		if dc.ctx.Err() != nil || !p.recordsTarget(dc.targetAddress()) {
+			return
+		}
+		if p.recorder != nil {
+			dc.recording = p.recorder.start(dc)
+		}
+		if p.capture != nil {
+			dc.captured = p.capture.start(dc)
+		}
+	})
+	if dc.recording != nil {
+		dc.recording.write(rx, data)
+	}
+	if dc.captured != nil {
+		dc.captured.payload(rx, data)
+	}
+}
+
+// stopRecording closes the recording and capture of a closed data
+// connection
+func (dc *DataConnection) stopRecording() {
+	dc.recordOnce.Do(func() {})
+	if dc.recording != nil {
+		dc.recording.close()
+	}
+	if dc.captured != nil {
+		dc.captured.close()
+	}
+}
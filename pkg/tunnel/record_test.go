@@ -0,0 +1,78 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordDataConnections(t *testing.T) {
+	assert := require.New(t)
+
+	target, err := startEchoServer()
+	assert.Nil(err)
+
+	dir := t.TempDir()
+	p, err := NewProvider(Config{RecordDir: dir, RecordTargets: "*:" + fmt.Sprint(target.(*net.TCPAddr).Port),
+		RecordMaxSize: 4, RecordMaxFiles: 2})
+	assert.Nil(err)
+	defer p.Close()
+	addr, err := p.StartListener(0)
+	assert.Nil(err)
+
+	client := newProvider()
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tun, err := client.Connect(ctx, ConnectorConfig{
+		ProviderAddress: fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port),
+		Target:          target.String(),
+	})
+	assert.Nil(err)
+	defer tun.Close()
+
+	echo := func(payload string) {
+		consumer, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", tun.Port()))
+		assert.Nil(err)
+		defer consumer.Close()
+
+		consumer.Write([]byte(payload))
+		reply := make([]byte, len(payload))
+		consumer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(consumer, reply)
+		assert.Nil(err)
+	}
+	echo("hello")
+	echo("world")
+
+	assert.Eventually(func() bool {
+		_, connections := p.connectionSnapshot()
+		return len(connections) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the files of the first data connection are pruned, those of the
+	// second capped
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	sort.Strings(files)
+	assert.Len(files, 2)
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		assert.Nil(err)
+		assert.Equal("worl", string(data), f)
+	}
+	assert.Equal(".rx", filepath.Ext(files[0]))
+	assert.Equal(".tx", filepath.Ext(files[1]))
+
+	_, err = NewProvider(Config{RecordDir: dir, RecordTargets: "[db"})
+	assert.NotNil(err)
+}
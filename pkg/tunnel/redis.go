@@ -0,0 +1,200 @@
+package tunnel
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redisTimeout = 5 * time.Second
+
+// redisClient speaks the subset of the Redis protocol the cluster store
+// needs over a single connection, re-dialed once it fails. Commands are
+// serialized, the store issues few and small ones.
+type redisClient struct {
+	address  string
+	password string
+	db       int
+
+	lock   sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+	closed bool
+}
+
+var errRedisClosed = errors.New("redis client closed")
+
+// newRedisClient parses redis://[:password@]host:port[/db]
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported cluster store %q, use redis://host:port", rawURL)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, fmt.Errorf("cluster store %s: %w", u.Redacted(), err)
+	}
+
+	c := &redisClient{address: u.Host}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+
+	if db := strings.Trim(u.Path, "/"); len(db) > 0 {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("cluster store %s: invalid database %q", u.Redacted(), db)
+		}
+	}
+
+	return c, nil
+}
+
+// redisError is an error reply of the server
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// do sends the command and returns its reply: string, int64, nil, []interface{}
+// or a redisError
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return nil, errRedisClosed
+	}
+	if c.conn == nil {
+		if err := c.dialLocked(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := c.roundTripLocked(args)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			c.conn.Close()
+			c.conn = nil
+		}
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+func (c *redisClient) dialLocked() error {
+	conn, err := net.DialTimeout("tcp", c.address, redisTimeout)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+
+	var setup [][]string
+	if len(c.password) > 0 {
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+
+	for _, args := range setup {
+		if _, err := c.roundTripLocked(args); err != nil {
+			conn.Close()
+			c.conn = nil
+			return fmt.Errorf("redis %s: %w", args[0], err)
+		}
+	}
+
+	return nil
+}
+
+func (c *redisClient) roundTripLocked(args []string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(c.reader)
+}
+
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("malformed redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+
+	case '-':
+		return nil, redisError(line[1:])
+
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+
+	return nil, fmt.Errorf("malformed redis reply %q", line)
+}
+
+func (c *redisClient) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.closed = true
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
@@ -0,0 +1,99 @@
+package tunnel
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// registryEntry is the persisted form of a tunnelSession
+type registryEntry struct {
+	SessionID    string `json:"session_id"`
+	Identity     string `json:"identity"`
+	ProxyAddress string `json:"proxy_address"`
+	ProxyPort    int    `json:"proxy_port"`
+	TunnelPort   int    `json:"tunnel_port"`
+}
+
+// tunnelRegistry persists the tunnel sessions of a provider to a JSON file so
+// that their ports can be re-bound after a restart. A nil registry persists
+// nothing.
+type tunnelRegistry struct {
+	// serializes snapshots and file writes so that the latest snapshot wins
+	lock sync.Mutex
+	path string
+}
+
+func newTunnelRegistry(path string) *tunnelRegistry {
+	return &tunnelRegistry{path: path}
+}
+
+// load returns the persisted sessions, none if the file does not exist yet
+func (r *tunnelRegistry) load() ([]registryEntry, error) {
+	b, err := ioutil.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []registryEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// save replaces the file atomically, a crash leaves either the old or the
+// new registry behind
+func (r *tunnelRegistry) save(entries []registryEntry) error {
+	if entries == nil {
+		entries = []registryEntry{}
+	}
+
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(r.path, b)
+}
+
+// writeFileAtomic replaces path with b through a temporary file in the same
+// directory
+func writeFileAtomic(path string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func newRegistryEntry(s *tunnelSession) registryEntry {
+	return registryEntry{
+		SessionID:    hex.EncodeToString([]byte(s.id)),
+		Identity:     s.identity,
+		ProxyAddress: s.proxyAddress,
+		ProxyPort:    s.proxyPort,
+		TunnelPort:   s.port,
+	}
+}
@@ -0,0 +1,91 @@
+package tunnel
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelRegistry(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "registry")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	r := newTunnelRegistry(filepath.Join(dir, "tunnels.json"))
+
+	entries, err := r.load()
+	assert.Nil(err)
+	assert.Empty(entries)
+
+	saved := []registryEntry{{
+		SessionID:    "00ff",
+		Identity:     "alice",
+		ProxyAddress: "127.0.0.1",
+		ProxyPort:    80,
+		TunnelPort:   20000,
+	}}
+	assert.Nil(r.save(saved))
+
+	entries, err = r.load()
+	assert.Nil(err)
+	assert.Equal(saved, entries)
+
+	// no temporary files are left behind
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(err)
+	assert.Len(files, 1)
+}
+
+func TestSessionRestore(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "registry")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tunnels.json")
+
+	p := newProvider()
+	p.sessions = newSessionTable(time.Minute)
+	p.sessions.registry = newTunnelRegistry(path)
+
+	tc := newSessionTunnel(t, p, nil)
+	port, err := tc.startListenFor(forward{proxyAddress: "127.0.0.1", proxyPort: 80})
+	assert.Nil(err)
+
+	// the provider goes away without expiring its sessions
+	for _, l := range tc.sessions[0].listeners {
+		l.Close()
+	}
+
+	restarted := newProvider()
+	restarted.sessions = newSessionTable(time.Minute)
+	restarted.sessions.registry = newTunnelRegistry(path)
+	assert.Nil(restarted.sessions.restore(restarted.bind))
+
+	// the port is bound again before the client is back
+	_, err = net.Listen("tcp4", fmt.Sprintf(":%d", port))
+	assert.NotNil(err)
+
+	resumedTc := newSessionTunnel(t, restarted, []byte(tc.sessionID))
+	assert.Equal(tc.sessionID, resumedTc.sessionID)
+
+	resumedPort, resumed := resumedTc.resumeListenFor(forward{proxyAddress: "127.0.0.1", proxyPort: 80})
+	assert.True(resumed)
+	assert.Equal(port, resumedPort)
+
+	// expired sessions are dropped from the registry
+	restarted.sessions.grace = 0
+	restarted.closeTunnelConnection(resumedTc)
+
+	entries, err := restarted.sessions.registry.load()
+	assert.Nil(err)
+	assert.Empty(entries)
+}
@@ -0,0 +1,46 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// relay copies between a and b in both directions until both directions
+// are done, then closes both connections. io.Copy lets the runtime splice
+// TCP to TCP copies on Linux, within the deadlines set on the connections.
+func relay(a net.Conn, b net.Conn) (int64, int64) {
+	var aToB, bToA int64
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		aToB, _ = io.Copy(b, a)
+		closeWrite(b)
+	}()
+
+	go func() {
+		defer wg.Done()
+		bToA, _ = io.Copy(a, b)
+		closeWrite(a)
+	}()
+
+	wg.Wait()
+	a.Close()
+	b.Close()
+
+	return aToB, bToA
+}
+
+// closeWrite half-closes conn so that the peer sees EOF while the other
+// direction keeps flowing
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+		return
+	}
+
+	conn.Close()
+}
@@ -0,0 +1,64 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelay(t *testing.T) {
+	assert := require.New(t)
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer target.Close()
+
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer front.Close()
+
+	done := make(chan [2]int64, 1)
+	go func() {
+		a, err := front.Accept()
+		if err != nil {
+			return
+		}
+		b, err := net.Dial("tcp", target.Addr().String())
+		if err != nil {
+			a.Close()
+			return
+		}
+		sent, received := relay(a, b)
+		done <- [2]int64{sent, received}
+	}()
+
+	conn, err := net.Dial("tcp", front.Addr().String())
+	assert.Nil(err)
+	defer conn.Close()
+
+	payload := bytes.Repeat([]byte("relay"), 200000)
+	go func() {
+		conn.Write(payload)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+
+	echoed, err := ioutil.ReadAll(conn)
+	assert.Nil(err)
+	assert.True(bytes.Equal(echoed, payload), "echoed %d bytes, expected %d", len(echoed), len(payload))
+
+	counts := <-done
+	assert.Equal([2]int64{int64(len(payload)), int64(len(payload))}, counts)
+}
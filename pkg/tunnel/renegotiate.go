@@ -0,0 +1,259 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// the admin API waits this long for the peer to answer a renegotiation
+const renegotiateTimeout = 10 * time.Second
+
+// Renegotiation changes the payload processing of a live tunnel connection,
+// its data connections stay open
+type Renegotiation struct {
+	// turns payload compression on or off, unchanged if nil. Only tunnels
+	// that negotiated compression in the handshake can compress.
+	Compress *bool `json:"compress,omitempty"`
+
+	// rotates to new payload keys of the cipher suite, "aes-256-gcm" or
+	// "chacha20-poly1305", unchanged if empty. Only encrypted tunnels can
+	// rotate.
+	CipherSuite string `json:"cipher_suite,omitempty"`
+}
+
+var (
+	errRenegotiationPending     = errors.New("a renegotiation is in progress")
+	errRenegotiationUnsupported = errors.New("peer does not support renegotiation")
+	errRenegotiationDeclined    = errors.New("peer declined the renegotiation")
+	errNotEncrypted             = errors.New("payloads are not encrypted")
+	errNotCompressible          = errors.New("compression was not negotiated in the handshake")
+	errRotateDataChannels       = errors.New("payload keys cannot be rotated on a tunnel with data channels")
+)
+
+// pendingRenegotiation is a RenegotiateRequest waiting for its response
+type pendingRenegotiation struct {
+	request *RenegotiateRequest
+
+	// with RENEGOTIATE_ROTATE, the key pair of the new keys
+	keyExchange *sessionKeyExchange
+
+	// receives the changes the peer made
+	done chan uint32
+}
+
+// compressing reports whether payloads sent are compressed
+func (tc *TunnelConnection) compressing() bool {
+	return tc.capabilities&CAPABILITY_COMPRESSION != 0 && atomic.LoadInt32(&tc.compressOff) == 0
+}
+
+// renegotiate asks the peer for the changes of r and applies them once
+// granted. Payloads keep their compression markers while compression is
+// off, and payloads sealed with the keys replaced are still opened, so that
+// no data connection notices.
+func (tc *TunnelConnection) renegotiate(ctx context.Context, r Renegotiation) error {
+	if tc.capabilities&CAPABILITY_RENEGOTIATE == 0 {
+		return errRenegotiationUnsupported
+	}
+
+	request := &RenegotiateRequest{}
+	if r.Compress != nil {
+		if tc.capabilities&CAPABILITY_COMPRESSION == 0 {
+			return errNotCompressible
+		}
+
+		if *r.Compress {
+			request.flags |= RENEGOTIATE_COMPRESS_ON
+		} else {
+			request.flags |= RENEGOTIATE_COMPRESS_OFF
+		}
+	}
+
+	var kx *sessionKeyExchange
+	if len(r.CipherSuite) > 0 {
+		suite, ok := parseCipherSuite(r.CipherSuite)
+		if !ok {
+			return fmt.Errorf("unknown cipher suite %q", r.CipherSuite)
+		}
+		if tc.cipher == nil {
+			return errNotEncrypted
+		}
+		if tc.capabilities&(CAPABILITY_DATA_CHANNELS|CAPABILITY_PROMOTE) != 0 {
+			return errRotateDataChannels
+		}
+
+		var err error
+		if kx, err = newSessionKeyExchange(); err != nil {
+			return err
+		}
+
+		request.flags |= RENEGOTIATE_ROTATE
+		request.cipherSuite = suite
+		request.publicKey = kx.publicKey
+	}
+
+	if request.flags == 0 {
+		return nil
+	}
+
+	pending := &pendingRenegotiation{request: request, keyExchange: kx, done: make(chan uint32, 1)}
+
+	tc.renegotiateLock.Lock()
+	if tc.renegotiation != nil {
+		tc.renegotiateLock.Unlock()
+		return errRenegotiationPending
+	}
+	if kx != nil {
+		// rekeying is held until the response arrives, the epoch stays next
+		request.epoch = tc.cipher.nextSendEpoch()
+	}
+	tc.renegotiation = pending
+	tc.renegotiateLock.Unlock()
+
+	// ahead of any payload queued later, see onRenegotiateRequest
+	if err := tc.sendAt(request, priorityHigh); err != nil {
+		tc.cancelRenegotiation(pending)
+		return err
+	}
+
+	select {
+	case granted := <-pending.done:
+		if granted&request.flags != request.flags {
+			return errRenegotiationDeclined
+		}
+		return nil
+
+	case <-tc.ctx.Done():
+		return errTunnelClosed
+
+	case <-ctx.Done():
+		// a late response is still applied, the peer has made the changes
+		return ctx.Err()
+	}
+}
+
+func (tc *TunnelConnection) cancelRenegotiation(pending *pendingRenegotiation) {
+	tc.renegotiateLock.Lock()
+	defer tc.renegotiateLock.Unlock()
+
+	if tc.renegotiation == pending {
+		tc.renegotiation = nil
+	}
+}
+
+// setCompression turns sending compressed payloads on or off as flags ask
+func (tc *TunnelConnection) setCompression(flags uint32) uint32 {
+	if tc.capabilities&CAPABILITY_COMPRESSION == 0 {
+		return 0
+	}
+
+	switch {
+	case flags&RENEGOTIATE_COMPRESS_ON != 0 && tc.provider.compressMin > 0:
+		atomic.StoreInt32(&tc.compressOff, 0)
+		return RENEGOTIATE_COMPRESS_ON
+
+	case flags&RENEGOTIATE_COMPRESS_OFF != 0:
+		atomic.StoreInt32(&tc.compressOff, 1)
+		return RENEGOTIATE_COMPRESS_OFF
+	}
+
+	return 0
+}
+
+// onRenegotiateRequest makes the changes asked for that this side supports.
+// New keys take over receiving at once, the peer only seals with them once
+// it has the response. The response is queued ahead of the payloads sealed
+// with the new send key, so that the peer has the key before them.
+func (tc *TunnelConnection) onRenegotiateRequest(pdu *RenegotiateRequest) {
+	tc.renegotiateLock.Lock()
+	defer tc.renegotiateLock.Unlock()
+
+	response := &RenegotiateResponse{}
+
+	// of two requests crossing each other the listener's goes through
+	if tc.renegotiation != nil && tc.accepted {
+		tc.log.info("Decline renegotiation crossing our own")
+		tc.sendAt(response, priorityHigh)
+		return
+	}
+
+	response.flags |= tc.setCompression(pdu.flags)
+
+	// payloads sealed with the new keys could overtake the response on a
+	// data channel
+	var next *payloadCipher
+	if pdu.flags&RENEGOTIATE_ROTATE != 0 && tc.capabilities&(CAPABILITY_DATA_CHANNELS|CAPABILITY_PROMOTE) != 0 {
+		tc.log.warn("Decline payload key rotation", "error", errRotateDataChannels)
+	} else if pdu.flags&RENEGOTIATE_ROTATE != 0 && tc.cipher != nil {
+		kx, err := newSessionKeyExchange()
+		if err == nil {
+			next, err = kx.deriveCipher(pdu.publicKey, !tc.accepted, pdu.cipherSuite, tc.cipher.binding)
+		}
+		if err == nil {
+			err = tc.cipher.replaceReceiveKey(next, pdu.epoch)
+		}
+
+		if err != nil {
+			tc.log.warn("Decline payload key rotation", "error", err)
+			next = nil
+		} else {
+			response.flags |= RENEGOTIATE_ROTATE
+			response.cipherSuite = pdu.cipherSuite
+			response.publicKey = kx.publicKey
+			response.epoch = tc.cipher.nextSendEpoch()
+		}
+	}
+
+	tc.sendAt(response, priorityHigh)
+	if next != nil {
+		tc.cipher.replaceSendKey(next, response.epoch)
+	}
+
+	tc.logRenegotiation(response.flags, response.cipherSuite)
+}
+
+// onRenegotiateResponse applies the changes the peer made for our request
+func (tc *TunnelConnection) onRenegotiateResponse(pdu *RenegotiateResponse) {
+	tc.renegotiateLock.Lock()
+	defer tc.renegotiateLock.Unlock()
+
+	pending := tc.renegotiation
+	if pending == nil {
+		tc.log.warn("Renegotiate response without a request")
+		return
+	}
+	tc.renegotiation = nil
+
+	granted := tc.setCompression(pdu.flags & pending.request.flags)
+
+	if pdu.flags&RENEGOTIATE_ROTATE != 0 && pending.keyExchange != nil {
+		next, err := pending.keyExchange.deriveCipher(pdu.publicKey, !tc.accepted, pdu.cipherSuite, tc.cipher.binding)
+		if err == nil {
+			err = tc.cipher.replaceReceiveKey(next, pdu.epoch)
+		}
+
+		// the peer seals with keys this side does not have
+		if err != nil {
+			tc.log.error("Payload key rotation error", "error", err)
+			tc.conn.Close()
+			return
+		}
+
+		tc.cipher.replaceSendKey(next, pending.request.epoch)
+		granted |= RENEGOTIATE_ROTATE
+	}
+
+	tc.logRenegotiation(granted, pdu.cipherSuite)
+	pending.done <- granted
+}
+
+func (tc *TunnelConnection) logRenegotiation(flags uint32, suite uint32) {
+	if flags&(RENEGOTIATE_COMPRESS_ON|RENEGOTIATE_COMPRESS_OFF) != 0 {
+		tc.log.info("Payload compression renegotiated", "compress", flags&RENEGOTIATE_COMPRESS_ON != 0)
+	}
+	if flags&RENEGOTIATE_ROTATE != 0 {
+		tc.log.info("Payload keys rotated", "cipher_suite", cipherSuiteNames[suite])
+	}
+}
@@ -0,0 +1,134 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPayloadCipherReplaceKey(t *testing.T) {
+	assert := require.New(t)
+
+	pair := func(suite uint32) (*payloadCipher, *payloadCipher) {
+		connector, err := newSessionKeyExchange()
+		assert.NoError(err)
+		listener, err := newSessionKeyExchange()
+		assert.NoError(err)
+
+		sender, err := connector.deriveCipher(listener.publicKey, true, suite, nil)
+		assert.NoError(err)
+		receiver, err := listener.deriveCipher(connector.publicKey, false, suite, nil)
+		assert.NoError(err)
+		return sender, receiver
+	}
+
+	sender, receiver := pair(CIPHER_AES_256_GCM)
+	nextSender, nextReceiver := pair(CIPHER_CHACHA20_POLY1305)
+
+	beforeRotation := sender.encrypt(nil, []byte("before"), 1, 1)
+
+	// the peer has rekeyed once, the rekey indication arrives ahead of the
+	// renegotiation
+	epoch, _, err := sender.rotateSendKey(0)
+	assert.NoError(err)
+	ratcheted := sender.encrypt(nil, []byte("ratcheted"), 1, 2)
+
+	// epochs other than the next one are refused
+	assert.Error(receiver.replaceReceiveKey(nextReceiver, epoch+1))
+	assert.Error(receiver.replaceReceiveKey(nextReceiver, 1<<31))
+	assert.NoError(receiver.rotateReceiveKey(epoch))
+	assert.Error(receiver.replaceReceiveKey(nextReceiver, epoch))
+
+	epoch = sender.nextSendEpoch()
+	assert.NoError(receiver.replaceReceiveKey(nextReceiver, epoch))
+	sender.replaceSendKey(nextSender, epoch)
+	assert.Equal(uint32(CIPHER_CHACHA20_POLY1305), sender.suite())
+
+	plain, _, err := receiver.decrypt(sender.encrypt(nil, []byte("after"), 1, 3), 1, 1)
+	assert.NoError(err)
+	assert.Equal("after", string(plain))
+
+	// payloads sealed before the rotation are still opened
+	plain, _, err = receiver.decrypt(ratcheted, 1, 1)
+	assert.NoError(err)
+	assert.Equal("ratcheted", string(plain))
+	_, _, err = receiver.decrypt(beforeRotation, 1, 1)
+	assert.Error(err)
+
+	// rekeying ratchets the new key
+	epoch, _, err = sender.rotateSendKey(0)
+	assert.NoError(err)
+	plain, _, err = receiver.decrypt(sender.encrypt(nil, []byte("rekeyed"), 1, 4), 1, 4)
+	assert.NoError(err)
+	assert.Equal("rekeyed", string(plain))
+	assert.NoError(receiver.rotateReceiveKey(epoch))
+}
+
+func TestRenegotiate(t *testing.T) {
+	assert := require.New(t)
+
+	target, err := startEchoServer()
+	assert.Nil(err)
+
+	p, err := NewProvider(Config{CompressMin: 16})
+	assert.Nil(err)
+	defer p.Close()
+	addr, err := p.StartListener(0)
+	assert.Nil(err)
+
+	client, err := NewProvider(Config{CompressMin: 16})
+	assert.Nil(err)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tun, err := client.Connect(ctx, ConnectorConfig{
+		ProviderAddress: fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port),
+		Target:          target.String(),
+		Encrypt:         true,
+	})
+	assert.Nil(err)
+	defer tun.Close()
+
+	consumer, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", tun.Port()))
+	assert.Nil(err)
+	defer consumer.Close()
+
+	echo := func(size int) {
+		payload := bytes.Repeat([]byte("z"), size)
+		_, err := consumer.Write(payload)
+		assert.Nil(err)
+
+		reply := make([]byte, size)
+		consumer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(consumer, reply)
+		assert.Nil(err)
+		assert.Equal(payload, reply)
+	}
+	echo(1000)
+
+	off := false
+	assert.Nil(tun.Renegotiate(ctx, Renegotiation{Compress: &off, CipherSuite: "chacha20-poly1305"}))
+	echo(1000)
+
+	tunnels, _ := p.connectionSnapshot()
+	assert.Equal("chacha20-poly1305", tunnels[0].CipherSuite)
+	assert.False(tunnels[0].Compressed)
+
+	// either side may start it
+	tc := p.getTunnelConnection(tunnels[0].Handle)
+	on := true
+	assert.Nil(tc.renegotiate(ctx, Renegotiation{Compress: &on, CipherSuite: "aes-256-gcm"}))
+	echo(1000)
+	assert.Equal("aes-256-gcm", tunnelView(tc).CipherSuite)
+	assert.True(tunnelView(tc).Compressed)
+
+	assert.NotNil(tc.renegotiate(ctx, Renegotiation{CipherSuite: "rc4"}))
+}
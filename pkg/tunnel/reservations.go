@@ -0,0 +1,289 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxReservationProbes caps how often an OS picked tunnel port reserved by
+// another identity is skipped
+const maxReservationProbes = 16
+
+// portReservation binds a tunnel port to the identity of the client that
+// held it, for the target it forwarded to. An empty Target matches any
+// target of the identity, as for reservations written by hand.
+type portReservation struct {
+	Identity   string `json:"identity"`
+	Target     string `json:"target,omitempty"`
+	TunnelPort int    `json:"tunnel_port"`
+
+	// when the port was closed last, nil for reservations never released,
+	// which do not expire
+	Released *time.Time `json:"released,omitempty"`
+
+	// the tunnel port is open
+	inUse bool
+}
+
+// ReservationInfo is a tunnel port reserved for a client identity
+type ReservationInfo struct {
+	Identity   string     `json:"identity"`
+	Target     string     `json:"target,omitempty"`
+	TunnelPort int        `json:"tunnel_port"`
+	InUse      bool       `json:"in_use"`
+	Expires    *time.Time `json:"expires,omitempty"`
+}
+
+// reservationTable keeps the tunnel ports authenticated clients held, so
+// that they get the same ports back whenever they reconnect and no other
+// identity takes them meanwhile. Reservations of ports closed longer than
+// ttl ago expire, never with a zero ttl. With a path they are persisted
+// across restarts. A nil table reserves nothing.
+type reservationTable struct {
+	path string
+	ttl  time.Duration
+
+	// by tunnel port
+	lock   sync.Mutex
+	byPort map[int]*portReservation
+}
+
+// loadReservationTable loads the reservations persisted in path, none if it
+// does not exist yet
+func loadReservationTable(path string, ttl time.Duration) (*reservationTable, error) {
+	t := &reservationTable{path: path, ttl: ttl, byPort: make(map[int]*portReservation)}
+	if len(path) == 0 {
+		return t, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*portReservation
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	for i, r := range entries {
+		if len(r.Identity) == 0 || r.TunnelPort < 1 || r.TunnelPort > 65535 {
+			return nil, fmt.Errorf("%s: entry %d: expected an identity and a tunnel port", path, i+1)
+		}
+		if _, ok := t.byPort[r.TunnelPort]; ok {
+			return nil, fmt.Errorf("%s: entry %d: tunnel port %d is reserved twice", path, i+1, r.TunnelPort)
+		}
+		t.byPort[r.TunnelPort] = r
+	}
+
+	return t, nil
+}
+
+func (t *reservationTable) expiredLocked(r *portReservation, now time.Time) bool {
+	return !r.inUse && t.ttl > 0 && r.Released != nil && now.Sub(*r.Released) > t.ttl
+}
+
+// portFor returns the free tunnel port reserved for the target of identity,
+// 0 if there is none
+func (t *reservationTable) portFor(identity string, target string) int {
+	if t == nil {
+		return 0
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	port := 0
+	for _, r := range t.byPort {
+		if r.Identity != identity || r.inUse || t.expiredLocked(r, now) {
+			continue
+		}
+
+		if r.Target == target {
+			return r.TunnelPort
+		}
+		if len(r.Target) == 0 && (port == 0 || r.TunnelPort < port) {
+			port = r.TunnelPort
+		}
+	}
+
+	return port
+}
+
+// reservedByOther reports whether port is reserved for another identity
+func (t *reservationTable) reservedByOther(identity string, port int) bool {
+	if t == nil {
+		return false
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	r := t.byPort[port]
+	return r != nil && r.Identity != identity && !t.expiredLocked(r, time.Now())
+}
+
+// guard wraps bind to skip the ports reserved for identities other than
+// identity, retrying the OS picks
+func (t *reservationTable) guard(identity string, bind func(address string) ([]net.Listener, error)) func(address string) ([]net.Listener, error) {
+	if t == nil {
+		return bind
+	}
+
+	return func(address string) ([]net.Listener, error) {
+		_, port, _ := net.SplitHostPort(address)
+		if port != "0" {
+			if n, _ := strconv.Atoi(port); t.reservedByOther(identity, n) {
+				return nil, fmt.Errorf("tunnel port %d is reserved", n)
+			}
+			return bind(address)
+		}
+
+		var skipped []net.Listener
+		defer func() {
+			for _, l := range skipped {
+				l.Close()
+			}
+		}()
+
+		for i := 0; i < maxReservationProbes; i++ {
+			listeners, err := bind(address)
+			if err != nil {
+				return nil, err
+			}
+			if !t.reservedByOther(identity, listeners[0].Addr().(*net.TCPAddr).Port) {
+				return listeners, nil
+			}
+			skipped = append(skipped, listeners...)
+		}
+
+		return nil, fmt.Errorf("no free tunnel port after skipping %d reserved ones", maxReservationProbes)
+	}
+}
+
+// reserve records port as open for the target of identity
+func (t *reservationTable) reserve(identity string, target string, port int) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	r := t.byPort[port]
+	if r == nil || r.Identity != identity {
+		r = &portReservation{Identity: identity, Target: target, TunnelPort: port}
+		t.byPort[port] = r
+	}
+	r.inUse = true
+	r.Released = nil
+	t.lock.Unlock()
+
+	t.persist()
+}
+
+// reopen marks the reservation of port in use by identity again, for the
+// tunnel ports of restored sessions
+func (t *reservationTable) reopen(identity string, port int) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	if r := t.byPort[port]; r != nil && r.Identity == identity {
+		r.inUse = true
+		r.Released = nil
+	}
+	t.lock.Unlock()
+}
+
+// release records port as closed, its reservation expires after the ttl
+func (t *reservationTable) release(port int) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	r := t.byPort[port]
+	if r == nil || !r.inUse {
+		t.lock.Unlock()
+		return
+	}
+	now := time.Now()
+	r.inUse = false
+	r.Released = &now
+	t.lock.Unlock()
+
+	t.persist()
+}
+
+// list returns the reservations in effect, ordered by tunnel port
+func (t *reservationTable) list() []ReservationInfo {
+	if t == nil {
+		return []ReservationInfo{}
+	}
+
+	t.lock.Lock()
+	now := time.Now()
+	list := make([]ReservationInfo, 0, len(t.byPort))
+	for _, r := range t.byPort {
+		if t.expiredLocked(r, now) {
+			continue
+		}
+
+		info := ReservationInfo{Identity: r.Identity, Target: r.Target, TunnelPort: r.TunnelPort, InUse: r.inUse}
+		if t.ttl > 0 && r.Released != nil {
+			expires := r.Released.Add(t.ttl)
+			info.Expires = &expires
+		}
+		list = append(list, info)
+	}
+	t.lock.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].TunnelPort < list[j].TunnelPort
+	})
+	return list
+}
+
+// persist writes the reservations in effect to the file, dropping the
+// expired ones
+func (t *reservationTable) persist() {
+	if len(t.path) == 0 {
+		return
+	}
+
+	// held across the write so that the latest snapshot wins
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	entries := make([]*portReservation, 0, len(t.byPort))
+	for port, r := range t.byPort {
+		if t.expiredLocked(r, now) {
+			delete(t.byPort, port)
+			continue
+		}
+		entries = append(entries, r)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].TunnelPort < entries[j].TunnelPort
+	})
+
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(t.path, b)
+	}
+	if err != nil {
+		logger.error("Port reservations error", "error", err)
+	}
+}
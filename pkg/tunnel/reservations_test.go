@@ -0,0 +1,146 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReservationTable(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "reservations")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "reservations.json")
+
+	r, err := loadReservationTable(path, time.Hour)
+	assert.Nil(err)
+
+	r.reserve("alice", "localhost:8080", 8443)
+	assert.True(r.reservedByOther("bob", 8443))
+	assert.False(r.reservedByOther("alice", 8443))
+
+	// in use, not handed out twice
+	assert.Equal(0, r.portFor("alice", "localhost:8080"))
+	r.release(8443)
+	assert.Equal(8443, r.portFor("alice", "localhost:8080"))
+	assert.Equal(0, r.portFor("alice", "localhost:22"))
+	assert.Equal(0, r.portFor("bob", "localhost:8080"))
+
+	list := r.list()
+	assert.Len(list, 1)
+	assert.False(list[0].InUse)
+	assert.NotNil(list[0].Expires)
+
+	// kept across restarts, expired once closed longer than the ttl
+	r, err = loadReservationTable(path, time.Hour)
+	assert.Nil(err)
+	assert.Equal(8443, r.portFor("alice", "localhost:8080"))
+
+	released := time.Now().Add(-2 * time.Hour)
+	r.byPort[8443].Released = &released
+	assert.False(r.reservedByOther("bob", 8443))
+	assert.Empty(r.list())
+
+	// reservations written by hand match any target and do not expire
+	assert.Nil(ioutil.WriteFile(path, []byte(`[{"identity": "carol", "tunnel_port": 9000}]`), 0600))
+	r, err = loadReservationTable(path, time.Hour)
+	assert.Nil(err)
+	assert.Equal(9000, r.portFor("carol", "localhost:8080"))
+
+	for _, content := range []string{`[{"tunnel_port": 9000}]`, `[{"identity": "carol", "tunnel_port": 9000}, {"identity": "dave", "tunnel_port": 9000}]`, `{`} {
+		assert.Nil(ioutil.WriteFile(path, []byte(content), 0600))
+		_, err := loadReservationTable(path, time.Hour)
+		assert.NotNil(err, content)
+	}
+}
+
+func TestReservationGuard(t *testing.T) {
+	assert := require.New(t)
+
+	var listeners []net.Listener
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp4", "127.0.0.1:0")
+		assert.Nil(err)
+		listeners = append(listeners, l)
+	}
+	defer listeners[1].Close()
+
+	r, err := loadReservationTable("", 0)
+	assert.Nil(err)
+	reserved := listeners[0].Addr().(*net.TCPAddr).Port
+	r.reserve("alice", "localhost:8080", reserved)
+
+	next := 0
+	bind := func(address string) ([]net.Listener, error) {
+		next++
+		return listeners[next-1 : next], nil
+	}
+
+	// the OS picked port reserved for alice is skipped, and closed
+	got, err := r.guard("bob", bind)(":0")
+	assert.Nil(err)
+	assert.Equal(listeners[1], got[0])
+	_, err = listeners[0].Accept()
+	assert.NotNil(err)
+
+	_, err = r.guard("bob", bind)(fmt.Sprintf(":%d", reserved))
+	assert.NotNil(err)
+}
+
+func TestReservedPortOnReconnect(t *testing.T) {
+	assert := require.New(t)
+
+	target, err := startEchoServer()
+	assert.Nil(err)
+
+	f, err := ioutil.TempFile("", "tokens")
+	assert.Nil(err)
+	defer os.Remove(f.Name())
+	f.WriteString("alice a-token\nbob b-token\n")
+	f.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	p, err := NewProvider(Config{TokenFile: f.Name(), Reservations: true})
+	assert.Nil(err)
+	defer p.Close()
+	addr, err := p.StartListener(0)
+	assert.Nil(err)
+	providerAddress := fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port)
+
+	client := newProvider()
+	defer client.Close()
+
+	alice := ConnectorConfig{ProviderAddress: providerAddress, Identity: "alice", Token: "a-token", Target: target.String()}
+	tun, err := client.Connect(ctx, alice)
+	assert.Nil(err)
+	port := tun.Port()
+	tun.Close()
+
+	assert.Eventually(func() bool {
+		list := p.sessions.reservations.list()
+		return len(list) == 1 && !list[0].InUse
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// bob cannot take the port while alice is offline
+	assert.True(p.sessions.reservations.reservedByOther("bob", port))
+	bob, err := client.Connect(ctx, ConnectorConfig{ProviderAddress: providerAddress, Identity: "bob", Token: "b-token", Target: target.String()})
+	assert.Nil(err)
+	defer bob.Close()
+	assert.NotEqual(port, bob.Port())
+
+	tun, err = client.Connect(ctx, alice)
+	assert.Nil(err)
+	defer tun.Close()
+	assert.Equal(port, tun.Port())
+}
@@ -0,0 +1,56 @@
+package tunnel
+
+import (
+	"net"
+	"strconv"
+	"sync"
+)
+
+// serializes port probing and binding, so that two listen calls of this
+// process never end up sharing a SO_REUSEPORT port
+var reusePortLock sync.Mutex
+
+// listenShared binds address n times with SO_REUSEPORT so that the kernel
+// spreads incoming connections across n accept goroutines. Port 0 resolves
+// to one ephemeral port shared by all listeners. With n <= 1 it is a plain
+// net.Listen.
+func listenShared(network string, address string, n int) ([]net.Listener, error) {
+	if n <= 1 {
+		l, err := net.Listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{l}, nil
+	}
+
+	reusePortLock.Lock()
+	defer reusePortLock.Unlock()
+
+	// a plain bind fails on ports already held, SO_REUSEPORT ones included
+	probe, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	port := probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	address = net.JoinHostPort(host, strconv.Itoa(port))
+
+	listeners := make([]net.Listener, 0, n)
+	for len(listeners) < n {
+		l, err := listenReusePort(network, address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,25 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func listenReusePort(network string, address string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network string, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+
+	return lc.Listen(context.Background(), network, address)
+}
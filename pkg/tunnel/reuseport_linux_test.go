@@ -0,0 +1,30 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenShared(t *testing.T) {
+	assert := require.New(t)
+
+	listeners, err := listenShared("tcp4", "127.0.0.1:0", 4)
+	assert.NoError(err)
+	assert.Len(listeners, 4)
+
+	port := listeners[0].Addr().(*net.TCPAddr).Port
+	for _, l := range listeners {
+		assert.Equal(port, l.Addr().(*net.TCPAddr).Port)
+	}
+
+	// a held port is never shared with another listen call
+	_, err = listenShared("tcp4", fmt.Sprintf("127.0.0.1:%d", port), 2)
+	assert.Error(err)
+
+	for _, l := range listeners {
+		l.Close()
+	}
+}
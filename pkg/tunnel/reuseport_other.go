@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package tunnel
+
+import (
+	"errors"
+	"net"
+)
+
+func listenReusePort(network string, address string) (net.Listener, error) {
+	return nil, errors.New("multiple acceptors need SO_REUSEPORT, which is only supported on Linux")
+}
@@ -0,0 +1,78 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// ResolveSecret resolves a secret reference:
+//
+//	file:/path            contents of the file, trailing newline trimmed
+//	env:NAME              value of the environment variable
+//	keyring:service/user  entry of the OS keyring
+//
+// any other value is taken literally
+func ResolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "file:"):
+		b, err := ioutil.ReadFile(strings.TrimPrefix(value, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v, nil
+
+	case strings.HasPrefix(value, "keyring:"):
+		return readKeyring(strings.TrimPrefix(value, "keyring:"))
+	}
+
+	return value, nil
+}
+
+// IsSecretReference reports whether value names a secret for ResolveSecret
+func IsSecretReference(value string) bool {
+	return strings.HasPrefix(value, "file:") ||
+		strings.HasPrefix(value, "env:") ||
+		strings.HasPrefix(value, "keyring:")
+}
+
+// readKeyring looks up service/user in the OS keyring through the platform
+// tool: secret-tool (libsecret) on Linux, security on macOS
+func readKeyring(entry string) (string, error) {
+	parts := strings.SplitN(entry, "/", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid keyring entry %q, expected service/user", entry)
+	}
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "linux", "freebsd", "openbsd", "netbsd":
+		cmd = exec.Command("secret-tool", "lookup", "service", parts[0], "username", parts[1])
+	case "darwin":
+		cmd = exec.Command("security", "find-generic-password", "-s", parts[0], "-a", parts[1], "-w")
+	default:
+		return "", fmt.Errorf("OS keyring is not supported on %s", runtime.GOOS)
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("keyring lookup of %s failed: %v %s", entry, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
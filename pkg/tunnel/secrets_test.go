@@ -0,0 +1,33 @@
+package tunnel
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveSecret(t *testing.T) {
+	assert := require.New(t)
+
+	f, err := ioutil.TempFile("", "secret")
+	assert.NoError(err)
+	defer os.Remove(f.Name())
+	f.WriteString("s3cr3t\n")
+	f.Close()
+
+	v, err := ResolveSecret("file:" + f.Name())
+	assert.NoError(err)
+	assert.Equal("s3cr3t", v)
+
+	os.Setenv("TUNNEL_TEST_SECRET", "from-env")
+	defer os.Unsetenv("TUNNEL_TEST_SECRET")
+
+	v, err = ResolveSecret("env:TUNNEL_TEST_SECRET")
+	assert.NoError(err)
+	assert.Equal("from-env", v)
+
+	_, err = ResolveSecret("env:TUNNEL_TEST_UNSET")
+	assert.Error(err)
+}
@@ -0,0 +1,479 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxServiceNameLength is the longest DNS label
+const maxServiceNameLength = 63
+
+// ServiceInfo is a service name and the tunnel port registered under it
+type ServiceInfo struct {
+	Name       string `json:"name"`
+	Namespace  string `json:"namespace,omitempty"`
+	Identity   string `json:"identity"`
+	Tunnel     Handle `json:"tunnel"`
+	Target     string `json:"target"`
+	TunnelPort int    `json:"tunnel_port"`
+
+	// host:port of the tunnel port when held by another provider of the
+	// cluster
+	Address string `json:"address,omitempty"`
+}
+
+// serviceBacker is a client forwarding a registered service
+type serviceBacker struct {
+	tc *TunnelConnection
+	f  forward
+}
+
+func (b serviceBacker) info() ServiceInfo {
+	return ServiceInfo{
+		Name:       b.f.service,
+		Namespace:  b.tc.namespace,
+		Identity:   b.tc.identity,
+		Tunnel:     b.tc.handle,
+		Target:     b.f.target(),
+		TunnelPort: b.f.tunnelPort,
+	}
+}
+
+// registeredService is a name and the clients backing it, the first one is
+// the one lookups return
+type registeredService struct {
+	backers []serviceBacker
+
+	// rotates the choice among equally busy backers
+	next int
+}
+
+func (s *registeredService) info() ServiceInfo {
+	return s.backers[0].info()
+}
+
+// serviceRegistry maps the service names clients register their forwards
+// under to the tunnel ports, so that consumers find tunnels by name rather
+// than by the port the provider happened to allocate. Several clients
+// authenticated with the same identity may back one name: consumers of any
+// of their tunnel ports are handed to the least busy of them, and the name
+// is released once the last one closes. Names are scoped by the namespace
+// of the client, clients of one namespace neither see nor take the names of
+// another.
+type serviceRegistry struct {
+	// by serviceKey, names are case insensitive like DNS labels. ports maps
+	// the tunnel ports of the backers to the names, ports of backers gone
+	// stay until their session expires so that the consumers waiting on
+	// them fail over.
+	lock     sync.Mutex
+	services map[string]*registeredService
+	ports    map[int]string
+
+	// optional, shares the names with the other providers of a cluster.
+	// claimLock serializes registrations so that the store is not queried
+	// under lock.
+	cluster   *cluster
+	claimLock sync.Mutex
+}
+
+var errServiceTaken = errors.New("registered by another client")
+
+func newServiceRegistry() *serviceRegistry {
+	return &serviceRegistry{
+		services: make(map[string]*registeredService),
+		ports:    make(map[int]string),
+	}
+}
+
+// validServiceName reports whether name is a DNS label: letters, digits and
+// inner hyphens
+func validServiceName(name string) bool {
+	if len(name) == 0 || len(name) > maxServiceNameLength {
+		return false
+	}
+
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' && i > 0 && i < len(name)-1:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+func serviceKey(namespace string, name string) string {
+	return strings.ToLower(namespace + "/" + name)
+}
+
+// register names the forward f of tc, whose tunnel port is open. A client
+// authenticated with the same identity as the backers of a name joins them,
+// any other client is refused unless resuming its session, takeover. The
+// backer of the same tunnel port is replaced, as when its client reconnects
+// before the provider noticed the previous connection to be lost.
+func (r *serviceRegistry) register(tc *TunnelConnection, f forward, takeover bool) error {
+	if !validServiceName(f.service) {
+		return fmt.Errorf("invalid service name %q", f.service)
+	}
+
+	r.claimLock.Lock()
+	defer r.claimLock.Unlock()
+
+	key := serviceKey(tc.namespace, f.service)
+	backer := serviceBacker{tc: tc, f: f}
+
+	r.lock.Lock()
+	s := r.services[key]
+	r.lock.Unlock()
+
+	if s != nil && !takeover && !s.joinable(tc) {
+		return fmt.Errorf("service %q is %w", f.service, errServiceTaken)
+	}
+
+	// the name stays local while the store is unreachable, it is shared
+	// with the next refresh
+	if s == nil && r.cluster != nil {
+		if err := r.cluster.claim(key, backer, takeover); err == errServiceTaken {
+			return fmt.Errorf("service %q is %w", f.service, err)
+		} else if err != nil {
+			logger.warn("Cluster store, keep service local", "service", f.service, "error", err)
+		}
+	}
+
+	r.lock.Lock()
+	if s == nil {
+		r.services[key] = &registeredService{backers: []serviceBacker{backer}}
+	} else {
+		s.add(backer)
+	}
+	r.ports[f.tunnelPort] = key
+	r.lock.Unlock()
+	return nil
+}
+
+// joinable reports whether tc may back the service along with its backers
+func (s *registeredService) joinable(tc *TunnelConnection) bool {
+	for _, b := range s.backers {
+		if b.tc == tc {
+			return true
+		}
+	}
+	return tc.authenticated && s.backers[0].tc.identity == tc.identity
+}
+
+// add replaces the backer of the same tunnel port, or appends b
+func (s *registeredService) add(b serviceBacker) {
+	for i := range s.backers {
+		if s.backers[i].f.tunnelPort == b.f.tunnelPort {
+			s.backers[i] = b
+			return
+		}
+	}
+	s.backers = append(s.backers, b)
+}
+
+// unregister removes tc from the backers of the names it registered, and
+// returns the names released as it was the last one
+func (r *serviceRegistry) unregister(tc *TunnelConnection) []string {
+	r.claimLock.Lock()
+	defer r.claimLock.Unlock()
+
+	r.lock.Lock()
+	var names, keys []string
+	for key, s := range r.services {
+		name := s.backers[0].f.service
+		backers := s.backers[:0]
+		for _, b := range s.backers {
+			if b.tc != tc {
+				backers = append(backers, b)
+			}
+		}
+		s.backers = backers
+
+		if len(backers) == 0 {
+			r.deleteUnLocked(key)
+			names = append(names, name)
+			keys = append(keys, key)
+		}
+	}
+	r.lock.Unlock()
+
+	r.release(keys)
+
+	sort.Strings(names)
+	return names
+}
+
+func (r *serviceRegistry) deleteUnLocked(key string) {
+	delete(r.services, key)
+	for port, k := range r.ports {
+		if k == key {
+			delete(r.ports, port)
+		}
+	}
+}
+
+// forget is called once the tunnel port is closed
+func (r *serviceRegistry) forget(port int) {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	delete(r.ports, port)
+	r.lock.Unlock()
+}
+
+// pick returns the healthy backer of the service the tunnel port backs with
+// the fewest data connections, false if the port backs no name or no
+// backer is healthy
+func (r *serviceRegistry) pick(port int) (serviceBacker, bool) {
+	if r == nil {
+		return serviceBacker{}, false
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key, ok := r.ports[port]
+	if !ok {
+		return serviceBacker{}, false
+	}
+	s := r.services[key]
+
+	var selected serviceBacker
+	found, least := false, 0
+	for i := range s.backers {
+		b := s.backers[(s.next+i)%len(s.backers)]
+		if b.tc.ctx.Err() != nil {
+			continue
+		}
+
+		if n := len(b.tc.dataConnections()); !found || n < least {
+			selected, found, least = b, true, n
+		}
+	}
+	s.next++
+
+	return selected, found
+}
+
+func (r *serviceRegistry) release(keys []string) {
+	if r.cluster == nil {
+		return
+	}
+
+	for _, key := range keys {
+		if err := r.cluster.release(key); err != nil {
+			logger.warn("Cluster store, release service", "key", key, "error", err)
+		}
+	}
+}
+
+// lookup returns the service name registered in namespace, at this provider
+// or another of its cluster
+func (r *serviceRegistry) lookup(namespace string, name string) (ServiceInfo, bool) {
+	key := serviceKey(namespace, name)
+
+	r.lock.Lock()
+	s := r.services[key]
+	r.lock.Unlock()
+
+	if s != nil {
+		return s.info(), true
+	}
+	if r.cluster == nil {
+		return ServiceInfo{}, false
+	}
+
+	info, ok, err := r.cluster.lookup(key)
+	if err != nil {
+		logger.warn("Cluster store, lookup service", "service", name, "error", err)
+	}
+	return info, ok
+}
+
+// list returns the registered services of all namespaces, of the cluster
+// if any, ordered by namespace and name
+func (r *serviceRegistry) list() []ServiceInfo {
+	r.lock.Lock()
+	services := make([]ServiceInfo, 0, len(r.services))
+	for _, s := range r.services {
+		services = append(services, s.info())
+	}
+	r.lock.Unlock()
+
+	if r.cluster != nil {
+		remote, err := r.cluster.list()
+		if err != nil {
+			logger.warn("Cluster store, list services", "error", err)
+		}
+		services = append(services, remote...)
+	}
+
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].Namespace != services[j].Namespace {
+			return services[i].Namespace < services[j].Namespace
+		}
+		return services[i].Name < services[j].Name
+	})
+	return services
+}
+
+// refreshLoop keeps the names of this provider from expiring in the cluster
+// store until ctx is done. A name another provider took over meanwhile,
+// while the store was unreachable, is dropped here.
+func (r *serviceRegistry) refreshLoop(ctx context.Context) {
+	ticker := time.NewTicker(clusterTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		r.lock.Lock()
+		services := make(map[string]*registeredService, len(r.services))
+		for key, s := range r.services {
+			services[key] = s
+		}
+		r.lock.Unlock()
+
+		for key, s := range services {
+			r.refresh(key, s)
+		}
+	}
+}
+
+func (r *serviceRegistry) refresh(key string, s *registeredService) {
+	r.claimLock.Lock()
+	defer r.claimLock.Unlock()
+
+	// unregistered meanwhile, the entry is released already
+	r.lock.Lock()
+	current := r.services[key]
+	r.lock.Unlock()
+	if current != s {
+		return
+	}
+
+	// backers only change under claimLock
+	b := s.backers[0]
+	err := r.cluster.refresh(key, b)
+	if err == errServiceTaken {
+		r.lock.Lock()
+		r.deleteUnLocked(key)
+		r.lock.Unlock()
+
+		for _, b := range s.backers {
+			b.tc.log.warn("Service taken over by another provider", "service", b.f.service)
+		}
+	} else if err != nil {
+		logger.warn("Cluster store, refresh service", "service", b.f.service, "error", err)
+	}
+}
+
+// close releases the names of this provider in the cluster store
+func (r *serviceRegistry) close() {
+	if r.cluster == nil {
+		return
+	}
+
+	r.claimLock.Lock()
+	defer r.claimLock.Unlock()
+
+	r.lock.Lock()
+	keys := make([]string, 0, len(r.services))
+	for key := range r.services {
+		keys = append(keys, key)
+	}
+	r.lock.Unlock()
+
+	r.release(keys)
+	r.cluster.close()
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+func (tc *TunnelConnection) onLookupRequest(pdu *LookupRequest) {
+	response := &LookupResponse{requestID: pdu.requestID}
+
+	if tc.provider.authRequired() && !tc.authenticated {
+		response.code = ERROR_UNAUTHENTICATED
+	} else if s, ok := tc.provider.services.lookup(tc.namespace, pdu.service); ok {
+		response.tunnelPort = s.TunnelPort
+		if len(s.Address) > 0 {
+			response.tunnelAddress, _, _ = net.SplitHostPort(s.Address)
+		}
+	} else {
+		response.code = ERROR_NOT_FOUND
+	}
+
+	tc.send(response)
+}
+
+func (tc *TunnelConnection) onLookupResponse(pdu *LookupResponse) {
+	tc.lookupLock.Lock()
+	response := tc.lookups[pdu.requestID]
+	delete(tc.lookups, pdu.requestID)
+	tc.lookupLock.Unlock()
+
+	// buffered, the lookup may have given up already
+	if response != nil {
+		response <- pdu
+	}
+}
+
+// lookup asks the listener for the tunnel port registered under service, and
+// the host of the provider holding it if it is another one of the cluster
+func (tc *TunnelConnection) lookup(ctx context.Context, service string) (string, int, error) {
+	id := tc.provider.getNextHandle()
+	response := make(chan *LookupResponse, 1)
+
+	tc.lookupLock.Lock()
+	if tc.lookups == nil {
+		tc.lookups = make(map[uint32]chan *LookupResponse)
+	}
+	tc.lookups[id] = response
+	tc.lookupLock.Unlock()
+
+	defer func() {
+		tc.lookupLock.Lock()
+		delete(tc.lookups, id)
+		tc.lookupLock.Unlock()
+	}()
+
+	if err := tc.send(&LookupRequest{requestID: id, service: service}); err != nil {
+		return "", 0, err
+	}
+
+	select {
+	case pdu := <-response:
+		switch pdu.code {
+		case 0:
+			return pdu.tunnelAddress, pdu.tunnelPort, nil
+		case ERROR_NOT_FOUND:
+			return "", 0, fmt.Errorf("service %q is not registered", service)
+		case ERROR_UNAUTHENTICATED:
+			return "", 0, errors.New("authentication required")
+		default:
+			return "", 0, fmt.Errorf("lookup of service %q failed with error %d", service, pdu.code)
+		}
+
+	case <-tc.ctx.Done():
+		return "", 0, errTunnelClosed
+
+	case <-ctx.Done():
+		return "", 0, ctx.Err()
+	}
+}
@@ -0,0 +1,283 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidServiceName(t *testing.T) {
+	assert := require.New(t)
+
+	assert.True(validServiceName("web"))
+	assert.True(validServiceName("edge-01"))
+	assert.False(validServiceName(""))
+	assert.False(validServiceName("-web"))
+	assert.False(validServiceName("web-"))
+	assert.False(validServiceName("web.internal"))
+	assert.False(validServiceName(string(make([]byte, maxServiceNameLength+1))))
+}
+
+func TestServiceRegistry(t *testing.T) {
+	assert := require.New(t)
+
+	r := newServiceRegistry()
+	alice := &TunnelConnection{handle: 1, identity: "alice", authenticated: true}
+	bob := &TunnelConnection{handle: 2, identity: "bob", authenticated: true}
+	aliceAgain := &TunnelConnection{handle: 3, identity: "alice", authenticated: true}
+
+	web := forward{proxyAddress: "localhost", proxyPort: 8080, tunnelPort: 40000, service: "web"}
+	assert.Nil(r.register(alice, web, false))
+	assert.NotNil(r.register(bob, web, false))
+	assert.NotNil(r.register(bob, forward{service: "no_such"}, false))
+
+	// names are case insensitive like DNS labels
+	service, ok := r.lookup("", "WEB")
+	assert.True(ok)
+	assert.Equal(ServiceInfo{Name: "web", Identity: "alice", Tunnel: 1, Target: "localhost:8080", TunnelPort: 40000}, service)
+
+	// the name is free in other namespaces, and invisible there
+	carol := &TunnelConnection{handle: 4, identity: "carol", authenticated: true, namespace: "acme"}
+	_, ok = r.lookup("acme", "web")
+	assert.False(ok)
+	assert.Nil(r.register(carol, web, false))
+	service, _ = r.lookup("ACME", "web")
+	assert.Equal("carol", service.Identity)
+	assert.Equal([]string{"web"}, r.unregister(carol))
+
+	// a reconnecting client takes its name over, the lost connection
+	// releases nothing then
+	assert.Nil(r.register(aliceAgain, web, false))
+	assert.Empty(r.unregister(alice))
+
+	// other clients of alice back the name too, it is released along with
+	// the last of them
+	aliceStandby := &TunnelConnection{handle: 5, identity: "alice", authenticated: true}
+	assert.Nil(r.register(aliceStandby, forward{proxyAddress: "localhost", proxyPort: 8080, tunnelPort: 40001, service: "web"}, false))
+	assert.Empty(r.unregister(aliceAgain))
+	service, _ = r.lookup("", "web")
+	assert.Equal(40001, service.TunnelPort)
+	assert.Equal([]string{"web"}, r.unregister(aliceStandby))
+
+	_, ok = r.lookup("", "web")
+	assert.False(ok)
+	assert.Empty(r.list())
+}
+
+func TestServiceLookup(t *testing.T) {
+	assert := require.New(t)
+
+	target, err := startEchoServer()
+	assert.Nil(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	p := newProvider()
+	defer p.Close()
+	addr, err := p.StartListener(0)
+	assert.Nil(err)
+	providerAddress := fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port)
+
+	client := newProvider()
+	defer client.Close()
+
+	tun, err := client.Connect(ctx, ConnectorConfig{
+		ProviderAddress: providerAddress,
+		Target:          "web=" + target.String(),
+	})
+	assert.Nil(err)
+	assert.Equal("web", tun.Forwards()[0].Service)
+
+	// registered right after the listen response
+	assert.Eventually(func() bool {
+		return len(p.services.list()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// anonymous clients do not take names of others over
+	other, err := client.Connect(ctx, ConnectorConfig{
+		ProviderAddress: providerAddress,
+		Target:          "web=" + target.String(),
+	})
+	assert.Nil(err)
+	defer other.Close()
+
+	c := client.NewClient(ConnectorConfig{ProviderAddress: providerAddress})
+	defer c.Close()
+
+	address, err := c.Lookup(ctx, "web")
+	assert.Nil(err)
+	assert.Equal(fmt.Sprintf("127.0.0.1:%d", tun.Port()), address)
+
+	_, err = c.Lookup(ctx, "db")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "not registered")
+
+	consumer, err := net.Dial("tcp4", address)
+	assert.Nil(err)
+	defer consumer.Close()
+
+	_, err = consumer.Write([]byte("ping"))
+	assert.Nil(err)
+	reply := make([]byte, 4)
+	consumer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(consumer, reply)
+	assert.Nil(err)
+	assert.Equal("ping", string(reply))
+
+	// the name is released along with the tunnel
+	tun.Close()
+	assert.Eventually(func() bool {
+		_, err := c.Lookup(ctx, "web")
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestServiceNamespaces(t *testing.T) {
+	assert := require.New(t)
+
+	target, err := startEchoServer()
+	assert.Nil(err)
+
+	f, err := ioutil.TempFile("", "tokens")
+	assert.Nil(err)
+	defer os.Remove(f.Name())
+	f.WriteString("alice a-token acme\nbob b-token ACME\ncarol c-token\n")
+	f.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	p, err := NewProvider(Config{TokenFile: f.Name()})
+	assert.Nil(err)
+	defer p.Close()
+	addr, err := p.StartListener(0)
+	assert.Nil(err)
+	providerAddress := fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port)
+
+	client := newProvider()
+	defer client.Close()
+
+	tun, err := client.Connect(ctx, ConnectorConfig{
+		ProviderAddress: providerAddress,
+		Identity:        "alice",
+		Token:           "a-token",
+		Target:          "web=" + target.String(),
+	})
+	assert.Nil(err)
+	defer tun.Close()
+
+	// carol's web lives in the default namespace, next to acme's
+	other, err := client.Connect(ctx, ConnectorConfig{
+		ProviderAddress: providerAddress,
+		Identity:        "carol",
+		Token:           "c-token",
+		Target:          "web=" + target.String(),
+	})
+	assert.Nil(err)
+	defer other.Close()
+
+	assert.Eventually(func() bool {
+		return len(p.services.list()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	services := p.services.list()
+	assert.Equal("", services[0].Namespace)
+	assert.Equal("acme", services[1].Namespace)
+
+	bob := client.NewClient(ConnectorConfig{ProviderAddress: providerAddress, Identity: "bob", Token: "b-token"})
+	defer bob.Close()
+	address, err := bob.Lookup(ctx, "web")
+	assert.Nil(err)
+	assert.Equal(fmt.Sprintf("127.0.0.1:%d", tun.Port()), address)
+
+	carol := client.NewClient(ConnectorConfig{ProviderAddress: providerAddress, Identity: "carol", Token: "c-token"})
+	defer carol.Close()
+	address, err = carol.Lookup(ctx, "web")
+	assert.Nil(err)
+	assert.Equal(fmt.Sprintf("127.0.0.1:%d", other.Port()), address)
+}
+
+func TestServiceFailover(t *testing.T) {
+	assert := require.New(t)
+
+	target, err := startEchoServer()
+	assert.Nil(err)
+
+	path := writeTenantFile(t, "alice a-token\n")
+	defer os.Remove(path)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	p, err := NewProvider(Config{TokenFile: path, SessionGrace: time.Minute})
+	assert.Nil(err)
+	defer p.Close()
+	addr, err := p.StartListener(0)
+	assert.Nil(err)
+
+	client := newProvider()
+	defer client.Close()
+
+	config := ConnectorConfig{
+		ProviderAddress: fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port),
+		Identity:        "alice",
+		Token:           "a-token",
+		Target:          "web=" + target.String(),
+	}
+	first, err := client.Connect(ctx, config)
+	assert.Nil(err)
+	defer first.Close()
+	second, err := client.Connect(ctx, config)
+	assert.Nil(err)
+	defer second.Close()
+
+	backers := func() int {
+		p.services.lock.Lock()
+		defer p.services.lock.Unlock()
+
+		if s := p.services.services[serviceKey("", "web")]; s != nil {
+			return len(s.backers)
+		}
+		return 0
+	}
+	assert.Eventually(func() bool { return backers() == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	ping := func() net.Conn {
+		consumer, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", first.Port()))
+		assert.Nil(err)
+
+		_, err = consumer.Write([]byte("ping"))
+		assert.Nil(err)
+		reply := make([]byte, 4)
+		consumer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(consumer, reply)
+		assert.Nil(err)
+		assert.Equal("ping", string(reply))
+		return consumer
+	}
+
+	// consumers of the port of the first client are shared by both
+	for i := 0; i < 2; i++ {
+		defer ping().Close()
+	}
+	for _, tc := range p.tunnelConnectionList() {
+		assert.Len(tc.dataConnections(), 1)
+	}
+
+	// the port of the first client, kept for its session, fails over to
+	// the second one
+	first.Close()
+	assert.Eventually(func() bool { return backers() == 1 }, 5*time.Second, 10*time.Millisecond)
+	ping().Close()
+
+	service, ok := p.services.lookup("", "web")
+	assert.True(ok)
+	assert.Equal(second.Port(), service.TunnelPort)
+}
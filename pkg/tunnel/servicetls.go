@@ -0,0 +1,374 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// how the provider forwards the traffic of a service whose TLS it
+// terminates: in plaintext, or over a new TLS connection to the target
+const (
+	serviceTLSPlain     = "plain"
+	serviceTLSReencrypt = "reencrypt"
+)
+
+// ServiceCertificateInfo is a service whose TLS the provider terminates and
+// the certificate it presents
+type ServiceCertificateInfo struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+	Mode      string `json:"mode"`
+
+	// "uploaded", "acme", or empty while the service has no certificate
+	Source   string     `json:"source,omitempty"`
+	Subject  string     `json:"subject,omitempty"`
+	NotAfter *time.Time `json:"not_after,omitempty"`
+}
+
+// serviceTLS terminates TLS at the provider for the service names listed in
+// its file, so that the clients behind them need no certificates. A service
+// presents the certificate uploaded for it, kept in dir, or without one a
+// certificate obtained from ACME for its name within domain, e.g.
+// web.acme.example.com for the service web of namespace acme.
+type serviceTLS struct {
+	// by serviceKey
+	modes map[string]string
+	names map[string]ServiceCertificateInfo
+
+	// optional, the uploaded certificates survive restarts there
+	dir string
+
+	// optional
+	acme   *autocert.Manager
+	domain string
+
+	// uploaded certificates by serviceKey
+	lock  sync.Mutex
+	certs map[string]*tls.Certificate
+}
+
+var errServiceNotTerminated = errors.New("provider does not terminate TLS for the service")
+
+// loadServiceTLSFile loads "[namespace/]service plain|reencrypt" entries and
+// the certificates uploaded to dir before
+func loadServiceTLSFile(path string, dir string) (*serviceTLS, error) {
+	lines, err := readConfigFields(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &serviceTLS{
+		modes: make(map[string]string),
+		names: make(map[string]ServiceCertificateInfo),
+		dir:   dir,
+		certs: make(map[string]*tls.Certificate),
+	}
+	for i, fields := range lines {
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: entry %d: expected \"[namespace/]service plain|reencrypt\"", path, i+1)
+		}
+
+		var namespace string
+		name := fields[0]
+		if j := strings.Index(name, "/"); j >= 0 {
+			namespace, name = name[:j], name[j+1:]
+		}
+		if !validServiceName(name) {
+			return nil, fmt.Errorf("%s: entry %d: invalid service name %q", path, i+1, name)
+		}
+		if fields[1] != serviceTLSPlain && fields[1] != serviceTLSReencrypt {
+			return nil, fmt.Errorf("%s: entry %d: invalid mode %q, expected plain or reencrypt", path, i+1, fields[1])
+		}
+
+		key := serviceKey(namespace, name)
+		t.modes[key] = fields[1]
+		t.names[key] = ServiceCertificateInfo{Name: name, Namespace: namespace, Mode: fields[1]}
+
+		cert, err := t.read(namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		if cert != nil {
+			t.certs[key] = cert
+		}
+	}
+
+	return t, nil
+}
+
+func (t *serviceTLS) certificatePath(namespace string, name string) string {
+	return filepath.Join(t.dir, strings.ToLower(namespace), strings.ToLower(name)+".pem")
+}
+
+// read loads the certificate uploaded for the service, nil if there is none
+func (t *serviceTLS) read(namespace string, name string) (*tls.Certificate, error) {
+	if len(t.dir) == 0 {
+		return nil, nil
+	}
+
+	path := t.certificatePath(namespace, name)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	cert, err := parseServiceCertificate(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cert, nil
+}
+
+// parseServiceCertificate parses a PEM certificate chain and its private key
+func parseServiceCertificate(data []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// enableACME obtains the certificates of the services without an uploaded
+// one from Let's Encrypt, for their names within domain
+func (t *serviceTLS) enableACME(domain string, cacheDir string, email string) {
+	t.domain = strings.ToLower(strings.Trim(domain, "."))
+	t.acme = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: t.hostPolicy,
+		Email:      email,
+	}
+
+	if len(cacheDir) > 0 {
+		t.acme.Cache = autocert.DirCache(cacheDir)
+	}
+}
+
+// hostName returns the name the ACME certificate of the service is issued
+// for, nested like the DNS names of the provider
+func (t *serviceTLS) hostName(namespace string, name string) string {
+	if len(namespace) > 0 {
+		return strings.ToLower(name + "." + namespace + "." + t.domain)
+	}
+	return strings.ToLower(name + "." + t.domain)
+}
+
+func (t *serviceTLS) hostPolicy(ctx context.Context, host string) error {
+	for _, s := range t.names {
+		if t.hostName(s.Namespace, s.Name) == host {
+			return nil
+		}
+	}
+	return fmt.Errorf("no service terminates TLS for %s", host)
+}
+
+// mode returns how the service is forwarded, empty if its TLS is not
+// terminated
+func (t *serviceTLS) mode(namespace string, name string) string {
+	if t == nil || len(name) == 0 {
+		return ""
+	}
+	return t.modes[serviceKey(namespace, name)]
+}
+
+// config returns the TLS configuration consumers of the service are served
+// with
+func (t *serviceTLS) config(namespace string, name string) *tls.Config {
+	key := serviceKey(namespace, name)
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			t.lock.Lock()
+			cert := t.certs[key]
+			t.lock.Unlock()
+
+			if cert != nil {
+				return cert, nil
+			}
+			if t.acme == nil {
+				return nil, fmt.Errorf("no certificate for service %s", name)
+			}
+
+			// consumers may connect by address, without SNI
+			h := *hello
+			h.ServerName = t.hostName(namespace, name)
+			return t.acme.GetCertificate(&h)
+		},
+	}
+
+	// only ACME TLS-ALPN-01 challenges negotiate a protocol, consumers get
+	// none so that any protocol passes through
+	if t.acme != nil {
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			for _, proto := range hello.SupportedProtos {
+				if proto == acme.ALPNProto {
+					challenge := config.Clone()
+					challenge.NextProtos = []string{acme.ALPNProto}
+					return challenge, nil
+				}
+			}
+			return nil, nil
+		}
+	}
+	return config
+}
+
+// upload replaces the certificate of the service with the PEM certificate
+// chain and private key in data
+func (t *serviceTLS) upload(namespace string, name string, data []byte) error {
+	key := serviceKey(namespace, name)
+	if t == nil || len(t.modes[key]) == 0 {
+		return errServiceNotTerminated
+	}
+
+	cert, err := parseServiceCertificate(data)
+	if err != nil {
+		return err
+	}
+
+	if len(t.dir) > 0 {
+		path := t.certificatePath(namespace, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(path, data); err != nil {
+			return err
+		}
+	}
+
+	t.lock.Lock()
+	t.certs[key] = cert
+	t.lock.Unlock()
+	return nil
+}
+
+// remove deletes the certificate uploaded for the service, ACME takes over
+// if enabled
+func (t *serviceTLS) remove(namespace string, name string) error {
+	key := serviceKey(namespace, name)
+	if t == nil || len(t.modes[key]) == 0 {
+		return errServiceNotTerminated
+	}
+
+	if len(t.dir) > 0 {
+		if err := os.Remove(t.certificatePath(namespace, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	t.lock.Lock()
+	delete(t.certs, key)
+	t.lock.Unlock()
+	return nil
+}
+
+// list returns the services whose TLS is terminated ordered by namespace and
+// name
+func (t *serviceTLS) list() []ServiceCertificateInfo {
+	services := []ServiceCertificateInfo{}
+	if t == nil {
+		return services
+	}
+
+	t.lock.Lock()
+	for key, s := range t.names {
+		if cert := t.certs[key]; cert != nil {
+			notAfter := cert.Leaf.NotAfter
+			s.Source, s.Subject, s.NotAfter = "uploaded", cert.Leaf.Subject.String(), &notAfter
+		} else if t.acme != nil {
+			s.Source, s.Subject = "acme", t.hostName(s.Namespace, s.Name)
+		}
+		services = append(services, s)
+	}
+	t.lock.Unlock()
+
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].Namespace != services[j].Namespace {
+			return services[i].Namespace < services[j].Namespace
+		}
+		return services[i].Name < services[j].Name
+	})
+	return services
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// addrConn reports the address and SNI of the consumer for the pipe a
+// re-encrypted consumer is tunneled over
+type addrConn struct {
+	net.Conn
+	remote     net.Addr
+	serverName string
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// onIncomingTerminatedConnection completes the TLS handshake of a consumer of
+// the service of f at the provider before tunneling it, in plaintext or
+// over TLS to the target. The certificate of the target is not verified,
+// the tunnel is what authenticates it.
+func (tc *TunnelConnection) onIncomingTerminatedConnection(f forward, conn net.Conn, mode string) {
+	defer recoverPanic("TLS terminated data connection", func() { conn.Close() })
+
+	tlsConn := tls.Server(conn, tc.provider.serviceTLS.config(tc.namespace, f.service))
+
+	conn.SetDeadline(time.Now().Add(sniPeekTimeout))
+	err := tlsConn.Handshake()
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		tc.log.warn("TLS handshake error, reject data connection", "client", conn.RemoteAddr(), "service", f.service, "error", err)
+		conn.Close()
+		return
+	}
+
+	serverName := tlsConn.ConnectionState().ServerName
+	if tc.provider.sniPolicy != nil && !tc.provider.sniPolicy(serverName) {
+		tc.log.warn("Reject data connection, SNI is not allowed", "client", conn.RemoteAddr(), "sni", serverName)
+
+		tc.provider.audit.record("data_denied", auditFields{
+			"identity": tc.identity,
+			"client":   conn.RemoteAddr().String(),
+			"target":   f.target(),
+			"sni":      serverName,
+		})
+
+		tlsConn.Close()
+		return
+	}
+
+	if mode != serviceTLSReencrypt {
+		tc.onIncomingDataConnection(f, tlsConn)
+		return
+	}
+
+	inner, outer := net.Pipe()
+	target := tls.Client(inner, &tls.Config{
+		ServerName:         f.proxyAddress,
+		InsecureSkipVerify: true,
+	})
+	go relay(tlsConn, target)
+
+	tc.onIncomingDataConnection(f, &addrConn{Conn: outer, remote: conn.RemoteAddr(), serverName: serverName})
+}
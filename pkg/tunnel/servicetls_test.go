@@ -0,0 +1,181 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCertificatePEM returns a self-signed certificate for name followed
+// by its private key
+func newTestCertificatePEM(t *testing.T, name string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...)
+}
+
+func TestLoadServiceTLSFile(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "service-certs")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	path := writeTenantFile(t, "web plain\nacme/api reencrypt\n")
+	defer os.Remove(path)
+
+	s, err := loadServiceTLSFile(path, dir)
+	assert.Nil(err)
+	assert.Equal(serviceTLSPlain, s.mode("", "WEB"))
+	assert.Equal(serviceTLSReencrypt, s.mode("acme", "api"))
+	assert.Empty(s.mode("", "api"))
+
+	// uploads survive restarts, ACME serves the services without one
+	assert.NotNil(s.upload("", "web", []byte("not a certificate")))
+	assert.Equal(errServiceNotTerminated, s.upload("", "db", newTestCertificatePEM(t, "db")))
+	assert.Nil(s.upload("acme", "api", newTestCertificatePEM(t, "api.example.com")))
+
+	s, err = loadServiceTLSFile(path, dir)
+	assert.Nil(err)
+	s.enableACME("example.com.", "", "")
+	list := s.list()
+	assert.Len(list, 2)
+	assert.Equal("acme", list[0].Source)
+	assert.Equal("web.example.com", list[0].Subject)
+	assert.Equal("uploaded", list[1].Source)
+	assert.Equal("CN=api.example.com", list[1].Subject)
+	assert.Nil(s.hostPolicy(context.Background(), "api.acme.example.com"))
+	assert.NotNil(s.hostPolicy(context.Background(), "db.example.com"))
+
+	assert.Nil(s.remove("acme", "api"))
+	assert.Equal("acme", s.list()[1].Source)
+
+	for _, content := range []string{"web\n", "web tls\n", "we_b plain\n"} {
+		path := writeTenantFile(t, content)
+		_, err := loadServiceTLSFile(path, dir)
+		assert.NotNil(err, content)
+		os.Remove(path)
+	}
+}
+
+// startTLSEchoServer echoes every TLS connection accepted on an ephemeral
+// loopback port back to its sender
+func startTLSEchoServer(t *testing.T) net.Addr {
+	cert, err := parseServiceCertificate(newTestCertificatePEM(t, "localhost"))
+	require.NoError(t, err)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{*cert}})
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	return l.Addr()
+}
+
+func TestServiceTLSTermination(t *testing.T) {
+	assert := require.New(t)
+
+	plain, err := startEchoServer()
+	assert.Nil(err)
+	secure := startTLSEchoServer(t)
+
+	path := writeTenantFile(t, "web plain\nsecure reencrypt\n")
+	defer os.Remove(path)
+
+	p, err := NewProvider(Config{ServiceTLSFile: path})
+	assert.Nil(err)
+	defer p.Close()
+	addr, err := p.StartListener(0)
+	assert.Nil(err)
+
+	for _, name := range []string{"web", "secure"} {
+		assert.Nil(p.serviceTLS.upload("", name, newTestCertificatePEM(t, name+".example.com")))
+	}
+
+	client := newProvider()
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tun, err := client.Connect(ctx, ConnectorConfig{
+		ProviderAddress: fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port),
+		Target:          "web=" + plain.String(),
+		Forwards:        []string{"secure=" + secure.String()},
+	})
+	assert.Nil(err)
+	defer tun.Close()
+
+	assert.Eventually(func() bool {
+		return len(p.services.list()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for _, f := range tun.Forwards() {
+		serverName := f.Service + ".example.com"
+		consumer, err := tls.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", f.TunnelPort), &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		assert.Nil(err)
+		assert.Equal("CN="+f.Service+".example.com", consumer.ConnectionState().PeerCertificates[0].Subject.String())
+
+		_, err = consumer.Write([]byte("ping"))
+		assert.Nil(err)
+		reply := make([]byte, 4)
+		consumer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(consumer, reply)
+		assert.Nil(err, f.Service)
+		assert.Equal("ping", string(reply))
+
+		// the access log records the host name of terminated connections
+		assert.Eventually(func() bool {
+			var hosts []string
+			for _, tc := range p.tunnelConnectionList() {
+				for _, dc := range tc.dataConnections() {
+					hosts = append(hosts, dc.serverName)
+				}
+			}
+			return len(hosts) == 1 && hosts[0] == serverName
+		}, 5*time.Second, 10*time.Millisecond)
+		consumer.Close()
+	}
+}
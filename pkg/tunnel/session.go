@@ -0,0 +1,386 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const sessionIDLength = 16
+
+// tunnelSession owns a tunnel port on behalf of a client. When the client's
+// signaling connection drops, the port stays open for a grace period so that
+// the client can resume the session and keep its port. Consumers connecting
+// meanwhile wait in the listen backlog until the session is resumed.
+type tunnelSession struct {
+	id           string
+	identity     string
+	proxyAddress string
+	proxyPort    int
+	port         int
+	listeners    []net.Listener
+
+	// optional, consumers of a port backing a service name are handed to
+	// the least busy client backing it
+	services *serviceRegistry
+
+	lock sync.Mutex
+	tc   *TunnelConnection
+
+	// set while detached, closed once the session is resumed or expires
+	attached chan struct{}
+	expired  bool
+	expiry   *time.Timer
+}
+
+// owner returns the tunnel connection consumers of the port are handed to,
+// waiting while the client is reconnecting, nil once the session expired
+func (s *tunnelSession) owner() *TunnelConnection {
+	for {
+		s.lock.Lock()
+		tc, attached, expired := s.tc, s.attached, s.expired
+		s.lock.Unlock()
+
+		if expired {
+			return nil
+		}
+		if tc != nil {
+			return tc
+		}
+
+		<-attached
+	}
+}
+
+func (s *tunnelSession) isExpired() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.expired
+}
+
+func (s *tunnelSession) accept(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if !s.isExpired() {
+				logger.error("Tunnel port accept error", "tunnel_port", s.port, "error", err)
+			}
+			return
+		}
+
+		f := forward{proxyAddress: s.proxyAddress, proxyPort: s.proxyPort, tunnelPort: s.port}
+		var tc *TunnelConnection
+		if b, ok := s.services.pick(s.port); ok {
+			tc = b.tc
+			f = forward{proxyAddress: b.f.proxyAddress, proxyPort: b.f.proxyPort, tunnelPort: s.port, service: b.f.service}
+		} else if tc = s.owner(); tc == nil {
+			c.Close()
+			return
+		}
+		tc.provider.socketOptions.apply(c)
+
+		tc.onIncomingConnection(f, c)
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// sessionTable keeps the tunnel sessions of a provider. With a zero grace
+// period sessions end with their signaling connection and are never resumed.
+type sessionTable struct {
+	grace time.Duration
+
+	// optional, keeps sessions across provider restarts
+	registry *tunnelRegistry
+
+	// optional, tunnel ports reserved for the identities that held them
+	reservations *reservationTable
+
+	// optional, the service names the tunnel ports back
+	services *serviceRegistry
+
+	// by sessionKey, a client resumes the sessions of all its forwards with
+	// one session ID
+	lock     sync.Mutex
+	sessions map[string]*tunnelSession
+
+	// set by close, the registry keeps the sessions from then on
+	closed bool
+}
+
+func newSessionTable(grace time.Duration) *sessionTable {
+	return &sessionTable{
+		grace:    grace,
+		sessions: make(map[string]*tunnelSession),
+	}
+}
+
+func sessionKey(id string, proxyAddress string, proxyPort int) string {
+	return id + "/" + net.JoinHostPort(proxyAddress, strconv.Itoa(proxyPort))
+}
+
+func (s *tunnelSession) key() string {
+	return sessionKey(s.id, s.proxyAddress, s.proxyPort)
+}
+
+// sessionID returns requested when it names a known session, a new random
+// ID otherwise. Empty when sessions cannot be resumed.
+func (t *sessionTable) sessionID(requested []byte) (string, error) {
+	if t.grace <= 0 {
+		return "", nil
+	}
+
+	t.lock.Lock()
+	known := false
+	for _, s := range t.sessions {
+		if s.id == string(requested) {
+			known = true
+			break
+		}
+	}
+	t.lock.Unlock()
+
+	if known {
+		return string(requested), nil
+	}
+
+	id := make([]byte, sessionIDLength)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return string(id), nil
+}
+
+// open starts a session for the freshly bound tunnel port listeners of the
+// target of tc
+func (t *sessionTable) open(tc *TunnelConnection, proxyAddress string, proxyPort int, listeners []net.Listener) *tunnelSession {
+	s := &tunnelSession{
+		id:           tc.sessionID,
+		identity:     tc.identity,
+		proxyAddress: proxyAddress,
+		proxyPort:    proxyPort,
+		port:         listeners[0].Addr().(*net.TCPAddr).Port,
+		listeners:    listeners,
+		services:     t.services,
+		tc:           tc,
+	}
+
+	if len(s.id) > 0 {
+		t.lock.Lock()
+		t.sessions[s.key()] = s
+		t.lock.Unlock()
+
+		t.persist()
+	}
+
+	for _, l := range listeners {
+		l := l
+		supervise("tunnel port accept loop", func() { s.accept(l) })
+	}
+
+	return s
+}
+
+// resume hands the session of tc's session ID over to tc when it was opened
+// by the same identity for the same target, taking it over from a previous
+// connection the provider has not yet noticed to be dead
+func (t *sessionTable) resume(tc *TunnelConnection, proxyAddress string, proxyPort int) *tunnelSession {
+	if len(tc.sessionID) == 0 {
+		return nil
+	}
+
+	t.lock.Lock()
+	s := t.sessions[sessionKey(tc.sessionID, proxyAddress, proxyPort)]
+	t.lock.Unlock()
+
+	if s == nil || s.identity != tc.identity {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.expired {
+		return nil
+	}
+
+	previous := s.tc
+	s.tc = tc
+	if previous == nil {
+		s.expiry.Stop()
+		close(s.attached)
+		s.attached = nil
+	} else {
+		previous.conn.Close()
+	}
+
+	return s
+}
+
+// detach is called when the signaling connection of tc is gone, the session
+// expires after the grace period unless it is resumed
+func (t *sessionTable) detach(s *tunnelSession, tc *TunnelConnection) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.tc != tc || s.expired {
+		return
+	}
+
+	if t.grace <= 0 || len(s.id) == 0 {
+		t.expireUnLocked(s, "tunnel connection closed")
+		return
+	}
+
+	s.tc = nil
+	s.attached = make(chan struct{})
+	t.expireAfterUnLocked(s)
+}
+
+func (t *sessionTable) expireAfterUnLocked(s *tunnelSession) {
+	s.expiry = time.AfterFunc(t.grace, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		if s.tc == nil && !s.expired {
+			t.expireUnLocked(s, "session expired")
+		}
+	})
+}
+
+func (t *sessionTable) expireUnLocked(s *tunnelSession, reason string) {
+	logger.info("Close tunnel port", "tunnel_port", s.port, "identity", s.identity,
+		"target", net.JoinHostPort(s.proxyAddress, strconv.Itoa(s.proxyPort)), "reason", reason)
+
+	s.expired = true
+	if s.attached != nil {
+		close(s.attached)
+	}
+
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	t.reservations.release(s.port)
+	t.services.forget(s.port)
+
+	t.lock.Lock()
+	removed := t.sessions[s.key()] == s
+	if removed {
+		delete(t.sessions, s.key())
+	}
+	t.lock.Unlock()
+
+	if removed {
+		t.persist()
+	}
+}
+
+// close ends all sessions along with the provider, leaving the registry as
+// is so that they are restored on the next start
+func (t *sessionTable) close() {
+	t.lock.Lock()
+	t.closed = true
+	sessions := make([]*tunnelSession, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		sessions = append(sessions, s)
+	}
+	t.lock.Unlock()
+
+	for _, s := range sessions {
+		s.lock.Lock()
+		if !s.expired {
+			if s.expiry != nil {
+				s.expiry.Stop()
+			}
+			t.expireUnLocked(s, "provider closed")
+		}
+		s.lock.Unlock()
+	}
+}
+
+// persist writes the current sessions to the registry
+func (t *sessionTable) persist() {
+	if t.registry == nil {
+		return
+	}
+
+	t.registry.lock.Lock()
+	defer t.registry.lock.Unlock()
+
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return
+	}
+
+	entries := make([]registryEntry, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		entries = append(entries, newRegistryEntry(s))
+	}
+	t.lock.Unlock()
+
+	if err := t.registry.save(entries); err != nil {
+		logger.error("Tunnel registry error", "error", err)
+	}
+}
+
+// restore re-binds the tunnel ports of the sessions in the registry. They
+// stay detached until their clients resume them, or expire after the grace
+// period like the sessions of a lost connection.
+func (t *sessionTable) restore(bind func(address string) ([]net.Listener, error)) error {
+	entries, err := t.registry.load()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		id, err := hex.DecodeString(e.SessionID)
+		if err != nil || len(id) == 0 {
+			logger.warn("Tunnel registry, skip invalid session ID", "session", e.SessionID)
+			continue
+		}
+
+		listeners, err := bind(fmt.Sprintf(":%d", e.TunnelPort))
+		if err != nil {
+			logger.warn("Tunnel registry, cannot re-bind port", "tunnel_port", e.TunnelPort, "identity", e.Identity, "error", err)
+			continue
+		}
+
+		s := &tunnelSession{
+			id:           string(id),
+			identity:     e.Identity,
+			proxyAddress: e.ProxyAddress,
+			proxyPort:    e.ProxyPort,
+			port:         e.TunnelPort,
+			listeners:    listeners,
+			services:     t.services,
+			attached:     make(chan struct{}),
+		}
+
+		t.lock.Lock()
+		t.sessions[s.key()] = s
+		t.lock.Unlock()
+		t.reservations.reopen(s.identity, s.port)
+
+		s.lock.Lock()
+		t.expireAfterUnLocked(s)
+		s.lock.Unlock()
+
+		for _, l := range listeners {
+			l := l
+			supervise("tunnel port accept loop", func() { s.accept(l) })
+		}
+
+		logger.info("Restored tunnel port", "tunnel_port", s.port, "identity", s.identity,
+			"target", net.JoinHostPort(s.proxyAddress, strconv.Itoa(s.proxyPort)))
+	}
+
+	// drops the sessions that could not be restored
+	t.persist()
+	return nil
+}
@@ -0,0 +1,152 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newSessionTunnel(t *testing.T, p *Provider, sessionID []byte) *TunnelConnection {
+	assert := require.New(t)
+
+	local, remote := net.Pipe()
+	t.Cleanup(func() { remote.Close() })
+
+	tc := p.newTunnelConnection(local)
+	tc.identity = "alice"
+
+	id, err := p.sessions.sessionID(sessionID)
+	assert.Nil(err)
+	tc.sessionID = id
+
+	return tc
+}
+
+func TestSessionResume(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+	p.sessions = newSessionTable(time.Minute)
+
+	tc := newSessionTunnel(t, p, nil)
+	assert.Len(tc.sessionID, sessionIDLength)
+
+	port, err := tc.startListenFor(forward{proxyAddress: "127.0.0.1", proxyPort: 80})
+	assert.Nil(err)
+
+	p.closeTunnelConnection(tc)
+
+	// the port is held for the client while it reconnects
+	_, err = net.Listen("tcp4", fmt.Sprintf(":%d", port))
+	assert.NotNil(err)
+
+	consumer, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+	assert.Nil(err)
+	defer consumer.Close()
+
+	// another target does not resume the session
+	other := newSessionTunnel(t, p, []byte(tc.sessionID))
+	_, resumed := other.resumeListenFor(forward{proxyAddress: "127.0.0.1", proxyPort: 81})
+	assert.False(resumed)
+
+	resumedTc := newSessionTunnel(t, p, []byte(tc.sessionID))
+	assert.Equal(tc.sessionID, resumedTc.sessionID)
+
+	resumedPort, resumed := resumedTc.resumeListenFor(forward{proxyAddress: "127.0.0.1", proxyPort: 80})
+	assert.True(resumed)
+	assert.Equal(port, resumedPort)
+
+	// the consumer that connected meanwhile is handed to the new connection
+	assert.Eventually(func() bool {
+		return len(resumedTc.dataConnections()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	p.sessions.grace = 0
+	p.closeTunnelConnection(resumedTc)
+}
+
+func TestSessionTakeOver(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+	p.sessions = newSessionTable(time.Minute)
+
+	tc := newSessionTunnel(t, p, nil)
+	port, err := tc.startListenFor(forward{proxyAddress: "127.0.0.1", proxyPort: 80})
+	assert.Nil(err)
+
+	// a client reconnecting before the provider noticed the old connection
+	// is gone takes the session over
+	resumedTc := newSessionTunnel(t, p, []byte(tc.sessionID))
+	resumedPort, resumed := resumedTc.resumeListenFor(forward{proxyAddress: "127.0.0.1", proxyPort: 80})
+	assert.True(resumed)
+	assert.Equal(port, resumedPort)
+
+	_, err = tc.conn.Write([]byte{0})
+	assert.NotNil(err)
+
+	// closing the old connection leaves the session attached
+	p.closeTunnelConnection(tc)
+	assert.Equal(resumedTc, tc.sessions[0].owner())
+}
+
+func TestSessionExpires(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+	p.sessions = newSessionTable(50 * time.Millisecond)
+
+	tc := newSessionTunnel(t, p, nil)
+	port, err := tc.startListenFor(forward{proxyAddress: "127.0.0.1", proxyPort: 80})
+	assert.Nil(err)
+
+	p.closeTunnelConnection(tc)
+
+	// the tunnel port closes before the session leaves the table
+	assert.Eventually(func() bool {
+		p.sessions.lock.Lock()
+		defer p.sessions.lock.Unlock()
+		if len(p.sessions.sessions) > 0 {
+			return false
+		}
+
+		l, err := net.Listen("tcp4", fmt.Sprintf(":%d", port))
+		if err != nil {
+			return false
+		}
+		l.Close()
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// an unknown session is replaced by a new one
+	resumedTc := newSessionTunnel(t, p, []byte(tc.sessionID))
+	assert.NotEqual(tc.sessionID, resumedTc.sessionID)
+
+	_, resumed := resumedTc.resumeListenFor(forward{proxyAddress: "127.0.0.1", proxyPort: 80})
+	assert.False(resumed)
+}
+
+func TestSessionWithoutGrace(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+
+	tc := newSessionTunnel(t, p, nil)
+	assert.Empty(tc.sessionID)
+
+	port, err := tc.startListenFor(forward{proxyAddress: "127.0.0.1", proxyPort: 80})
+	assert.Nil(err)
+
+	p.closeTunnelConnection(tc)
+
+	// nothing accepts consumers the tunnel can no longer serve
+	_, err = net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+	assert.NotNil(err)
+
+	l, err := net.Listen("tcp4", fmt.Sprintf(":%d", port))
+	assert.Nil(err)
+	l.Close()
+}
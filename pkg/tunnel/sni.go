@@ -0,0 +1,157 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"path"
+	"strings"
+	"time"
+)
+
+const sniPeekTimeout = 5 * time.Second
+
+// sniPolicy decides whether a data connection whose TLS ClientHello carries
+// serverName may be tunneled. serverName is empty for non-TLS connections
+// and ClientHellos without SNI.
+type sniPolicy func(serverName string) bool
+
+// pattern allowing connections without a server name, i.e. plain TCP and
+// ClientHellos without SNI
+const sniNonePattern = "-"
+
+// newSNIPatternPolicy builds a policy from comma separated glob patterns.
+// Names matching deny are refused, when allow is not empty only names
+// matching it are accepted. Connections without a server name are refused
+// unless allow lists sniNonePattern.
+func newSNIPatternPolicy(allow string, deny string) (sniPolicy, error) {
+	allowPatterns, err := splitPatterns(allow)
+	if err != nil {
+		return nil, err
+	}
+
+	denyPatterns, err := splitPatterns(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	allowNone := false
+	for _, p := range allowPatterns {
+		allowNone = allowNone || p == sniNonePattern
+	}
+
+	return func(serverName string) bool {
+		if len(serverName) == 0 {
+			return allowNone
+		}
+		name := strings.ToLower(serverName)
+
+		if matchAny(denyPatterns, name) {
+			return false
+		}
+
+		return len(allowPatterns) == 0 || matchAny(allowPatterns, name)
+	}, nil
+}
+
+func splitPatterns(s string) ([]string, error) {
+	var patterns []string
+	for _, p := range strings.Split(s, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if len(p) == 0 {
+			continue
+		}
+
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+
+	return patterns, nil
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// peekedConn replays the bytes consumed while peeking before reading on
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+
+	// SNI of the ClientHello peeked, empty without
+	serverName string
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// peekServerName reads the TLS ClientHello from conn without terminating
+// TLS, returning its SNI and a connection that still yields every byte
+func peekServerName(conn net.Conn) (string, net.Conn, error) {
+	peeked := new(bytes.Buffer)
+
+	conn.SetReadDeadline(time.Now().Add(sniPeekTimeout))
+	hello, err := readClientHello(io.TeeReader(conn, peeked))
+	conn.SetReadDeadline(time.Time{})
+
+	wrapped := &peekedConn{
+		Conn: conn,
+		r:    io.MultiReader(peeked, conn),
+	}
+
+	if hello == nil {
+		return "", wrapped, err
+	}
+
+	wrapped.serverName = hello.ServerName
+	return hello.ServerName, wrapped, nil
+}
+
+var errClientHelloRead = errors.New("client hello read")
+
+func readClientHello(r io.Reader) (*tls.ClientHelloInfo, error) {
+	var hello *tls.ClientHelloInfo
+
+	err := tls.Server(readOnlyConn{r: r}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = new(tls.ClientHelloInfo)
+			*hello = *h
+
+			// stop the handshake, nothing is ever written back
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+
+	if hello != nil {
+		return hello, nil
+	}
+
+	return nil, err
+}
+
+// readOnlyConn feeds a reader to tls.Server, writes are discarded
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)         { return c.r.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
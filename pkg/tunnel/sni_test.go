@@ -0,0 +1,44 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeekServerName(t *testing.T) {
+	assert := require.New(t)
+
+	client, server := net.Pipe()
+	go tls.Client(client, &tls.Config{ServerName: "api.example.com"}).Handshake()
+
+	serverName, conn, err := peekServerName(server)
+	assert.NoError(err)
+	assert.Equal("api.example.com", serverName)
+
+	// the ClientHello is still readable after peeking
+	header := make([]byte, 5)
+	_, err = io.ReadFull(conn, header)
+	assert.NoError(err)
+	assert.Equal(byte(0x16), header[0])
+
+	policy, err := newSNIPatternPolicy("*.example.com", "admin.example.com")
+	assert.NoError(err)
+	assert.True(policy("api.example.com"))
+	assert.False(policy("admin.example.com"))
+	assert.False(policy("example.org"))
+	assert.False(policy(""))
+
+	// deny patterns alone do not let connections without SNI through
+	policy, err = newSNIPatternPolicy("", "admin.example.com")
+	assert.NoError(err)
+	assert.True(policy("api.example.com"))
+	assert.False(policy(""))
+
+	policy, err = newSNIPatternPolicy("*.example.com,-", "")
+	assert.NoError(err)
+	assert.True(policy(""))
+}
@@ -0,0 +1,67 @@
+package tunnel
+
+import (
+	"net"
+	"time"
+)
+
+// socketOptions tunes the TCP tunnel and data connections, zero values keep
+// the Go defaults (Nagle off, 15s keepalive, OS buffer sizes). A nil
+// *socketOptions leaves connections untouched.
+type socketOptions struct {
+	// enable Nagle's algorithm, trading latency for fewer small packets
+	nagle bool
+
+	// keepalive probe period, negative disables keepalive
+	keepAlive time.Duration
+
+	// SO_SNDBUF and SO_RCVBUF in bytes
+	sendBuffer    int
+	receiveBuffer int
+}
+
+// apply tunes conn if it is a TCP connection, failures are logged only
+func (o *socketOptions) apply(conn net.Conn) {
+	tcp, ok := conn.(*net.TCPConn)
+	if o == nil || !ok {
+		return
+	}
+
+	var errs []error
+	if o.nagle {
+		errs = append(errs, tcp.SetNoDelay(false))
+	}
+
+	if o.keepAlive < 0 {
+		errs = append(errs, tcp.SetKeepAlive(false))
+	} else if o.keepAlive > 0 {
+		errs = append(errs, tcp.SetKeepAlive(true), tcp.SetKeepAlivePeriod(o.keepAlive))
+	}
+
+	if o.sendBuffer > 0 {
+		errs = append(errs, tcp.SetWriteBuffer(o.sendBuffer))
+	}
+	if o.receiveBuffer > 0 {
+		errs = append(errs, tcp.SetReadBuffer(o.receiveBuffer))
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			logger.warn("Socket option error", "error", err)
+		}
+	}
+}
+
+// tunedListener applies socket options to every accepted connection
+type tunedListener struct {
+	net.Listener
+	options *socketOptions
+}
+
+func (l *tunedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.options.apply(conn)
+	}
+	return conn, err
+}
@@ -0,0 +1,41 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunedListener(t *testing.T) {
+	assert := require.New(t)
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(err)
+	defer l.Close()
+
+	tuned := &tunedListener{Listener: l, options: &socketOptions{
+		nagle:         true,
+		keepAlive:     time.Minute,
+		sendBuffer:    64 * 1024,
+		receiveBuffer: 64 * 1024,
+	}}
+
+	go func() {
+		conn, err := net.Dial("tcp4", l.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := tuned.Accept()
+	assert.NoError(err)
+	conn.Close()
+
+	// nil options and non TCP connections are left alone
+	var none *socketOptions
+	a, b := net.Pipe()
+	none.apply(a)
+	tuned.options.apply(b)
+}
@@ -0,0 +1,71 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// spiffeID returns the SPIFFE ID of an X.509-SVID, the single spiffe:// URI
+// SAN of the certificate, or "" if the certificate carries none
+func spiffeID(cert *x509.Certificate) (string, error) {
+	var id *url.URL
+	for _, uri := range cert.URIs {
+		if !strings.EqualFold(uri.Scheme, "spiffe") {
+			continue
+		}
+
+		if id != nil {
+			return "", errors.New("certificate carries more than one SPIFFE ID")
+		}
+		id = uri
+	}
+
+	if id == nil {
+		return "", nil
+	}
+
+	if len(id.Host) == 0 || id.User != nil || len(id.Port()) > 0 || len(id.RawQuery) > 0 || len(id.Fragment) > 0 {
+		return "", fmt.Errorf("malformed SPIFFE ID %s", id)
+	}
+
+	return "spiffe://" + strings.ToLower(id.Host) + id.EscapedPath(), nil
+}
+
+// peerIdentity maps the verified client certificate of an mTLS connection to
+// a client identity: its SPIFFE ID if present, the subject common name
+// otherwise. SPIFFE IDs outside trustDomain are rejected when it is set.
+func peerIdentity(state tls.ConnectionState, trustDomain string) (string, int, error) {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", 0, errors.New("no verified client certificate")
+	}
+
+	cert := state.VerifiedChains[0][0]
+
+	id, err := spiffeID(cert)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if len(id) > 0 {
+		if len(trustDomain) > 0 && !strings.HasPrefix(id, "spiffe://"+strings.ToLower(trustDomain)+"/") &&
+			id != "spiffe://"+strings.ToLower(trustDomain) {
+			return "", 0, fmt.Errorf("SPIFFE ID %s is outside trust domain %s", id, trustDomain)
+		}
+
+		return id, AUTH_SOURCE_SPIFFE, nil
+	}
+
+	if len(trustDomain) > 0 {
+		return "", 0, errors.New("client certificate carries no SPIFFE ID")
+	}
+
+	if len(cert.Subject.CommonName) == 0 {
+		return "", 0, errors.New("client certificate has neither SPIFFE ID nor common name")
+	}
+
+	return cert.Subject.CommonName, AUTH_SOURCE_CERTIFICATE, nil
+}
@@ -0,0 +1,50 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerIdentity(t *testing.T) {
+	assert := require.New(t)
+
+	svid := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "edge"},
+		URIs:    []*url.URL{{Scheme: "spiffe", Host: "Example.org", Path: "/edge/box1"}},
+	}
+	state := tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{svid}}}
+
+	identity, source, err := peerIdentity(state, "")
+	assert.NoError(err)
+	assert.Equal("spiffe://example.org/edge/box1", identity)
+	assert.Equal(AUTH_SOURCE_SPIFFE, source)
+
+	_, _, err = peerIdentity(state, "example.org")
+	assert.NoError(err)
+
+	_, _, err = peerIdentity(state, "other.org")
+	assert.Error(err)
+
+	plain := &x509.Certificate{Subject: pkix.Name{CommonName: "edge"}}
+	identity, source, err = peerIdentity(tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{plain}}}, "")
+	assert.NoError(err)
+	assert.Equal("edge", identity)
+	assert.Equal(AUTH_SOURCE_CERTIFICATE, source)
+
+	acl := &accessControlList{
+		rules: map[string][]targetPattern{
+			"spiffe://example.org/edge/*": {{host: "10.0.0.1", port: "22"}},
+		},
+	}
+	assert.True(acl.isAllowed("spiffe://example.org/edge/box1", AUTH_SOURCE_SPIFFE, "10.0.0.1", 22))
+	assert.False(acl.isAllowed("spiffe://example.org/core/box1", AUTH_SOURCE_SPIFFE, "10.0.0.1", 22))
+
+	// a common name or token identity spelled like a SPIFFE ID is not one
+	assert.False(acl.isAllowed("spiffe://example.org/edge/box1", AUTH_SOURCE_CERTIFICATE, "10.0.0.1", 22))
+	assert.False(acl.isAllowed("spiffe://example.org/edge/box1", AUTH_SOURCE_TOKEN, "10.0.0.1", 22))
+}
@@ -0,0 +1,95 @@
+package tunnel
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// PeerStats is what the peer of a tunnel last reported of it with a
+// StatsIndication. Rx is read from the data connections of the peer, Tx
+// written to them, Errors counts the ErrorIndications it sent.
+type PeerStats struct {
+	DataConnections int `json:"data_connections"`
+	TrafficSnapshot
+	Errors  uint64    `json:"errors"`
+	Updated time.Time `json:"updated"`
+}
+
+// startStatsTimer reports the numbers of tc to the peer every stats interval
+// of the provider, once the handshake negotiated CAPABILITY_STATS
+func (tc *TunnelConnection) startStatsTimer() {
+	interval := tc.provider.statsInterval
+	if interval <= 0 || tc.capabilities&CAPABILITY_STATS == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				tc.sendStats()
+
+			case <-tc.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (tc *TunnelConnection) sendStats() {
+	counters := tc.snapshot()
+	tc.send(&StatsIndication{
+		dataConnections: uint32(len(tc.dataConnections())),
+		rxBytes:         counters.RxBytes,
+		txBytes:         counters.TxBytes,
+		rxFrames:        counters.RxFrames,
+		txFrames:        counters.TxFrames,
+		errors:          atomic.LoadUint64(&tc.errors),
+	})
+}
+
+func (tc *TunnelConnection) onStatsIndication(pdu *StatsIndication) {
+	stats := &PeerStats{
+		DataConnections: int(pdu.dataConnections),
+		TrafficSnapshot: TrafficSnapshot{
+			RxBytes:  pdu.rxBytes,
+			TxBytes:  pdu.txBytes,
+			RxFrames: pdu.rxFrames,
+			TxFrames: pdu.txFrames,
+		},
+		Errors:  pdu.errors,
+		Updated: time.Now(),
+	}
+
+	tc.statsLock.Lock()
+	tc.peerStats = stats
+	tc.statsLock.Unlock()
+
+	tc.log.debug("Peer stats", append([]interface{}{"data_connections", stats.DataConnections},
+		append(stats.fields(), "errors", stats.Errors)...)...)
+}
+
+// reportedStats returns a copy of what the peer last reported, nil until
+// it has
+func (tc *TunnelConnection) reportedStats() *PeerStats {
+	tc.statsLock.Lock()
+	defer tc.statsLock.Unlock()
+
+	if tc.peerStats == nil {
+		return nil
+	}
+	stats := *tc.peerStats
+	return &stats
+}
+
+// PeerStats returns what the provider last reported of the tunnel, false
+// until it has
+func (t *Tunnel) PeerStats() (PeerStats, bool) {
+	if stats := t.tc.reportedStats(); stats != nil {
+		return *stats, true
+	}
+	return PeerStats{}, false
+}
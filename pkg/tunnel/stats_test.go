@@ -0,0 +1,74 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsPdu(t *testing.T) {
+	assert := require.New(t)
+
+	frame := encodePdu(&StatsIndication{dataConnections: 2, rxBytes: 10, txBytes: 20, rxFrames: 1, txFrames: 2, errors: 3})
+	pdu := serializePduFrom(bytes.NewBuffer(frame[4:])).(*StatsIndication)
+	assert.Equal(uint32(2), pdu.dataConnections)
+	assert.Equal(uint64(20), pdu.txBytes)
+	assert.Equal(uint64(3), pdu.errors)
+}
+
+func TestPeerStats(t *testing.T) {
+	assert := require.New(t)
+
+	target, err := startEchoServer()
+	assert.Nil(err)
+
+	p, err := NewProvider(Config{StatsInterval: 50 * time.Millisecond})
+	assert.Nil(err)
+	defer p.Close()
+	addr, err := p.StartListener(0)
+	assert.Nil(err)
+
+	client, err := NewProvider(Config{StatsInterval: 50 * time.Millisecond})
+	assert.Nil(err)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tun, err := client.Connect(ctx, ConnectorConfig{
+		ProviderAddress: fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port),
+		Target:          target.String(),
+	})
+	assert.Nil(err)
+	defer tun.Close()
+
+	consumer, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", tun.Port()))
+	assert.Nil(err)
+	defer consumer.Close()
+
+	payload := []byte("hello")
+	consumer.Write(payload)
+	reply := make([]byte, len(payload))
+	consumer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(consumer, reply)
+	assert.Nil(err)
+
+	// the provider wrote to the target what the client read from the consumer
+	assert.Eventually(func() bool {
+		stats, ok := tun.PeerStats()
+		return ok && stats.DataConnections == 1 && stats.TxBytes == uint64(len(payload))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	tunnels, _ := p.connectionSnapshot()
+	assert.Len(tunnels, 1)
+	assert.Eventually(func() bool {
+		stats := tunnelView(p.getTunnelConnection(tunnels[0].Handle)).Peer
+		return stats != nil && stats.RxBytes == uint64(len(payload))
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,47 @@
+package tunnel
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// delay before a panicked loop is restarted, keeps a loop that panics on
+// every iteration from spinning
+const restartDelay = time.Second
+
+// supervise runs loop in its own goroutine and restarts it whenever it
+// panics, so that a bug hit by one connection does not silently take a
+// listener down with it. Supervision ends once loop returns.
+func supervise(name string, loop func()) {
+	go func() {
+		for !runSupervised(name, loop) {
+			logger.warn("Restart after panic", "loop", name, "delay", restartDelay)
+			time.Sleep(restartDelay)
+		}
+	}()
+}
+
+// runSupervised reports whether loop returned rather than panicked
+func runSupervised(name string, loop func()) (returned bool) {
+	defer recoverPanic(name, nil)
+
+	loop()
+	return true
+}
+
+// recoverPanic logs a panic of the calling goroutine with its stack trace and
+// runs cleanup, the goroutine then ends instead of the whole process. Must be
+// deferred directly.
+func recoverPanic(name string, cleanup func()) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	logger.error("Panic", "in", name, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+
+	if cleanup != nil {
+		cleanup()
+	}
+}
@@ -0,0 +1,43 @@
+package tunnel
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSuperviseRestartsPanickedLoop(t *testing.T) {
+	assert := require.New(t)
+
+	var runs int32
+	done := make(chan struct{})
+
+	supervise("test loop", func() {
+		if atomic.AddInt32(&runs, 1) == 1 {
+			panic("boom")
+		}
+		close(done)
+	})
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		assert.Fail("loop was not restarted")
+	}
+	assert.Equal(int32(2), atomic.LoadInt32(&runs))
+}
+
+func TestRecoverPanicRunsCleanup(t *testing.T) {
+	assert := require.New(t)
+
+	cleaned := false
+
+	func() {
+		defer recoverPanic("test reader", func() { cleaned = true })
+		panic("boom")
+	}()
+
+	assert.True(cleaned)
+}
@@ -0,0 +1,194 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syslogFacilities are the facility codes of RFC 5424 by name
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// ParseSyslogFacility returns the code of a facility name, e.g. daemon
+func ParseSyslogFacility(s string) (int, error) {
+	if facility, ok := syslogFacilities[strings.ToLower(s)]; ok {
+		return facility, nil
+	}
+
+	return 0, fmt.Errorf("unknown syslog facility %q", s)
+}
+
+// syslog severities of the log levels
+var syslogSeverities = [...]int{
+	levelTrace: 7,
+	levelDebug: 7,
+	levelInfo:  6,
+	levelWarn:  4,
+	levelError: 3,
+}
+
+// levelWriter is an output that records the level of each event itself
+type levelWriter interface {
+	writeLevel(level logLevel, b []byte) (int, error)
+}
+
+// syslogWriter sends each write as an RFC 5424 message to a syslog
+// endpoint: the local daemon, over UDP, or over TCP framed by octet counting
+// as in RFC 6587. Stream connections are redialed after a failed write.
+type syslogWriter struct {
+	lock sync.Mutex
+
+	network string
+	address string
+	conn    net.Conn
+	closed  bool
+
+	facility int
+	hostname string
+	app      string
+	msgID    string
+}
+
+// DialSyslog returns an output sending RFC 5424 messages to target, see
+// dialSyslog, e.g. for SetLogOutput. The log level of each event sets the
+// severity of its message.
+func DialSyslog(target string, facility int, msgID string) (io.WriteCloser, error) {
+	return dialSyslog(target, facility, msgID)
+}
+
+// dialSyslog connects to target: "local" for the local daemon at /dev/log,
+// unix:///path, udp://host:port or tcp://host:port. Messages carry
+// facility and msgID.
+func dialSyslog(target string, facility int, msgID string) (*syslogWriter, error) {
+	w := &syslogWriter{
+		facility: facility,
+		app:      filepath.Base(os.Args[0]),
+		msgID:    msgID,
+	}
+
+	w.hostname, _ = os.Hostname()
+	if len(w.hostname) == 0 {
+		w.hostname = "-"
+	}
+
+	switch {
+	case target == "local":
+		w.network, w.address = "unixgram", "/dev/log"
+	case strings.HasPrefix(target, "unix://"):
+		w.network, w.address = "unixgram", strings.TrimPrefix(target, "unix://")
+	case strings.HasPrefix(target, "udp://"):
+		w.network, w.address = "udp", strings.TrimPrefix(target, "udp://")
+	case strings.HasPrefix(target, "tcp://"):
+		w.network, w.address = "tcp", strings.TrimPrefix(target, "tcp://")
+	default:
+		return nil, fmt.Errorf("unknown syslog target %q, use local, unix:///path, udp://host:port or tcp://host:port", target)
+	}
+
+	if err := w.dial(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *syslogWriter) dial() error {
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+
+	conn, err := net.Dial(w.network, w.address)
+
+	// local daemons listening on a stream socket
+	if err != nil && w.network == "unixgram" {
+		if conn, err = net.Dial("unix", w.address); err == nil {
+			w.network = "unix"
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	w.conn = conn
+	return nil
+}
+
+// Write sends b as one message at informational severity
+func (w *syslogWriter) Write(b []byte) (int, error) {
+	return w.writeLevel(levelInfo, b)
+}
+
+func (w *syslogWriter) writeLevel(level logLevel, b []byte) (int, error) {
+	message := w.format(level, time.Now(), bytes.TrimRight(b, "\n"))
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return 0, net.ErrClosed
+	}
+
+	// redial streams, also when the last redial failed
+	err := w.send(message)
+	if err != nil && w.network != "udp" && w.network != "unixgram" {
+		if err = w.dial(); err == nil {
+			err = w.send(message)
+		}
+	}
+
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (w *syslogWriter) send(message []byte) error {
+	if w.conn == nil {
+		return net.ErrClosed
+	}
+
+	switch w.network {
+	case "tcp":
+		message = append([]byte(strconv.Itoa(len(message))+" "), message...)
+	case "unix":
+		message = append(message, '\n')
+	}
+
+	_, err := w.conn.Write(message)
+	return err
+}
+
+// format returns the RFC 5424 message, without structured data
+func (w *syslogWriter) format(level logLevel, t time.Time, msg []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d %s - ", w.facility*8+syslogSeverities[level],
+		t.UTC().Format("2006-01-02T15:04:05.000000Z07:00"), w.hostname, w.app, os.Getpid(), w.msgID)
+	b.Write(msg)
+	return b.Bytes()
+}
+
+func (w *syslogWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.closed = true
+	if w.conn == nil {
+		return nil
+	}
+
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
@@ -0,0 +1,107 @@
+package tunnel
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyslogUDP(t *testing.T) {
+	assert := require.New(t)
+
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer server.Close()
+
+	receive := func() string {
+		buffer := make([]byte, 2048)
+		server.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := server.ReadFrom(buffer)
+		assert.Nil(err)
+		return string(buffer[:n])
+	}
+
+	w, err := dialSyslog("udp://"+server.LocalAddr().String(), 3, "-")
+	assert.Nil(err)
+	defer w.Close()
+
+	l := newLogger(w).with("tunnel", 3)
+	l.warn("AUTH_FAILURE", "reason", "bad token")
+
+	header := regexp.MustCompile(`^<28>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}Z \S+ \S+ ` + strconv.Itoa(os.Getpid()) + ` - - `)
+	message := receive()
+	assert.Regexp(header, message)
+	assert.True(strings.HasSuffix(message, ` - AUTH_FAILURE tunnel=3 reason="bad token"`), message)
+
+	audit, err := openAuditLog("syslog:udp://"+server.LocalAddr().String(), 16)
+	assert.Nil(err)
+	defer audit.close()
+
+	audit.record("tunnel_open", auditFields{"handle": 3})
+	message = receive()
+	assert.True(strings.HasPrefix(message, "<134>1 "), message)
+	assert.Contains(message, ` audit - {"event":"tunnel_open",`)
+
+	_, err = dialSyslog("syslog.example.com:514", 3, "-")
+	assert.NotNil(err)
+}
+
+func TestSyslogTCPRedial(t *testing.T) {
+	assert := require.New(t)
+
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer server.Close()
+
+	// octet counted frames of the first connection, then of the next
+	received := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+
+			r := bufio.NewReader(conn)
+			length, err := r.ReadString(' ')
+			if err == nil {
+				n, _ := strconv.Atoi(strings.TrimSpace(length))
+				frame := make([]byte, n)
+				io.ReadFull(r, frame)
+				received <- string(frame)
+			}
+			conn.Close()
+		}
+	}()
+
+	w, err := dialSyslog("tcp://"+server.Addr().String(), 3, "-")
+	assert.Nil(err)
+	defer w.Close()
+
+	_, err = w.writeLevel(levelError, []byte("first\n"))
+	assert.Nil(err)
+	assert.True(strings.HasSuffix(<-received, " - - first"))
+
+	// the server closed the connection, writes fail once it is noticed
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		_, err := w.writeLevel(levelError, []byte("second"))
+		assert.Nil(err)
+
+		select {
+		case message := <-received:
+			assert.True(strings.HasSuffix(message, " - - second"))
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	assert.Fail("no message after redial")
+}
@@ -0,0 +1,117 @@
+package tunnel
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync/atomic"
+)
+
+// tenantSpec is the limits of one client identity, 0 means unlimited
+type tenantSpec struct {
+	maxTunnels         int
+	maxDataConnections int
+	quota              quotaSpec
+}
+
+// loadTenantFile loads "identity max_tunnels max_conns bytes_per_second
+// monthly_bytes" entries, sizes take K/M/G/T suffixes, 0 means unlimited.
+// Identity "*" applies to clients without an entry.
+func loadTenantFile(path string) (map[string]tenantSpec, error) {
+	lines, err := readConfigFields(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tenants := make(map[string]tenantSpec)
+	for i, fields := range lines {
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("%s: entry %d: expected \"identity max_tunnels max_conns bytes_per_second monthly_bytes\"", path, i+1)
+		}
+
+		var spec tenantSpec
+		if spec.maxTunnels, err = strconv.Atoi(fields[1]); err != nil || spec.maxTunnels < 0 {
+			return nil, fmt.Errorf("%s: entry %d: invalid max_tunnels %q", path, i+1, fields[1])
+		}
+		if spec.maxDataConnections, err = strconv.Atoi(fields[2]); err != nil || spec.maxDataConnections < 0 {
+			return nil, fmt.Errorf("%s: entry %d: invalid max_conns %q", path, i+1, fields[2])
+		}
+		if spec.quota, err = parseQuotaSpec(fields[3], fields[4]); err != nil {
+			return nil, fmt.Errorf("%s: entry %d: %v", path, i+1, err)
+		}
+
+		if _, ok := tenants[fields[0]]; ok {
+			return nil, fmt.Errorf("%s: entry %d: identity %s is listed twice", path, i+1, fields[0])
+		}
+		tenants[fields[0]] = spec
+	}
+
+	return tenants, nil
+}
+
+// TenantInfo is the limits of a client identity and its current usage, 0
+// limits are unlimited
+type TenantInfo struct {
+	Identity string `json:"identity"`
+
+	Tunnels            int `json:"tunnels"`
+	MaxTunnels         int `json:"max_tunnels"`
+	DataConnections    int `json:"data_connections"`
+	MaxDataConnections int `json:"max_data_connections"`
+
+	BytesPerSecond uint64 `json:"bytes_per_second"`
+	MonthlyBytes   uint64 `json:"monthly_bytes"`
+	MonthlyUsed    uint64 `json:"monthly_used"`
+}
+
+// tenantSnapshot returns the identities with tunnels open at the listener or
+// with limits of their own, ordered by identity
+func (p *Provider) tenantSnapshot() []TenantInfo {
+	tenants := make(map[string]*TenantInfo)
+	tenantOf := func(identity string) *TenantInfo {
+		t, ok := tenants[identity]
+		if !ok {
+			t = &TenantInfo{Identity: identity}
+			tenants[identity] = t
+		}
+		return t
+	}
+
+	if p.limits != nil {
+		for identity := range p.limits.tenants {
+			if identity != anonymousIdentity {
+				tenantOf(identity)
+			}
+		}
+	}
+
+	for _, tc := range p.tunnelConnectionList() {
+		if !tc.accepted {
+			continue
+		}
+
+		t := tenantOf(tc.identity)
+		for _, f := range tc.forwardList() {
+			if f.tunnelPort > 0 && atomic.LoadInt32(&tc.standby) == 0 {
+				t.Tunnels++
+			}
+		}
+		t.DataConnections += len(tc.dataConnections())
+	}
+
+	list := make([]TenantInfo, 0, len(tenants))
+	for identity, t := range tenants {
+		t.MaxTunnels, t.MaxDataConnections = p.limits.limitsOf(identity)
+		if spec, used, ok := p.quotas.usage(identity); ok {
+			t.BytesPerSecond = spec.bytesPerSecond
+			t.MonthlyBytes = spec.monthlyBytes
+			t.MonthlyUsed = used
+		}
+		list = append(list, *t)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Identity < list[j].Identity
+	})
+	return list
+}
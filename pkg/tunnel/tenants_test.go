@@ -0,0 +1,97 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeTenantFile(t *testing.T, content string) string {
+	assert := require.New(t)
+
+	f, err := ioutil.TempFile("", "tenants")
+	assert.Nil(err)
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+func TestLoadTenantFile(t *testing.T) {
+	assert := require.New(t)
+
+	path := writeTenantFile(t, "alice 10 200 1M 100G # paying\n* 1 2 256K/s 0\n")
+	defer os.Remove(path)
+
+	tenants, err := loadTenantFile(path)
+	assert.Nil(err)
+	assert.Equal(tenantSpec{maxTunnels: 10, maxDataConnections: 200,
+		quota: quotaSpec{bytesPerSecond: 1 << 20, monthlyBytes: 100 << 30}}, tenants["alice"])
+	assert.Equal(256<<10, int(tenants["*"].quota.bytesPerSecond))
+
+	l := newConnectionLimits(5, 5)
+	l.tenants = tenants
+	maxTunnels, maxConns := l.limitsOf("alice")
+	assert.Equal(10, maxTunnels)
+	assert.Equal(200, maxConns)
+
+	// the * entry wins over the command line caps
+	assert.True(l.acquireTunnel("bob"))
+	assert.False(l.acquireTunnel("bob"))
+
+	for _, content := range []string{"alice 10 200 1M\n", "alice ten 200 1M 0\n", "alice 1 -1 1M 0\n", "alice 1 1 0 0\nalice 2 2 0 0\n"} {
+		path := writeTenantFile(t, content)
+		_, err := loadTenantFile(path)
+		assert.NotNil(err, content)
+		os.Remove(path)
+	}
+}
+
+func TestTenantSnapshot(t *testing.T) {
+	assert := require.New(t)
+
+	target, err := startEchoServer()
+	assert.Nil(err)
+
+	path := writeTenantFile(t, "alice 3 10 1M 10G\n* 1 1 0 0\n")
+	defer os.Remove(path)
+
+	_, err = NewProvider(Config{TenantFile: path, QuotaFile: path})
+	assert.NotNil(err)
+
+	p, err := NewProvider(Config{TenantFile: path})
+	assert.Nil(err)
+	defer p.Close()
+	addr, err := p.StartListener(0)
+	assert.Nil(err)
+
+	client := newProvider()
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tun, err := client.Connect(ctx, ConnectorConfig{
+		ProviderAddress: fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port),
+		Target:          target.String(),
+	})
+	assert.Nil(err)
+	defer tun.Close()
+
+	tenants := p.tenantSnapshot()
+	assert.Len(tenants, 2)
+
+	assert.Equal(anonymousIdentity, tenants[0].Identity)
+	assert.Equal(1, tenants[0].Tunnels)
+	assert.Equal(1, tenants[0].MaxTunnels)
+	assert.Equal(uint64(0), tenants[0].BytesPerSecond)
+
+	// listed with no tunnels open
+	assert.Equal(TenantInfo{Identity: "alice", MaxTunnels: 3, MaxDataConnections: 10,
+		BytesPerSecond: 1 << 20, MonthlyBytes: 10 << 30}, tenants[1])
+}
@@ -0,0 +1,194 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// loadKeyPair loads a certificate file and its private key, which is either
+// a file path or a secret reference (env:, keyring:) holding the PEM key
+func loadKeyPair(certFile string, key string) (tls.Certificate, error) {
+	if !IsSecretReference(key) || strings.HasPrefix(key, "file:") {
+		return tls.LoadX509KeyPair(certFile, strings.TrimPrefix(key, "file:"))
+	}
+
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	keyPEM, err := ResolveSecret(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.X509KeyPair(certPEM, []byte(keyPEM))
+}
+
+func LoadServerTLSConfig(certFile string, keyFile string) (*tls.Config, error) {
+	cert, err := loadKeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// NewClientTLSConfig builds the connector side TLS configuration. When pin is
+// set the provider certificate is accepted only if the SHA-256 of either its
+// DER encoding or its public key matches the pin, no CA setup is required.
+// With caFile as well, the chain must verify against it before the pin is
+// checked.
+func NewClientTLSConfig(providerAddress string, caFile string, pin string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(providerAddress)
+	if err != nil {
+		host = providerAddress
+	}
+
+	config := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if len(caFile) > 0 {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if len(pin) > 0 {
+		digest, err := parsePin(pin)
+		if err != nil {
+			return nil, err
+		}
+
+		// without a CA chain verification is replaced by the pin check below,
+		// with one the pin is checked on top of it
+		config.InsecureSkipVerify = len(caFile) == 0
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPin(digest, rawCerts)
+		}
+	}
+
+	return config, nil
+}
+
+// RequireClientCertificates turns config into an mTLS configuration that
+// only accepts clients presenting a certificate issued by a CA in caFile
+func RequireClientCertificates(config *tls.Config, caFile string) error {
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		return err
+	}
+
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return nil
+}
+
+func LoadClientCertificate(config *tls.Config, certFile string, keyFile string) error {
+	cert, err := loadKeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	config.Certificates = []tls.Certificate{cert}
+	return nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates found", file)
+	}
+
+	return pool, nil
+}
+
+// parsePin accepts a SHA-256 digest as hex (colons allowed) or base64,
+// optionally prefixed with "sha256/" or "sha256//"
+func parsePin(pin string) ([]byte, error) {
+	s := strings.TrimPrefix(pin, "sha256/")
+
+	if b, err := hex.DecodeString(strings.ReplaceAll(strings.TrimPrefix(s, "/"), ":", "")); err == nil && len(b) == sha256.Size {
+		return b, nil
+	}
+
+	// base64 digests may start with a slash themselves
+	for _, digest := range []string{s, strings.TrimPrefix(s, "/")} {
+		if b, err := base64.StdEncoding.DecodeString(digest); err == nil && len(b) == sha256.Size {
+			return b, nil
+		}
+	}
+
+	return nil, fmt.Errorf("invalid pin %q, expected SHA-256 digest in hex or base64", pin)
+}
+
+func verifyPin(digest []byte, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("provider presented no certificate")
+	}
+
+	// only the leaf is pinned
+	certPin, keyPin, err := certificatePins(rawCerts[0])
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(digest, certPin) || bytes.Equal(digest, keyPin) {
+		return nil
+	}
+
+	return errors.New("provider certificate does not match pin")
+}
+
+// certificatePins returns the SHA-256 of the DER certificate and of its
+// SubjectPublicKeyInfo
+func certificatePins(der []byte) ([]byte, []byte, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPin := sha256.Sum256(der)
+	keyPin := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	return certPin[:], keyPin[:], nil
+}
+
+// LogCertificatePins logs the pins of the certificates of config, for
+// clients to verify the provider with
+func LogCertificatePins(config *tls.Config) {
+	for _, cert := range config.Certificates {
+		if len(cert.Certificate) == 0 {
+			continue
+		}
+
+		certPin, keyPin, err := certificatePins(cert.Certificate[0])
+		if err != nil {
+			continue
+		}
+
+		logger.info("TLS certificate pin", "pin", "sha256/"+base64.StdEncoding.EncodeToString(certPin))
+		logger.info("TLS public key pin", "pin", "sha256/"+base64.StdEncoding.EncodeToString(keyPin))
+	}
+}
@@ -0,0 +1,142 @@
+package tunnel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCertificate(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return der
+}
+
+func TestCertificatePin(t *testing.T) {
+	assert := require.New(t)
+
+	der := newTestCertificate(t)
+	certPin := sha256.Sum256(der)
+
+	digest, err := parsePin(hex.EncodeToString(certPin[:]))
+	assert.NoError(err)
+	assert.NoError(verifyPin(digest, [][]byte{der}))
+
+	_, keyPin, err := certificatePins(der)
+	assert.NoError(err)
+
+	digest, err = parsePin("sha256/" + base64.StdEncoding.EncodeToString(keyPin))
+	assert.NoError(err)
+	assert.NoError(verifyPin(digest, [][]byte{der}))
+
+	assert.Error(verifyPin(digest, [][]byte{newTestCertificate(t)}))
+
+	// base64 of a digest starting with 0xfc starts with a slash
+	slashed := make([]byte, sha256.Size)
+	slashed[0] = 0xfc
+	for _, prefix := range []string{"sha256/", "sha256//"} {
+		digest, err = parsePin(prefix + base64.StdEncoding.EncodeToString(slashed))
+		assert.NoError(err)
+		assert.Equal(slashed, digest)
+	}
+
+	_, err = parsePin("not-a-pin")
+	assert.Error(err)
+}
+
+// newTestServerCertificate returns a self-signed certificate of localhost
+// that verifies as its own CA
+func newTestServerCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCertificatePinWithCA(t *testing.T) {
+	assert := require.New(t)
+
+	cert := newTestServerCertificate(t)
+	certPin := sha256.Sum256(cert.Certificate[0])
+	pin := hex.EncodeToString(certPin[:])
+
+	dir, err := ioutil.TempDir("", "tls")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	writeCA := func(der []byte) string {
+		file := filepath.Join(dir, "ca.pem")
+		assert.NoError(ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+		return file
+	}
+
+	handshake := func(config *tls.Config) error {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+
+		go tls.Server(server, &tls.Config{Certificates: []tls.Certificate{cert}}).Handshake()
+		return tls.Client(client, config).Handshake()
+	}
+
+	// the pin alone, the CA alone and both accept the certificate
+	config, err := NewClientTLSConfig("localhost:5555", "", pin)
+	assert.NoError(err)
+	assert.NoError(handshake(config))
+
+	ca := writeCA(cert.Certificate[0])
+	config, err = NewClientTLSConfig("localhost:5555", ca, "")
+	assert.NoError(err)
+	assert.NoError(handshake(config))
+
+	config, err = NewClientTLSConfig("localhost:5555", ca, pin)
+	assert.NoError(err)
+	assert.False(config.InsecureSkipVerify)
+	assert.NoError(handshake(config))
+
+	// a matching pin does not override a CA the chain does not verify against
+	ca = writeCA(newTestServerCertificate(t).Certificate[0])
+	config, err = NewClientTLSConfig("localhost:5555", ca, pin)
+	assert.NoError(err)
+	assert.Error(handshake(config))
+}
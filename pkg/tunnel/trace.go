@@ -0,0 +1,403 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// spans are exported this often, or as soon as a batch is full
+	traceExportInterval = 5 * time.Second
+	traceBatchSize      = 512
+
+	// ended spans waiting for export, more are dropped
+	traceQueueLength = 4096
+)
+
+// tracer exports spans to an OpenTelemetry collector with OTLP over HTTP,
+// JSON encoded. A nil tracer, and the nil spans it starts, record nothing.
+type tracer struct {
+	url     string
+	service string
+	client  *http.Client
+
+	lock    sync.Mutex
+	pending []*span
+	dropped int
+
+	flush   chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// newTracer exports to the collector at endpoint, e.g. http://localhost:4318
+func newTracer(endpoint string, service string) *tracer {
+	t := &tracer{
+		url:     strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		service: service,
+		client:  &http.Client{Timeout: 10 * time.Second},
+
+		flush:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	go t.exportLoop()
+	return t
+}
+
+// close exports the spans ended so far
+func (t *tracer) close() {
+	if t == nil {
+		return
+	}
+
+	close(t.done)
+	<-t.stopped
+}
+
+// start begins a root span with the given key/value attributes
+func (t *tracer) start(name string, kv ...interface{}) *span {
+	if t == nil {
+		return nil
+	}
+
+	s := &span{
+		tracer:     t,
+		name:       name,
+		start:      time.Now(),
+		attributes: kv,
+	}
+	rand.Read(s.traceID[:])
+	rand.Read(s.spanID[:])
+
+	return s
+}
+
+func (t *tracer) enqueue(s *span) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if len(t.pending) >= traceQueueLength {
+		t.dropped++
+		return
+	}
+
+	t.pending = append(t.pending, s)
+	if len(t.pending) >= traceBatchSize {
+		select {
+		case t.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *tracer) exportLoop() {
+	defer close(t.stopped)
+
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.flush:
+		case <-t.done:
+			t.export()
+			return
+		}
+
+		t.export()
+	}
+}
+
+func (t *tracer) export() {
+	t.lock.Lock()
+	spans := t.pending
+	dropped := t.dropped
+	t.pending = nil
+	t.dropped = 0
+	t.lock.Unlock()
+
+	if dropped > 0 {
+		logger.warn("Trace export queue full, spans dropped", "spans", dropped)
+	}
+
+	for len(spans) > 0 {
+		n := len(spans)
+		if n > traceBatchSize {
+			n = traceBatchSize
+		}
+
+		if err := t.post(spans[:n]); err != nil {
+			logger.warn("Trace export error", "spans", n, "error", err)
+		}
+		spans = spans[n:]
+	}
+}
+
+func (t *tracer) post(spans []*span) error {
+	body, err := json.Marshal(t.encode(spans))
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded %s", resp.Status)
+	}
+
+	return nil
+}
+
+// OTLP/JSON, see opentelemetry-proto trace/v1/trace.proto
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpEvent struct {
+	Time       string         `json:"timeUnixNano"`
+	Name       string         `json:"name"`
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID    string         `json:"traceId"`
+	SpanID     string         `json:"spanId"`
+	ParentID   string         `json:"parentSpanId,omitempty"`
+	Name       string         `json:"name"`
+	Kind       int            `json:"kind"`
+	Start      string         `json:"startTimeUnixNano"`
+	End        string         `json:"endTimeUnixNano"`
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+	Events     []otlpEvent    `json:"events,omitempty"`
+	Status     otlpStatus     `json:"status"`
+}
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusError      = 2
+)
+
+func (t *tracer) encode(spans []*span) interface{} {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		encoded = append(encoded, s.encode())
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes([]interface{}{"service.name", t.service}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "github.com/kelveny/tunnel"},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	}
+}
+
+func otlpAttributes(kv []interface{}) []otlpKeyValue {
+	attributes := make([]otlpKeyValue, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		attributes = append(attributes, otlpKeyValue{
+			Key:   fmt.Sprint(kv[i]),
+			Value: otlpValue(kv[i+1]),
+		})
+	}
+
+	return attributes
+}
+
+func otlpValue(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.FormatInt(int64(v), 10)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case uint32:
+		return map[string]interface{}{"intValue": strconv.FormatUint(uint64(v), 10)}
+	case uint64:
+		return map[string]interface{}{"intValue": strconv.FormatUint(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	case error:
+		return map[string]interface{}{"stringValue": v.Error()}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// span times an operation, it is exported once finished. All methods are
+// no-ops on a nil span.
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	start    time.Time
+
+	lock       sync.Mutex
+	end        time.Time
+	attributes []interface{}
+	events     []spanEvent
+	err        string
+	finished   bool
+}
+
+type spanEvent struct {
+	name       string
+	time       time.Time
+	attributes []interface{}
+}
+
+// child begins a span of the same trace
+func (s *span) child(name string, kv ...interface{}) *span {
+	if s == nil {
+		return nil
+	}
+
+	c := &span{
+		tracer:     s.tracer,
+		traceID:    s.traceID,
+		parentID:   s.spanID,
+		name:       name,
+		start:      time.Now(),
+		attributes: kv,
+	}
+	rand.Read(c.spanID[:])
+
+	return c
+}
+
+// set adds key/value attributes
+func (s *span) set(kv ...interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.attributes = append(s.attributes, kv...)
+}
+
+// event records a point in time of the operation
+func (s *span) event(name string, kv ...interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.finished {
+		s.events = append(s.events, spanEvent{name: name, time: time.Now(), attributes: kv})
+	}
+}
+
+// fail marks the operation failed by err unless it has already finished or
+// failed, a nil err is ignored
+func (s *span) fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.finished && len(s.err) == 0 {
+		s.err = err.Error()
+	}
+}
+
+// finish ends the span and queues it for export, only the first call counts
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	if s.finished {
+		s.lock.Unlock()
+		return
+	}
+	s.finished = true
+	s.end = time.Now()
+	s.lock.Unlock()
+
+	s.tracer.enqueue(s)
+}
+
+func (s *span) encode() otlpSpan {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	encoded := otlpSpan{
+		TraceID:    hex.EncodeToString(s.traceID[:]),
+		SpanID:     hex.EncodeToString(s.spanID[:]),
+		Name:       s.name,
+		Kind:       otlpSpanKindInternal,
+		Start:      otlpTime(s.start),
+		End:        otlpTime(s.end),
+		Attributes: otlpAttributes(s.attributes),
+	}
+
+	if s.parentID != [8]byte{} {
+		encoded.ParentID = hex.EncodeToString(s.parentID[:])
+	}
+
+	for _, e := range s.events {
+		encoded.Events = append(encoded.Events, otlpEvent{
+			Time:       otlpTime(e.time),
+			Name:       e.name,
+			Attributes: otlpAttributes(e.attributes),
+		})
+	}
+
+	if len(s.err) > 0 {
+		encoded.Status = otlpStatus{Code: otlpStatusError, Message: s.err}
+		encoded.Attributes = append(encoded.Attributes, otlpKeyValue{
+			Key:   "error",
+			Value: otlpValue(true),
+		})
+	}
+
+	return encoded
+}
@@ -0,0 +1,127 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// collector records the spans of OTLP/JSON export requests
+type collector struct {
+	lock  sync.Mutex
+	spans []map[string]interface{}
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []map[string]interface{}
+			}
+		}
+	}
+	if r.URL.Path != "/v1/traces" || json.NewDecoder(r.Body).Decode(&request) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, rs := range request.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+}
+
+func (c *collector) span(name string) map[string]interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, s := range c.spans {
+		if s["name"] == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func TestTracerExport(t *testing.T) {
+	assert := require.New(t)
+
+	c := &collector{}
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	tr := newTracer(server.URL, "tunnel")
+	root := tr.start("tunnel", "tunnel", 1)
+	child := root.child("tunnel.data_connection", "handle", Handle(2))
+	child.event("connect_request")
+	child.fail(errors.New("connection reset"))
+	child.finish()
+	root.finish()
+	tr.close()
+
+	assert.Len(c.spans, 2)
+	s := c.span("tunnel.data_connection")
+	assert.Equal(c.span("tunnel")["traceId"], s["traceId"])
+	assert.Equal(c.span("tunnel")["spanId"], s["parentSpanId"])
+	assert.Equal("connect_request", s["events"].([]interface{})[0].(map[string]interface{})["name"])
+
+	status := s["status"].(map[string]interface{})
+	assert.Equal(float64(otlpStatusError), status["code"])
+	assert.Equal("connection reset", status["message"])
+
+	// nil tracers and spans record nothing
+	var none *tracer
+	none.start("tunnel").child("tunnel.data_connection").finish()
+	none.close()
+}
+
+func TestDataConnectionSpan(t *testing.T) {
+	assert := require.New(t)
+
+	c := &collector{}
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	p := newProvider()
+	p.tracer = newTracer(server.URL, "tunnel")
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			if _, err := remote.Read(b); err != nil {
+				return
+			}
+		}
+	}()
+	tc := p.newTunnelConnection(local)
+	go tc.writeLoop()
+
+	dataLocal, dataRemote := net.Pipe()
+	defer dataRemote.Close()
+	dc := p.newDataConnection(tc, dataLocal)
+
+	// closed before the peer connected it
+	dc.close(false)
+	p.closeTunnelConnection(tc)
+	p.tracer.close()
+
+	s := c.span("tunnel.data_connection")
+	assert.NotNil(s)
+	assert.Equal(c.span("tunnel")["spanId"], s["parentSpanId"])
+	assert.Equal(errNotConnected.Error(), s["status"].(map[string]interface{})["message"])
+
+	establish := c.span("tunnel.establish")
+	assert.Equal(errTunnelClosed.Error(), establish["status"].(map[string]interface{})["message"])
+}
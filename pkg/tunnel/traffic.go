@@ -0,0 +1,72 @@
+package tunnel
+
+import "sync/atomic"
+
+// traffic counts the data payload relayed by a data connection, or by all
+// data connections of a tunnel, accessed atomically. rx is read from data
+// connections and sent through the tunnel, tx is received through the tunnel
+// and written to data connections.
+type traffic struct {
+	rxBytes  uint64
+	txBytes  uint64
+	rxFrames uint64
+	txFrames uint64
+}
+
+// TrafficSnapshot is the payload bytes and data frames a connection has
+// received and sent
+type TrafficSnapshot struct {
+	RxBytes  uint64 `json:"rx_bytes"`
+	TxBytes  uint64 `json:"tx_bytes"`
+	RxFrames uint64 `json:"rx_frames"`
+	TxFrames uint64 `json:"tx_frames"`
+}
+
+func (t *traffic) snapshot() TrafficSnapshot {
+	return TrafficSnapshot{
+		RxBytes:  atomic.LoadUint64(&t.rxBytes),
+		TxBytes:  atomic.LoadUint64(&t.txBytes),
+		RxFrames: atomic.LoadUint64(&t.rxFrames),
+		TxFrames: atomic.LoadUint64(&t.txFrames),
+	}
+}
+
+// fields returns the counters as log key/value pairs
+func (s TrafficSnapshot) fields() []interface{} {
+	return []interface{}{
+		"rx_bytes", s.RxBytes,
+		"tx_bytes", s.TxBytes,
+		"rx_frames", s.RxFrames,
+		"tx_frames", s.TxFrames,
+	}
+}
+
+// countRead accounts n bytes read from conn, sent as one data frame
+func (dc *DataConnection) countRead(n int) {
+	tc := dc.tunnelConnection
+
+	atomic.AddUint64(&dc.rxBytes, uint64(n))
+	atomic.AddUint64(&dc.rxFrames, 1)
+	atomic.AddUint64(&tc.rxBytes, uint64(n))
+	atomic.AddUint64(&tc.rxFrames, 1)
+
+	metrics.bytesReceived.Add(int64(n))
+	metrics.framesReceived.Add(1)
+}
+
+// countFrame accounts a data frame received for dc, its payload is counted
+// by countWritten as it is written, possibly in chunks
+func (dc *DataConnection) countFrame() {
+	atomic.AddUint64(&dc.txFrames, 1)
+	atomic.AddUint64(&dc.tunnelConnection.txFrames, 1)
+
+	metrics.framesSent.Add(1)
+}
+
+// countWritten accounts n bytes written to conn
+func (dc *DataConnection) countWritten(n int) {
+	atomic.AddUint64(&dc.txBytes, uint64(n))
+	atomic.AddUint64(&dc.tunnelConnection.txBytes, uint64(n))
+
+	metrics.bytesSent.Add(int64(n))
+}
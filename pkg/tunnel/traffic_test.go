@@ -0,0 +1,44 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrafficAccounting(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+	defer p.Close()
+
+	tunnelLocal, tunnelRemote := net.Pipe()
+	defer tunnelRemote.Close()
+	tc := p.newTunnelConnection(tunnelLocal)
+
+	first, firstRemote := net.Pipe()
+	defer firstRemote.Close()
+	dc1 := p.newDataConnection(tc, first)
+
+	second, secondRemote := net.Pipe()
+	defer secondRemote.Close()
+	dc2 := p.newDataConnection(tc, second)
+
+	dc1.countRead(100)
+	dc1.countRead(20)
+	dc2.countFrame()
+	dc2.countWritten(30)
+	dc2.countWritten(12)
+
+	assert.Equal(TrafficSnapshot{RxBytes: 120, RxFrames: 2}, dc1.snapshot())
+	assert.Equal(TrafficSnapshot{TxBytes: 42, TxFrames: 1}, dc2.snapshot())
+	assert.Equal(TrafficSnapshot{RxBytes: 120, TxBytes: 42, RxFrames: 2, TxFrames: 1}, tc.snapshot())
+
+	// tunnel totals outlive the data connections
+	p.closeDataConnection(dc1, false)
+	assert.Equal(uint64(120), tc.snapshot().RxBytes)
+
+	assert.Equal([]interface{}{"rx_bytes", uint64(120), "tx_bytes", uint64(0), "rx_frames", uint64(2), "tx_frames", uint64(0)},
+		dc1.snapshot().fields())
+}
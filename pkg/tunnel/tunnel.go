@@ -0,0 +1,2596 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Handle = uint32
+
+// bytes read from a data connection at a time
+const dataReadSize = 4096
+
+// bytes read from a datagram data connection at a time, the largest message
+// it relays whole
+const maxDatagramSize = 64 * 1024
+
+// frames queued per tunnel connection and priority class before senders
+// block
+const outboundQueueLength = 256
+
+// unwritten data frames per tunnel connection and priority class before data
+// connections stop reading from their sockets, bounds buffering to about 64
+// read buffers per class
+const dataSendCredits = 64
+
+// frames queued behind each other are coalesced into writes of up to this
+// many bytes
+const maxWriteBatch = 64 * 1024
+
+// plain data frames larger than this are relayed to their data connection in
+// chunks of this size as they arrive, instead of being buffered whole
+const streamChunkSize = 32 * 1024
+
+// frames that have to be buffered whole, e.g. encrypted payloads, may not
+// exceed this size
+const maxFrameLength = 16 * 1024 * 1024
+
+var errTunnelClosed = errors.New("tunnel connection closed")
+
+var (
+	errNotConnected   = errors.New("data connection closed before it was connected")
+	errConnectTimeout = errors.New("no connect response in time")
+	errQuotaExceeded  = errors.New("monthly transfer quota exceeded")
+)
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+// Provider is either side of tunnels: the listener accepting signaling
+// connections of clients and opening a tunnel port for each, or the
+// connector dialing a provider and relaying the data connections of its
+// tunnel to the target.
+type Provider struct {
+	// map handle -> *TunnelConnection
+	tunnelConnections *handleMap
+
+	// map handle -> *DataConnection
+	dataConnections *handleMap
+
+	// last allocated handle, accessed atomically
+	lastHandle uint32
+
+	// optional, clients must authenticate before requesting a tunnel when set
+	authenticator Authenticator
+
+	// optional, clients may authenticate with JWTs of a trusted issuer
+	jwtValidator *jwtValidator
+
+	// optional, limits the targets each client may request
+	acl *accessControlList
+
+	// clients may dial targets their ACL allows through their tunnel
+	// connection
+	allowDial bool
+
+	// optional, connects data connections to their targets instead of
+	// net.Dial
+	dialer Dialer
+
+	// optional, carries signaling connections and tunnel ports instead of
+	// TCP sockets
+	transport Transport
+
+	// optional, wraps the stream of every data connection
+	streamMiddleware []StreamMiddleware
+
+	// optional, throttles and bans sources failing authentication
+	lockout *authLockout
+
+	// optional, records tunnels and data connections
+	audit *auditLog
+
+	// optional, logs the data connections of tunnel ports
+	accessLog *accessLog
+
+	// optional, exports spans of tunnels and data connections
+	tracer *tracer
+
+	// optional, streams tunnel state changes to admin clients and webhooks
+	events *eventHub
+
+	// optional, per client bandwidth quotas
+	quotas *quotaTable
+
+	// optional, per client tunnel and data connection caps
+	limits *connectionLimits
+
+	// range tunnel ports are allocated from, any ephemeral port if zero
+	portRange portRange
+
+	// optional, filters data connections by the SNI of their TLS ClientHello
+	sniPolicy sniPolicy
+
+	// data connections whose peer does not answer the connect request
+	// within this long are closed, never if zero
+	connectTimeout time.Duration
+
+	// optional, terminates TLS for services at the provider
+	serviceTLS *serviceTLS
+
+	// optional, signaling connections are carried over TLS when set
+	tlsConfig *tls.Config
+
+	// with mTLS, SPIFFE IDs of clients must belong to this trust domain
+	spiffeTrustDomain string
+
+	// optional, signaling connections are obfuscated with this key when set
+	obfsKey []byte
+
+	// payload key rotation thresholds, 0 disables the respective trigger
+	rekeyInterval time.Duration
+	rekeyBytes    uint64
+
+	// data payloads of at least this many bytes are compressed once
+	// CAPABILITY_COMPRESSION is negotiated, 0 disables compression
+	compressMin int
+
+	// optional, tunes tunnel and data connections
+	socketOptions *socketOptions
+
+	// writes to tunnel and data connections blocked longer than this fail and
+	// close the connection, 0 waits forever
+	writeTimeout time.Duration
+
+	// optional, caps data queued for tunnel writes across all tunnels
+	memoryBudget *memoryBudget
+
+	// refuse new data connections while the memory budget is used up
+	memoryShed bool
+
+	// optional, reads idle data connections through epoll readiness instead
+	// of a goroutine each
+	pollEngine *pollEngine
+
+	// tunnel ports of clients that reconnect in time
+	sessions *sessionTable
+
+	// tunnel ports registered under service names
+	services *serviceRegistry
+
+	// optional, tunnel ports served by standby clients
+	onDemand *onDemandTable
+
+	// listener side, signaling connections by the token their data channels
+	// present
+	channelLock   sync.Mutex
+	channelOwners map[string]*TunnelConnection
+
+	// tunnels are probed this often and half-open data connections reaped,
+	// 0 disables
+	keepaliveInterval time.Duration
+
+	// tunnels report their numbers to the peer this often, 0 disables
+	statsInterval time.Duration
+
+	// PDUs logged at trace level come with a hex dump of this many of their
+	// leading bytes
+	traceBytes int
+
+	// optional, record the payload of the data connections to the targets
+	// matching recordTargets to files and to a pcapng capture
+	recordTargets []string
+	recorder      *recorder
+	capture       *capture
+
+	// optional, degrades tunnels on purpose, see faultInjector
+	faults *faultInjector
+
+	// accept goroutines per listener, more than one share the port through
+	// SO_REUSEPORT
+	acceptors int
+
+	// optional, aggregate rate of data read from and written to all data
+	// connections of the process
+	ingressLimiter *rateLimiter
+	egressLimiter  *rateLimiter
+
+	// signaling accept loops running, accessed atomically; the provider is
+	// ready while there is any
+	acceptLoops int32
+
+	// signaling address Serve listens on
+	address string
+
+	// signaling listeners close once listening is done, before the provider
+	// when it shuts down gracefully
+	listening     context.Context
+	stopListening context.CancelFunc
+
+	// set by Shutdown, new data connections are refused while draining,
+	// accessed atomically
+	draining int32
+
+	// parent of the tunnel connection contexts, cancelled by Close
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
+func newProvider() *Provider {
+	ctx, cancel := context.WithCancel(context.Background())
+	listening, stopListening := context.WithCancel(ctx)
+	p := &Provider{
+		tunnelConnections: newHandleMap(),
+		dataConnections:   newHandleMap(),
+		sessions:          newSessionTable(0),
+		services:          newServiceRegistry(),
+		channelOwners:     make(map[string]*TunnelConnection),
+		listening:         listening,
+		stopListening:     stopListening,
+		ctx:               ctx,
+		cancel:            cancel,
+	}
+	p.sessions.services = p.services
+	return p
+}
+
+// getNextHandle allocates handles 1, 2, ... without taking any lock
+func (p *Provider) getNextHandle() Handle {
+	return atomic.AddUint32(&p.lastHandle, 1)
+}
+
+func (p *Provider) newTunnelConnection(conn net.Conn) *TunnelConnection {
+	tc := p.initTunnelConnection(conn)
+
+	tc.handle = p.getNextHandle()
+	tc.log = logger.with("tunnel", tc.handle, "remote", conn.RemoteAddr())
+	tc.span = p.tracer.start("tunnel", "tunnel", tc.handle, "remote", conn.RemoteAddr())
+	tc.establish = tc.span.child("tunnel.establish")
+	p.tunnelConnections.store(tc.handle, tc)
+
+	metrics.tunnelsOpened.Add(1)
+	metrics.tunnelsActive.Add(1)
+
+	return tc
+}
+
+// initTunnelConnection returns a tunnel connection over conn with its
+// queues, without a handle
+func (p *Provider) initTunnelConnection(conn net.Conn) *TunnelConnection {
+	ctx, cancel := context.WithCancel(p.ctx)
+	tc := &TunnelConnection{
+		provider: p,
+		conn:     conn,
+		created:  time.Now(),
+		ctx:      ctx,
+		cancel:   cancel,
+
+		opened: make(chan struct{}),
+
+		identity: anonymousIdentity,
+
+		data: make(map[Handle]*DataConnection),
+	}
+	tc.budget.budget = p.memoryBudget
+	for c := range tc.outbound {
+		tc.outbound[c] = make(chan outboundFrame, outboundQueueLength)
+		tc.credits[c] = make(chan struct{}, dataSendCredits)
+	}
+
+	return tc
+}
+
+func (p *Provider) authRequired() bool {
+	return p.authenticator != nil || p.jwtValidator != nil
+}
+
+func (p *Provider) closeTunnelConnection(tc *TunnelConnection) {
+	if tc.owner != nil {
+		p.closeDataChannel(tc)
+		return
+	}
+
+	if p.tunnelConnections.loadAndDelete(tc.handle) != nil {
+		metrics.tunnelsActive.Add(-1)
+	}
+
+	// every tunnel port opened, by this listener or for this connector,
+	// the traffic of the connection is reported with the first
+	traffic := tc.snapshot()
+	for _, f := range tc.forwardList() {
+		if f.tunnelPort == 0 || atomic.LoadInt32(&tc.standby) != 0 {
+			continue
+		}
+
+		p.events.publish(&tunnelEvent{
+			kind:       eventTunnelDown,
+			tunnel:     tc.handle,
+			identity:   tc.identity,
+			remote:     tc.conn.RemoteAddr().String(),
+			target:     f.target(),
+			tunnelPort: f.tunnelPort,
+			traffic:    traffic,
+			duration:   time.Since(tc.created),
+		})
+		traffic = TrafficSnapshot{}
+	}
+
+	// stops the writer, pending frames are dropped
+	tc.cancel()
+	tc.conn.Close()
+	tc.budget.close()
+	tc.sealed.close()
+	tc.revokeDataChannels()
+
+	for ; tc.tunnelsHeld > 0; tc.tunnelsHeld-- {
+		p.limits.releaseTunnel(tc.identity)
+	}
+
+	// data connections do not outlive their tunnel, the tunnel port is kept
+	// for the session grace period
+	for _, s := range tc.sessions {
+		p.sessions.detach(s, tc)
+	}
+	for _, name := range p.services.unregister(tc) {
+		tc.log.info("Unregister service", "service", name)
+	}
+	for _, dc := range tc.closeDataConnections() {
+		p.closeDataConnection(dc, false)
+	}
+
+	counters := tc.snapshot()
+	tc.log.info("Close tunnel connection", append([]interface{}{
+		"duration", time.Since(tc.created).Round(time.Millisecond)}, counters.fields()...)...)
+
+	tc.establish.fail(errTunnelClosed)
+	tc.establish.finish()
+	tc.span.set("identity", tc.identity,
+		"target", net.JoinHostPort(tc.proxyAddress, strconv.Itoa(tc.proxyPort)),
+		"tunnel_port", tc.tunnelPort)
+	tc.span.set(counters.fields()...)
+	tc.span.finish()
+
+	p.audit.record("tunnel_close", auditFields{
+		"handle":      tc.handle,
+		"identity":    tc.identity,
+		"remote":      tc.conn.RemoteAddr().String(),
+		"target":      net.JoinHostPort(tc.proxyAddress, strconv.Itoa(tc.proxyPort)),
+		"tunnel_port": tc.tunnelPort,
+		"rx_bytes":    counters.RxBytes,
+		"tx_bytes":    counters.TxBytes,
+		"rx_frames":   counters.RxFrames,
+		"tx_frames":   counters.TxFrames,
+	})
+}
+
+func (p *Provider) getTunnelConnection(handle Handle) *TunnelConnection {
+	if tc, ok := p.tunnelConnections.load(handle).(*TunnelConnection); ok {
+		return tc
+	}
+
+	return nil
+}
+
+func (p *Provider) getAndClearTunnelConnection(handle Handle) *TunnelConnection {
+	if tc, ok := p.tunnelConnections.loadAndDelete(handle).(*TunnelConnection); ok {
+		return tc
+	}
+
+	return nil
+}
+
+func (p *Provider) newDataConnection(tc *TunnelConnection, conn net.Conn) *DataConnection {
+	ctx, cancel := context.WithCancel(tc.ctx)
+	dc := &DataConnection{
+		conn:    wrapStream(conn, p.streamMiddleware),
+		created: time.Now(),
+
+		tunnelConnection: tc,
+		channel:          tc.assignChannel(),
+		switched:         make(chan struct{}),
+		ctx:              ctx,
+		cancel:           cancel,
+	}
+
+	dc.handle = p.getNextHandle()
+	dc.log = tc.log.with("handle", dc.handle)
+	dc.span = tc.span.child("tunnel.data_connection", "handle", dc.handle)
+	p.dataConnections.store(dc.handle, dc)
+
+	metrics.dataConnectionsOpened.Add(1)
+	metrics.dataConnectionsActive.Add(1)
+
+	// raced with the teardown of its tunnel
+	if !tc.attach(dc) {
+		p.closeDataConnection(dc, false)
+	}
+
+	return dc
+}
+
+func (p *Provider) closeDataConnection(dc *DataConnection, notifyPeer bool) {
+	dc = p.getAndClearDataConnection(dc.handle)
+	if dc != nil {
+		counters := dc.snapshot()
+		dc.log.debug("Close data connection", append([]interface{}{"peer_handle", dc.peerHandle,
+			"duration", time.Since(dc.created).Round(time.Millisecond)}, counters.fields()...)...)
+		metrics.dataConnectionsActive.Add(-1)
+
+		dc.cancel()
+		dc.stopConnectTimer()
+		p.pollEngine.remove(dc)
+		dc.conn.Close()
+		dc.stopRecording()
+
+		tc := dc.tunnelConnection
+		tc.detach(dc)
+		if dc.limited {
+			p.limits.releaseDataConnection(tc.identity)
+		}
+
+		if atomic.LoadUint32(&dc.opened) == 0 {
+			dc.span.fail(errNotConnected)
+		} else if d := time.Since(dc.created).Seconds(); d > 0 {
+			metrics.throughputPerConn.observe(float64(counters.RxBytes+counters.TxBytes) / d)
+		}
+		dc.span.set("peer_handle", dc.peerHandle)
+		dc.span.set(counters.fields()...)
+		dc.span.finish()
+
+		p.events.publish(&tunnelEvent{
+			kind:       eventConnectionClose,
+			tunnel:     tc.handle,
+			connection: dc.handle,
+			identity:   tc.identity,
+			client:     dc.clientAddress,
+			target:     dc.targetAddress(),
+			traffic:    counters,
+			duration:   time.Since(dc.created),
+		})
+
+		p.audit.record("data_close", auditFields{
+			"handle":      dc.handle,
+			"peer_handle": dc.peerHandle,
+			"identity":    tc.identity,
+			"client":      dc.clientAddress,
+			"target":      dc.targetAddress(),
+			"rx_bytes":    counters.RxBytes,
+			"tx_bytes":    counters.TxBytes,
+			"rx_frames":   counters.RxFrames,
+			"tx_frames":   counters.TxFrames,
+			"duration_ms": time.Since(dc.created).Milliseconds(),
+		})
+
+		if dc.accepted {
+			p.accessLog.record(&accessEntry{
+				Time:     time.Now(),
+				Client:   dc.clientAddress,
+				Host:     dc.serverName,
+				Target:   dc.targetAddress(),
+				Identity: tc.identity,
+				RxBytes:  counters.RxBytes,
+				TxBytes:  counters.TxBytes,
+				Duration: time.Since(dc.created).Milliseconds(),
+			})
+		}
+
+		if notifyPeer {
+			pdu := &TunnelDisconnectRequest{
+				peerConnectionHandle: dc.peerHandle,
+			}
+			dc.sender().sendAt(pdu, dc.priority)
+		}
+		dc.closeDedicated()
+	}
+}
+
+// targetAddress is the host:port dc is relayed to
+func (dc *DataConnection) targetAddress() string {
+	if len(dc.target) > 0 {
+		return dc.target
+	}
+
+	tc := dc.tunnelConnection
+	return net.JoinHostPort(tc.proxyAddress, strconv.Itoa(tc.proxyPort))
+}
+
+func (p *Provider) getDataConnection(handle Handle) *DataConnection {
+	if dc, ok := p.dataConnections.load(handle).(*DataConnection); ok {
+		return dc
+	}
+
+	return nil
+}
+
+// StartListener accepts signaling connections on port, an ephemeral port
+// if 0, and returns the bound address
+func (p *Provider) StartListener(port int) (net.Addr, error) {
+	return p.listen(fmt.Sprintf("0.0.0.0:%d", port))
+}
+
+func (p *Provider) listen(address string) (net.Addr, error) {
+	if p.listening.Err() != nil {
+		return nil, ErrProviderClosed
+	}
+
+	listeners, err := p.bind(address)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, l := range listeners {
+		if p.socketOptions != nil {
+			l = &tunedListener{Listener: l, options: p.socketOptions}
+		}
+
+		if len(p.obfsKey) > 0 {
+			l = newObfsListener(l, p.obfsKey)
+		}
+
+		if p.tlsConfig != nil {
+			l = tls.NewListener(l, p.tlsConfig)
+		}
+
+		l := l
+		atomic.AddInt32(&p.acceptLoops, 1)
+		supervise("signaling accept loop", func() {
+			p.acceptSignaling(l)
+			atomic.AddInt32(&p.acceptLoops, -1)
+		})
+
+		go func() {
+			<-p.listening.Done()
+			l.Close()
+		}()
+	}
+
+	return listeners[0].Addr(), nil
+}
+
+// bind listens on a tcp4 address with the acceptors of the provider, see
+// listenShared, or once on its transport
+func (p *Provider) bind(address string) ([]net.Listener, error) {
+	if p.transport == nil {
+		return listenShared("tcp4", address, p.acceptors)
+	}
+
+	l, err := p.transport.Listen("tcp4", address)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{l}, nil
+}
+
+func (p *Provider) acceptSignaling(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if p.listening.Err() == nil {
+				logger.error("Signaling accept error", "error", err)
+			}
+			break
+		} else {
+			if p.lockout != nil {
+				if until := p.lockout.bannedUntil(remoteIP(conn.RemoteAddr())); !until.IsZero() {
+					logger.warn("AUTH_BANNED", "ip", remoteIP(conn.RemoteAddr()), "until", until.Format(time.RFC3339))
+					conn.Close()
+					continue
+				}
+			}
+
+			tc := p.newTunnelConnection(conn)
+			tc.accepted = true
+			tc.open()
+		}
+	}
+
+	l.Close()
+}
+
+// Dialer connects data connections to their targets, *net.Dialer satisfies
+// it. Custom dialers resolve names their own way, chain proxies or connect
+// to services in the same process.
+type Dialer interface {
+	DialContext(ctx context.Context, network string, address string) (net.Conn, error)
+}
+
+// dialTarget connects a data connection to address, a tcp4 host:port
+func (p *Provider) dialTarget(ctx context.Context, address string) (net.Conn, error) {
+	if p.dialer != nil {
+		return p.dialer.DialContext(ctx, "tcp4", address)
+	}
+
+	return (&net.Dialer{}).DialContext(ctx, "tcp4", address)
+}
+
+func (p *Provider) startConnector(providerAddress string) (*TunnelConnection, error) {
+	conn, err := p.dialProvider(providerAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	tc := p.newTunnelConnection(conn)
+	tc.open()
+
+	return tc, nil
+}
+
+// dialProvider opens a signaling connection, or a data channel, to the
+// provider at providerAddress
+func (p *Provider) dialProvider(providerAddress string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if p.transport != nil {
+		conn, err = p.transport.DialContext(p.ctx, "tcp4", providerAddress)
+	} else {
+		conn, err = net.Dial("tcp4", providerAddress)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.socketOptions.apply(conn)
+
+	if len(p.obfsKey) > 0 {
+		conn = newObfsConn(conn, p.obfsKey)
+	}
+
+	if p.tlsConfig != nil {
+		tlsConn := tls.Client(conn, p.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	return conn, nil
+}
+
+func (p *Provider) getAndClearDataConnection(handle Handle) *DataConnection {
+	if dc, ok := p.dataConnections.loadAndDelete(handle).(*DataConnection); ok {
+		return dc
+	}
+
+	return nil
+}
+
+func (p *Provider) onTunnelPacket(tc *TunnelConnection, data []byte) {
+	// fast path for the bulk of the traffic, decodes without allocating
+	if decodeDataIndication(data, &tc.dataPdu) {
+		tc.trace("PDU received", &tc.dataPdu, data)
+		tc.onTunnelDataIndication(&tc.dataPdu)
+		return
+	}
+
+	r := bytes.NewBuffer(data)
+	pdu := serializePduFrom(r)
+	if pdu == nil {
+		// sent by a newer peer, frames of unknown types are skipped
+		if len(data) > 0 {
+			tc.log.debug("Skip PDU of unknown type", "type", data[0], "length", len(data))
+		}
+		return
+	}
+
+	tc.trace("PDU received", pdu, data)
+
+	if tc.owner != nil {
+		tc.onChannelPacket(pdu)
+		return
+	}
+
+	switch int(pdu.GetSerialType()) {
+	case PDU_LISTEN_REQUEST:
+		tc.onListenRequest(pdu.(*ListenRequest))
+
+	case PDU_LISTEN_RESPONSE:
+		tc.onListenResponse(pdu.(*ListenResponse))
+
+	case PDU_TUNNEL_CONNECT_REQUEST:
+		tc.onTunnelConnectRequest(pdu.(*TunnelConnectRequest))
+
+	case PDU_TUNNEL_CONNECT_RESPONSE:
+		tc.onTunnelConnectResponse(pdu.(*TunnelConnectResponse))
+
+	case PDU_TUNNEL_DATA_INDICATION:
+		tc.onTunnelDataIndication(pdu.(*TunnelDataIndication))
+
+	case PDU_TUNNEL_DISCONNECT_REQUEST:
+		tc.onTunnelDisconnectRequest(pdu.(*TunnelDisconnectRequest))
+
+	case PDU_TUNNEL_DISCONNECT_RESPONSE:
+		tc.onTunnelDisconnectResponse(pdu.(*TunnelDisconnectResponse))
+
+	case PDU_AUTH_REQUEST:
+		tc.onAuthRequest(pdu.(*AuthRequest))
+
+	case PDU_ERROR_INDICATION:
+		tc.onErrorIndication(pdu.(*ErrorIndication))
+
+	case PDU_HELLO_REQUEST:
+		tc.onHelloRequest(pdu.(*HelloRequest))
+
+	case PDU_HELLO_RESPONSE:
+		tc.onHelloResponse(pdu.(*HelloResponse))
+
+	case PDU_REKEY_INDICATION:
+		tc.onRekeyIndication(pdu.(*RekeyIndication))
+
+	case PDU_KEEPALIVE_REQUEST:
+		tc.onKeepaliveRequest(pdu.(*KeepaliveRequest))
+
+	case PDU_KEEPALIVE_RESPONSE:
+		tc.onKeepaliveResponse(pdu.(*KeepaliveResponse))
+
+	case PDU_LOOKUP_REQUEST:
+		tc.onLookupRequest(pdu.(*LookupRequest))
+
+	case PDU_LOOKUP_RESPONSE:
+		tc.onLookupResponse(pdu.(*LookupResponse))
+
+	case PDU_RENEGOTIATE_REQUEST:
+		tc.onRenegotiateRequest(pdu.(*RenegotiateRequest))
+
+	case PDU_RENEGOTIATE_RESPONSE:
+		tc.onRenegotiateResponse(pdu.(*RenegotiateResponse))
+
+	case PDU_TUNNEL_DATAGRAM_INDICATION:
+		tc.onTunnelDatagramIndication(pdu.(*TunnelDatagramIndication))
+
+	case PDU_DATA_CHANNEL_REQUEST:
+		tc.onDataChannelRequest(pdu.(*DataChannelRequest))
+
+	case PDU_CHANNEL_SWITCH_INDICATION:
+		tc.onChannelSwitchIndication(pdu.(*ChannelSwitchIndication))
+
+	case PDU_STATS_INDICATION:
+		tc.onStatsIndication(pdu.(*StatsIndication))
+	}
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+type DataConnection struct {
+	conn       net.Conn
+	handle     Handle
+	peerHandle Handle
+
+	// set once peerHandle is known, accessed atomically
+	opened uint32
+
+	// address of the consumer connecting to the tunnel port
+	clientAddress string
+	created       time.Time
+
+	// accepted on a tunnel port, with the SNI of its ClientHello if peeked
+	accepted   bool
+	serverName string
+
+	// payload relayed from / to conn
+	traffic
+
+	// counted against the connection limits of the client
+	limited bool
+
+	// set when dialed through the tunnel, a target other than the tunnel's
+	target string
+
+	// class of the forward, its frames are queued in
+	priority priority
+
+	// opened with CONNECT_DATAGRAM, each read is sent as one message
+	datagram bool
+
+	// counter of the last payload sealed for the peer, and of the last one
+	// opened, see payloadCipher
+	sealCounter uint64
+	openCounter uint64
+
+	// connection its payload and disconnect request are sent over, a data
+	// channel or the tunnel connection itself, and the data channel of its
+	// own once promoted; guarded by channelLock, see sender
+	channelLock sync.Mutex
+	channel     *TunnelConnection
+	dedicated   *TunnelConnection
+
+	// cleartext payload written to files and to the capture, started by
+	// the first payload if the provider records the target, see recorder
+	// and capture
+	recordOnce sync.Once
+	recording  *recording
+	captured   *capturedStream
+
+	// opened for the peer's TunnelConnectRequest, conn leads to the target
+	// rather than to the consumer
+	toTarget bool
+
+	// closed by the peer's ChannelSwitchIndication, payload read from the
+	// dedicated data channel is held until then
+	switched   chan struct{}
+	switchOnce sync.Once
+
+	// payloads waiting for the egress rate limit or quota, written by a
+	// goroutine of their own, see queueEgress
+	egress     chan []byte
+	egressOnce sync.Once
+
+	// connector side, set by promoteLoop once a dedicated data channel is
+	// dialed for it
+	promoting bool
+
+	// connector side, set while DialContext waits for the provider to
+	// connect target: closed once connected, dialErr is the reason the
+	// provider refused
+	dialing chan struct{}
+	dialErr string
+
+	// closes the data connection unless the peer answers its
+	// TunnelConnectRequest in time, see awaitConnect
+	connectLock  sync.Mutex
+	connectTimer *time.Timer
+
+	// socket registered with the poll engine, see pollEngine
+	pollFd int
+
+	// adds the tunnel and local handle to every event
+	log *leveledLogger
+
+	// lasts from creation to close, child of the tunnel span
+	span *span
+
+	tunnelConnection *TunnelConnection
+	ctx              context.Context
+	cancel           context.CancelFunc
+}
+
+func (dc *DataConnection) open(peerHandle Handle) {
+	dc.peerHandle = peerHandle
+	atomic.StoreUint32(&dc.opened, 1)
+
+	dc.stopConnectTimer()
+
+	if dc.dialing != nil {
+		close(dc.dialing)
+	}
+
+	// connections handed to a Listen listener are pipes, read by goroutine
+	// and datagram ones too, the engine reads dataReadSize at a time
+	_, isTCP := dc.conn.(*net.TCPConn)
+	if engine := dc.tunnelConnection.provider.pollEngine; engine != nil && isTCP && !dc.datagram {
+		err := engine.register(dc)
+		if err == nil {
+			return
+		}
+		dc.log.warn("Poll engine registration error", "error", err)
+	}
+
+	go dc.readLoop()
+}
+
+// awaitConnect closes dc unless the peer answers its TunnelConnectRequest
+// within the connect timeout of the provider, so that the consumer does not
+// hang on a peer that never does. Handles are never reused, the peer is
+// told to close its end should the response arrive late.
+func (dc *DataConnection) awaitConnect() {
+	timeout := dc.tunnelConnection.provider.connectTimeout
+	if timeout <= 0 {
+		return
+	}
+
+	dc.connectLock.Lock()
+	defer dc.connectLock.Unlock()
+
+	dc.connectTimer = time.AfterFunc(timeout, func() {
+		if atomic.LoadUint32(&dc.opened) != 0 {
+			return
+		}
+
+		dc.log.warn("No connect response, close data connection", "target", dc.targetAddress(), "timeout", timeout)
+		dc.span.fail(errConnectTimeout)
+		if dc.dialing != nil {
+			dc.dialErr = errConnectTimeout.Error()
+		}
+		dc.close(false)
+	})
+}
+
+func (dc *DataConnection) stopConnectTimer() {
+	dc.connectLock.Lock()
+	defer dc.connectLock.Unlock()
+
+	if dc.connectTimer != nil {
+		dc.connectTimer.Stop()
+	}
+}
+
+func (dc *DataConnection) readLoop() {
+	defer recoverPanic("data connection reader", func() { dc.close(true) })
+
+	size := dataReadSize
+	if dc.datagram {
+		size = maxDatagramSize
+	}
+	b := make([]byte, size)
+	var scratch dataScratch
+
+	for {
+		sz, err := dc.conn.Read(b)
+
+		// closed locally, already torn down
+		if dc.ctx.Err() != nil {
+			return
+		}
+
+		if sz == 0 || err != nil {
+			if err != nil && err != io.EOF {
+				dc.span.fail(err)
+			}
+			dc.close(true)
+			return
+		}
+
+		if !dc.forward(b[:sz], &scratch) {
+			return
+		}
+	}
+}
+
+// dataScratch holds the buffers a data connection reader reuses for every
+// payload, sendData copies them into the frame
+type dataScratch struct {
+	compressed []byte
+	sealed     []byte
+	pdu        TunnelDataIndication
+	datagram   TunnelDatagramIndication
+}
+
+// forward sends data read from conn through the tunnel, returns false once
+// dc is closed
+func (dc *DataConnection) forward(data []byte, scratch *dataScratch) bool {
+	sz := len(data)
+	dc.countRead(sz)
+	dc.record(true, data)
+
+	if err := dc.tunnelConnection.provider.ingressLimiter.wait(dc.ctx, sz); err != nil {
+		return false
+	}
+	if !dc.tunnelConnection.quota.transfer(dc.ctx, sz) {
+		dc.onQuotaExceeded()
+		return false
+	}
+
+	switch dc.tunnelConnection.provider.faults.payload(dc.ctx, dc.datagram) {
+	case faultDrop:
+		return dc.ctx.Err() == nil
+
+	case faultReset:
+		dc.log.warn("Inject data connection reset")
+		dc.span.fail(errFaultReset)
+		dc.close(true)
+		return false
+	}
+
+	if dc.tunnelConnection.capabilities&CAPABILITY_COMPRESSION != 0 {
+		// payloads keep their marker while compression is turned off
+		minSize := dc.tunnelConnection.provider.compressMin
+		if !dc.tunnelConnection.compressing() {
+			minSize = maxFrameLength
+		}
+
+		scratch.compressed = compressPayload(scratch.compressed, data, minSize)
+		data = scratch.compressed
+	}
+
+	c := dc.tunnelConnection.cipher
+	var epoch uint32
+	if c != nil {
+		dc.sealCounter++
+		scratch.sealed, epoch = c.encryptQueued(scratch.sealed, data, dc.peerHandle, dc.sealCounter)
+		data = scratch.sealed
+
+		if limit := dc.tunnelConnection.provider.rekeyBytes; limit > 0 && c.sentSinceRekey() >= limit {
+			dc.tunnelConnection.rekey(limit)
+		}
+	}
+
+	var pdu Serializable
+	if dc.datagram {
+		scratch.datagram.peerConnectionHandle = dc.peerHandle
+		scratch.datagram.data = data
+		pdu = &scratch.datagram
+	} else {
+		scratch.pdu.peerConnectionHandle = dc.peerHandle
+		scratch.pdu.data = data
+		pdu = &scratch.pdu
+	}
+
+	// multiplex through tunnel connection, blocks while the tunnel is backed
+	// up so the local peer is throttled by TCP flow control
+	var err error
+	if c != nil {
+		err = dc.sender().sendSealed(pdu, dc.priority, c, epoch)
+	} else {
+		err = dc.sender().sendData(pdu, dc.priority)
+	}
+	if err != nil {
+		dc.span.fail(err)
+		dc.close(false)
+		return false
+	}
+
+	return true
+}
+
+func (dc *DataConnection) onQuotaExceeded() {
+	tc := dc.tunnelConnection
+	dc.log.warn("Monthly transfer quota exceeded, close data connection", "identity", tc.identity)
+
+	tc.sendError(dc.peerHandle, ERROR_QUOTA_EXCEEDED, "monthly transfer quota exceeded")
+	dc.span.fail(errQuotaExceeded)
+	dc.close(true)
+}
+
+func (dc *DataConnection) close(notifyPeer bool) {
+	dc.tunnelConnection.provider.closeDataConnection(dc, notifyPeer)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+
+type TunnelConnection struct {
+	provider *Provider
+	conn     net.Conn
+	handle   Handle
+
+	// adds the tunnel handle and remote address to every event
+	log *leveledLogger
+
+	created time.Time
+
+	// payload relayed by all data connections of the tunnel
+	traffic
+
+	// span lasts from connect to close, establish until the tunnel port is
+	// open
+	span      *span
+	establish *span
+
+	tunnelPort int
+
+	// listener side, sessions owning the tunnel ports, detached when the
+	// tunnel connection closes
+	sessions []*tunnelSession
+
+	// session to resume, assigned by the listener in HelloResponse
+	sessionID string
+
+	// closed once the provider has opened the tunnel port, or when dialing
+	// only once the handshake is done
+	opened chan struct{}
+
+	// client identity, anonymousIdentity until authenticated, and the
+	// AUTH_SOURCE_XXX it was authenticated by
+	identity      string
+	authSource    int
+	authenticated bool
+
+	// listener side, namespace of identity its service names belong to
+	namespace string
+
+	// labels the connector reported in its hello, e.g. hostname
+	labels map[string]string
+
+	// set once a connector serves on-demand ports rather than holding
+	// tunnel ports of its own, on both sides; accessed atomically
+	standby int32
+
+	// listener side, bandwidth quota of identity, nil if unlimited
+	quota *clientQuota
+
+	// listener side, tunnels counted against the connection limits
+	tunnelsHeld int
+
+	// listener side, outstanding authentication challenge
+	challenge *authChallenge
+
+	// connector side, credentials answering the listener's challenge
+	token      string
+	credential string
+
+	// negotiated CAPABILITY_XXX flags
+	capabilities uint32
+
+	// connector side key pair, kept until HelloResponse arrives
+	keyExchange *sessionKeyExchange
+
+	// public keys of the payload key exchange, signed by the client when
+	// authenticating, see authMac
+	keyTranscript []byte
+
+	// set by the first HelloRequest or HelloResponse, the handshake is never
+	// repeated
+	helloDone bool
+
+	// set when payload encryption is negotiated, its keys may be replaced
+	// by renegotiation but never the cipher itself
+	cipher *payloadCipher
+
+	// set while compression is turned off by renegotiation, accessed
+	// atomically
+	compressOff int32
+
+	// guards renegotiation, the outstanding RenegotiateRequest of this side,
+	// and holds rekeying while one is
+	renegotiateLock sync.Mutex
+	renegotiation   *pendingRenegotiation
+
+	// refuse data connections unless payload encryption is negotiated
+	encryptionRequired bool
+
+	// target and tunnel port of the first forward
+	proxyAddress string
+	proxyPort    int
+
+	// targets tunneled over the connection, see addForward
+	forwardLock sync.Mutex
+	forwards    []forward
+
+	// listener side, accepted from a signaling listener
+	accepted bool
+
+	// connector side, the signaling connection only carries connections of
+	// DialContext, no tunnel port is requested
+	dialOnly bool
+
+	// connector side, optional, data connections are handed to it instead
+	// of dialed to the target
+	listener *tunnelListener
+
+	// connector side, the provider dialed and the data channels to open
+	// there once granted
+	providerAddress string
+	dataChannels    int
+
+	// connector side, data connections relaying more bytes per second are
+	// promoted to a dedicated data channel, see promoteLoop
+	promoteRate uint64
+
+	// set on a data channel, the tunnel connection whose data connections
+	// it carries, and the one data connection of a dedicated data channel
+	owner    *TunnelConnection
+	promoted *DataConnection
+
+	// data channels attached, the one the last data connection was assigned
+	// and, listener side, the token they present
+	channelLock  sync.Mutex
+	channels     []*TunnelConnection
+	nextChannel  int
+	channelToken string
+
+	// connector side, outstanding lookups by request ID
+	lookupLock sync.Mutex
+	lookups    map[uint32]chan *LookupResponse
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// encoded frames by priority class, written to conn by writeLoop only
+	// so that frames of concurrent senders never interleave
+	outbound [priorityClasses]chan outboundFrame
+
+	// position in priorityTurns, used by writeLoop only
+	turn int
+
+	// hold one token per queued data frame of their class, released once it
+	// is written, so that bulk data connections never take the credits of
+	// interactive ones
+	credits [priorityClasses]chan struct{}
+
+	// share of the process memory budget held by queued data frames
+	budget budgetAccount
+
+	// sealed payloads queued, rekeys of their cipher wait for them
+	sealed sealedAccount
+
+	// data connections multiplexed over this tunnel, no more are attached
+	// once dataClosed is set
+	dataLock   sync.Mutex
+	data       map[Handle]*DataConnection
+	dataClosed bool
+
+	// keepalive intervals without a frame from the peer, accessed atomically
+	idleKeepalives int32
+
+	// ErrorIndications sent, accessed atomically, and what the peer last
+	// reported with a StatsIndication
+	errors    uint64
+	statsLock sync.Mutex
+	peerStats *PeerStats
+
+	// scratch buffers of the read loop, reused for every frame
+	received     []byte
+	decompressed []byte
+	dataPdu      TunnelDataIndication
+}
+
+type outboundFrame struct {
+	// pooled, released by the writer once copied into a batch
+	data *bytes.Buffer
+
+	// return a send credit of class once written
+	credit bool
+	class  priority
+
+	// bytes charged to the memory budget
+	charged int
+
+	// payload sealed under the send key of epoch, held by the sealed account
+	sealed bool
+	epoch  uint32
+
+	// carries no data, conn is closed once the frames queued ahead of it
+	// are written
+	last bool
+}
+
+// attach tracks dc as multiplexed over tc, false once tc is closed
+func (tc *TunnelConnection) attach(dc *DataConnection) bool {
+	tc.dataLock.Lock()
+	defer tc.dataLock.Unlock()
+
+	if tc.dataClosed {
+		return false
+	}
+
+	tc.data[dc.handle] = dc
+	return true
+}
+
+func (tc *TunnelConnection) detach(dc *DataConnection) {
+	tc.dataLock.Lock()
+	defer tc.dataLock.Unlock()
+
+	delete(tc.data, dc.handle)
+}
+
+// dataConnections returns the data connections multiplexed over tc
+func (tc *TunnelConnection) dataConnections() []*DataConnection {
+	tc.dataLock.Lock()
+	defer tc.dataLock.Unlock()
+
+	connections := make([]*DataConnection, 0, len(tc.data))
+	for _, dc := range tc.data {
+		connections = append(connections, dc)
+	}
+
+	return connections
+}
+
+// closeDataConnections stops tracking data connections and returns the ones
+// still attached, for the caller to close
+func (tc *TunnelConnection) closeDataConnections() []*DataConnection {
+	tc.dataLock.Lock()
+	tc.dataClosed = true
+	tc.dataLock.Unlock()
+
+	return tc.dataConnections()
+}
+
+// send queues pdu for the writer goroutine
+func (tc *TunnelConnection) send(pdu Serializable) error {
+	return tc.sendAt(pdu, priorityNormal)
+}
+
+// sendAt queues pdu in the priority class c. The PDUs of a data connection
+// all go through its class, so that none overtakes its data frames.
+func (tc *TunnelConnection) sendAt(pdu Serializable, c priority) error {
+	frame := newFrame(pdu)
+	tc.trace("PDU sent", pdu, frame.Bytes()[4:])
+	return tc.enqueue(outboundFrame{data: frame, class: c})
+}
+
+// sendData queues a data or datagram pdu in the priority class c once a send credit of
+// the class is available, so that data connections stop reading while the
+// tunnel write path is backed up
+func (tc *TunnelConnection) sendData(pdu Serializable, c priority) error {
+	return tc.queueData(pdu, outboundFrame{credit: true, class: c})
+}
+
+// sendSealed is sendData for a payload cipher sealed under the send key of
+// epoch, held as queued until written so that rekeys wait for it
+func (tc *TunnelConnection) sendSealed(pdu Serializable, c priority, cipher *payloadCipher, epoch uint32) error {
+	if !tc.sealed.hold(cipher, epoch) {
+		cipher.written(epoch, 1)
+		return errTunnelClosed
+	}
+
+	err := tc.queueData(pdu, outboundFrame{credit: true, class: c, sealed: true, epoch: epoch})
+	if err != nil {
+		tc.sealed.release(epoch)
+	}
+	return err
+}
+
+func (tc *TunnelConnection) queueData(pdu Serializable, frame outboundFrame) error {
+	c := frame.class
+	select {
+	case tc.credits[c] <- struct{}{}:
+
+	case <-tc.ctx.Done():
+		return errTunnelClosed
+	}
+
+	frame.data = newFrame(pdu)
+	frame.charged = frame.data.Len()
+	tc.trace("PDU sent", pdu, frame.data.Bytes()[4:])
+	if err := tc.budget.charge(tc.ctx, frame.charged); err != nil {
+		// the frame is never queued, nor its credit returned by the writer
+		releaseFrame(frame.data)
+		<-tc.credits[c]
+		return err
+	}
+
+	return tc.enqueue(frame)
+}
+
+func (tc *TunnelConnection) enqueue(frame outboundFrame) error {
+	select {
+	case tc.outbound[frame.class] <- frame:
+		return nil
+
+	case <-tc.ctx.Done():
+		return errTunnelClosed
+	}
+}
+
+func (tc *TunnelConnection) writeLoop() {
+	// the reader notices the closed connection and cleans up
+	defer recoverPanic("tunnel connection writer", func() { tc.conn.Close() })
+
+	batch := make([]byte, 0, maxWriteBatch)
+
+	for {
+		frame, ok := tc.dequeue(true)
+		if !ok {
+			// unblocks the read loop, which tears the tunnel connection down
+			tc.conn.Close()
+			return
+		}
+
+		var credits [priorityClasses]int
+		var charged int
+		var last bool
+		batch, credits, charged, last = tc.coalesce(batch[:0], frame)
+
+		if timeout := tc.provider.writeTimeout; timeout > 0 {
+			tc.conn.SetWriteDeadline(time.Now().Add(timeout))
+		}
+
+		_, err := tc.conn.Write(batch)
+		for c, n := range credits {
+			for ; n > 0; n-- {
+				<-tc.credits[c]
+			}
+		}
+		tc.budget.release(charged)
+
+		if err != nil {
+			tc.log.error("Tunnel write error", "error", err)
+
+			// the read loop notices and tears the tunnel connection down
+			tc.conn.Close()
+			return
+		}
+
+		if last {
+			// the reader notices and tears the data channel down
+			tc.conn.Close()
+			return
+		}
+	}
+}
+
+// coalesce appends frame and the frames already queued behind it to batch,
+// in the weighted turns of dequeue, so that bursts of small frames (e.g.
+// interactive traffic) cost one write. Returns the batch, the number of send
+// credits of each class, the memory budget bytes it holds and whether it
+// ends with the last frame.
+func (tc *TunnelConnection) coalesce(batch []byte, frame outboundFrame) ([]byte, [priorityClasses]int, int, bool) {
+	var credits [priorityClasses]int
+	charged := 0
+
+	for {
+		if frame.last {
+			return batch, credits, charged, true
+		}
+
+		batch = append(batch, frame.data.Bytes()...)
+		releaseFrame(frame.data)
+		if frame.credit {
+			credits[frame.class]++
+		}
+		charged += frame.charged
+		if frame.sealed {
+			// written ahead of the RekeyIndications queued from now on
+			tc.sealed.release(frame.epoch)
+		}
+
+		if len(batch) >= maxWriteBatch {
+			return batch, credits, charged, false
+		}
+
+		var ok bool
+		if frame, ok = tc.dequeue(false); !ok {
+			return batch, credits, charged, false
+		}
+	}
+}
+
+func (tc *TunnelConnection) startListenFor(f forward) (int, error) {
+	p := tc.provider
+	reservations := p.sessions.reservations
+
+	// authenticated clients get the ports they held back, and no one else
+	// gets them
+	var listeners []net.Listener
+	var err error
+	if port := reservations.portFor(tc.identity, f.target()); port > 0 && tc.authenticated {
+		if listeners, err = p.bind(fmt.Sprintf(":%d", port)); err != nil {
+			return 0, fmt.Errorf("reserved tunnel port %d: %v", port, err)
+		}
+	} else if listeners, err = p.portRange.listen(reservations.guard(tc.identity, p.bind)); err != nil {
+		return 0, err
+	}
+
+	s := p.sessions.open(tc, f.proxyAddress, f.proxyPort, listeners)
+	tc.sessions = append(tc.sessions, s)
+	f.tunnelPort = s.port
+	tc.addForward(f)
+
+	if tc.authenticated {
+		reservations.reserve(tc.identity, f.target(), s.port)
+	}
+
+	return s.port, nil
+}
+
+// resumeListenFor takes the tunnel port of the session being resumed back
+func (tc *TunnelConnection) resumeListenFor(f forward) (int, bool) {
+	s := tc.provider.sessions.resume(tc, f.proxyAddress, f.proxyPort)
+	if s == nil {
+		return 0, false
+	}
+
+	tc.sessions = append(tc.sessions, s)
+	f.tunnelPort = s.port
+	tc.addForward(f)
+
+	return s.port, true
+}
+
+// requestForwards asks the listener for a tunnel port for every forward
+func (tc *TunnelConnection) requestForwards() {
+	for _, f := range tc.forwardList() {
+		pdu := &ListenRequest{
+			proxyAddress: f.proxyAddress,
+			proxyPort:    f.proxyPort,
+			service:      f.service,
+			standby:      atomic.LoadInt32(&tc.standby) != 0,
+		}
+		if f.priority != priorityNormal {
+			pdu.ext = extensions{EXT_LISTEN_PRIORITY: {byte(f.priority)}}
+		}
+
+		tc.send(pdu)
+	}
+}
+
+func (tc *TunnelConnection) hello(capabilities uint32) error {
+	pdu := &HelloRequest{
+		capabilities: capabilities,
+		sessionID:    []byte(tc.sessionID),
+		labels:       tc.labels,
+	}
+
+	if capabilities&CAPABILITY_ENCRYPTION != 0 {
+		kx, err := newSessionKeyExchange()
+		if err != nil {
+			return err
+		}
+
+		tc.keyExchange = kx
+		tc.encryptionRequired = true
+		pdu.publicKey = kx.publicKey
+	}
+
+	return tc.send(pdu)
+}
+
+func (tc *TunnelConnection) onHelloRequest(pdu *HelloRequest) {
+	if tc.helloDone {
+		tc.log.warn("Repeated hello request, close tunnel connection")
+		tc.conn.Close()
+		return
+	}
+	tc.helloDone = true
+
+	response := &HelloResponse{}
+
+	// informational, a connector is not refused for its labels
+	if len(pdu.labels) > 0 {
+		if err := ValidateLabels(pdu.labels); err != nil {
+			tc.log.warn("Ignore client labels", "error", err)
+		} else {
+			tc.labels = pdu.labels
+			tc.log.info("Client labels", "labels", FormatLabels(pdu.labels))
+		}
+	}
+
+	// clients that predate challenges are refused in onAuthRequest, they
+	// would send their token in the clear
+	if tc.provider.authRequired() && !tc.authenticated && pdu.capabilities&CAPABILITY_AUTH_CHALLENGE != 0 {
+		challenge, err := newAuthChallenge()
+		if err != nil {
+			tc.log.error("Authentication challenge error", "error", err)
+			tc.sendError(0, ERROR_UNAUTHENTICATED, "authentication unavailable")
+			return
+		}
+
+		tc.challenge = challenge
+		response.capabilities |= CAPABILITY_AUTH_CHALLENGE
+		response.authNonce = challenge.nonce
+		response.authTimestamp = challenge.timestamp
+	}
+
+	if pdu.capabilities&CAPABILITY_ENCRYPTION != 0 {
+		kx, err := newSessionKeyExchange()
+		if err == nil {
+			tc.cipher, err = kx.deriveCipher(pdu.publicKey, false, CIPHER_AES_256_GCM, nil)
+		}
+
+		if err != nil {
+			tc.log.error("Payload encryption setup error", "error", err)
+		} else {
+			response.capabilities |= CAPABILITY_ENCRYPTION
+			response.publicKey = kx.publicKey
+			tc.keyTranscript = kx.transcript(pdu.publicKey, false)
+		}
+	}
+
+	if pdu.capabilities&CAPABILITY_COMPRESSION != 0 && tc.provider.compressMin > 0 {
+		response.capabilities |= CAPABILITY_COMPRESSION
+	}
+
+	if pdu.capabilities&CAPABILITY_DIAL != 0 && tc.provider.allowDial {
+		response.capabilities |= CAPABILITY_DIAL
+	}
+
+	if pdu.capabilities&CAPABILITY_RENEGOTIATE != 0 {
+		response.capabilities |= CAPABILITY_RENEGOTIATE
+	}
+
+	if pdu.capabilities&CAPABILITY_DATAGRAM != 0 {
+		response.capabilities |= CAPABILITY_DATAGRAM
+	}
+
+	if pdu.capabilities&CAPABILITY_STATS != 0 {
+		response.capabilities |= CAPABILITY_STATS
+	}
+
+	// dedicated data channels present the token of data channels as well
+	if channels := pdu.capabilities & (CAPABILITY_DATA_CHANNELS | CAPABILITY_PROMOTE); channels != 0 {
+		token, err := tc.grantDataChannels()
+		if err != nil {
+			tc.log.error("Data channel setup error", "error", err)
+		} else {
+			response.capabilities |= channels
+			response.ext = extensions{EXT_HELLO_CHANNEL_TOKEN: token}
+		}
+	}
+
+	sessionID, err := tc.provider.sessions.sessionID(pdu.sessionID)
+	if err != nil {
+		tc.log.error("Tunnel session error", "error", err)
+	}
+	tc.sessionID = sessionID
+	response.sessionID = []byte(sessionID)
+
+	tc.capabilities = response.capabilities
+	tc.send(response)
+	tc.startStatsTimer()
+
+	if tc.cipher != nil {
+		tc.startRekeyTimer()
+	}
+}
+
+// onHelloResponse completes the connector side handshake: authenticates if
+// challenged and then requests the tunnel set up by hello
+func (tc *TunnelConnection) onHelloResponse(pdu *HelloResponse) {
+	if tc.helloDone {
+		tc.log.warn("Repeated hello response, close tunnel connection")
+		tc.conn.Close()
+		return
+	}
+	tc.helloDone = true
+
+	tc.capabilities = pdu.capabilities
+	tc.sessionID = string(pdu.sessionID)
+	tc.startStatsTimer()
+
+	if pdu.capabilities&CAPABILITY_ENCRYPTION != 0 && tc.keyExchange != nil {
+		c, err := tc.keyExchange.deriveCipher(pdu.publicKey, true, CIPHER_AES_256_GCM, nil)
+		if err != nil {
+			tc.log.error("Payload encryption setup error", "error", err)
+		} else {
+			tc.cipher = c
+			tc.keyTranscript = tc.keyExchange.transcript(pdu.publicKey, true)
+			tc.log.info("Payload encryption enabled")
+
+			tc.startRekeyTimer()
+		}
+	}
+
+	tc.keyExchange = nil
+
+	if pdu.capabilities&CAPABILITY_COMPRESSION != 0 {
+		tc.log.info("Payload compression enabled")
+	}
+
+	if token := pdu.ext[EXT_HELLO_CHANNEL_TOKEN]; len(token) > 0 {
+		if pdu.capabilities&CAPABILITY_DATA_CHANNELS != 0 {
+			go tc.openDataChannels(token)
+		}
+		if pdu.capabilities&CAPABILITY_PROMOTE != 0 && tc.promoteRate > 0 {
+			go tc.promoteLoop(token)
+		}
+	}
+
+	if pdu.capabilities&CAPABILITY_AUTH_CHALLENGE != 0 && len(pdu.authNonce) > 0 {
+		if tc.identity == anonymousIdentity && len(tc.credential) == 0 {
+			tc.log.error("Provider requires authentication, use -id and -token or -jwt")
+		} else {
+			tc.authenticate(pdu.authNonce, pdu.authTimestamp)
+		}
+	}
+
+	if tc.dialOnly {
+		close(tc.opened)
+		return
+	}
+
+	tc.requestForwards()
+}
+
+func (tc *TunnelConnection) startRekeyTimer() {
+	interval := tc.provider.rekeyInterval
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				tc.rekey(0)
+
+			case <-tc.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// rekey rotates the payload send key once minBytes have been sent with it
+func (tc *TunnelConnection) rekey(minBytes uint64) {
+	tc.renegotiateLock.Lock()
+	defer tc.renegotiateLock.Unlock()
+
+	// the outstanding renegotiation replaces the key at its epoch
+	if tc.renegotiation != nil && tc.renegotiation.keyExchange != nil {
+		return
+	}
+
+	epoch, rotated, err := tc.cipher.rotateSendKey(minBytes)
+	if err != nil {
+		tc.log.error("Payload rekey error", "error", err)
+		return
+	}
+
+	if rotated {
+		tc.log.info("Payload send key rotated", "epoch", epoch)
+
+		// in the class of renegotiation PDUs, the peer has every rekey
+		// before a renegotiated key takes over at the next epoch. It may
+		// overtake payloads of the previous epoch, the next rekey waits for
+		// them.
+		tc.sendAt(&RekeyIndication{epoch: epoch}, priorityHigh)
+	}
+}
+
+func (tc *TunnelConnection) onRekeyIndication(pdu *RekeyIndication) {
+	if tc.cipher == nil {
+		return
+	}
+
+	if err := tc.cipher.rotateReceiveKey(pdu.epoch); err != nil {
+		tc.log.error("Payload rekey error", "error", err)
+		tc.sendError(0, ERROR_ENCRYPTION, err.Error())
+		return
+	}
+
+	tc.log.info("Payload receive key rotated", "epoch", pdu.epoch)
+}
+
+func (tc *TunnelConnection) authenticate(nonce []byte, timestamp uint64) {
+	pdu := &AuthRequest{
+		identity:  tc.identity,
+		nonce:     nonce,
+		timestamp: timestamp,
+	}
+
+	// JWTs are bearer credentials, a MAC keyed with one proves nothing once
+	// it crossed the wire
+	if len(tc.credential) > 0 {
+		if !tc.overTLS() {
+			tc.log.error("JWT authentication requires TLS to the provider, JWT not sent")
+			return
+		}
+		pdu.credential = tc.credential
+	} else {
+		pdu.mac = authMac(tc.identity, tc.token, nonce, timestamp, tc.keyTranscript)
+	}
+
+	tc.send(pdu)
+}
+
+func (tc *TunnelConnection) onAuthRequest(pdu *AuthRequest) {
+	if !tc.provider.authRequired() {
+		return
+	}
+
+	// challenges are single use
+	challenge := tc.challenge
+	tc.challenge = nil
+
+	if tc.capabilities&CAPABILITY_AUTH_CHALLENGE == 0 {
+		tc.onAuthFailure(pdu.identity, "client does not answer authentication challenges")
+		return
+	}
+
+	if challenge == nil {
+		tc.onAuthFailure(pdu.identity, "no outstanding authentication challenge")
+		return
+	}
+
+	if err := challenge.verify(pdu.nonce, pdu.timestamp); err != nil {
+		tc.onAuthFailure(pdu.identity, err.Error())
+		return
+	}
+
+	credentials := Credentials{
+		Identity:   pdu.identity,
+		JWT:        pdu.credential,
+		nonce:      pdu.nonce,
+		timestamp:  pdu.timestamp,
+		transcript: tc.keyTranscript,
+		mac:        pdu.mac,
+	}
+
+	var identity, namespace string
+	var err error
+	source := AUTH_SOURCE_TOKEN
+	if len(pdu.credential) > 0 && !tc.overTLS() {
+		err = errors.New("JWT authentication requires TLS")
+	} else if len(pdu.credential) > 0 && tc.provider.jwtValidator != nil {
+		identity, err = tc.provider.jwtValidator.validate(pdu.credential)
+		source = AUTH_SOURCE_JWT
+	} else if tc.provider.authenticator != nil {
+		identity, err = tc.provider.authenticator.Authenticate(credentials, tc.conn.RemoteAddr())
+		if namespacer, ok := tc.provider.authenticator.(Namespacer); ok && err == nil {
+			namespace = namespacer.Namespace(identity)
+		}
+	} else {
+		err = errAuthenticationFailed
+	}
+
+	if err == nil && len(identity) == 0 {
+		err = errAuthenticationFailed
+	}
+	if err != nil {
+		tc.onAuthFailure(pdu.identity, err.Error())
+		return
+	}
+
+	if tc.provider.lockout != nil {
+		tc.provider.lockout.onSuccess(remoteIP(tc.conn.RemoteAddr()))
+	}
+
+	tc.identity = identity
+	tc.authSource = source
+	tc.authenticated = true
+	tc.namespace = namespace
+
+	if len(namespace) > 0 {
+		tc.log.info("Authenticated", "identity", identity, "namespace", tc.namespace)
+	} else {
+		tc.log.info("Authenticated", "identity", identity)
+	}
+}
+
+// onAuthFailure answers a failed authentication after the back-off delay of
+// the source IP and drops the connection once the source gets banned
+func (tc *TunnelConnection) onAuthFailure(identity string, reason string) {
+	ip := remoteIP(tc.conn.RemoteAddr())
+	tc.publishAuthFailure(identity, reason)
+
+	if tc.provider.lockout == nil {
+		tc.log.warn("AUTH_FAILURE", "ip", ip, "identity", identity, "reason", reason)
+		tc.sendError(0, ERROR_UNAUTHENTICATED, reason)
+		return
+	}
+
+	delay, failures, banned := tc.provider.lockout.onFailure(ip)
+	tc.log.warn("AUTH_FAILURE", "ip", ip, "identity", identity, "reason", reason, "failures", failures)
+
+	// holds up this connection's read loop only
+	time.Sleep(delay)
+	tc.sendError(0, ERROR_UNAUTHENTICATED, reason)
+
+	if banned {
+		tc.log.warn("AUTH_LOCKOUT", "ip", ip, "identity", identity, "failures", failures,
+			"duration", tc.provider.lockout.banDuration)
+		tc.conn.Close()
+	}
+}
+
+func (tc *TunnelConnection) publishAuthFailure(identity string, reason string) {
+	tc.provider.events.publish(&tunnelEvent{
+		kind:     eventAuthFailure,
+		tunnel:   tc.handle,
+		identity: identity,
+		remote:   tc.conn.RemoteAddr().String(),
+		reason:   reason,
+	})
+}
+
+func (tc *TunnelConnection) sendError(peerHandle Handle, code uint32, message string) {
+	pdu := &ErrorIndication{
+		peerConnectionHandle: peerHandle,
+		code:                 code,
+		message:              message,
+	}
+
+	atomic.AddUint64(&tc.errors, 1)
+	tc.send(pdu)
+}
+
+func (tc *TunnelConnection) onErrorIndication(pdu *ErrorIndication) {
+	tc.log.warn("Error from peer", "code", pdu.code, "handle", pdu.peerConnectionHandle, "message", pdu.message)
+	tc.span.event("peer_error", "code", pdu.code, "handle", pdu.peerConnectionHandle, "message", pdu.message)
+
+	if pdu.peerConnectionHandle == 0 {
+		return
+	}
+
+	// the disconnect response following it fails DialContext
+	if dc := tc.peerDataConnection(pdu.peerConnectionHandle, PDU_ERROR_INDICATION); dc != nil && dc.dialing != nil {
+		dc.dialErr = pdu.message
+	}
+}
+
+func (tc *TunnelConnection) onListenRequest(pdu *ListenRequest) {
+	if tc.provider.authRequired() && !tc.authenticated {
+		tc.sendError(0, ERROR_UNAUTHENTICATED, "authentication required")
+		return
+	}
+
+	if !tc.provider.acl.isAllowed(tc.identity, tc.authSource, pdu.proxyAddress, pdu.proxyPort) {
+		tc.log.warn("Reject listen request, target is not allowed", "identity", tc.identity,
+			"target", net.JoinHostPort(pdu.proxyAddress, strconv.Itoa(pdu.proxyPort)))
+
+		tc.sendError(0, ERROR_ACCESS_DENIED,
+			fmt.Sprintf("target %s:%d is not allowed", pdu.proxyAddress, pdu.proxyPort))
+		return
+	}
+
+	if pdu.standby {
+		tc.onStandbyRequest(pdu)
+		return
+	}
+
+	if !tc.provider.limits.acquireTunnel(tc.identity) {
+		tc.log.warn("Reject listen request, tunnel limit reached", "identity", tc.identity)
+
+		tc.sendError(0, ERROR_RESOURCE_EXHAUSTED, "too many tunnels")
+		return
+	}
+	tc.tunnelsHeld++
+
+	// read by the tunnel ports of earlier forwards from then on
+	if len(tc.sessions) == 0 {
+		tc.quota = tc.provider.quotas.quotaFor(tc.identity)
+	}
+
+	f := forward{proxyAddress: pdu.proxyAddress, proxyPort: pdu.proxyPort, service: pdu.service,
+		priority: priorityFrom(pdu.ext)}
+	tunnelPort, resumed := tc.resumeListenFor(f)
+	if resumed {
+		tc.log.info("Resume tunnel session", "identity", tc.identity, "tunnel_port", tunnelPort)
+	}
+
+	var err error
+	if !resumed {
+		tunnelPort, err = tc.startListenFor(f)
+	}
+	if err != nil {
+		tc.log.error("Tunnel listen error", "error", err)
+		tc.establish.fail(err)
+
+		tc.provider.limits.releaseTunnel(tc.identity)
+		tc.tunnelsHeld--
+		tc.sendError(0, ERROR_RESOURCE_EXHAUSTED, err.Error())
+		return
+	}
+
+	responsePdu := &ListenResponse{
+		tunnelAddress: "0.0.0.0",
+		tunnelPort:    tunnelPort,
+		proxyAddress:  pdu.proxyAddress,
+		proxyPort:     pdu.proxyPort,
+	}
+
+	tc.provider.audit.record("tunnel_open", auditFields{
+		"handle":      tc.handle,
+		"identity":    tc.identity,
+		"remote":      tc.conn.RemoteAddr().String(),
+		"target":      net.JoinHostPort(pdu.proxyAddress, strconv.Itoa(pdu.proxyPort)),
+		"tunnel_port": tunnelPort,
+	})
+
+	tc.send(responsePdu)
+
+	// the tunnel port stays open, unnamed, when the name is refused
+	if len(f.service) > 0 {
+		f.tunnelPort = tunnelPort
+		if err := tc.provider.services.register(tc, f, resumed); err != nil {
+			tc.log.warn("Reject service registration", "identity", tc.identity, "service", f.service, "error", err)
+			tc.sendError(0, ERROR_ACCESS_DENIED, err.Error())
+		} else {
+			tc.log.info("Register service", "identity", tc.identity, "service", f.service, "tunnel_port", tunnelPort)
+		}
+	}
+
+	tc.provider.events.publish(&tunnelEvent{
+		kind:       eventTunnelUp,
+		tunnel:     tc.handle,
+		identity:   tc.identity,
+		remote:     tc.conn.RemoteAddr().String(),
+		target:     net.JoinHostPort(pdu.proxyAddress, strconv.Itoa(pdu.proxyPort)),
+		tunnelPort: tunnelPort,
+	})
+
+	tc.establish.set("identity", tc.identity,
+		"target", net.JoinHostPort(pdu.proxyAddress, strconv.Itoa(pdu.proxyPort)),
+		"tunnel_port", tunnelPort,
+		"resumed", resumed)
+	tc.establish.finish()
+}
+
+func (tc *TunnelConnection) onListenResponse(pdu *ListenResponse) {
+	target := net.JoinHostPort(pdu.proxyAddress, strconv.Itoa(pdu.proxyPort))
+	f, ok := tc.openForward(pdu.proxyAddress, pdu.proxyPort, pdu.tunnelPort)
+	if !ok {
+		tc.log.warn("Tunnel port opened for a target not requested", "target", target, "tunnel_port", pdu.tunnelPort)
+		return
+	}
+
+	if len(f.service) > 0 {
+		tc.log.info("Tunnel port is open", "target", target, "tunnel_port", pdu.tunnelPort, "service", f.service)
+	} else {
+		tc.log.info("Tunnel port is open", "target", target, "tunnel_port", pdu.tunnelPort)
+	}
+	tc.provider.events.publish(&tunnelEvent{
+		kind:       eventTunnelUp,
+		tunnel:     tc.handle,
+		identity:   tc.identity,
+		remote:     tc.conn.RemoteAddr().String(),
+		target:     target,
+		tunnelPort: pdu.tunnelPort,
+	})
+	tc.establish.set("tunnel_port", pdu.tunnelPort)
+	tc.establish.finish()
+
+	select {
+	case <-tc.opened:
+	default:
+		close(tc.opened)
+	}
+}
+
+func (tc *TunnelConnection) onTunnelConnectRequest(pdu *TunnelConnectRequest) {
+	if tc.encryptionRequired && tc.cipher == nil {
+		tc.log.warn("Refuse data connection, payload encryption is not negotiated", "peer_handle", pdu.dataConnectionHandle)
+
+		tc.refuseConnect(pdu.dataConnectionHandle, ERROR_ENCRYPTION, "payload encryption is required")
+		return
+	}
+
+	if tc.provider.memoryShed && tc.provider.memoryBudget.exhausted() {
+		tc.log.warn("Refuse data connection, memory budget exhausted", "peer_handle", pdu.dataConnectionHandle)
+
+		tc.refuseConnect(pdu.dataConnectionHandle, ERROR_RESOURCE_EXHAUSTED, "connector memory budget exhausted")
+		return
+	}
+
+	target := net.JoinHostPort(pdu.proxyAddress, strconv.Itoa(pdu.proxyPort))
+
+	// a client dialing through its tunnel connection, or a consumer of one
+	// of the forwards
+	limited := false
+	class := priorityNormal
+	if tc.accepted {
+		if !tc.admitDial(pdu) {
+			return
+		}
+		limited = true
+	} else if f, ok := tc.forwardOf(pdu.proxyAddress, pdu.proxyPort); !ok {
+		tc.log.warn("Refuse data connection, target is not forwarded", "peer_handle", pdu.dataConnectionHandle, "target", target)
+
+		tc.refuseConnect(pdu.dataConnectionHandle, ERROR_ACCESS_DENIED, fmt.Sprintf("target %s is not forwarded", target))
+		return
+	} else {
+		class = f.priority
+	}
+
+	var conn net.Conn
+	var err error
+	if tc.listener != nil {
+		conn, err = tc.listener.deliver(pdu.clientAddress)
+		if err != nil {
+			tc.log.warn("Refuse data connection", "peer_handle", pdu.dataConnectionHandle, "error", err)
+		}
+	} else {
+		dial := tc.span.child("tunnel.dial", "peer_handle", pdu.dataConnectionHandle, "target", target)
+		conn, err = tc.provider.dialTarget(tc.ctx, target)
+		dial.fail(err)
+		dial.finish()
+
+		if err != nil {
+			metrics.dialErrors.Add(1)
+		}
+	}
+
+	if err != nil {
+		if limited {
+			tc.provider.limits.releaseDataConnection(tc.identity)
+		}
+
+		response := &TunnelDisconnectResponse{
+			peerConnectionHandle: pdu.dataConnectionHandle,
+		}
+
+		tc.send(response)
+		return
+	}
+	tc.provider.socketOptions.apply(conn)
+
+	dc := tc.provider.newDataConnection(tc, conn)
+	dc.clientAddress = pdu.clientAddress
+	dc.toTarget = true
+	dc.limited = limited
+	dc.priority = class
+	dc.datagram = pdu.flags&CONNECT_DATAGRAM != 0 && tc.capabilities&CAPABILITY_DATAGRAM != 0
+	if len(pdu.proxyAddress) > 0 {
+		dc.target = target
+	}
+	dc.span.set("client", dc.clientAddress, "target", target)
+	dc.span.event("connect_request", "peer_handle", pdu.dataConnectionHandle)
+	dc.open(pdu.dataConnectionHandle)
+
+	tc.provider.events.publish(&tunnelEvent{
+		kind:       eventConnectionOpen,
+		tunnel:     tc.handle,
+		connection: dc.handle,
+		identity:   tc.identity,
+		client:     dc.clientAddress,
+		target:     target,
+	})
+
+	tc.provider.audit.record("data_open", auditFields{
+		"handle":      dc.handle,
+		"peer_handle": pdu.dataConnectionHandle,
+		"client":      dc.clientAddress,
+		"target":      target,
+	})
+
+	dc.log.debug("Open data connection", "peer_handle", pdu.dataConnectionHandle, "target", target)
+
+	response := &TunnelConnectResponse{
+		dataConnectionHandle:  pdu.dataConnectionHandle,
+		proxyConnectionHandle: dc.handle,
+	}
+	tc.sendAt(response, dc.priority)
+	dc.span.event("connect_response")
+}
+
+// admitDial checks a connect request of a client dialing through its tunnel
+// connection, refusing it unless the provider allows dialing and the ACL the
+// target. Admitted requests are counted against the connection limits.
+func (tc *TunnelConnection) admitDial(pdu *TunnelConnectRequest) bool {
+	target := net.JoinHostPort(pdu.proxyAddress, strconv.Itoa(pdu.proxyPort))
+
+	switch {
+	case !tc.provider.allowDial:
+		tc.log.warn("Refuse dial, dialing is not enabled", "identity", tc.identity, "target", target)
+		tc.refuseConnect(pdu.dataConnectionHandle, ERROR_ACCESS_DENIED, "dialing through the provider is not enabled")
+
+	case tc.capabilities&CAPABILITY_DIAL == 0:
+		tc.log.warn("Refuse dial, dialing is not negotiated", "identity", tc.identity, "target", target)
+		tc.refuseConnect(pdu.dataConnectionHandle, ERROR_ACCESS_DENIED, "dialing was not negotiated in the handshake")
+
+	case tc.provider.authRequired() && !tc.authenticated:
+		tc.refuseConnect(pdu.dataConnectionHandle, ERROR_UNAUTHENTICATED, "authentication required")
+
+	case !tc.provider.acl.isAllowed(tc.identity, tc.authSource, pdu.proxyAddress, pdu.proxyPort):
+		tc.log.warn("Refuse dial, target is not allowed", "identity", tc.identity, "target", target)
+		tc.refuseConnect(pdu.dataConnectionHandle, ERROR_ACCESS_DENIED, fmt.Sprintf("target %s is not allowed", target))
+
+	case !tc.provider.limits.acquireDataConnection(tc.identity):
+		tc.log.warn("Refuse dial, data connection limit reached", "identity", tc.identity, "target", target)
+		tc.refuseConnect(pdu.dataConnectionHandle, ERROR_RESOURCE_EXHAUSTED, "too many data connections")
+
+	default:
+		return true
+	}
+
+	return false
+}
+
+// refuseConnect answers a connect request with an error and a disconnect
+func (tc *TunnelConnection) refuseConnect(peerHandle Handle, code uint32, message string) {
+	tc.sendError(peerHandle, code, message)
+
+	response := &TunnelDisconnectResponse{
+		peerConnectionHandle: peerHandle,
+	}
+	tc.send(response)
+}
+
+// onTunnelConnectResponse opens the data connection waiting for it. The
+// peer end of a response that finds no data connection waiting, one that
+// closed meanwhile, e.g. timed out, or one connected already, is closed.
+func (tc *TunnelConnection) onTunnelConnectResponse(pdu *TunnelConnectResponse) {
+	dc := tc.peerDataConnection(pdu.dataConnectionHandle, PDU_TUNNEL_CONNECT_RESPONSE)
+	if dc != nil && atomic.LoadUint32(&dc.opened) != 0 {
+		if dc.peerHandle == pdu.proxyConnectionHandle {
+			dc.log.debug("Duplicate connect response", "peer_handle", pdu.proxyConnectionHandle)
+			return
+		}
+
+		metrics.invalidHandles.Add(1)
+		dc.log.warn("Connect response for a connected data connection, close the peer end",
+			"peer_handle", dc.peerHandle, "duplicate_peer_handle", pdu.proxyConnectionHandle)
+		dc = nil
+	}
+
+	if dc == nil {
+		tc.send(&TunnelDisconnectRequest{peerConnectionHandle: pdu.proxyConnectionHandle})
+		return
+	}
+
+	dc.span.event("connect_response", "peer_handle", pdu.proxyConnectionHandle)
+	metrics.connectSeconds.observe(time.Since(dc.created).Seconds())
+	dc.open(pdu.proxyConnectionHandle)
+
+	dc.log.debug("Connect data connection", "peer_handle", pdu.proxyConnectionHandle,
+		"target", dc.targetAddress())
+}
+
+func (tc *TunnelConnection) onTunnelDataIndication(pdu *TunnelDataIndication) {
+	if dc := tc.payloadConnection(pdu.peerConnectionHandle); dc != nil {
+		tc.onPayload(dc, pdu.data)
+	}
+}
+
+// onTunnelDatagramIndication writes the message to its data connection at
+// once, so that a connection keeping message boundaries, e.g. a pipe of
+// Client.DialDatagram, reads it whole
+func (tc *TunnelConnection) onTunnelDatagramIndication(pdu *TunnelDatagramIndication) {
+	if dc := tc.payloadConnection(pdu.peerConnectionHandle); dc != nil {
+		tc.onPayload(dc, pdu.data)
+	}
+}
+
+// onPayload decrypts and decompresses payload read from tc for dc and
+// delivers it
+func (tc *TunnelConnection) onPayload(dc *DataConnection, data []byte) {
+	dc.countFrame()
+
+	owner := dc.tunnelConnection
+	if owner.cipher != nil {
+		var err error
+		if data, dc.openCounter, err = owner.cipher.decrypt(data, dc.handle, dc.openCounter+1); err != nil {
+			dc.log.error("Payload decryption error", "error", err)
+			dc.span.fail(err)
+			dc.close(true)
+			return
+		}
+	}
+
+	if owner.capabilities&CAPABILITY_COMPRESSION != 0 {
+		// raw payloads alias the frame, only keep buffers decoded into
+		compressed := len(data) > 0 && data[0] == payloadCompressed
+
+		var err error
+		if data, err = decompressPayload(tc.decompressed, data); err != nil {
+			dc.log.error("Payload decompression error", "error", err)
+			dc.span.fail(err)
+			dc.close(true)
+			return
+		}
+		if compressed && cap(data) <= maxPooledFrame {
+			tc.decompressed = data
+		}
+	}
+
+	owner.deliver(dc, data)
+}
+
+// deliver writes plain payload to dc, returns false once dc is closed.
+// Payloads subject to the egress rate limit or a quota are queued instead,
+// so that the tunnel reader never waits for them.
+func (tc *TunnelConnection) deliver(dc *DataConnection, data []byte) bool {
+	if tc.provider.egressLimiter != nil || tc.quota != nil {
+		return dc.queueEgress(data)
+	}
+
+	return tc.write(dc, data)
+}
+
+// throttledWrite writes data to dc once the egress rate limit and quota
+// allow it
+func (tc *TunnelConnection) throttledWrite(dc *DataConnection, data []byte) bool {
+	if err := tc.provider.egressLimiter.wait(dc.ctx, len(data)); err != nil {
+		return false
+	}
+	if !tc.quota.transfer(dc.ctx, len(data)) {
+		dc.onQuotaExceeded()
+		return false
+	}
+
+	return tc.write(dc, data)
+}
+
+func (tc *TunnelConnection) write(dc *DataConnection, data []byte) bool {
+	// a consumer that stops reading would otherwise stall every data
+	// connection of the tunnel
+	if timeout := tc.provider.writeTimeout; timeout > 0 {
+		dc.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+
+	sz, err := dc.conn.Write(data)
+	dc.countWritten(sz)
+	dc.record(false, data[:sz])
+
+	if err != nil {
+		if isTimeout(err) {
+			dc.log.warn("Data connection write timed out")
+		}
+		dc.span.fail(err)
+		dc.close(true)
+		return false
+	}
+
+	return true
+}
+
+// streamFrame relays a frame of length bytes whose 4 byte length has been
+// read. Data indications are copied to their data connection in
+// streamChunkSize chunks, other frames are buffered.
+func (tc *TunnelConnection) streamFrame(length uint32) error {
+	var head [9]byte
+	if _, err := io.ReadFull(tc.conn, head[:]); err != nil {
+		return err
+	}
+
+	remaining := length - uint32(len(head))
+	if head[0] != PDU_TUNNEL_DATA_INDICATION || binary.BigEndian.Uint32(head[5:]) != remaining {
+		if length > maxFrameLength {
+			return fmt.Errorf("frame of %d bytes exceeds the limit", length)
+		}
+
+		frame := make([]byte, length)
+		copy(frame, head[:])
+		if _, err := io.ReadFull(tc.conn, frame[len(head):]); err != nil {
+			return err
+		}
+
+		tc.provider.onTunnelPacket(tc, frame)
+		return nil
+	}
+
+	// payload of closed data connections is read and dropped
+	dc := tc.payloadConnection(binary.BigEndian.Uint32(head[1:]))
+	if dc != nil {
+		dc.countFrame()
+	}
+
+	chunk := resizeBuffer(tc.received, streamChunkSize)
+	tc.received = chunk
+	for remaining > 0 {
+		n := uint32(len(chunk))
+		if remaining < n {
+			n = remaining
+		}
+
+		if _, err := io.ReadFull(tc.conn, chunk[:n]); err != nil {
+			return err
+		}
+		remaining -= n
+
+		if dc != nil && !dc.tunnelConnection.deliver(dc, chunk[:n]) {
+			dc = nil
+		}
+	}
+
+	return nil
+}
+
+func (tc *TunnelConnection) onTunnelDisconnectRequest(pdu *TunnelDisconnectRequest) {
+	tc.log.debug("Tunnel disconnect request", "handle", pdu.peerConnectionHandle)
+
+	if dc := tc.peerDataConnection(pdu.peerConnectionHandle, PDU_TUNNEL_DISCONNECT_REQUEST); dc != nil {
+		dc.closeAfterEgress()
+
+		response := &TunnelDisconnectResponse{
+			peerConnectionHandle: dc.peerHandle,
+		}
+		tc.sendAt(response, dc.priority)
+	}
+}
+
+func (tc *TunnelConnection) onTunnelDisconnectResponse(pdu *TunnelDisconnectResponse) {
+	tc.log.debug("Tunnel disconnect response", "handle", pdu.peerConnectionHandle)
+
+	if dc := tc.peerDataConnection(pdu.peerConnectionHandle, PDU_TUNNEL_DISCONNECT_RESPONSE); dc != nil {
+		dc.close(false)
+	}
+}
+
+// onIncomingConnection tunnels a consumer of the tunnel port of f, having the
+// provider terminate TLS for its service or applying the SNI policy first
+// when configured. Both wait for the consumer's handshake on a goroutine of
+// their own.
+func (tc *TunnelConnection) onIncomingConnection(f forward, conn net.Conn) {
+	if mode := tc.provider.serviceTLS.mode(tc.namespace, f.service); len(mode) > 0 {
+		go tc.onIncomingTerminatedConnection(f, conn, mode)
+	} else if tc.provider.sniPolicy != nil {
+		go tc.onIncomingTLSConnection(f, conn)
+	} else {
+		tc.onIncomingDataConnection(f, conn)
+	}
+}
+
+// onIncomingTLSConnection applies the SNI policy before tunneling conn
+func (tc *TunnelConnection) onIncomingTLSConnection(f forward, conn net.Conn) {
+	defer recoverPanic("TLS data connection", func() { conn.Close() })
+
+	serverName, conn, err := peekServerName(conn)
+	if err != nil {
+		tc.log.warn("No TLS ClientHello", "client", conn.RemoteAddr(), "error", err)
+	}
+
+	if !tc.provider.sniPolicy(serverName) {
+		tc.log.warn("Reject data connection, SNI is not allowed", "client", conn.RemoteAddr(), "sni", serverName)
+
+		tc.provider.audit.record("data_denied", auditFields{
+			"identity": tc.identity,
+			"client":   conn.RemoteAddr().String(),
+			"target":   f.target(),
+			"sni":      serverName,
+		})
+
+		conn.Close()
+		return
+	}
+
+	tc.onIncomingDataConnection(f, conn)
+}
+
+// onIncomingDataConnection asks the connector to connect a consumer of the
+// tunnel port of forward f
+func (tc *TunnelConnection) onIncomingDataConnection(f forward, conn net.Conn) {
+	if atomic.LoadInt32(&tc.provider.draining) != 0 {
+		tc.log.debug("Provider shutting down, reject data connection", "client", conn.RemoteAddr())
+
+		tc.sendError(0, ERROR_RESOURCE_EXHAUSTED, "provider shutting down")
+		conn.Close()
+		return
+	}
+
+	if tc.quota.exhausted() {
+		tc.log.warn("Monthly transfer quota exceeded, reject data connection", "identity", tc.identity, "client", conn.RemoteAddr())
+
+		tc.sendError(0, ERROR_QUOTA_EXCEEDED, "monthly transfer quota exceeded")
+		conn.Close()
+		return
+	}
+
+	if tc.provider.memoryShed && tc.provider.memoryBudget.exhausted() {
+		tc.log.warn("Memory budget exhausted, reject data connection", "client", conn.RemoteAddr())
+
+		tc.sendError(0, ERROR_RESOURCE_EXHAUSTED, "provider memory budget exhausted")
+		conn.Close()
+		return
+	}
+
+	if !tc.provider.limits.acquireDataConnection(tc.identity) {
+		tc.log.warn("Data connection limit reached, reject data connection", "identity", tc.identity, "client", conn.RemoteAddr())
+
+		tc.sendError(0, ERROR_RESOURCE_EXHAUSTED, "too many data connections")
+		conn.Close()
+		return
+	}
+
+	dc := tc.provider.newDataConnection(tc, conn)
+	dc.clientAddress = conn.RemoteAddr().String()
+	dc.limited = true
+	dc.target = f.target()
+	if known, ok := tc.forwardOf(f.proxyAddress, f.proxyPort); ok {
+		dc.priority = known.priority
+	}
+	dc.accepted = true
+	switch c := conn.(type) {
+	case *peekedConn:
+		dc.serverName = c.serverName
+	case *tls.Conn:
+		// terminated at the provider, see onIncomingTerminatedConnection
+		dc.serverName = c.ConnectionState().ServerName
+	case *addrConn:
+		dc.serverName = c.serverName
+	}
+
+	tc.provider.events.publish(&tunnelEvent{
+		kind:       eventConnectionOpen,
+		tunnel:     tc.handle,
+		connection: dc.handle,
+		identity:   tc.identity,
+		client:     dc.clientAddress,
+		target:     dc.target,
+	})
+
+	tc.provider.audit.record("data_open", auditFields{
+		"handle":   dc.handle,
+		"identity": tc.identity,
+		"client":   dc.clientAddress,
+		"target":   dc.target,
+	})
+
+	req := &TunnelConnectRequest{
+		dataConnectionHandle: dc.handle,
+		clientAddress:        dc.clientAddress,
+
+		proxyAddress: f.proxyAddress,
+		proxyPort:    f.proxyPort,
+	}
+
+	dc.span.set("identity", tc.identity, "client", dc.clientAddress, "target", dc.target)
+	dc.span.event("connect_request")
+	dc.awaitConnect()
+	tc.sendAt(req, dc.priority)
+}
+
+// overTLS reports whether the signaling connection runs TLS
+func (tc *TunnelConnection) overTLS() bool {
+	_, ok := tc.conn.(*tls.Conn)
+	return ok
+}
+
+// authenticatePeerCertificate completes the TLS handshake of an accepted
+// connection and, with mTLS, takes the client identity from its certificate
+func (tc *TunnelConnection) authenticatePeerCertificate() error {
+	tlsConn, ok := tc.conn.(*tls.Conn)
+	if !ok || tc.provider.tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		return nil
+	}
+
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+
+	identity, source, err := peerIdentity(tlsConn.ConnectionState(), tc.provider.spiffeTrustDomain)
+	if err != nil {
+		return err
+	}
+
+	tc.identity = identity
+	tc.authSource = source
+	tc.authenticated = true
+
+	tc.log.info("Authenticated by client certificate", "identity", identity)
+	return nil
+}
+
+func (tc *TunnelConnection) open() {
+	go tc.writeLoop()
+	tc.startKeepaliveTimer()
+	tc.provider.faults.scheduleReset(tc)
+
+	go func() {
+		defer recoverPanic("tunnel connection reader", func() {
+			tc.conn.Close()
+			tc.provider.closeTunnelConnection(tc)
+		})
+
+		if err := tc.authenticatePeerCertificate(); err != nil {
+			tc.log.warn("AUTH_FAILURE", "ip", remoteIP(tc.conn.RemoteAddr()), "reason", err.Error())
+			tc.publishAuthFailure("", err.Error())
+
+			tc.conn.Close()
+			tc.provider.closeTunnelConnection(tc)
+			return
+		}
+
+		var b [4]byte
+		for {
+			len, err := io.ReadFull(tc.conn, b[:])
+			if len < 4 || err != nil {
+				tc.provider.closeTunnelConnection(tc)
+				break
+			}
+
+			dataLength := binary.BigEndian.Uint32(b[:])
+			atomic.StoreInt32(&tc.idleKeepalives, 0)
+
+			// encrypted and compressed payloads can only be opened whole
+			owner := tc.primary()
+			if dataLength > streamChunkSize && owner.cipher == nil && owner.capabilities&CAPABILITY_COMPRESSION == 0 {
+				if err := tc.streamFrame(dataLength); err != nil {
+					tc.log.error("Tunnel read error", "error", err)
+					tc.provider.closeTunnelConnection(tc)
+					break
+				}
+				continue
+			}
+
+			if dataLength > maxFrameLength {
+				tc.log.error("Frame exceeds the limit", "bytes", dataLength)
+				tc.provider.closeTunnelConnection(tc)
+				break
+			}
+
+			// frames are only valid until onTunnelPacket returns, the buffer
+			// is reused for the next one
+			data := resizeBuffer(tc.received, int(dataLength))
+			if cap(data) <= maxPooledFrame {
+				tc.received = data
+			}
+			len, err = io.ReadFull(tc.conn, data)
+
+			if len < int(dataLength) || err != nil {
+				tc.provider.closeTunnelConnection(tc)
+				break
+			}
+
+			tc.provider.onTunnelPacket(tc, data)
+		}
+	}()
+}
@@ -0,0 +1,378 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendDataBackpressure(t *testing.T) {
+	assert := require.New(t)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	tc := newProvider().newTunnelConnection(local)
+
+	// nothing drains the tunnel yet, data senders block once out of credits
+	for i := 0; i < dataSendCredits; i++ {
+		assert.Nil(tc.sendData(&TunnelDataIndication{data: []byte("x")}, priorityNormal))
+	}
+
+	blocked := make(chan error, 1)
+	go func() {
+		blocked <- tc.sendData(&TunnelDataIndication{data: []byte("x")}, priorityNormal)
+	}()
+
+	select {
+	case <-blocked:
+		assert.Fail("sendData did not block without credits")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// writing the queued frames returns their credits
+	go tc.writeLoop()
+	buf := make([]byte, dataSendCredits*len(encodePdu(&TunnelDataIndication{data: []byte("x")})))
+	_, err := io.ReadFull(remote, buf)
+	assert.Nil(err)
+
+	select {
+	case err := <-blocked:
+		assert.Nil(err)
+	case <-time.After(time.Second):
+		assert.Fail("sendData still blocked after a frame was written")
+	}
+
+	tc.cancel()
+	for i := 0; i < dataSendCredits; i++ {
+		if err := tc.sendData(&TunnelDataIndication{}, priorityNormal); err != nil {
+			assert.Equal(errTunnelClosed, err)
+			return
+		}
+	}
+	assert.Fail("sendData did not fail on a closed tunnel")
+}
+
+func TestSendDataReturnsCreditWhenOverBudget(t *testing.T) {
+	assert := require.New(t)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	tc := newProvider().newTunnelConnection(local)
+	defer tc.cancel()
+	tc.budget.budget = newMemoryBudget(100)
+	tc.budget.close()
+
+	// the frame is refused, its credit is not lost with it
+	for i := 0; i <= dataSendCredits; i++ {
+		assert.Equal(errTunnelClosed, tc.sendData(&TunnelDataIndication{data: []byte("x")}, priorityNormal))
+	}
+	assert.Len(tc.credits[priorityNormal], 0)
+}
+
+func TestRekeyWaitsForQueuedPayloads(t *testing.T) {
+	assert := require.New(t)
+
+	connector, err := newSessionKeyExchange()
+	assert.NoError(err)
+	listener, err := newSessionKeyExchange()
+	assert.NoError(err)
+	sender, err := connector.deriveCipher(listener.publicKey, true, CIPHER_AES_256_GCM, nil)
+	assert.NoError(err)
+	receiver, err := listener.deriveCipher(connector.publicKey, false, CIPHER_AES_256_GCM, nil)
+	assert.NoError(err)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	tc := newProvider().newTunnelConnection(local)
+	defer tc.cancel()
+	tc.cipher = sender
+
+	// bulk data sealed under epoch 0 waits in the low class
+	payload, epoch := sender.encryptQueued(nil, []byte("backup"), 1, 1)
+	data := &TunnelDataIndication{peerConnectionHandle: 1, data: payload}
+	assert.Nil(tc.sendSealed(data, priorityLow, sender, epoch))
+
+	// the second rekey waits until the payload of epoch 0 is written
+	tc.rekey(0)
+	tc.rekey(0)
+	assert.Equal(uint32(2), sender.nextSendEpoch())
+
+	go tc.writeLoop()
+
+	// the indication overtakes the payload
+	expected := append(encodePdu(&RekeyIndication{epoch: 1}), encodePdu(data)...)
+	buf := make([]byte, len(expected))
+	_, err = io.ReadFull(remote, buf)
+	assert.Nil(err)
+	assert.Equal(expected, buf)
+
+	assert.NoError(receiver.rotateReceiveKey(1))
+
+	tc.rekey(0)
+	assert.Equal(uint32(3), sender.nextSendEpoch())
+
+	expected = encodePdu(&RekeyIndication{epoch: 2})
+	buf = make([]byte, len(expected))
+	_, err = io.ReadFull(remote, buf)
+	assert.Nil(err)
+	assert.Equal(expected, buf)
+
+	plain, _, err := receiver.decrypt(payload, 1, 1)
+	assert.NoError(err)
+	assert.Equal("backup", string(plain))
+	assert.NoError(receiver.rotateReceiveKey(2))
+}
+
+func TestWriteLoopCoalesces(t *testing.T) {
+	assert := require.New(t)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	tc := newProvider().newTunnelConnection(local)
+	defer tc.cancel()
+
+	var expected []byte
+	for i := 0; i < 10; i++ {
+		pdu := &TunnelDataIndication{peerConnectionHandle: Handle(i), data: []byte("keystroke")}
+		assert.Nil(tc.sendData(pdu, priorityNormal))
+		expected = append(expected, encodePdu(pdu)...)
+	}
+
+	go tc.writeLoop()
+
+	// net.Pipe delivers each Write separately, all queued frames arrive in one
+	buf := make([]byte, 2*len(expected))
+	n, err := remote.Read(buf)
+	assert.Nil(err)
+	assert.Equal(expected, buf[:n])
+}
+
+func TestGetNextHandleConcurrent(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+
+	const n = 1000
+	handles := make(chan Handle, 4*n)
+	done := make(chan struct{})
+	for g := 0; g < 4; g++ {
+		go func() {
+			for i := 0; i < n; i++ {
+				handles <- p.getNextHandle()
+			}
+			done <- struct{}{}
+		}()
+	}
+	for g := 0; g < 4; g++ {
+		<-done
+	}
+	close(handles)
+
+	seen := make(map[Handle]bool)
+	for h := range handles {
+		assert.False(seen[h], "handle %d allocated twice", h)
+		assert.NotEqual(Handle(0), h)
+		seen[h] = true
+	}
+	assert.Len(seen, 4*n)
+}
+
+func TestStreamFrame(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+
+	tunnelLocal, tunnelRemote := net.Pipe()
+	defer tunnelRemote.Close()
+	tc := p.newTunnelConnection(tunnelLocal)
+
+	dataLocal, dataRemote := net.Pipe()
+	defer dataRemote.Close()
+	dc := p.newDataConnection(tc, dataLocal)
+	atomic.StoreUint32(&dc.opened, 1)
+
+	payload := make([]byte, 5*streamChunkSize+123)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	frame := encodePdu(&TunnelDataIndication{peerConnectionHandle: dc.handle, data: payload})
+
+	go tunnelRemote.Write(frame[4:])
+
+	// net.Pipe writes block until read, so chunks are relayed as they arrive
+	result := make(chan error, 1)
+	go func() {
+		result <- tc.streamFrame(binary.BigEndian.Uint32(frame))
+	}()
+
+	relayed := make([]byte, len(payload))
+	_, err := io.ReadFull(dataRemote, relayed)
+	assert.Nil(err)
+	assert.Equal(payload, relayed)
+	assert.Nil(<-result)
+	assert.Equal(streamChunkSize, len(tc.received))
+}
+
+func TestDeliverWriteTimeout(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+	p.writeTimeout = 50 * time.Millisecond
+
+	tunnelLocal, tunnelRemote := net.Pipe()
+	defer tunnelRemote.Close()
+	tc := p.newTunnelConnection(tunnelLocal)
+	defer tc.cancel()
+
+	// the consumer never reads
+	dataLocal, dataRemote := net.Pipe()
+	defer dataRemote.Close()
+	dc := p.newDataConnection(tc, dataLocal)
+
+	start := time.Now()
+	assert.False(tc.deliver(dc, []byte("stuck")))
+	assert.Less(int64(time.Since(start)), int64(time.Second))
+	assert.Nil(p.getDataConnection(dc.handle))
+}
+
+func TestCloseTunnelConnectionClosesDataConnections(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+
+	tunnelLocal, tunnelRemote := net.Pipe()
+	defer tunnelRemote.Close()
+	tc := p.newTunnelConnection(tunnelLocal)
+	other := p.newTunnelConnection(tunnelRemote)
+
+	port, err := tc.startListenFor(forward{proxyAddress: "127.0.0.1", proxyPort: 80})
+	assert.Nil(err)
+
+	dataLocal, dataRemote := net.Pipe()
+	defer dataRemote.Close()
+	dc := p.newDataConnection(tc, dataLocal)
+	kept := p.newDataConnection(other, dataRemote)
+
+	p.closeTunnelConnection(tc)
+
+	assert.Nil(p.getDataConnection(dc.handle))
+	assert.NotNil(p.getDataConnection(kept.handle))
+
+	// the tunnel port is free again
+	l, err := net.Listen("tcp4", fmt.Sprintf(":%d", port))
+	assert.Nil(err)
+	l.Close()
+}
+
+func TestProviderClose(t *testing.T) {
+	assert := require.New(t)
+
+	target, err := startEchoServer()
+	assert.Nil(err)
+
+	p := newProvider()
+	addr, err := p.StartListener(0)
+	assert.Nil(err)
+	signaling := fmt.Sprintf("127.0.0.1:%d", addr.(*net.TCPAddr).Port)
+
+	client := newProvider()
+	tc, err := client.startConnector(signaling)
+	assert.Nil(err)
+	tc.addForward(forward{proxyAddress: "127.0.0.1", proxyPort: target.(*net.TCPAddr).Port})
+	assert.Nil(tc.hello(0))
+
+	select {
+	case <-tc.opened:
+	case <-time.After(5 * time.Second):
+		assert.Fail("tunnel was not opened")
+	}
+	tunnel := fmt.Sprintf("127.0.0.1:%d", tc.tunnelPort)
+
+	consumer, err := net.Dial("tcp4", tunnel)
+	assert.Nil(err)
+	defer consumer.Close()
+
+	_, err = consumer.Write([]byte("ping"))
+	assert.Nil(err)
+	_, err = io.ReadFull(consumer, make([]byte, 4))
+	assert.Nil(err)
+
+	p.Close()
+
+	// the client sees its tunnel and data connection go away
+	select {
+	case <-tc.ctx.Done():
+	case <-time.After(5 * time.Second):
+		assert.Fail("tunnel connection was not closed")
+	}
+	consumer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = consumer.Read(make([]byte, 1))
+	assert.Equal(io.EOF, err)
+
+	_, err = net.Dial("tcp4", signaling)
+	assert.NotNil(err)
+	_, err = net.Dial("tcp4", tunnel)
+	assert.NotNil(err)
+}
+
+// startEchoServer echoes every connection accepted on an ephemeral loopback
+// port back to its sender
+func startEchoServer() (net.Addr, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				break
+			}
+
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+
+		l.Close()
+	}()
+
+	return l.Addr(), nil
+}
+
+func TestConnectTimeout(t *testing.T) {
+	assert := require.New(t)
+
+	p := newProvider()
+	p.connectTimeout = 50 * time.Millisecond
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go io.Copy(ioutil.Discard, remote)
+	tc := p.newTunnelConnection(local)
+	go tc.writeLoop()
+
+	consumer, conn := net.Pipe()
+	defer consumer.Close()
+	tc.onIncomingDataConnection(forward{proxyAddress: "127.0.0.1", proxyPort: 80}, conn)
+	assert.Len(tc.dataConnections(), 1)
+
+	// the peer never answers, the consumer is not left hanging
+	consumer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := consumer.Read(make([]byte, 1))
+	assert.Equal(io.EOF, err)
+	assert.Empty(tc.dataConnections())
+}
@@ -0,0 +1,144 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	webhookTimeout  = 10 * time.Second
+	webhookAttempts = 3
+	webhookBackoff  = time.Second
+)
+
+// webhookEvents are the event kinds posted to webhooks, by payload name
+var webhookEvents = map[int]string{
+	eventTunnelUp:    "tunnel_open",
+	eventTunnelDown:  "tunnel_close",
+	eventAuthFailure: "auth_failure",
+}
+
+// webhookPayload is the JSON body posted for an event. Text summarizes it
+// for chat incoming webhooks, which display the "text" field.
+type webhookPayload struct {
+	Event      string `json:"event"`
+	Time       string `json:"time"`
+	Tunnel     Handle `json:"tunnel"`
+	Identity   string `json:"identity,omitempty"`
+	Remote     string `json:"remote,omitempty"`
+	Target     string `json:"target,omitempty"`
+	TunnelPort int    `json:"tunnel_port,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	Text       string `json:"text"`
+}
+
+// StartWebhook posts tunnel opens, closes and authentication failures to url
+// until the provider closes. Events are posted one at a time, in order; a
+// webhook too slow to keep up loses the events it fell behind on.
+func (p *Provider) StartWebhook(url string) {
+	client := &http.Client{Timeout: webhookTimeout}
+	events := p.events.subscribe()
+
+	go func() {
+		defer func() { p.events.unsubscribe(events) }()
+
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					logger.warn("Webhook fell behind, events dropped", "url", url)
+					events = p.events.subscribe()
+					continue
+				}
+
+				name, ok := webhookEvents[e.kind]
+				if !ok {
+					continue
+				}
+
+				if err := postWebhook(p, client, url, newWebhookPayload(name, e)); err != nil {
+					logger.error("Webhook error", "url", url, "event", name, "error", err)
+				}
+
+			case <-p.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func newWebhookPayload(name string, e *tunnelEvent) *webhookPayload {
+	payload := &webhookPayload{
+		Event:      name,
+		Time:       e.time.UTC().Format(time.RFC3339Nano),
+		Tunnel:     e.tunnel,
+		Identity:   e.identity,
+		Remote:     e.remote,
+		Target:     e.target,
+		TunnelPort: e.tunnelPort,
+		Reason:     e.reason,
+	}
+
+	switch e.kind {
+	case eventTunnelUp:
+		payload.Text = fmt.Sprintf("Tunnel %d opened by %s from %s: port %d to %s",
+			e.tunnel, e.identity, e.remote, e.tunnelPort, e.target)
+	case eventTunnelDown:
+		payload.Text = fmt.Sprintf("Tunnel %d of %s closed: port %d to %s", e.tunnel, e.identity, e.tunnelPort, e.target)
+	case eventAuthFailure:
+		payload.Text = fmt.Sprintf("Authentication failed from %s: %s", e.remote, e.reason)
+		if len(e.identity) > 0 {
+			payload.Text = fmt.Sprintf("Authentication of %s failed from %s: %s", e.identity, e.remote, e.reason)
+		}
+	}
+
+	return payload
+}
+
+// postWebhook posts payload, retrying network errors and server errors with
+// a growing delay
+func postWebhook(p *Provider, client *http.Client, url string, payload *webhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	delay := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := postWebhookOnce(client, url, body)
+		if err == nil || !retry || attempt == webhookAttempts {
+			return err
+		}
+
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-p.ctx.Done():
+			return err
+		}
+	}
+}
+
+// postWebhookOnce posts body, reporting whether a failure may be retried
+func postWebhookOnce(client *http.Client, url string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tunnel")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode/100 == 5, fmt.Errorf("webhook replied %s", resp.Status)
+	}
+	return false, nil
+}
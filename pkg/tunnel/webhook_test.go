@@ -0,0 +1,89 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhook(t *testing.T) {
+	assert := require.New(t)
+
+	// the handler runs on a server goroutine, the test goroutine checks what
+	// it received
+	type request struct {
+		contentType string
+		payload     webhookPayload
+		err         error
+	}
+	received := make(chan request, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload webhookPayload
+		err := json.NewDecoder(r.Body).Decode(&payload)
+		received <- request{contentType: r.Header.Get("Content-Type"), payload: payload, err: err}
+	}))
+	defer server.Close()
+
+	p := newProvider()
+	defer p.Close()
+	p.events = newEventHub()
+	p.StartWebhook(server.URL)
+
+	p.events.publish(&tunnelEvent{kind: eventConnectionOpen, tunnel: 1, connection: 2})
+	p.events.publish(&tunnelEvent{kind: eventTunnelUp, tunnel: 1, identity: "alice",
+		remote: "192.0.2.1:5000", target: "127.0.0.1:80", tunnelPort: 20000})
+	p.events.publish(&tunnelEvent{kind: eventAuthFailure, tunnel: 3, remote: "192.0.2.2:5000", reason: "authentication failed"})
+
+	receive := func() webhookPayload {
+		select {
+		case r := <-received:
+			assert.Equal("application/json", r.contentType)
+			assert.Nil(r.err)
+			return r.payload
+		case <-time.After(5 * time.Second):
+			assert.Fail("no webhook request")
+			return webhookPayload{}
+		}
+	}
+
+	payload := receive()
+	assert.Equal("tunnel_open", payload.Event)
+	assert.Equal("alice", payload.Identity)
+	assert.Equal(20000, payload.TunnelPort)
+	assert.Equal("Tunnel 1 opened by alice from 192.0.2.1:5000: port 20000 to 127.0.0.1:80", payload.Text)
+
+	payload = receive()
+	assert.Equal("auth_failure", payload.Event)
+	assert.Equal("authentication failed", payload.Reason)
+}
+
+func TestWebhookRetry(t *testing.T) {
+	assert := require.New(t)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	p := newProvider()
+	defer p.Close()
+
+	assert.Nil(postWebhook(p, server.Client(), server.URL, &webhookPayload{Event: "tunnel_open"}))
+	assert.Equal(2, requests)
+
+	// client errors are not retried
+	assert.NotNil(postWebhook(p, server.Client(), server.URL+"/gone", &webhookPayload{Event: "tunnel_open"}))
+	assert.Equal(3, requests)
+}
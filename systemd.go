@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/kelveny/tunnel/pkg/tunnel"
+)
+
+// sdNotify sends state to the service manager over $NOTIFY_SOCKET, as
+// sd_notify(3) does. It reports false without error when the process was not
+// started by systemd as a Type=notify service.
+func sdNotify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if len(socket) == 0 {
+		return false, nil
+	}
+
+	// abstract namespace socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// sdWatchdogInterval returns the interval systemd expects watchdog keepalives
+// within, 0 if WatchdogSec is not configured for this process
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); len(pid) > 0 && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// notifyReady tells systemd that the provider accepts signaling connections,
+// then feeds its watchdog at half the interval for as long as the signaling
+// listeners keep accepting, until the provider closes
+func notifyReady(p *tunnel.Provider) {
+	notified, err := sdNotify("READY=1\nSTATUS=Accepting tunnel connections")
+	if err != nil {
+		tunnel.LogWarn("systemd notification failed", "error", err)
+		return
+	}
+
+	interval := sdWatchdogInterval()
+	if !notified || interval == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-p.Done():
+				return
+
+			case <-ticker.C:
+				// a stalled provider is restarted by the missed keepalives
+				if !p.Ready() {
+					continue
+				}
+
+				if _, err := sdNotify("WATCHDOG=1"); err != nil {
+					tunnel.LogWarn("systemd watchdog notification failed", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// notifyStopping tells systemd that the provider is shutting down
+func notifyStopping() {
+	if _, err := sdNotify("STOPPING=1\nSTATUS=Shutting down"); err != nil {
+		tunnel.LogWarn("systemd notification failed", "error", err)
+	}
+}
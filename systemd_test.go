@@ -0,0 +1,86 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kelveny/tunnel/pkg/tunnel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSystemdNotify(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "sdnotify")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	assert.Nil(err)
+	defer conn.Close()
+
+	receive := func() string {
+		buffer := make([]byte, 256)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buffer)
+		assert.Nil(err)
+		return string(buffer[:n])
+	}
+
+	os.Unsetenv("NOTIFY_SOCKET")
+	notified, err := sdNotify("READY=1")
+	assert.Nil(err)
+	assert.False(notified)
+
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	os.Setenv("WATCHDOG_USEC", "20000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+
+	p, err := tunnel.NewProvider(tunnel.Config{})
+	assert.Nil(err)
+	defer p.Close()
+	_, err = p.StartListener(0)
+	assert.Nil(err)
+
+	notifyReady(p)
+	assert.Contains(receive(), "READY=1")
+	assert.Equal("WATCHDOG=1", receive())
+
+	notifyStopping()
+	for {
+		if state := receive(); state != "WATCHDOG=1" {
+			assert.Contains(state, "STOPPING=1")
+			break
+		}
+	}
+}
+
+func TestSystemdWatchdogInterval(t *testing.T) {
+	assert := require.New(t)
+
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	os.Unsetenv("WATCHDOG_USEC")
+	assert.Equal(time.Duration(0), sdWatchdogInterval())
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	assert.Equal(30*time.Second, sdWatchdogInterval())
+
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	assert.Equal(30*time.Second, sdWatchdogInterval())
+
+	// meant for another process
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	assert.Equal(time.Duration(0), sdWatchdogInterval())
+}
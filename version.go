@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+)
+
+// build metadata, set with -ldflags "-X main.version=1.4.0 -X main.commit=...
+// -X main.buildDate=..."
+var (
+	version   = ""
+	commit    = ""
+	buildDate = ""
+)
+
+// versionString returns the version of the binary, the module version when
+// not set at build time, e.g. by go install
+func versionString() string {
+	if len(version) > 0 {
+		return version
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "(devel)" && len(info.Main.Version) > 0 {
+		return info.Main.Version
+	}
+	return "devel"
+}
+
+// printVersion writes the version and build metadata of the binary
+func printVersion(w io.Writer) {
+	fmt.Fprintf(w, "tunnel %s\n", versionString())
+	if len(commit) > 0 {
+		fmt.Fprintf(w, "commit: %s\n", commit)
+	}
+	if len(buildDate) > 0 {
+		fmt.Fprintf(w, "built:  %s\n", buildDate)
+	}
+	fmt.Fprintf(w, "go:     %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
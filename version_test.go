@@ -0,0 +1,23 @@
+package main
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrintVersion(t *testing.T) {
+	assert := require.New(t)
+
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "1.4.0", "ae003ba", "2026-10-17T12:00:00Z"
+
+	var out bytes.Buffer
+	printVersion(&out)
+	assert.Contains(out.String(), "tunnel 1.4.0\n")
+	assert.Contains(out.String(), "commit: ae003ba\n")
+	assert.Contains(out.String(), "built:  2026-10-17T12:00:00Z\n")
+	assert.Contains(out.String(), runtime.Version())
+}